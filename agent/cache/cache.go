@@ -9,8 +9,11 @@
 
     It's also useful for storing key/value type data, such as what
     group the agent is in, it's agent UUID, etc. The Init() function
-    will delete and recreate this cache, so no data in this cache
-    will persist between restarts of the agent.
+    will clear this cache, so most data in this cache will not persist
+    between restarts of the agent. The exceptions are the agent UUID,
+    and the IDs of recently handled tasks - these are kept so that tasks
+    which were in flight while the agent restarted are still delivered
+    to it, and are not run twice.
 
 	Copyright 2016 Matt Oswalt. Use or modification of this
 	source code is governed by the license provided here:
@@ -22,10 +25,10 @@ package cache
 import (
 	"database/sql"
 	"fmt"
-	"os"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	_ "github.com/mattn/go-sqlite3" // This look strange but is necessary - the sqlite package is used indirectly by database/sql
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/config"
 )
@@ -46,9 +49,6 @@ type AgentCache struct {
 // Init will set up the sqlite database to serve as this agent cache.
 func (ac AgentCache) Init() {
 
-	// Clean up any old cache data
-	os.Remove(ac.db_loc)
-
 	// Open connection
 	db, err := sql.Open("sqlite3", ac.db_loc)
 	if err != nil {
@@ -56,13 +56,15 @@ func (ac AgentCache) Init() {
 	}
 	defer db.Close()
 
-	// Initialize database
-	sqlStmt := `
-    create table testruns (id integer not null primary key, uuid text, testlet text, args text, targets text, results text);
+	// Initialize database, and clean up any old cache data
+	sqlStmt := fmt.Sprintf(`
+    create table if not exists testruns (id integer not null primary key, uuid text, testlet text, args text, targets text, results text);
     delete from testruns;
-    create table keyvalue (id integer not null primary key, key text, value text);
-    delete from keyvalue;
-    `
+    create table if not exists keyvalue (id integer not null primary key, key text, value text);
+    delete from keyvalue where key not in ("uuid", "boundgroup");
+    create table if not exists handledtasks (id text not null primary key, handled integer, error text);
+    delete from handledtasks where handled < %d;
+    `, time.Now().Add(-handledTaskRetention).Unix())
 
 	_, err = db.Exec(sqlStmt)
 	if err != nil {
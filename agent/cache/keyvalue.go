@@ -13,8 +13,8 @@ import (
 
 	"database/sql"
 
-	log "github.com/Sirupsen/logrus"
 	_ "github.com/mattn/go-sqlite3" // This look strange but is necessary - the sqlite package is used indirectly by database/sql
+	log "github.com/sirupsen/logrus"
 )
 
 // GetKeyValue will retrieve a value from the agent cache using a key string
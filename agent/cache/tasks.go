@@ -0,0 +1,61 @@
+/*
+    ToDD Agent Cache - working with handled tasks
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package cache
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // This look strange but is necessary - the sqlite package is used indirectly by database/sql
+	log "github.com/sirupsen/logrus"
+)
+
+// handledTaskRetention is how long the ID of a handled task is remembered. Tasks are only redelivered while
+// they sit unacknowledged in the message queue, so this only needs to cover a reasonable agent outage.
+const handledTaskRetention = 24 * time.Hour
+
+// GetTaskResult returns true if a task with the provided ID has already been run by this agent, along with the error the
+// task failed with ("" if it succeeded)
+func (ac AgentCache) GetTaskResult(id string) (bool, string, error) {
+
+	// Open connection
+	db, err := sql.Open("sqlite3", ac.db_loc)
+	if err != nil {
+		return false, "", err
+	}
+	defer db.Close()
+
+	var taskErr string
+	err = db.QueryRow("select error from handledtasks where id = ?", id).Scan(&taskErr)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	return true, taskErr, nil
+}
+
+// MarkTaskHandled records that the task with the provided ID was run by this agent, along with the error it failed
+// with ("" if it succeeded), so that the same outcome can be reported if the task is delivered again
+func (ac AgentCache) MarkTaskHandled(id, taskErr string) error {
+
+	// Open connection
+	db, err := sql.Open("sqlite3", ac.db_loc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	log.Debugf("Marking task %s as handled", id)
+
+	_, err = db.Exec("insert or replace into handledtasks(id, handled, error) values(?, ?, ?)", id, time.Now().Unix(), taskErr)
+	return err
+}
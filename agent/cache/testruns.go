@@ -14,8 +14,8 @@ import (
 	"errors"
 	"fmt"
 
-	log "github.com/Sirupsen/logrus"
 	_ "github.com/mattn/go-sqlite3" // This looks strange but is necessary - the sqlite package is used indirectly by database/sql
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/agent/defs"
 )
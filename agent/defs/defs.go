@@ -14,13 +14,19 @@ package defs
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
+// ProtocolVersion is the version of the messages exchanged between the ToDD server and agents. This should be incremented
+// whenever a change is made that older servers or agents would not understand.
+const ProtocolVersion = 2
+
 type AgentRegistry struct {
 	Agents map[string]*AgentAdvert
 	Mu     sync.Mutex
@@ -30,11 +36,82 @@ type AgentRegistry struct {
 type AgentAdvert struct {
 	Uuid           string              `json:"Uuid"`
 	DefaultAddr    string              `json:"DefaultAddr"`
-	Expires        time.Duration       `json:"Expires"`
+	Expires        time.Duration       `json:"Expires"` // no longer used - see LastSeen and State
 	LocalTime      time.Time           `json:"LocalTime"`
 	Facts          map[string][]string `json:"Facts"`
 	FactCollectors map[string]string   `json:"FactCollectors"`
 	Testlets       map[string]string   `json:"Testlets"`
+
+	// ProtocolVersion and SupportedTasks describe what this agent is able to do. These are not present
+	// in advertisements from agents that predate the versioned message protocol.
+	ProtocolVersion int      `json:"ProtocolVersion"`
+	SupportedTasks  []string `json:"SupportedTasks"`
+
+	// LastSeen and State are maintained by the server, based on the heartbeats it receives from this agent
+	LastSeen time.Time `json:"LastSeen"`
+	State    string    `json:"State"`
+}
+
+// These are the states an agent moves through as the server stops receiving heartbeats from it
+const (
+	AgentOnline  = "online"
+	AgentStale   = "stale"
+	AgentOffline = "offline"
+)
+
+// AgentHeartbeat is a lightweight message that agents send regularly, in between advertisements. AdvertHash is the hash
+// of the last advertisement sent by this agent, so that the server can tell if it missed one.
+type AgentHeartbeat struct {
+	Uuid       string    `json:"Uuid"`
+	LocalTime  time.Time `json:"LocalTime"`
+	AdvertHash string    `json:"AdvertHash"`
+}
+
+// Hash returns a hash of the contents of this advertisement. Fields that change on every advertisement (like the time),
+// or that are maintained by the server, are not included, so the hash only changes when the agent's facts, assets or
+// capabilities do.
+func (a AgentAdvert) Hash() string {
+	a.Expires = 0
+	a.LocalTime = time.Time{}
+	a.LastSeen = time.Time{}
+	a.State = ""
+
+	// Maps are marshalled with sorted keys, so this is stable
+	advJSON, err := json.Marshal(a)
+	if err != nil {
+		log.Warn("Error hashing agent advertisement")
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(advJSON))
+}
+
+// Supports returns true if this agent has advertised that it is able to run tasks of the provided type
+func (a AgentAdvert) Supports(taskType string) bool {
+	for i := range a.SupportedTasks {
+		if a.SupportedTasks[i] == taskType {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionMismatch returns true if this agent uses a different protocol version than this version of ToDD
+func (a AgentAdvert) VersionMismatch() bool {
+	return a.ProtocolVersion != ProtocolVersion
+}
+
+// VersionSummary produces a string containing the protocol version of this agent, and whether or not it
+// matches the protocol version of this version of ToDD.
+func (a AgentAdvert) VersionSummary() string {
+	version := fmt.Sprintf("v%d", a.ProtocolVersion)
+	if a.ProtocolVersion == 0 {
+		version = "unknown"
+	}
+	if a.VersionMismatch() {
+		return fmt.Sprintf("%s (MISMATCH - expected v%d)", version, ProtocolVersion)
+	}
+	return version
 }
 
 // FactSummary produces a string containing a list of facts present in this agent advertisement.
@@ -0,0 +1,369 @@
+/*
+   testrun data definition
+
+    Copyright 2016 Matt Oswalt. Use or modification of this
+    source code is governed by the license provided here:
+    https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package defs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are the types of value a testlet can report
+const (
+	MetricFloat    = "float"
+	MetricInt      = "int"
+	MetricBool     = "bool"
+	MetricString   = "string"
+	MetricDuration = "duration"
+)
+
+// TestData is the results of a testrun, by agent UUID, then target
+type TestData map[string]map[string]TargetData
+
+// Measured returns when the most recent results in this testrun were measured. It is zero if this isn't known for any
+// of them.
+func (data TestData) Measured() time.Time {
+	var latest time.Time
+	for _, targets := range data {
+		for _, td := range targets {
+			if t := td.Measured(); t.After(latest) {
+				latest = t
+			}
+		}
+	}
+	return latest
+}
+
+// TestletRun records a single run of a testlet by an agent, against a single target. Times are taken from the agent's
+// clock. ExitStatus is -1 if the testlet didn't exit on its own - it failed to start, or was killed at the testrun's
+// time limit (as testlets running in server mode are).
+type TestletRun struct {
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Duration   time.Duration `json:"duration"`
+	ExitStatus int           `json:"exitstatus"`
+}
+
+// TestletResult is what an agent uploads for each target of a testrun - the output of the testlet, and when and how it
+// ran. Agents older than protocol version 2 upload only the output, as a string.
+type TestletResult struct {
+	TestletRun
+	Output string `json:"output"`
+}
+
+// TargetData is the results of a testrun for a single agent and target - the metrics reported by the testlet, and when
+// and how it ran. The run is zero for results uploaded by agents older than protocol version 2, and for results kept
+// in the database before it was added.
+type TargetData struct {
+	TestletRun
+	Metrics map[string]MetricValue `json:"metrics"`
+}
+
+// UnmarshalJSON reads the results for a target, including results kept before TargetData was added, which only had the
+// metrics
+func (td *TargetData) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	_, hasMetrics := fields["metrics"]
+	_, hasStart := fields["start"]
+	if !hasMetrics || !hasStart {
+		*td = TargetData{}
+		return json.Unmarshal(data, &td.Metrics)
+	}
+
+	// A type without this method, so that the fields are read as usual
+	type targetData TargetData
+	var read targetData
+	err = json.Unmarshal(data, &read)
+	if err != nil {
+		return err
+	}
+	*td = TargetData(read)
+	return nil
+}
+
+// Measured returns when the metrics for this target were measured - when the testlet finished. It is zero if this
+// isn't known.
+func (td TargetData) Measured() time.Time {
+	return td.End
+}
+
+// MetricValue is a single value reported by a testlet, along with its type and (optionally) its unit.
+//
+// Testlets can report each value as a plain JSON string, number or boolean, or as an object declaring its type and
+// unit, such as {"value": 27.007, "type": "float", "unit": "ms"}. Numbers, and strings containing a number (which
+// is how testlets reported every value before types were added), are floats unless declared otherwise. Durations are
+// either strings such as "27.007ms", or numbers in their unit (seconds if not provided) - they don't keep a unit once
+// they've been read, since they carry their own.
+type MetricValue struct {
+	Type  string
+	Value interface{} // float64, int64, bool, string or time.Duration, depending on Type
+	Unit  string
+}
+
+// metricJSON is how a MetricValue is kept in the database and shown by the API, and one of the ways that a testlet can
+// report a value
+type metricJSON struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+	Unit  string          `json:"unit,omitempty"`
+}
+
+// durationUnits are the units that a duration can be reported in as a number
+var durationUnits = map[string]time.Duration{
+	"":   time.Second,
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// Float returns the value as a number, for TSDBs that only store numbers. Booleans are 1 or 0, and durations are in
+// seconds. The second return value is false for strings, which have no number.
+func (m MetricValue) Float() (float64, bool) {
+	switch v := m.Value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case time.Duration:
+		return v.Seconds(), true
+	}
+	return 0, false
+}
+
+// String returns the value as text, without its unit
+func (m MetricValue) String() string {
+	switch v := m.Value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Duration:
+		return v.String()
+	case string:
+		return v
+	}
+	return fmt.Sprint(m.Value)
+}
+
+// MarshalJSON always writes the object form of a value, so that its type isn't lost
+func (m MetricValue) MarshalJSON() ([]byte, error) {
+	var value interface{}
+	switch v := m.Value.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v is not a finite number", v)
+		}
+		value = v
+	case int64, bool, string:
+		value = v
+	case time.Duration:
+		value = v.String()
+	default:
+		return nil, fmt.Errorf("Unsupported metric value %#v", m.Value)
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(metricJSON{Type: m.Type, Value: valueJSON, Unit: m.Unit})
+}
+
+// UnmarshalJSON reads a value in any of the forms described on MetricValue, checking that it matches its declared type
+func (m *MetricValue) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	var decl metricJSON
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &decl)
+		if err != nil {
+			return err
+		}
+		if len(decl.Value) == 0 {
+			return errors.New("Metric has no value")
+		}
+	} else {
+		decl.Value = data
+	}
+
+	value, err := parseMetric(decl.Type, decl.Value, decl.Unit)
+	if err != nil {
+		return err
+	}
+	*m = value
+	return nil
+}
+
+// parseMetric reads a plain JSON value as the provided type, or works out its type if none is provided
+func parseMetric(metricType string, data json.RawMessage, unit string) (MetricValue, error) {
+	m := MetricValue{Type: metricType, Unit: unit}
+
+	// Decode numbers as json.Number, so that large ints don't lose precision by going through a float
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return m, err
+	}
+
+	var err error
+	switch metricType {
+	case "":
+		switch v := raw.(type) {
+		case bool:
+			m.Type, m.Value = MetricBool, v
+		case json.Number:
+			m.Type = MetricFloat
+			m.Value, err = parseFloat(string(v))
+		case string:
+			// Testlets used to report every value as a string, so keep numbers in strings as numbers
+			if f, ferr := parseFloat(strings.TrimSpace(v)); ferr == nil {
+				m.Type, m.Value = MetricFloat, f
+			} else {
+				m.Type, m.Value = MetricString, v
+			}
+		default:
+			err = fmt.Errorf("Unsupported metric value %s - values must be a string, number or boolean", data)
+		}
+
+	case MetricFloat:
+		if s, ok := numberOrString(raw); ok {
+			m.Value, err = parseFloat(strings.TrimSpace(s))
+		} else {
+			err = fmt.Errorf("%s is not a float", data)
+		}
+
+	case MetricInt:
+		if s, ok := numberOrString(raw); ok {
+			m.Value, err = strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		} else {
+			err = fmt.Errorf("%s is not an int", data)
+		}
+
+	case MetricBool:
+		switch v := raw.(type) {
+		case bool:
+			m.Value = v
+		case string:
+			m.Value, err = strconv.ParseBool(strings.TrimSpace(v))
+		default:
+			err = fmt.Errorf("%s is not a bool", data)
+		}
+
+	case MetricString:
+		if s, ok := numberOrString(raw); ok {
+			m.Value = s
+		} else if b, ok := raw.(bool); ok {
+			m.Value = strconv.FormatBool(b)
+		} else {
+			err = fmt.Errorf("%s is not a string", data)
+		}
+
+	case MetricDuration:
+		m.Value, err = parseDuration(raw, unit)
+		m.Unit = ""
+
+	default:
+		err = fmt.Errorf("Unknown metric type %q", metricType)
+	}
+
+	return m, err
+}
+
+// numberOrString returns the text of a value decoded from JSON, if it's a number or a string
+func numberOrString(raw interface{}) (string, bool) {
+	switch v := raw.(type) {
+	case json.Number:
+		return string(v), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+// parseFloat parses a float, refusing NaN and infinity, which can't be kept in JSON
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%s is not a finite number", s)
+	}
+	return f, nil
+}
+
+// parseDuration parses a duration, either as a string such as "27.007ms", or as a number in the provided unit
+func parseDuration(raw interface{}, unit string) (time.Duration, error) {
+	switch v := raw.(type) {
+	case string:
+		return time.ParseDuration(strings.TrimSpace(v))
+	case json.Number:
+		scale, ok := durationUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("Unknown duration unit %q", unit)
+		}
+		f, err := parseFloat(string(v))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(f * float64(scale)), nil
+	}
+	return 0, fmt.Errorf("%v is not a duration", raw)
+}
+
+// ParseTestletOutput reads the metrics reported by a single testlet run, leaving out any reported as an empty string. Metrics that can't be read are left out, and
+// returned as errors alongside the rest, so that a single bad value doesn't lose the others. An error is only returned
+// on its own if the output isn't a JSON object at all.
+func ParseTestletOutput(output []byte) (map[string]MetricValue, []error, error) {
+	var rawMetrics map[string]json.RawMessage
+	err := json.Unmarshal(output, &rawMetrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metrics := make(map[string]MetricValue)
+	var metricErrs []error
+	for name, raw := range rawMetrics {
+
+		// An empty string is how testlets report that they have no value for a metric, such as when a ping fails
+		var s string
+		if json.Unmarshal(raw, &s) == nil && strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		var m MetricValue
+		if err := json.Unmarshal(raw, &m); err != nil {
+			metricErrs = append(metricErrs, fmt.Errorf("Metric %q: %v", name, err))
+			continue
+		}
+		metrics[name] = m
+	}
+	return metrics, metricErrs, nil
+}
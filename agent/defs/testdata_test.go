@@ -0,0 +1,130 @@
+/*
+   Tests for testrun data
+
+    Copyright 2016 Matt Oswalt. Use or modification of this
+    source code is governed by the license provided here:
+    https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package defs
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestParseTestletOutput tests each way a testlet can report a value, and that bad values don't lose the others
+func TestParseTestletOutput(t *testing.T) {
+	output := `{
+		"legacy_number": " 27.007 ",
+		"legacy_string": "ok",
+		"empty": "",
+		"number": 12,
+		"bool": true,
+		"float": {"value": "0.5", "type": "float", "unit": "%"},
+		"int": {"value": 9007199254740993, "type": "int", "unit": "packets"},
+		"declared_bool": {"value": "false", "type": "bool"},
+		"string": {"value": 10, "type": "string"},
+		"duration": {"value": "27.007ms", "type": "duration"},
+		"duration_ms": {"value": 1.5, "type": "duration", "unit": "ms"},
+		"untyped": {"value": "3"},
+		"bad_int": {"value": 1.5, "type": "int"},
+		"bad_type": {"value": 1, "type": "complex"},
+		"bad_unit": {"value": 1, "type": "duration", "unit": "fortnights"},
+		"nan": "NaN",
+		"bad_float": {"value": "NaN", "type": "float"},
+		"nested": {"a": 1},
+		"list": [1, 2]
+	}`
+
+	metrics, metricErrs, err := ParseTestletOutput([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]MetricValue{
+		"legacy_number": {MetricFloat, 27.007, ""},
+		"legacy_string": {MetricString, "ok", ""},
+		"number":        {MetricFloat, float64(12), ""},
+		"bool":          {MetricBool, true, ""},
+		"float":         {MetricFloat, 0.5, "%"},
+		"int":           {MetricInt, int64(9007199254740993), "packets"},
+		"declared_bool": {MetricBool, false, ""},
+		"string":        {MetricString, "10", ""},
+		"duration":      {MetricDuration, 27007 * time.Microsecond, ""},
+		"duration_ms":   {MetricDuration, 1500 * time.Microsecond, ""},
+		"untyped":       {MetricFloat, float64(3), ""},
+		"nan":           {MetricString, "NaN", ""}, // JSON can't keep NaN as a number
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d metrics, got %+v", len(expected), metrics)
+	}
+	for name, e := range expected {
+		if metrics[name] != e {
+			t.Fatalf("Expected %s to be %#v, got %#v", name, e, metrics[name])
+		}
+	}
+	if len(metricErrs) != 6 {
+		t.Fatalf("Expected 6 errors, got %v", metricErrs)
+	}
+
+	if _, _, err = ParseTestletOutput([]byte("ping: unknown host")); err == nil {
+		t.Fatal("Expected an error for output that isn't JSON")
+	}
+}
+
+// TestTestDataJSON tests that values keep their type, and results keep their run, when they are written to the
+// database and read back
+func TestTestDataJSON(t *testing.T) {
+	start := time.Date(2016, 5, 2, 14, 21, 7, 0, time.UTC)
+	run := TestletRun{Start: start, End: start.Add(2 * time.Second), Duration: 2 * time.Second, ExitStatus: 1}
+	metrics := map[string]MetricValue{
+		"float":    {MetricFloat, 0.5, "%"},
+		"int":      {MetricInt, int64(42), ""},
+		"bool":     {MetricBool, true, ""},
+		"string":   {MetricString, "1.5", ""},
+		"duration": {MetricDuration, 27 * time.Millisecond, ""},
+	}
+	data := TestData{"agent1": {"8.8.8.8": {TestletRun: run, Metrics: metrics}}}
+
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var read TestData
+	if err = json.Unmarshal(dataJSON, &read); err != nil {
+		t.Fatal(err)
+	}
+	target := read["agent1"]["8.8.8.8"]
+	if target.TestletRun != run || !target.Measured().Equal(run.End) {
+		t.Fatalf("Expected the run to be %+v after reading it back, got %+v", run, target.TestletRun)
+	}
+	for name, m := range metrics {
+		if target.Metrics[name] != m {
+			t.Fatalf("Expected %s to be %#v after reading it back, got %#v", name, m, target.Metrics[name])
+		}
+	}
+
+	// Results kept before runs were recorded only have the metrics, with every value as a string
+	if err = json.Unmarshal([]byte(`{"agent1": {"8.8.8.8": {"metrics": "3", "packet_loss": "0"}}}`), &read); err != nil {
+		t.Fatal(err)
+	}
+	target = read["agent1"]["8.8.8.8"]
+	if len(target.Metrics) != 2 || target.Metrics["metrics"] != (MetricValue{MetricFloat, float64(3), ""}) || !target.Measured().IsZero() {
+		t.Fatalf("Unexpected results read from the old format: %+v", target)
+	}
+
+	if !read.Measured().IsZero() {
+		t.Fatal("Expected results in the old format to have no measurement time")
+	}
+	read["agent2"] = map[string]TargetData{"8.8.4.4": {TestletRun: run}}
+	if !read.Measured().Equal(run.End) {
+		t.Fatalf("Expected the testrun to have been measured at %v, got %v", run.End, read.Measured())
+	}
+
+	if _, err = json.Marshal(MetricValue{MetricInt, 42, ""}); err == nil {
+		t.Fatal("Expected an error for a value of the wrong Go type")
+	}
+}
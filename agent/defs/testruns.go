@@ -8,6 +8,12 @@
 
 package defs
 
+import (
+	"time"
+
+	"github.com/Mierdin/todd/server/objects"
+)
+
 // TestRun is a struct  for a testrun command to be sent to the agent. This is not to be confused with the testrun object.
 // Here, the "targets" property is a string slice - which means that the target type and targets have already been calculated by the server.
 // This struct is sent to a specific agent so that it has the instructions it needs to perform a test.
@@ -17,3 +23,61 @@ type TestRun struct {
 	Testlet string   `json:"testlet"`
 	Args    string   `json:"args"`
 }
+
+// These are the final states of a testrun, as kept in its TestRunRecord
+const (
+	TestRunRunning  = "running"
+	TestRunFinished = "finished"
+	TestRunFailed   = "failed"
+)
+
+// TestRunRecord is the server's history of a single testrun. Unlike the status and data the server keeps while a testrun is
+// in progress, this record is kept after the testrun is over, until it is removed by the retention settings in the [History]
+// section of the server configuration.
+type TestRunRecord struct {
+	Uuid      string                       `json:"uuid"`
+	Label     string                       `json:"label"`
+	Object    objects.TestRunObject        `json:"object"`    // the testrun object as it was run, with overrides applied
+	Revision  int                          `json:"revision"`  // the revision of the testrun object that was run
+	Overrides map[string]string            `json:"overrides"` // source overrides provided when the testrun was started
+	User      string                       `json:"user"`      // as reported by the client - this is not authenticated
+	Agents    map[string]map[string]string `json:"agents"`    // "sources" and "targets", each mapping agent UUIDs to groups
+	Phases    []TestRunPhase               `json:"phases"`
+	Sinks     []TestRunSink                `json:"sinks"` // where the results were written - empty if they weren't, such as when the source was overridden
+	State     string                       `json:"state"`
+	Started   time.Time                    `json:"started"`
+	Ended     time.Time                    `json:"ended"`
+}
+
+// TestRunPhase records when a testrun started and finished one of its phases, such as installing the testrun on the agents,
+// or running the tests. End is zero if the phase never finished.
+type TestRunPhase struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// These are the states of a sink in a TestRunRecord
+const (
+	SinkWritten = "written"
+	SinkSpooled = "spooled" // the write failed, and the results were saved to be retried
+	SinkFailed  = "failed"
+)
+
+// TestRunSink records whether the results of a testrun were written to one of the result sinks (TSDB plugins) configured
+// on the server
+type TestRunSink struct {
+	Name     string        `json:"name"`
+	Plugin   string        `json:"plugin"`
+	State    string        `json:"state"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Duration returns how long the testrun took, or how long it has been running so far
+func (r TestRunRecord) Duration() time.Duration {
+	if r.Ended.IsZero() {
+		return time.Since(r.Started)
+	}
+	return r.Ended.Sub(r.Started)
+}
@@ -17,7 +17,7 @@ import (
 	"path/filepath"
 
 	"github.com/Mierdin/todd/config"
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
 // GetFacts is responsible for gathering facts on a system (runs on the agent).
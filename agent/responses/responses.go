@@ -2,7 +2,8 @@
    ToDD agent responses
 
    These are asynchronous responses sent back to the server, usually as a response to a task.
-   Not all tasks result in an agent sending a response to the server. Responses are for highly sensitive operations like test distribution and execution.
+   Every task results in a TaskResultResponse, which tells the server whether or not the task succeeded. Other responses
+   are for highly sensitive operations like test distribution and execution.
 
     Copyright 2016 Matt Oswalt. Use or modification of this
     source code is governed by the license provided here:
@@ -0,0 +1,19 @@
+/*
+   ToDD response - task result
+
+    Copyright 2016 Matt Oswalt. Use or modification of this
+    source code is governed by the license provided here:
+    https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package responses
+
+// TaskResultResponse is sent by an agent after it has run a task, to report whether or not the task succeeded.
+// TaskID is the ID of the task this result is for, which allows the server to correlate the two.
+type TaskResultResponse struct {
+	BaseResponse
+	TaskID   string `json:"taskid"`
+	TaskType string `json:"tasktype"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
@@ -15,7 +15,7 @@ import (
 	"os"
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
 // DownloadAssetTask defines this particular task. It contains definitions not only for the task message, but
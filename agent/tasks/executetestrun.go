@@ -18,9 +18,10 @@ import (
 	"sync"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/agent/cache"
+	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/config"
 )
 
@@ -64,8 +65,9 @@ func (ett ExecuteTestRunTask) Run() error {
 	wg.Add(len(tr.Targets))
 
 	// gatheredData represents test data from this agent for all targets.
-	// Key is target name, value is JSON output from testlet for that target
-	gatheredData := make(map[string]string)
+	// Key is target name, value is the output from testlet for that target, along with when and how it ran
+	gatheredData := make(map[string]defs.TestletResult)
+	var gatheredMu sync.Mutex
 
 	// Execute testlets against all targets asynchronously
 	for i := range tr.Targets {
@@ -83,8 +85,25 @@ func (ett ExecuteTestRunTask) Run() error {
 			// Attach buffer to command
 			cmd.Stdout = cmdOutput
 
+			// Record test data, however the testlet ends up finishing
+			var result defs.TestletResult
+			result.ExitStatus = -1
+			defer func() {
+				result.End = time.Now().UTC()
+				result.Duration = result.End.Sub(result.Start)
+				result.Output = string(cmdOutput.Bytes())
+
+				gatheredMu.Lock()
+				gatheredData[thisTarget] = result
+				gatheredMu.Unlock()
+			}()
+
 			// Execute collector
-			cmd.Start()
+			result.Start = time.Now().UTC()
+			if err := cmd.Start(); err != nil {
+				log.Errorf("Failed to start testlet %s: %v", testlet_path, err)
+				return
+			}
 
 			done := make(chan error, 1)
 			go func() {
@@ -102,17 +121,13 @@ func (ett ExecuteTestRunTask) Run() error {
 					log.Debug("Successfully killed ", testlet_path)
 				}
 			case err := <-done:
+				result.ExitStatus = cmd.ProcessState.ExitCode()
 				if err != nil {
 					log.Errorf("Testlet %s completed with error '%s'", testlet_path, err)
-					gatheredData[thisTarget] = "error"
 				} else {
 					log.Debugf("Testlet %s completed without error", testlet_path)
 				}
 			}
-
-			// Record test data
-			gatheredData[thisTarget] = string(cmdOutput.Bytes())
-
 		}()
 	}
 
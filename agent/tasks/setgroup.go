@@ -12,7 +12,7 @@ import (
 	"errors"
 	"fmt"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/agent/cache"
 	"github.com/Mierdin/todd/config"
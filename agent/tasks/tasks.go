@@ -11,6 +11,8 @@ package tasks
 import (
 	"io"
 	"os"
+
+	"github.com/Mierdin/todd/hostresources"
 )
 
 // Task is an interface to define task behavior This is used for functions like those in comms
@@ -21,6 +23,21 @@ type Task interface {
 	// by this interface. If the task needs some additional data, it gets these through struct properties. This works but
 	// doesn't quite feel right. Come back to this and see if there's a better way.
 	Run() error
+
+	// TaskID returns the unique ID of this task. Agents use this to detect (and drop) tasks that have been
+	// delivered more than once.
+	TaskID() string
+}
+
+// SupportedTypes is the list of task types this version of the ToDD agent is able to run. Agents include this
+// in their advertisement, so that the server doesn't send them tasks they can't handle.
+var SupportedTypes = []string{
+	"DownloadAsset",
+	"KeyValue",
+	"SetGroup",
+	"DeleteTestData",
+	"InstallTestRun",
+	"ExecuteTestRun",
 }
 
 // BaseTask is a struct that is intended to be embedded by specific task structs. Both of these in conjunction
@@ -28,6 +45,21 @@ type Task interface {
 // dependencies of the task, such as an HTTP handler.
 type BaseTask struct {
 	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// NewBaseTask returns a BaseTask of the provided type, with a newly generated unique ID. This should be used
+// to populate the BaseTask of every task that is sent to an agent.
+func NewBaseTask(taskType string) BaseTask {
+	return BaseTask{
+		Type: taskType,
+		ID:   hostresources.GenerateUuid(),
+	}
+}
+
+// TaskID returns the unique ID of this task
+func (b BaseTask) TaskID() string {
+	return b.ID
 }
 
 // FileSystem is an interface to abstract the "os" calls, to properly mock out functions that work with the filesystem.
@@ -84,7 +84,10 @@ func (capi ClientApi) DisplayAgents(agents []defs.AgentAdvert, detail bool) erro
 		// TODO(moswalt): if nothing found, API should return either null or empty slice, and client should handle this
 		tmpl, err := template.New("test").Parse(
 			`Agent UUID:  {{.Uuid}}
-Expires:  {{.Expires}}
+State:  {{.State}}
+Last Seen:  {{.LastSeen}}
+Protocol Version: {{.VersionSummary}}
+Supported Tasks: {{range $i, $t := .SupportedTasks}}{{if $i}}, {{end}}{{$t}}{{end}}
 Collector Summary: {{.CollectorSummary}}
 Facts:
 {{.PPFacts}}` + "\n")
@@ -106,15 +109,16 @@ Facts:
 
 		// Format in tab-separated columns with a tab stop of 8.
 		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
-		fmt.Fprintln(w, "UUID\tEXPIRES\tADDR\tFACT SUMMARY\tCOLLECTOR SUMMARY")
+		fmt.Fprintln(w, "UUID\tSTATE\tADDR\tVERSION\tFACT SUMMARY\tCOLLECTOR SUMMARY")
 
 		for i := range agents {
 			fmt.Fprintf(
 				w,
-				"%s\t%s\t%s\t%s\t%s\n",
+				"%s\t%s\t%s\t%s\t%s\t%s\n",
 				hostresources.TruncateID(agents[i].Uuid),
-				agents[i].Expires,
+				agents[i].State,
 				agents[i].DefaultAddr,
+				agents[i].VersionSummary(),
 				agents[i].FactSummary(),
 				agents[i].CollectorSummary(),
 			)
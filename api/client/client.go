@@ -8,4 +8,18 @@
 
 package api
 
+import (
+	"os/user"
+)
+
 type ClientApi struct{}
+
+// currentUser returns the name of the user running the client, which the server records alongside the changes
+// they make. An empty string is returned if the user can't be determined.
+func currentUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"os"
 
 	"gopkg.in/yaml.v2"
@@ -84,7 +85,7 @@ func (capi ClientApi) Create(conf map[string]string, yamlFileName string) error
 
 	// Construct API request, and send POST to server for this object
 	var url string
-	url = fmt.Sprintf("http://%s:%s/v1/object/create", conf["host"], conf["port"])
+	url = fmt.Sprintf("http://%s:%s/v1/object/create?user=%s", conf["host"], conf["port"], neturl.QueryEscape(currentUser()))
 
 	var jsonByte = []byte(json_str)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonByte))
@@ -0,0 +1,84 @@
+/*
+    ToDD Client API Calls for "todd deadletters"
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+// DeadLetters will query ToDD for the messages that could not be delivered to agents (or to the server),
+// and display them to the user
+func (capi ClientApi) DeadLetters(conf map[string]string) error {
+
+	url := fmt.Sprintf("http://%s:%s/v1/deadletters", conf["host"], conf["port"])
+
+	// Build the request
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	// Send the request via a client
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	// Defer the closing of the body
+	defer resp.Body.Close()
+	// Read the content into a byte array
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// Marshal API data into object (see comms.DeadLetter)
+	var deadLetters []struct {
+		Queue    string `json:"queue"`
+		Reason   string `json:"reason"`
+		Attempts int    `json:"attempts"`
+		Body     string `json:"body"`
+	}
+	err = json.Unmarshal(body, &deadLetters)
+	if err != nil {
+		return err
+	}
+
+	if len(deadLetters) == 0 {
+		fmt.Println("No dead-lettered messages found.")
+		return nil
+	}
+
+	w := new(tabwriter.Writer)
+
+	// Format in tab-separated columns with a tab stop of 8.
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "QUEUE\tREASON\tATTEMPTS\tMESSAGE")
+
+	for _, dl := range deadLetters {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%d\t%s\n",
+			dl.Queue,
+			dl.Reason,
+			dl.Attempts,
+			dl.Body,
+		)
+	}
+	fmt.Fprintln(w)
+	w.Flush()
+
+	return nil
+}
@@ -28,9 +28,11 @@ func (capi ClientApi) Delete(conf map[string]string, objType, objLabel string) e
 	deleteinfo := struct {
 		Label string `json:"label"`
 		Type  string `json:"type"`
+		User  string `json:"user"`
 	}{
 		objLabel,
 		objType,
+		currentUser(),
 	}
 
 	// Marshal deleteinfo into JSON
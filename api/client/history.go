@@ -0,0 +1,267 @@
+/*
+    ToDD Client API Calls for "todd history", "todd diff" and "todd rollback"
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// ObjectHistory will query the ToDD server for every revision of an object, oldest first
+func (capi ClientApi) ObjectHistory(conf map[string]string, objType, objLabel string) ([]objects.ObjectRevision, error) {
+
+	var revs []objects.ObjectRevision
+
+	// If insufficient subargs were provided, error out
+	if objType == "" || objLabel == "" {
+		return revs, errors.New("Error, need to provide type and label (Ex. 'todd history group datacenter')")
+	}
+
+	url := fmt.Sprintf(
+		"http://%s:%s/v1/object/history?type=%s&label=%s",
+		conf["host"], conf["port"], neturl.QueryEscape(objType), neturl.QueryEscape(objLabel),
+	)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return revs, err
+	}
+
+	// Defer the closing of the body
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return revs, fmt.Errorf("ERROR - no history found for %s %s.", objType, objLabel)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return revs, errors.New(resp.Status)
+	}
+
+	// Read the content into a byte array
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return revs, err
+	}
+
+	// Marshal API data into object
+	err = json.Unmarshal(body, &revs)
+	if err != nil {
+		return revs, err
+	}
+
+	return revs, nil
+}
+
+// DisplayObjectHistory is responsible for displaying the revisions of an object to the terminal
+func (capi ClientApi) DisplayObjectHistory(revs []objects.ObjectRevision) {
+
+	w := new(tabwriter.Writer)
+
+	// Format in tab-separated columns with a tab stop of 8.
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "REVISION\tTIME\tAUTHOR\tCHANGE")
+
+	for i := range revs {
+
+		change := "updated"
+		if revs[i].Deleted {
+			change = "deleted"
+		} else if i == 0 || revs[i-1].Deleted {
+			change = "created"
+		}
+
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s\n",
+			revs[i].Revision,
+			formatTime(revs[i].Time),
+			revs[i].Author,
+			change,
+		)
+	}
+	fmt.Fprintln(w)
+	w.Flush()
+}
+
+// Diff will display the differences between two revisions of an object
+func (capi ClientApi) Diff(conf map[string]string, objType, objLabel, fromRev, toRev string) error {
+
+	if fromRev == "" || toRev == "" {
+		return errors.New("Error, need to provide type, label and two revisions (Ex. 'todd diff group datacenter 1 2')")
+	}
+
+	revs, err := capi.ObjectHistory(conf, objType, objLabel)
+	if err != nil {
+		return err
+	}
+
+	from, err := findRevision(revs, fromRev)
+	if err != nil {
+		return err
+	}
+	to, err := findRevision(revs, toRev)
+	if err != nil {
+		return err
+	}
+
+	fromLines, err := revisionLines(from)
+	if err != nil {
+		return err
+	}
+	toLines, err := revisionLines(to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("--- %s %s (revision %d)\n", objType, objLabel, from.Revision)
+	fmt.Printf("+++ %s %s (revision %d)\n", objType, objLabel, to.Revision)
+	for _, line := range diffLines(fromLines, toLines) {
+		fmt.Println(line)
+	}
+
+	return nil
+}
+
+// findRevision returns the revision with the provided number
+func findRevision(revs []objects.ObjectRevision, revision string) (objects.ObjectRevision, error) {
+	num, err := strconv.Atoi(revision)
+	if err != nil {
+		return objects.ObjectRevision{}, fmt.Errorf("Error, %q is not a revision number", revision)
+	}
+
+	for i := range revs {
+		if revs[i].Revision == num {
+			return revs[i], nil
+		}
+	}
+	return objects.ObjectRevision{}, fmt.Errorf("Error, revision %d not found", num)
+}
+
+// revisionLines renders an object as it was at a revision as indented JSON, split into lines. A revision that
+// deleted the object has no lines.
+func revisionLines(rev objects.ObjectRevision) ([]string, error) {
+	if rev.Deleted {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	err := json.Indent(&buf, rev.Object, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(buf.String(), "\n"), nil
+}
+
+// diffLines compares two sets of lines, and returns every line prefixed with "-" if it was removed, "+" if it was
+// added, or " " if it was left unchanged. Objects are small, so the longest common subsequence of the lines is
+// simply calculated in full.
+func diffLines(a, b []string) []string {
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ret []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ret = append(ret, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ret = append(ret, "-"+a[i])
+			i++
+		default:
+			ret = append(ret, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ret = append(ret, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		ret = append(ret, "+"+b[j])
+	}
+
+	return ret
+}
+
+// Rollback will ask the ToDD server to restore an object to the way it was at an earlier revision
+func (capi ClientApi) Rollback(conf map[string]string, objType, objLabel, revision string) error {
+
+	// If insufficient subargs were provided, error out
+	if objType == "" || objLabel == "" || revision == "" {
+		return errors.New("Error, need to provide type, label and revision (Ex. 'todd rollback group datacenter 2')")
+	}
+	num, err := strconv.Atoi(revision)
+	if err != nil {
+		return fmt.Errorf("Error, %q is not a revision number", revision)
+	}
+
+	// anonymous struct to hold our rollback info
+	rollbackInfo := struct {
+		Type     string `json:"type"`
+		Label    string `json:"label"`
+		Revision int    `json:"revision"`
+		User     string `json:"user"`
+	}{
+		objType,
+		objLabel,
+		num,
+		currentUser(),
+	}
+
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(rollbackInfo)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s:%s/v1/object/rollback", conf["host"], conf["port"])
+
+	resp, err := http.Post(url, "application/json", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Print a regular OK message if the object was rolled back successfully - else print the server's error
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(body)))
+	}
+	fmt.Println("[OK]")
+
+	return nil
+}
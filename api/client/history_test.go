@@ -0,0 +1,49 @@
+/*
+   Unit testing for ToDD Client API - history.go
+
+   Copyright 2016 Matt Oswalt. Use or modification of this
+   source code is governed by the license provided here:
+   https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want []string
+	}{
+		{
+			a:    []string{"{", `  "label": "dc",`, `  "group": "old"`, "}"},
+			b:    []string{"{", `  "label": "dc",`, `  "group": "new"`, "}"},
+			want: []string{" {", `   "label": "dc",`, `-  "group": "old"`, `+  "group": "new"`, " }"},
+		},
+		{
+			a:    []string{"a", "b"},
+			b:    []string{"a", "x", "b", "c"},
+			want: []string{" a", "+x", " b", "+c"},
+		},
+		{
+			// A revision that deleted the object has no lines
+			a:    []string{"a", "b"},
+			b:    nil,
+			want: []string{"-a", "-b"},
+		},
+		{
+			a:    nil,
+			b:    nil,
+			want: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		if got := diffLines(tc.a, tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
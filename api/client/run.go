@@ -52,11 +52,13 @@ func (capi ClientApi) Run(conf map[string]string, testrunName string, displayRep
 		SourceGroup string `json:"sourceGroup"`
 		SourceApp   string `json:"sourceApp"`
 		SourceArgs  string `json:"sourceArgs"`
+		User        string `json:"user"`
 	}{
 		testrunName,
 		sourceGroup,
 		sourceApp,
 		sourceArgs,
+		currentUser(),
 	}
 
 	// Marshal the final object into JSON
@@ -92,6 +94,8 @@ func (capi ClientApi) Run(conf map[string]string, testrunName string, displayRep
 		return errors.New("ERROR - Specified testrun object not found.")
 	case "invalidtopology":
 		return errors.New("ERROR - Not enough agents are in the groups specified by the testrun")
+	case "unsupportedagents":
+		return errors.New("ERROR - Some agents in the groups specified by the testrun are unable to run tests (check 'todd agents' for version mismatches)")
 	case "failure":
 		return errors.New("ERROR - some kind of error was encountered on the server. Test was not run.")
 	}
@@ -0,0 +1,89 @@
+/*
+    ToDD Client API Calls for "todd spool"
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Spool will query ToDD for the testrun results waiting to be written to each result sink (and those that have been given
+// up on), and display them to the user
+func (capi ClientApi) Spool(conf map[string]string) error {
+
+	url := fmt.Sprintf("http://%s:%s/v1/spool", conf["host"], conf["port"])
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+
+	// Defer the closing of the body
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	// Read the content into a byte array
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// Marshal API data into object (see tsdb.SpoolStatus)
+	var statuses []struct {
+		Sink        string    `json:"sink"`
+		Batches     int       `json:"batches"`
+		Oldest      time.Time `json:"oldest"`
+		Attempts    int       `json:"attempts"`
+		NextAttempt time.Time `json:"nextattempt"`
+		LastError   string    `json:"lasterror"`
+		Bad         int       `json:"bad"`
+	}
+	err = json.Unmarshal(body, &statuses)
+	if err != nil {
+		return err
+	}
+
+	if len(statuses) == 0 {
+		fmt.Println("No testrun results waiting to be written.")
+		return nil
+	}
+
+	w := new(tabwriter.Writer)
+
+	// Format in tab-separated columns with a tab stop of 8.
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "SINK\tTESTRUNS\tGIVEN UP\tOLDEST\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+
+	for _, s := range statuses {
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%d\t%s\t%d\t%s\t%s\n",
+			s.Sink,
+			s.Batches,
+			s.Bad,
+			formatTime(s.Oldest),
+			s.Attempts,
+			formatTime(s.NextAttempt),
+			s.LastError,
+		)
+	}
+	fmt.Fprintln(w)
+	w.Flush()
+
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+    ToDD Client API Calls for "todd testruns"
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/hostresources"
+)
+
+// TestRuns will query the ToDD server for the history of testruns. Optionally, the user can provide a subargument
+// containing the UUID of a testrun, and only the history of that testrun will be returned.
+func (capi ClientApi) TestRuns(conf map[string]string, testUuid string) ([]defs.TestRunRecord, error) {
+
+	var records []defs.TestRunRecord
+
+	url := fmt.Sprintf("http://%s:%s/v1/testruns", conf["host"], conf["port"])
+	if testUuid != "" {
+		url = fmt.Sprintf("%s?uuid=%s", url, testUuid)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return records, err
+	}
+
+	// Defer the closing of the body
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return records, fmt.Errorf("ERROR - testrun %s not found.", testUuid)
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		return records, fmt.Errorf("ERROR - more than one testrun matches %s, provide more of the UUID.", testUuid)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return records, errors.New(resp.Status)
+	}
+
+	// Read the content into a byte array
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return records, err
+	}
+
+	// Marshal API data into object
+	err = json.Unmarshal(body, &records)
+	if err != nil {
+		return records, err
+	}
+
+	return records, nil
+}
+
+// DisplayTestRuns is responsible for displaying the history of testruns to the terminal
+func (capi ClientApi) DisplayTestRuns(records []defs.TestRunRecord, detail bool) error {
+
+	if len(records) == 0 {
+		fmt.Println("No testruns found.")
+		return nil
+	}
+
+	if detail {
+
+		funcs := template.FuncMap{
+			"duration": formatDuration,
+			"time":     formatTime,
+			"phaseDuration": func(p defs.TestRunPhase) string {
+				if p.End.IsZero() {
+					return "unfinished"
+				}
+				return formatDuration(p.End.Sub(p.Start))
+			},
+		}
+
+		tmpl, err := template.New("testrun").Funcs(funcs).Parse(
+			`Testrun UUID:  {{.Uuid}}
+Label:  {{.Label}} (revision {{.Revision}})
+State:  {{.State}}
+User:  {{.User}}
+Started:  {{time .Started}}
+Ended:  {{time .Ended}}
+Duration:  {{duration .Duration}}
+Overrides:{{range $k, $v := .Overrides}}
+    {{$k}}: {{$v}}{{end}}
+Agents:{{range $role, $agents := .Agents}}{{range $uuid, $group := $agents}}
+    {{$uuid}} ({{$role}}, group {{$group}}){{end}}{{end}}
+Phases:{{range .Phases}}
+    {{.Name}}: {{time .Start}} ({{phaseDuration .}}){{end}}
+Sinks:{{range .Sinks}}
+    {{.Name}} ({{.Plugin}}): {{.State}}{{if .Error}} - {{.Error}}{{end}}{{end}}` + "\n")
+
+		if err != nil {
+			return err
+		}
+
+		// Output retrieved data
+		for i := range records {
+			err = tmpl.Execute(os.Stdout, records[i])
+			if err != nil {
+				return err
+			}
+		}
+
+	} else {
+		w := new(tabwriter.Writer)
+
+		// Format in tab-separated columns with a tab stop of 8.
+		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+		fmt.Fprintln(w, "UUID\tLABEL\tSTATE\tUSER\tSTARTED\tDURATION")
+
+		for i := range records {
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%s\t%s\t%s\n",
+				hostresources.TruncateID(records[i].Uuid),
+				records[i].Label,
+				records[i].State,
+				records[i].User,
+				formatTime(records[i].Started),
+				formatDuration(records[i].Duration()),
+			)
+		}
+		fmt.Fprintln(w)
+		w.Flush()
+
+	}
+
+	return nil
+}
+
+// formatTime displays a time in the local timezone, or "-" if it isn't set
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// formatDuration displays a duration rounded to the second
+func formatDuration(d time.Duration) string {
+	return (d / time.Second * time.Second).String()
+}
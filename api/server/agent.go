@@ -13,9 +13,11 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/Mierdin/todd/agent/defs"
-	log "github.com/Sirupsen/logrus"
+	"github.com/Mierdin/todd/server/agentstate"
+	log "github.com/sirupsen/logrus"
 )
 
 func (tapi ToDDApi) Agent(w http.ResponseWriter, r *http.Request) {
@@ -27,6 +29,11 @@ func (tapi ToDDApi) Agent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The state stored in the database is only updated periodically, so report the current one
+	for i := range agentList {
+		agentList[i].State = agentstate.State(tapi.cfg, agentList[i], time.Now())
+	}
+
 	// Make sure UUID string is provided
 	if uuid := r.URL.Query().Get("uuid"); uuid != "" {
 		// Let's use the full list so we can identify the right agent if the user specified a short
@@ -0,0 +1,68 @@
+/*
+    Tests for the agent API
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+)
+
+// TestAgent tests that agents can be listed, looked up by a shortened UUID, and are reported with their current state
+func TestAgent(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.Plugin = "memory"
+	cfg.DB.DatabaseName = "TestAgent"
+	cfg.Heartbeat.StaleAfter = 45
+	cfg.Heartbeat.OfflineAfter = 120
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tapi := ToDDApi{cfg: cfg, tdb: tdb}
+
+	adverts := []defs.AgentAdvert{
+		{Uuid: "abcdef0123", LastSeen: time.Now()},
+		{Uuid: "0123abcdef", LastSeen: time.Now().Add(-time.Minute), State: defs.AgentOnline},
+	}
+	for _, adv := range adverts {
+		if err = tdb.SetAgent(adv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	tapi.Agent(w, httptest.NewRequest("GET", "/v1/agent", nil))
+	var agents []defs.AgentAdvert
+	if err = json.Unmarshal(w.Body.Bytes(), &agents); err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 {
+		t.Fatalf("Expected 2 agents, got %+v", agents)
+	}
+
+	w = httptest.NewRecorder()
+	tapi.Agent(w, httptest.NewRequest("GET", "/v1/agent?uuid=0123", nil))
+	agents = nil
+	if err = json.Unmarshal(w.Body.Bytes(), &agents); err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0].Uuid != "0123abcdef" {
+		t.Fatalf("Expected only agent 0123abcdef, got %+v", agents)
+	}
+	if agents[0].State != defs.AgentStale {
+		t.Fatalf("Expected agent to be reported as %s, got %s", defs.AgentStale, agents[0].State)
+	}
+}
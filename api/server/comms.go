@@ -0,0 +1,172 @@
+/*
+    ToDD API - agent communication (mostly used by the "http" comms plugin)
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/comms"
+)
+
+// CommsAdvert receives an agent advertisement and hands it off to the comms package
+func (tapi ToDDApi) CommsAdvert(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading agent advertisement", 400)
+		return
+	}
+
+	// Check the message now, so that the agent knows if it was refused
+	err = comms.VerifyMessage(tapi.cfg, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Message rejected: %v", err), 403)
+		return
+	}
+
+	err = comms.PublishAgentAdvert(body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+}
+
+// CommsHeartbeat receives an agent heartbeat and hands it off to the comms package
+func (tapi ToDDApi) CommsHeartbeat(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading agent heartbeat", 400)
+		return
+	}
+
+	// Check the message now, so that the agent knows if it was refused
+	err = comms.VerifyMessage(tapi.cfg, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Message rejected: %v", err), 403)
+		return
+	}
+
+	err = comms.PublishHeartbeat(body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+}
+
+// CommsTasks will hold the request open until a task is available on the requested queue (agent UUID or group queue),
+// or until the poll times out. In the latter case, a 204 is returned. Agents may only poll their own queues.
+func (tapi ToDDApi) CommsTasks(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading task poll", 400)
+		return
+	}
+
+	queueName, groupName, err := comms.OpenTaskPoll(tapi.cfg, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Task poll rejected: %v", err), 403)
+		return
+	}
+
+	// Agents polling their group queue also tell us which group they're in, so that they receive tasks broadcast to that group
+	if groupName != "" {
+		comms.BindGroup(queueName, groupName)
+	}
+
+	// Stop waiting if the agent goes away, so that a task isn't taken off the queue for nobody
+	task := comms.PollTask(queueName, r.Context().Done())
+	if task == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The task is only delivered once it has been sent to the agent - otherwise, it is kept for the agent's next poll
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(task)
+	if err == nil {
+		err = http.NewResponseController(w).Flush()
+	}
+	if err != nil {
+		log.Warnf("Failed to send task to %s, requeueing: %v", queueName, err)
+		err = comms.RequeueTask(queueName, task)
+		if err != nil {
+			log.Errorf("Failed to requeue task for %s - this task is lost: %v", queueName, err)
+		}
+	}
+}
+
+// CommsResponse receives a response from an agent and hands it off to the comms package
+func (tapi ToDDApi) CommsResponse(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading agent response", 400)
+		return
+	}
+
+	// Check the message now, so that the agent knows if it was refused
+	err = comms.VerifyMessage(tapi.cfg, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Message rejected: %v", err), 403)
+		return
+	}
+
+	err = comms.PublishResponse(body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+}
+
+// DeadLetters returns the list of tasks and responses that could not be delivered, and were set aside by the comms package
+func (tapi ToDDApi) DeadLetters(w http.ResponseWriter, r *http.Request) {
+
+	log.Info("Received request for dead-lettered messages")
+
+	tc, err := comms.NewToDDComms(tapi.cfg)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	deadLetters, err := tc.CommsPackage.ListDeadLetters()
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	response, err := json.MarshalIndent(deadLetters, "", "  ")
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
@@ -0,0 +1,72 @@
+/*
+    Tests for the agent communication API
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/comms"
+	"github.com/Mierdin/todd/config"
+)
+
+// brokenWriter is a ResponseWriter for a connection that has gone away
+type brokenWriter struct {
+	header http.Header
+}
+
+func (b brokenWriter) Header() http.Header        { return b.header }
+func (b brokenWriter) Write([]byte) (int, error)  { return 0, errors.New("connection reset by peer") }
+func (b brokenWriter) WriteHeader(statusCode int) {}
+
+// taskPoll returns a request polling the provided queue for tasks, sent by the provided agent
+func taskPoll(t *testing.T, sender, queueName string) *http.Request {
+	env, err := json.Marshal(comms.Envelope{
+		Version:   defs.ProtocolVersion,
+		Sender:    sender,
+		Timestamp: time.Now().UTC(),
+		MessageID: sender + "-" + queueName + "-" + time.Now().String(),
+		Body:      json.RawMessage(`{"queue": "` + queueName + `"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest("POST", "/v1/comms/tasks", strings.NewReader(string(env)))
+}
+
+// TestCommsTasks tests that agents can only poll their own queues, and that a task isn't lost if it can't be sent to
+// the agent
+func TestCommsTasks(t *testing.T) {
+	tapi := ToDDApi{cfg: config.Config{}}
+
+	task := []byte(`{"type": "KeyValue"}`)
+	if err := comms.RequeueTask("apiagent1", task); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	tapi.CommsTasks(w, taskPoll(t, "apiagent2", "apiagent1"))
+	if w.Code != 403 {
+		t.Fatalf("Expected a poll of another agent's queue to be refused, got %d", w.Code)
+	}
+
+	tapi.CommsTasks(brokenWriter{header: make(http.Header)}, taskPoll(t, "apiagent1", "apiagent1"))
+
+	w = httptest.NewRecorder()
+	tapi.CommsTasks(w, taskPoll(t, "apiagent1", "apiagent1"))
+	if w.Code != 200 || w.Body.String() != string(task) {
+		t.Fatalf("Expected the task to be requeued after failing to send it, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -13,7 +13,7 @@ import (
 	"fmt"
 	"net/http"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
 func (tapi ToDDApi) Groups(w http.ResponseWriter, r *http.Request) {
@@ -13,9 +13,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/server/objects"
 )
@@ -49,7 +50,7 @@ func (tapi ToDDApi) ListObjects(w http.ResponseWriter, r *http.Request) {
 }
 
 // CreateObject will decode a JSON object into a proper ToddObject instance, and send that to the
-// database layer to be written persistently.
+// database layer to be written persistently. The "user" URL parameter is recorded as the author of this revision of the object.
 func (tapi ToDDApi) CreateObject(w http.ResponseWriter, r *http.Request) {
 
 	// Defer the closing of the body
@@ -72,7 +73,7 @@ func (tapi ToDDApi) CreateObject(w http.ResponseWriter, r *http.Request) {
 	// Generate a more specific Todd Object based on the JSON data
 	finalobj := baseobj.ParseToddObject(body)
 
-	err = tapi.tdb.SetObject(finalobj)
+	err = tapi.tdb.SetObject(finalobj, r.URL.Query().Get("user"))
 	if err != nil {
 		log.Errorln(err)
 		http.Error(w, "Internal Error", 500)
@@ -92,9 +93,96 @@ func (tapi ToDDApi) DeleteObject(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Error", 500)
 	}
 
-	err = tapi.tdb.DeleteObject(deleteInfo["label"], deleteInfo["type"])
+	err = tapi.tdb.DeleteObject(deleteInfo["label"], deleteInfo["type"], deleteInfo["user"])
 	if err != nil {
 		log.Errorln(err)
 		http.Error(w, "Internal Error", 500)
 	}
 }
+
+// ObjectHistory will return every revision of the object with the type and label provided in the URL, oldest first
+func (tapi ToDDApi) ObjectHistory(w http.ResponseWriter, r *http.Request) {
+
+	objType := r.URL.Query().Get("type")
+	label := r.URL.Query().Get("label")
+	if objType == "" || label == "" {
+		http.Error(w, "Error, object type and label not provided.", 400)
+		return
+	}
+
+	revs, err := tapi.tdb.GetObjectRevisions(objType, label)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	if len(revs) == 0 {
+		http.Error(w, "Error, object has no history.", 404)
+		return
+	}
+
+	response, err := json.MarshalIndent(revs, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+// RollbackObject will restore an object to the way it was at an earlier revision. The rollback is kept as a new revision,
+// so the revisions since then are not lost.
+func (tapi ToDDApi) RollbackObject(w http.ResponseWriter, r *http.Request) {
+
+	rollbackInfo := struct {
+		Type     string `json:"type"`
+		Label    string `json:"label"`
+		Revision int    `json:"revision"`
+		User     string `json:"user"`
+	}{}
+
+	err := json.NewDecoder(r.Body).Decode(&rollbackInfo)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	revs, err := tapi.tdb.GetObjectRevisions(rollbackInfo.Type, rollbackInfo.Label)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	var rev *objects.ObjectRevision
+	for i := range revs {
+		if revs[i].Revision == rollbackInfo.Revision {
+			rev = &revs[i]
+			break
+		}
+	}
+	if rev == nil {
+		http.Error(w, "Error, revision "+strconv.Itoa(rollbackInfo.Revision)+" not found.", 404)
+		return
+	}
+	if rev.Deleted {
+		http.Error(w, "Error, the object was deleted in revision "+strconv.Itoa(rollbackInfo.Revision)+".", 400)
+		return
+	}
+
+	obj, err := rev.ParseObject()
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	err = tapi.tdb.SetObject(obj, rollbackInfo.User)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	log.Infof("Rolled back %s/%s to revision %d", rollbackInfo.Type, rollbackInfo.Label, rollbackInfo.Revision)
+}
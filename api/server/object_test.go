@@ -0,0 +1,78 @@
+/*
+    Tests for the object API
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// TestObjectRollback tests that objects can be rolled back to an earlier revision, and that the rollback is kept as a new revision
+func TestObjectRollback(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.Plugin = "memory"
+	cfg.DB.DatabaseName = "TestObjectRollback"
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tapi := ToDDApi{cfg: cfg, tdb: tdb}
+
+	for _, hostname := range []string{"todd-agent-1", "todd-agent-2"} {
+		body := `{"label": "dc", "type": "group", "spec": {"group": "dc", "matches": [{"hostname": "` + hostname + `"}]}}`
+		w := httptest.NewRecorder()
+		tapi.CreateObject(w, httptest.NewRequest("POST", "/v1/object/create?user=alice", strings.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatalf("Failed to create object: %d %s", w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	tapi.RollbackObject(w, httptest.NewRequest("POST", "/v1/object/rollback", strings.NewReader(`{"type": "group", "label": "dc", "revision": 1, "user": "bob"}`)))
+	if w.Code != 200 {
+		t.Fatalf("Failed to roll back object: %d %s", w.Code, w.Body)
+	}
+
+	objs, err := tdb.GetObjects("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].(objects.GroupObject).Spec.Matches[0]["hostname"] != "todd-agent-1" {
+		t.Fatalf("Object was not rolled back: %+v", objs)
+	}
+
+	w = httptest.NewRecorder()
+	tapi.ObjectHistory(w, httptest.NewRequest("GET", "/v1/object/history?type=group&label=dc", nil))
+	var revs []objects.ObjectRevision
+	if err = json.Unmarshal(w.Body.Bytes(), &revs); err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 || revs[0].Author != "alice" || revs[2].Author != "bob" {
+		t.Fatalf("Expected two revisions by alice and a rollback by bob, got %+v", revs)
+	}
+
+	w = httptest.NewRecorder()
+	tapi.RollbackObject(w, httptest.NewRequest("POST", "/v1/object/rollback", strings.NewReader(`{"type": "group", "label": "dc", "revision": 9}`)))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 rolling back to a missing revision, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	tapi.ObjectHistory(w, httptest.NewRequest("GET", "/v1/object/history?type=group&label=missing", nil))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 for an object with no history, got %d", w.Code)
+	}
+}
@@ -13,9 +13,10 @@ import (
 	"net/http"
 
 	"github.com/Mierdin/todd/db"
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/server/metrics"
 )
 
 type ToDDApi struct {
@@ -44,8 +45,24 @@ func (tapi ToDDApi) Start(cfg config.Config) error {
 	http.HandleFunc("/v1/object/testrun", tapi.ListObjects)
 	http.HandleFunc("/v1/object/create", tapi.CreateObject)
 	http.HandleFunc("/v1/object/delete", tapi.DeleteObject)
+	http.HandleFunc("/v1/object/history", tapi.ObjectHistory)
+	http.HandleFunc("/v1/object/rollback", tapi.RollbackObject)
 	http.HandleFunc("/v1/testrun/run", tapi.Run)
 	http.HandleFunc("/v1/testdata", tapi.TestData)
+	http.HandleFunc("/v1/testruns", tapi.TestRuns)
+	http.HandleFunc("/v1/deadletters", tapi.DeadLetters)
+	http.HandleFunc("/v1/spool", tapi.Spool)
+
+	// Prometheus expects to scrape metrics from /metrics, so this isn't versioned like the rest of the API
+	http.Handle("/metrics", metrics.DefaultRegistry)
+
+	// Agents using the "http" comms plugin talk to these endpoints directly, instead of a message broker
+	if tapi.cfg.Comms.Plugin == "http" {
+		http.HandleFunc("/v1/comms/advert", tapi.CommsAdvert)
+		http.HandleFunc("/v1/comms/heartbeat", tapi.CommsHeartbeat)
+		http.HandleFunc("/v1/comms/tasks", tapi.CommsTasks)
+		http.HandleFunc("/v1/comms/response", tapi.CommsResponse)
+	}
 
 	serve_url := fmt.Sprintf("%s:%s", tapi.cfg.API.Host, tapi.cfg.API.Port)
 
@@ -0,0 +1,42 @@
+/*
+    ToDD API - result spool
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/server/tsdb"
+)
+
+// Spool returns the number of testrun results waiting to be written to each result sink, having failed to be written before,
+// and the number that have been given up on
+func (tapi ToDDApi) Spool(w http.ResponseWriter, r *http.Request) {
+
+	log.Info("Received request for spooled testrun results")
+
+	statuses, err := tsdb.Spool(tapi.cfg)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	response, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
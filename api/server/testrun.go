@@ -13,9 +13,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
+	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/db"
 	"github.com/Mierdin/todd/server/objects"
 	"github.com/Mierdin/todd/server/testrun"
@@ -40,6 +42,7 @@ func (tapi ToDDApi) Run(w http.ResponseWriter, r *http.Request) {
 		SourceGroup string `json:"sourceGroup"`
 		SourceApp   string `json:"sourceApp"`
 		SourceArgs  string `json:"sourceArgs"`
+		User        string `json:"user"`
 	}{}
 
 	// Marshal API data into our struct
@@ -80,7 +83,7 @@ func (tapi ToDDApi) Run(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send back the testrun UUID
-	testUUID := testrun.Start(tapi.cfg, finalObj.(objects.TestRunObject), sourceOverrideMap)
+	testUUID := testrun.Start(tapi.cfg, finalObj.(objects.TestRunObject), sourceOverrideMap, testRunInfo.User)
 	fmt.Fprint(w, testUUID)
 }
 
@@ -108,3 +111,41 @@ func (tapi ToDDApi) TestData(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte(testData))
 }
+
+// TestRuns will list the history of testruns, or retrieve the history of a single testrun if a (possibly shortened) UUID
+// is provided. A shortened UUID that matches more than one testrun is refused.
+func (tapi ToDDApi) TestRuns(w http.ResponseWriter, r *http.Request) {
+
+	records, err := tapi.tdb.GetTestRunRecords()
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	if uuid := r.URL.Query().Get("uuid"); uuid != "" {
+		var found []defs.TestRunRecord
+		for i := range records {
+			if strings.HasPrefix(records[i].Uuid, uuid) {
+				found = append(found, records[i])
+			}
+		}
+		switch len(found) {
+		case 0:
+			http.Error(w, "Error, testrun not found.", 404)
+			return
+		case 1:
+			records = found
+		default:
+			http.Error(w, "Error, more than one testrun matches this UUID - provide more of it.", 400)
+			return
+		}
+	}
+
+	response, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprint(w, string(response))
+}
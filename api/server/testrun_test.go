@@ -0,0 +1,85 @@
+/*
+    Tests for the testrun API
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+)
+
+// TestTestRuns tests that the testrun history can be listed, and that single testruns can be looked up by a shortened UUID,
+// as long as it only matches one testrun
+func TestTestRuns(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.Plugin = "memory"
+	cfg.DB.DatabaseName = "TestTestRuns"
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tapi := ToDDApi{cfg: cfg, tdb: tdb}
+
+	records := []defs.TestRunRecord{
+		{Uuid: "abcdef0123", Label: "first", Started: time.Now().Add(-time.Minute)},
+		{Uuid: "0123abcdef", Label: "second", Started: time.Now()},
+	}
+	for _, record := range records {
+		if err = tdb.SetTestRunRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	tapi.TestRuns(w, httptest.NewRequest("GET", "/v1/testruns", nil))
+	var got []defs.TestRunRecord
+	if err = json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Label != "second" {
+		t.Fatalf("Expected both testruns, most recent first, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	tapi.TestRuns(w, httptest.NewRequest("GET", "/v1/testruns?uuid=abcd", nil))
+	got = nil
+	if err = json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Uuid != "abcdef0123" {
+		t.Fatalf("Expected only testrun abcdef0123, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	tapi.TestRuns(w, httptest.NewRequest("GET", "/v1/testruns?uuid=ffff", nil))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 for an unknown testrun, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	tapi.TestRuns(w, httptest.NewRequest("GET", "/v1/testruns?uuid=abcdef", nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 for a UUID prefix matching one testrun, got %d", w.Code)
+	}
+
+	if err = tdb.SetTestRunRecord(defs.TestRunRecord{Uuid: "abcdff4567", Label: "third", Started: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	tapi.TestRuns(w, httptest.NewRequest("GET", "/v1/testruns?uuid=abcd", nil))
+	if w.Code != 400 {
+		t.Fatalf("Expected 400 for a UUID prefix matching more than one testrun, got %d", w.Code)
+	}
+}
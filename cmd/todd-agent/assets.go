@@ -14,7 +14,7 @@ import (
 	"path/filepath"
 
 	"github.com/Mierdin/todd/config"
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/hostresources"
 )
@@ -17,11 +17,12 @@ import (
 	"github.com/Mierdin/todd/agent/cache"
 	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/agent/facts"
+	"github.com/Mierdin/todd/agent/tasks"
 	"github.com/Mierdin/todd/agent/testing"
 	"github.com/Mierdin/todd/comms"
 	"github.com/Mierdin/todd/config"
 	"github.com/Mierdin/todd/hostresources"
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
 // Command-line Arguments
@@ -58,9 +59,13 @@ func main() {
 	var ac = cache.NewAgentCache(cfg)
 	ac.Init()
 
-	// Generate UUID
-	uuid := hostresources.GenerateUuid()
-	ac.SetKeyValue("uuid", uuid)
+	// Re-use the UUID from a previous run if there is one, so that tasks which were queued
+	// for this agent while it was restarting are still delivered to it
+	uuid := ac.GetKeyValue("uuid")
+	if uuid == "" {
+		uuid = hostresources.GenerateUuid()
+		ac.SetKeyValue("uuid", uuid)
+	}
 
 	log.Infof("ToDD Agent Activated: %s", uuid)
 
@@ -86,36 +91,65 @@ func main() {
 	// Watch for changes to group membership
 	go tc.CommsPackage.WatchForGroup()
 
-	// Continually advertise agent status into message queue
+	// Continually send heartbeats to the server. The full advertisement is only sent when it has changed, or when the
+	// server asks for it (by clearing the "adverthash" key in the cache)
+	var lastCollected time.Time
 	for {
 
-		// Gather assets here as a map, and refer to a key in that map in the below struct
-		gatheredAssets := GetLocalAssets(cfg)
+		if ac.GetKeyValue("adverthash") == "" || time.Since(lastCollected) >= time.Duration(cfg.Heartbeat.AdvertInterval)*time.Second {
+			me := getAdvert(cfg, uuid)
+			lastCollected = time.Now()
 
-		var defaultaddr string
-		if cfg.LocalResources.IPAddrOverride != "" {
-			defaultaddr = cfg.LocalResources.IPAddrOverride
-		} else {
-			defaultaddr = hostresources.GetIPOfInt(cfg.LocalResources.DefaultInterface).String()
-		}
+			hash := me.Hash()
+			if hash != ac.GetKeyValue("adverthash") {
 
-		// Create an AgentAdvert instance to represent this particular agent
-		me := defs.AgentAdvert{
-			Uuid:           uuid,
-			DefaultAddr:    defaultaddr,
-			FactCollectors: gatheredAssets["factcollectors"],
-			Testlets:       gatheredAssets["testlets"],
-			Facts:          facts.GetFacts(cfg),
-			LocalTime:      time.Now().UTC(),
+				// Advertise this agent
+				err := tc.CommsPackage.AdvertiseAgent(me)
+				if err != nil {
+					log.Error("Failed to advertise agent after several retries")
+				} else {
+					ac.SetKeyValue("adverthash", hash)
+				}
+			}
 		}
 
-		// Advertise this agent
-		err := tc.CommsPackage.AdvertiseAgent(me)
+		err := tc.CommsPackage.SendHeartbeat(defs.AgentHeartbeat{
+			Uuid:       uuid,
+			LocalTime:  time.Now().UTC(),
+			AdvertHash: ac.GetKeyValue("adverthash"),
+		})
 		if err != nil {
-			log.Error("Failed to advertise agent after several retries")
+			log.Error("Failed to send heartbeat")
 		}
 
-		time.Sleep(15 * time.Second) // TODO(moswalt): make configurable
+		time.Sleep(time.Duration(cfg.Heartbeat.Interval) * time.Second)
+	}
+
+}
+
+// getAdvert runs all of the fact collectors, and hashes all of the assets on this agent, in order to build a new agent advertisement
+func getAdvert(cfg config.Config, uuid string) defs.AgentAdvert {
+
+	// Gather assets here as a map, and refer to a key in that map in the below struct
+	gatheredAssets := GetLocalAssets(cfg)
+
+	var defaultaddr string
+	if cfg.LocalResources.IPAddrOverride != "" {
+		defaultaddr = cfg.LocalResources.IPAddrOverride
+	} else {
+		defaultaddr = hostresources.GetIPOfInt(cfg.LocalResources.DefaultInterface).String()
 	}
 
+	// Create an AgentAdvert instance to represent this particular agent
+	return defs.AgentAdvert{
+		Uuid:           uuid,
+		DefaultAddr:    defaultaddr,
+		FactCollectors: gatheredAssets["factcollectors"],
+		Testlets:       gatheredAssets["testlets"],
+		Facts:          facts.GetFacts(cfg),
+		LocalTime:      time.Now().UTC(),
+
+		ProtocolVersion: defs.ProtocolVersion,
+		SupportedTasks:  tasks.SupportedTypes,
+	}
 }
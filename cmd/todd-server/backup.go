@@ -0,0 +1,75 @@
+/*
+    Backup and restore commands for ToDD server
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package main
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/server/backup"
+)
+
+// runBackup writes a backup of the database used by this server to the provided file
+func runBackup(cfg config.Config, fileName string) {
+	if fileName == "" {
+		log.Fatal("Please provide the file to write the backup to (Ex. 'todd-server backup todd.backup')")
+	}
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		log.Fatalf("Error connecting to DB: %v", err)
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		log.Fatalf("Error creating backup file: %v", err)
+	}
+
+	archive, err := backup.Backup(tdb, f)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(fileName)
+		log.Fatalf("Error writing backup: %v", err)
+	}
+
+	log.Infof("Wrote %d objects and %d testruns to %s", len(archive.Objects), len(archive.TestRuns), fileName)
+}
+
+// runRestore loads a backup into the database used by this server. The database is initialized first, as it is
+// when the server starts, so that a backup can be restored into a new database.
+func runRestore(cfg config.Config, fileName string) {
+	if fileName == "" {
+		log.Fatal("Please provide the backup file to restore (Ex. 'todd-server restore todd.backup')")
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		log.Fatalf("Error opening backup file: %v", err)
+	}
+	defer f.Close()
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		log.Fatalf("Error connecting to DB: %v", err)
+	}
+	if err := tdb.Init(); err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	_, err = backup.Restore(tdb, f)
+	if err != nil {
+		log.Fatalf("Error restoring backup: %v", err)
+	}
+}
@@ -18,8 +18,12 @@ import (
 	"github.com/Mierdin/todd/comms"
 	"github.com/Mierdin/todd/config"
 	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/server/agentstate"
 	"github.com/Mierdin/todd/server/grouping"
-	log "github.com/Sirupsen/logrus"
+	"github.com/Mierdin/todd/server/metrics"
+	"github.com/Mierdin/todd/server/testrun"
+	"github.com/Mierdin/todd/server/tsdb"
+	log "github.com/sirupsen/logrus"
 )
 
 // Command-line Arguments
@@ -33,7 +37,12 @@ func init() {
     An extensible framework for providing natively distributed testing on demand
 
     Options:
-      --config="/etc/todd/server.cfg"          Absolute path to ToDD server config file`, "\n\n")
+      --config="/etc/todd/server.cfg"          Absolute path to ToDD server config file
+
+    Commands:
+      backup FILE     Write the objects, group map and testrun history in the server's database to FILE
+      restore FILE    Load a backup written by "backup" into the server's database
+                      (with no command, the server is started)`, "\n\n")
 
 		os.Exit(0)
 	}
@@ -54,6 +63,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "backup":
+		runBackup(cfg, flag.Arg(1))
+		return
+	case "restore":
+		runRestore(cfg, flag.Arg(1))
+		return
+	default:
+		log.Fatalf("Unknown command %q - see todd-server --help", flag.Arg(0))
+	}
+
+	// Check the result sinks now, rather than when the first testrun finishes
+	if _, err := tsdb.NewSinks(cfg); err != nil {
+		log.Fatal(err)
+	}
+
 	// Start serving collectors and testlets, and retrieve map of names and hashes
 	assets := serveAssets(cfg)
 
@@ -67,6 +93,11 @@ func main() {
 		log.Fatalf("Error initializing database: %v\n", err)
 	}
 
+	// Serve the results of testruns run before the server was restarted on /metrics, until they run again
+	if err := metrics.Load(tdb); err != nil {
+		log.Errorf("Error loading testrun results for /metrics: %v", err)
+	}
+
 	// Initialize API
 	var tapi toddapi.ToDDApi
 	go func() {
@@ -88,12 +119,72 @@ func main() {
 		}
 	}()
 
+	go func() {
+		for {
+			err := tc.CommsPackage.ListenForHeartbeats()
+			if err != nil {
+				log.Warn("ListenForHeartbeats reported a failure. Trying again...")
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+
+	// Keep track of agents that have stopped sending heartbeats
+	go func() {
+		for {
+			agentstate.Monitor(cfg)
+			time.Sleep(time.Second * time.Duration(cfg.Heartbeat.Interval))
+		}
+	}()
+
+	// Listen for responses from agents. Among other things, this is how the results of tasks sent
+	// with comms.SendTaskAndWait (such as group membership and asset sync) are received.
+	go func() {
+		stopListeningForResponses := make(chan bool)
+		for {
+			err := tc.CommsPackage.ListenForResponses(&stopListeningForResponses)
+			if err != nil {
+				log.Warn("ListenForResponses reported a failure. Trying again...")
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+
+	// Agents joining, going stale or coming back change which groups they belong in, so regroup as soon as
+	// that happens, rather than waiting for the next group calculation
+	regroup := make(chan bool, 1)
+	agentstate.Subscribe(func(e agentstate.Event) {
+		select {
+		case regroup <- true:
+		default:
+		}
+	})
+
 	// Kick off group calculation in background
 	go func() {
 		for {
 			log.Info("Beginning group calculation")
 			grouping.CalculateGroups(cfg)
-			time.Sleep(time.Second * time.Duration(cfg.Grouping.Interval))
+			select {
+			case <-regroup:
+			case <-time.After(time.Second * time.Duration(cfg.Grouping.Interval)):
+			}
+		}
+	}()
+
+	// Remove testruns that are past the retention configured in the [History] section
+	go func() {
+		for {
+			testrun.PruneHistory(cfg)
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	// Retry results that couldn't be written to a sink
+	go func() {
+		for {
+			tsdb.RetrySpool(cfg)
+			time.Sleep(10 * time.Second)
 		}
 	}()
 
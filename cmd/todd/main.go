@@ -89,6 +89,24 @@ func main() {
 			},
 		},
 
+		// "todd deadletters"
+		{
+			Name:  "deadletters",
+			Usage: "Show messages that could not be delivered",
+			Action: func(c *cli.Context) {
+				err := clientapi.DeadLetters(
+					map[string]string{
+						"host": host,
+						"port": port,
+					},
+				)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+
 		// "todd delete ..."
 		{
 			Name:  "delete",
@@ -110,6 +128,28 @@ func main() {
 			},
 		},
 
+		// "todd diff ..."
+		{
+			Name:  "diff",
+			Usage: "Show the differences between two revisions of a ToDD object",
+			Action: func(c *cli.Context) {
+				err := clientapi.Diff(
+					map[string]string{
+						"host": host,
+						"port": port,
+					},
+					c.Args().Get(0),
+					c.Args().Get(1),
+					c.Args().Get(2),
+					c.Args().Get(3),
+				)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+
 		// "todd groups ..."
 		{
 			Name:  "groups",
@@ -128,6 +168,27 @@ func main() {
 			},
 		},
 
+		// "todd history ..."
+		{
+			Name:  "history",
+			Usage: "Show the revisions of a ToDD object",
+			Action: func(c *cli.Context) {
+				revs, err := clientapi.ObjectHistory(
+					map[string]string{
+						"host": host,
+						"port": port,
+					},
+					c.Args().Get(0),
+					c.Args().Get(1),
+				)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				clientapi.DisplayObjectHistory(revs)
+			},
+		},
+
 		// "todd objects ..."
 		{
 			Name:  "objects",
@@ -147,6 +208,27 @@ func main() {
 			},
 		},
 
+		// "todd rollback ..."
+		{
+			Name:  "rollback",
+			Usage: "Restore a ToDD object to an earlier revision",
+			Action: func(c *cli.Context) {
+				err := clientapi.Rollback(
+					map[string]string{
+						"host": host,
+						"port": port,
+					},
+					c.Args().Get(0),
+					c.Args().Get(1),
+					c.Args().Get(2),
+				)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+
 		// "todd run ..."
 		{
 			Name: "run",
@@ -192,6 +274,47 @@ func main() {
 				}
 			},
 		},
+
+		// "todd spool"
+		{
+			Name:  "spool",
+			Usage: "Show testrun results waiting to be written to a result sink",
+			Action: func(c *cli.Context) {
+				err := clientapi.Spool(
+					map[string]string{
+						"host": host,
+						"port": port,
+					},
+				)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+
+		// "todd testruns ..."
+		{
+			Name:  "testruns",
+			Usage: "Show the history of testruns",
+			Action: func(c *cli.Context) {
+				records, err := clientapi.TestRuns(
+					map[string]string{
+						"host": host,
+						"port": port,
+					},
+					c.Args().Get(0),
+				)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				err = clientapi.DisplayTestRuns(records, !(c.Args().Get(0) == ""))
+				if err != nil {
+					fmt.Println("Problem displaying testruns (client-side)")
+				}
+			},
+		},
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,351 @@
+/*
+    ToDD comms message authentication
+
+    When enabled (using the "Auth" option in the [Comms] section of the config), every message envelope
+    is signed by its sender, and messages that are unsigned or badly signed are rejected. Two methods are
+    supported:
+
+    - "hmac" uses a secret shared by the server and all agents (HMAC-SHA256)
+    - "ed25519" gives the server and each agent their own keypair. Each side is configured with the
+      public keys it trusts: agents trust the server's key, and the server trusts every enrolled agent's key.
+      Each key is only trusted for messages from a single sender.
+
+    Signed messages are only accepted for a limited time after they were sent, and only once, so that they
+    can't be replayed.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/Mierdin/todd/config"
+)
+
+var (
+	// ErrUnsigned is returned when authentication is enabled, and a message was received without a signature
+	ErrUnsigned = errors.New("Message is not signed")
+
+	// ErrBadSignature is returned when a message's signature could not be verified
+	ErrBadSignature = errors.New("Message signature is invalid")
+
+	// ErrStaleMessage is returned when a signed message was sent too long ago (or too far in the future) to be accepted
+	ErrStaleMessage = errors.New("Message is too old")
+
+	// ErrReplayedMessage is returned when a signed message has already been received
+	ErrReplayedMessage = errors.New("Message has already been received")
+)
+
+// defaultMaxMessageAge is how long after it was sent a signed message is accepted, if MaxMessageAge isn't configured
+const defaultMaxMessageAge = 5 * time.Minute
+
+// trustedKeySenderHeader is the PEM header that names the sender a trusted public key belongs to
+const trustedKeySenderHeader = "Sender"
+
+// messageAuth signs and verifies message envelopes
+type messageAuth interface {
+	sign(env *Envelope) error
+
+	// verify checks that a message was signed by its sender
+	verify(env Envelope) error
+
+	// checkReplay records that a verified message has been received, and rejects it if it is stale or was already received
+	checkReplay(env Envelope) error
+
+	// forget allows a message to be received again, because it couldn't be handled, and will be redelivered
+	forget(messageID string)
+}
+
+var (
+	messageAuthsMu sync.Mutex
+	messageAuths   = make(map[config.Comms]messageAuth)
+)
+
+// getMessageAuth returns the message authentication described by the provided configuration, or nil if authentication is
+// disabled. Keys are only loaded once per configuration.
+func getMessageAuth(cfg config.Config) (messageAuth, error) {
+
+	messageAuthsMu.Lock()
+	defer messageAuthsMu.Unlock()
+
+	if ma, ok := messageAuths[cfg.Comms]; ok {
+		return ma, nil
+	}
+
+	var ma messageAuth
+
+	maxAge := defaultMaxMessageAge
+	if cfg.Comms.MaxMessageAge > 0 {
+		maxAge = time.Duration(cfg.Comms.MaxMessageAge) * time.Second
+	}
+
+	switch cfg.Comms.Auth {
+	case "":
+		return nil, nil
+	case "hmac":
+		if cfg.Comms.SharedSecret == "" {
+			return nil, errors.New("HMAC message authentication requires a shared secret")
+		}
+		ma = hmacAuth{secret: []byte(cfg.Comms.SharedSecret), replayGuard: newReplayGuard(maxAge)}
+	case "ed25519":
+		a, err := newEd25519Auth(cfg.Comms.PrivateKey, cfg.Comms.TrustedKeys)
+		if err != nil {
+			return nil, err
+		}
+		a.replayGuard = newReplayGuard(maxAge)
+		ma = a
+	default:
+		return nil, fmt.Errorf("Invalid message authentication method in config file: %s", cfg.Comms.Auth)
+	}
+
+	messageAuths[cfg.Comms] = ma
+	return ma, nil
+}
+
+// signingInput returns the bytes that are signed for an envelope. This covers every field except the signature itself.
+func signingInput(env Envelope) []byte {
+	header := fmt.Sprintf("%d\n%s\n%s\n%s\n%s\n",
+		env.Version,
+		env.Sender,
+		env.Timestamp.UTC().Format(time.RFC3339Nano),
+		env.MessageID,
+		env.KeyID,
+	)
+	return append([]byte(header), env.Body...)
+}
+
+// forgetMessage allows a message that couldn't be handled to be received again when it is redelivered. It does nothing
+// if message authentication is disabled.
+func forgetMessage(cfg config.Config, env Envelope) {
+	ma, err := getMessageAuth(cfg)
+	if err == nil && ma != nil {
+		ma.forget(env.MessageID)
+	}
+}
+
+// forgetOnError calls forgetMessage if handling a message failed, since a message that couldn't be handled may be
+// delivered again, and that mustn't be mistaken for a replay. Handlers defer this with a pointer to their named error
+// result, so that it sees the error they return.
+func forgetOnError(cfg config.Config, env Envelope, err *error) {
+	if *err != nil {
+		forgetMessage(cfg, env)
+	}
+}
+
+// replayGuard rejects signed messages that were sent too long ago, and messages that have already been received. Since
+// older messages are rejected anyway, it only needs to remember the IDs of messages sent within maxAge.
+type replayGuard struct {
+	maxAge time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // message ID to the time it was sent
+	lastPrune time.Time
+}
+
+func newReplayGuard(maxAge time.Duration) *replayGuard {
+	return &replayGuard{
+		maxAge:    maxAge,
+		seen:      make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// checkReplay records that a message has been received, returning an error if it is too old, or was already received.
+// This must only be called once the message's signature has been verified, since the timestamp and ID are trusted.
+func (g *replayGuard) checkReplay(env Envelope) error {
+	now := time.Now()
+
+	// Allow for the clocks of the sender and receiver being a little different
+	age := now.Sub(env.Timestamp)
+	if age > g.maxAge || age < -g.maxAge {
+		return ErrStaleMessage
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.lastPrune) > g.maxAge {
+		for id, sent := range g.seen {
+			if now.Sub(sent) > g.maxAge {
+				delete(g.seen, id)
+			}
+		}
+		g.lastPrune = now
+	}
+
+	if _, ok := g.seen[env.MessageID]; ok {
+		return ErrReplayedMessage
+	}
+	g.seen[env.MessageID] = env.Timestamp
+	return nil
+}
+
+func (g *replayGuard) forget(messageID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.seen, messageID)
+}
+
+// hmacAuth signs messages using HMAC-SHA256 and a shared secret
+type hmacAuth struct {
+	secret []byte
+	*replayGuard
+}
+
+func (h hmacAuth) mac(env Envelope) []byte {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(signingInput(env))
+	return mac.Sum(nil)
+}
+
+func (h hmacAuth) sign(env *Envelope) error {
+	env.KeyID = ""
+	env.Signature = base64.StdEncoding.EncodeToString(h.mac(*env))
+	return nil
+}
+
+func (h hmacAuth) verify(env Envelope) error {
+	if env.Signature == "" {
+		return ErrUnsigned
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil || !hmac.Equal(sig, h.mac(env)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ed25519Auth signs messages using this process's private key, and verifies them using a set of trusted public keys
+type ed25519Auth struct {
+	key     ed25519.PrivateKey
+	keyID   string
+	trusted map[string]trustedKey
+	*replayGuard
+}
+
+// trustedKey is a public key, and the only sender that it is trusted to sign messages for
+type trustedKey struct {
+	pub    ed25519.PublicKey
+	sender string
+}
+
+// newEd25519Auth loads a PEM-encoded (PKCS #8) private key, and a file containing one or more PEM-encoded (PKIX) public keys.
+// Keys in these formats can be created with "openssl genpkey -algorithm ed25519" and "openssl pkey -pubout".
+//
+// Each public key is only trusted for messages from the sender in its "Sender" header (an agent's UUID). Keys without
+// this header are only trusted for messages from the server.
+func newEd25519Auth(privateKeyFile, trustedKeysFile string) (*ed25519Auth, error) {
+
+	data, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read private key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", privateKeyFile)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key: %v", err)
+	}
+
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", privateKeyFile)
+	}
+
+	a := ed25519Auth{
+		key:     key,
+		keyID:   ed25519KeyID(key.Public().(ed25519.PublicKey)),
+		trusted: make(map[string]trustedKey),
+	}
+
+	data, err = ioutil.ReadFile(trustedKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read trusted keys: %v", err)
+	}
+
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse trusted key: %v", err)
+		}
+
+		pub, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Trusted key in %s is not an ed25519 public key", trustedKeysFile)
+		}
+
+		sender := block.Headers[trustedKeySenderHeader]
+		if sender == "" {
+			sender = ServerSenderID
+		}
+
+		a.trusted[ed25519KeyID(pub)] = trustedKey{pub: pub, sender: sender}
+	}
+
+	if len(a.trusted) == 0 {
+		return nil, fmt.Errorf("No trusted keys found in %s", trustedKeysFile)
+	}
+
+	return &a, nil
+}
+
+// ed25519KeyID returns a short identifier for a public key, which is sent along with each signature so that the
+// receiver knows which key to verify it with
+func ed25519KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (a *ed25519Auth) sign(env *Envelope) error {
+	env.KeyID = a.keyID
+	env.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, signingInput(*env)))
+	return nil
+}
+
+func (a *ed25519Auth) verify(env Envelope) error {
+	if env.Signature == "" {
+		return ErrUnsigned
+	}
+
+	key, ok := a.trusted[env.KeyID]
+	if !ok {
+		return fmt.Errorf("Message was signed with an untrusted key (%s)", env.KeyID)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil || !ed25519.Verify(key.pub, signingInput(env), sig) {
+		return ErrBadSignature
+	}
+
+	// A key belongs to a single sender, so that an agent can't sign messages as another agent (or the server)
+	if env.Sender != key.sender {
+		return fmt.Errorf("Message from %s was signed with the key of %s", env.Sender, key.sender)
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+    Tests for comms message authentication
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+// writeTestKeypair generates an ed25519 keypair, and writes it to the provided directory in PEM format, with the
+// public key trusted for the provided sender. The paths of the private and public key files are returned.
+func writeTestKeypair(t *testing.T, dir, name, sender string) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privFile := filepath.Join(dir, name+".key")
+	pubFile := filepath.Join(dir, name+".pub")
+
+	err = ioutil.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBlock := &pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}
+	if sender != "" {
+		pubBlock.Headers = map[string]string{"Sender": sender}
+	}
+	err = ioutil.WriteFile(pubFile, pem.EncodeToMemory(pubBlock), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privFile, pubFile
+}
+
+// testAuthRoundTrip checks that a message sealed by senderID with the "sender" configuration can be opened with the
+// "receiver" configuration, and that unsigned, tampered or replayed messages are rejected.
+func testAuthRoundTrip(t *testing.T, sender, receiver config.Config, senderID string) {
+	data, err := sealMessage(sender, senderID, "", map[string]string{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := openMessage(receiver, data)
+	if err != nil {
+		t.Fatalf("Failed to open signed message: %v", err)
+	}
+
+	_, err = openMessage(receiver, data)
+	if err != ErrReplayedMessage {
+		t.Fatalf("Expected ErrReplayedMessage for a message received twice, got %v", err)
+	}
+
+	// A message that couldn't be handled can be redelivered
+	forgetMessage(receiver, env)
+	_, err = openMessage(receiver, data)
+	if err != nil {
+		t.Fatalf("Failed to open redelivered message: %v", err)
+	}
+
+	tampered := bytes.Replace(data, []byte(`"bar"`), []byte(`"baz"`), 1)
+	_, err = openMessage(receiver, tampered)
+	if err != ErrBadSignature {
+		t.Fatalf("Expected ErrBadSignature for a tampered message, got %v", err)
+	}
+
+	unsigned, err := sealMessage(config.Config{}, senderID, "", map[string]string{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openMessage(receiver, unsigned)
+	if err != ErrUnsigned {
+		t.Fatalf("Expected ErrUnsigned for an unsigned message, got %v", err)
+	}
+}
+
+// TestHMACAuth tests signing and verifying messages with a shared secret
+func TestHMACAuth(t *testing.T) {
+	var cfg config.Config
+	cfg.Comms.Auth = "hmac"
+	cfg.Comms.SharedSecret = "sssh"
+
+	testAuthRoundTrip(t, cfg, cfg, "agent1")
+
+	// A different secret must not verify
+	other := cfg
+	other.Comms.SharedSecret = "hunter2"
+	data, err := sealMessage(other, "agent1", "", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openMessage(cfg, data)
+	if err != ErrBadSignature {
+		t.Fatalf("Expected ErrBadSignature, got %v", err)
+	}
+}
+
+// TestEd25519Auth tests signing and verifying messages with a server keypair and an enrolled agent keypair
+func TestEd25519Auth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "todd-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverKey, serverPub := writeTestKeypair(t, dir, "server", "")
+	agentKey, agentPub := writeTestKeypair(t, dir, "agent", "agent1")
+	_, roguePub := writeTestKeypair(t, dir, "rogue", "")
+
+	var server, agent config.Config
+	server.Comms.Auth = "ed25519"
+	server.Comms.PrivateKey = serverKey
+	server.Comms.TrustedKeys = agentPub
+	agent.Comms.Auth = "ed25519"
+	agent.Comms.PrivateKey = agentKey
+	agent.Comms.TrustedKeys = serverPub
+
+	testAuthRoundTrip(t, agent, server, "agent1")
+	testAuthRoundTrip(t, server, agent, ServerSenderID)
+
+	// An enrolled agent must not be able to pose as another agent, or as the server
+	for _, sender := range []string{"agent2", ServerSenderID} {
+		data, err := sealMessage(agent, sender, "", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = openMessage(server, data)
+		if err == nil {
+			t.Fatalf("Expected a message from %s signed with the key of agent1 to be rejected", sender)
+		}
+	}
+
+	// An agent must not be able to pose as the server to other agents
+	data, err := sealMessage(agent, ServerSenderID, "", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openMessage(agent, data)
+	if err == nil {
+		t.Fatal("Expected a message signed with an untrusted key to be rejected")
+	}
+
+	// A key that isn't enrolled must not verify
+	var rogue config.Config
+	rogue.Comms.Auth = "ed25519"
+	rogue.Comms.PrivateKey = serverKey
+	rogue.Comms.TrustedKeys = roguePub
+	_, err = openMessage(rogue, data)
+	if err == nil {
+		t.Fatal("Expected a message signed with an untrusted key to be rejected")
+	}
+}
+
+// TestStaleMessage tests that signed messages are only accepted for a limited time after they were sent
+func TestStaleMessage(t *testing.T) {
+	var cfg config.Config
+	cfg.Comms.Auth = "hmac"
+	cfg.Comms.SharedSecret = "sssh"
+	cfg.Comms.MaxMessageAge = 60
+
+	ma, err := getMessageAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		env := Envelope{
+			Version:   defs.ProtocolVersion,
+			Sender:    "agent1",
+			Timestamp: time.Now().Add(offset),
+			MessageID: "message" + offset.String(),
+			Body:      []byte(`"hello"`),
+		}
+		err = ma.sign(&env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = openMessage(cfg, data)
+		if err != ErrStaleMessage {
+			t.Fatalf("Expected ErrStaleMessage for a message sent %v from now, got %v", offset, err)
+		}
+	}
+}
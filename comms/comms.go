@@ -12,9 +12,11 @@ package comms
 
 import (
 	"errors"
+	"fmt"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
+	"github.com/Mierdin/todd/agent/cache"
 	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/agent/responses"
 	"github.com/Mierdin/todd/agent/tasks"
@@ -36,6 +38,10 @@ type CommsPackage interface {
 	// (map of assets:hashes)
 	ListenForAgent(map[string]map[string]string) error
 
+	// (heartbeat to send) - sent by agents in between advertisements
+	SendHeartbeat(defs.AgentHeartbeat) error
+	ListenForHeartbeats() error
+
 	// (uuid)
 	ListenForTasks(string) error
 
@@ -47,8 +53,34 @@ type CommsPackage interface {
 
 	ListenForGroupTasks(string, chan bool) error
 
+	// (group name, task) - sends a task to every agent in the group
+	BroadcastTask(string, tasks.Task) error
+
 	ListenForResponses(*chan bool) error
 	SendResponse(responses.Response) error
+
+	// returns the messages that could not be delivered, and have been set aside for inspection
+	ListDeadLetters() ([]DeadLetter, error)
+}
+
+// DeadLetter is a message that could not be handled after several delivery attempts
+type DeadLetter struct {
+	Queue     string `json:"queue"`
+	Reason    string `json:"reason"`
+	MessageId string `json:"message_id"`
+	Attempts  int    `json:"attempts"`
+	Body      string `json:"body"`
+}
+
+// groupQueueName returns the name of the queue an agent uses to receive tasks broadcast to its group. This is based on the agent's UUID,
+// rather than the group name, so that each agent receives its own copy of every group task.
+func groupQueueName(cfg config.Config) string {
+	return agentGroupQueueName(cache.NewAgentCache(cfg).GetKeyValue("uuid"))
+}
+
+// agentGroupQueueName returns the name of the group queue of the agent with the provided UUID
+func agentGroupQueueName(uuid string) string {
+	return fmt.Sprintf("%s.group", uuid)
 }
 
 // toddComms is a struct to hold anything that satisfies the CommsPackage interface
@@ -65,7 +97,17 @@ func NewToDDComms(cfg config.Config) (*toddComms, error) {
 	// Load the appropriate comms package based on config file
 	switch cfg.Comms.Plugin {
 	case "rabbitmq":
-		tc.CommsPackage = newRabbitMQComms(cfg)
+		rmq, err := newRabbitMQComms(cfg)
+		if err != nil {
+			log.Error("Failed to load RabbitMQ TLS configuration")
+			log.Debug(err)
+			return nil, err
+		}
+		tc.CommsPackage = rmq
+	case "memory":
+		tc.CommsPackage = newMemoryComms(cfg)
+	case "http":
+		tc.CommsPackage = newHTTPComms(cfg)
 	default:
 		log.Error("Invalid comms plugin in config file")
 		return nil, errors.New("Invalid comms plugin in config file")
@@ -0,0 +1,148 @@
+/*
+    ToDD comms message envelope
+
+    Every message exchanged between the ToDD server and agents (advertisements, tasks and responses)
+    is wrapped in an envelope, which identifies the version of the message protocol in use, who sent
+    the message, and when.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/cache"
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/hostresources"
+)
+
+// ServerSenderID is the sender ID used for messages sent by the ToDD server. Agents use their UUID.
+const ServerSenderID = "todd-server"
+
+var (
+	// ErrUnsupportedVersion is returned when a message was sent using a newer protocol version than this version of ToDD understands
+	ErrUnsupportedVersion = errors.New("Unsupported protocol version")
+
+	// ErrNoEnvelope is returned when a message was not wrapped in an envelope, usually because it was sent by an older version of ToDD
+	ErrNoEnvelope = errors.New("Message is not wrapped in an envelope")
+)
+
+// Envelope wraps every message sent over the comms package. Body contains the message itself (an agent
+// advertisement, task, or response).
+type Envelope struct {
+	Version   int             `json:"version"`
+	Sender    string          `json:"sender"`
+	Timestamp time.Time       `json:"timestamp"`
+	MessageID string          `json:"message_id"`
+	Body      json.RawMessage `json:"body"`
+
+	// These are only present if message authentication is enabled (see auth.go)
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// sealMessage marshals a message, and wraps it in an envelope from the provided sender. If messageID is empty,
+// a new one is generated. If message authentication is enabled, the envelope is signed.
+func sealMessage(cfg config.Config, sender, messageID string, msg interface{}) ([]byte, error) {
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if messageID == "" {
+		messageID = hostresources.GenerateUuid()
+	}
+
+	env := Envelope{
+		Version:   defs.ProtocolVersion,
+		Sender:    sender,
+		Timestamp: time.Now().UTC(),
+		MessageID: messageID,
+		Body:      body,
+	}
+
+	ma, err := getMessageAuth(cfg)
+	if err != nil {
+		log.Errorf("Unable to sign message: %v", err)
+		return nil, err
+	}
+	if ma != nil {
+		err = ma.sign(&env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(env)
+}
+
+// openMessage unwraps a message received over the comms package. Messages sent using a newer protocol version
+// than this one are rejected, as are messages that are unsigned, badly signed, stale or replayed (if message
+// authentication is enabled).
+func openMessage(cfg config.Config, data []byte) (Envelope, error) {
+	return openEnvelope(cfg, data, true)
+}
+
+// openEnvelope unwraps a message, as openMessage does. If replay is false, the message isn't checked for being stale
+// or replayed, and isn't recorded as received, so that it can be opened again later.
+func openEnvelope(cfg config.Config, data []byte, replay bool) (Envelope, error) {
+
+	var env Envelope
+	err := json.Unmarshal(data, &env)
+	if err != nil {
+		return env, err
+	}
+
+	if env.Version == 0 || env.Body == nil {
+		return env, ErrNoEnvelope
+	}
+
+	if env.Version > defs.ProtocolVersion {
+		log.Errorf("Rejecting message %s from %s - protocol version %d is not supported (this is v%d)",
+			env.MessageID, env.Sender, env.Version, defs.ProtocolVersion)
+		return env, ErrUnsupportedVersion
+	}
+
+	ma, err := getMessageAuth(cfg)
+	if err != nil {
+		log.Errorf("Unable to verify message: %v", err)
+		return env, err
+	}
+	if ma != nil {
+		err = ma.verify(env)
+		if err == nil && replay {
+			err = ma.checkReplay(env)
+		}
+		if err != nil {
+			log.Errorf("Rejecting message %s from %s: %v", env.MessageID, env.Sender, err)
+			return env, err
+		}
+	}
+
+	return env, nil
+}
+
+// agentSenderID returns the sender ID for messages sent by the agent using the provided configuration
+func agentSenderID(cfg config.Config) string {
+	return cache.NewAgentCache(cfg).GetKeyValue("uuid")
+}
+
+// CheckTaskSupported returns an error if the provided agent has not advertised support for tasks of the provided type.
+// The server should not send a task to an agent without checking this first.
+func CheckTaskSupported(agent defs.AgentAdvert, taskType string) error {
+	if !agent.Supports(taskType) {
+		return fmt.Errorf("Agent %s (protocol %s) does not support %s tasks", agent.Uuid, agent.VersionSummary(), taskType)
+	}
+	return nil
+}
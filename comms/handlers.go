@@ -0,0 +1,694 @@
+/*
+    ToDD comms message handlers
+
+    The functions in this file contain the logic for acting on messages received by a comms plugin.
+    They are independent of the transport being used, so that every plugin can share the same
+    behavior once a message has been pulled off of the wire.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/cache"
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/agent/responses"
+	"github.com/Mierdin/todd/agent/tasks"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/hostresources"
+	"github.com/Mierdin/todd/server/agentstate"
+)
+
+// handleAgentAdvert processes a single agent advertisement received by the server. If the agent has all of the
+// assets described in the server's asset map (by hash), the agent is written to the database. Otherwise, a
+// DownloadAsset task is sent back to the agent so that it can remediate.
+func handleAgentAdvert(tc CommsPackage, cfg config.Config, assets map[string]map[string]string, data []byte) (err error) {
+
+	// Advertisements from agents that predate the message envelope are still accepted, so that these agents
+	// show up (with a version mismatch) in "todd agents". They won't be sent any tasks.
+	body := data
+	env, err := openMessage(cfg, data)
+	switch err {
+	case nil:
+		body = env.Body
+	case ErrNoEnvelope:
+		// These can't be signed, so they're only accepted if message authentication is disabled
+		if cfg.Comms.Auth != "" {
+			log.Error("Rejecting unsigned agent advertisement")
+			return ErrUnsigned
+		}
+		log.Debug("Received agent advertisement without an envelope")
+	default:
+		log.Errorf("Rejecting agent advertisement: %v", err)
+		return err
+	}
+
+	defer forgetOnError(cfg, env, &err)
+
+	log.Debugf("Agent advertisement recieved: %s", body)
+
+	var agent defs.AgentAdvert
+	err = json.Unmarshal(body, &agent)
+	if err != nil {
+		log.Error("Failed to unmarshal agent advertisement")
+		log.Debug(err)
+		return err
+	}
+
+	if env.Sender != "" && env.Sender != agent.Uuid {
+		log.Errorf("Rejecting advertisement for agent %s sent by %s", agent.Uuid, env.Sender)
+		return fmt.Errorf("Advertisement sender %s does not match agent %s", env.Sender, agent.Uuid)
+	}
+
+	// Agents with a different protocol version are still registered (so that they show up in "todd agents"), but we
+	// will only send them the tasks they have told us they support
+	if agent.VersionMismatch() {
+		log.Warnf("Agent %s is using protocol %s", agent.Uuid, agent.VersionSummary())
+	}
+
+	// assetList is a slice that will contain any URLs that need to be sent to an
+	// agent as a response to an incorrect or incomplete list of assets
+	var assetList []string
+
+	// assets is the asset map from the SERVER's perspective
+	for asset_type, asset_hashes := range assets {
+
+		var agentAssets map[string]string
+
+		// agentAssets is the asset map from the AGENT's perspective
+		if asset_type == "factcollectors" {
+			agentAssets = agent.FactCollectors
+		} else if asset_type == "testlets" {
+			agentAssets = agent.Testlets
+		}
+
+		for name, hash := range asset_hashes {
+
+			// See if the hashes match (a missing asset will also result in False)
+			if agentAssets[name] != hash {
+
+				// hashes do not match, so we need to append the asset download URL to the remediate list
+				var default_ip string
+				if cfg.LocalResources.IPAddrOverride != "" {
+					default_ip = cfg.LocalResources.IPAddrOverride
+				} else {
+					default_ip = hostresources.GetIPOfInt(cfg.LocalResources.DefaultInterface).String()
+				}
+				asset_url := fmt.Sprintf("http://%s:%s/%s/%s", default_ip, cfg.Assets.Port, asset_type, name)
+
+				assetList = append(assetList, asset_url)
+
+			}
+		}
+
+	}
+
+	// Asset list is empty, so we can continue
+	if len(assetList) == 0 {
+
+		var tdb, err = db.NewToddDB(cfg)
+		if err != nil {
+			log.Error("Failed to connect to DB")
+			log.Debug(err)
+			return err
+		}
+		err = agentstate.MarkSeen(tdb, agent)
+		if err != nil {
+			log.Errorf("Error writing agent to DB: %v", err)
+			return err
+		}
+
+		// Heartbeats from this agent will now be accepted, for as long as they refer to this advertisement
+		setVerifiedAdvert(agent.Uuid, agent.Hash())
+
+		// This block of code checked that the agent time was within a certain range of the server time. If there was a large enough
+		// time skew, the agent advertisement would be rejected.
+		// I have disabled this for now - My plan was to use this to synchronize testrun execution amongst agents, but I have
+		// a solution to that for now. May revisit this later.
+		//
+		// Determine difference between server and agent time
+		// t1 := time.Now()
+		// var diff float64
+		// diff = t1.Sub(agent.LocalTime).Seconds()
+		//
+		// // If Agent is within half a second of server time, add insert to database
+		// if diff < 0.5 && diff > -0.5 {
+		// } else {
+		// 	// We don't want to register an agent if there is a severe time difference,
+		// 	// in order to ensure continuity during tests. So, just print log message.
+		// 	log.Warn("Agent time not within boundaries.")
+		// }
+
+	} else {
+		log.Warnf("Agent %s did not have the required asset files. This advertisement is ignored.", agent.Uuid)
+
+		var task tasks.DownloadAssetTask
+		task.BaseTask = tasks.NewBaseTask("DownloadAsset")
+		task.Assets = assetList
+
+		err = CheckTaskSupported(agent, "DownloadAsset")
+		if err != nil {
+			log.Errorf("Unable to send missing assets: %v", err)
+			return nil
+		}
+
+		// Agents advertise far more often than it takes to download assets, so only one asset sync is sent to an agent at a time
+		if !startAssetSync(agent.Uuid) {
+			log.Debugf("Agent %s is already downloading assets", agent.Uuid)
+			return nil
+		}
+
+		// Wait for the result in the background, so that other advertisements can be processed in the meantime
+		go func() {
+			defer finishAssetSync(agent.Uuid)
+
+			_, err := SendTaskAndWait(tc, agent.Uuid, task, DefaultTaskTimeout)
+			if err != nil {
+				log.Errorf("Asset sync for agent %s failed: %v", agent.Uuid, err)
+				return
+			}
+			log.Infof("Agent %s has downloaded the required asset files", agent.Uuid)
+		}()
+	}
+
+	return nil
+}
+
+// handleHeartbeat processes a single heartbeat received by the server, and records that the agent is still alive. If the
+// heartbeat refers to an advertisement that this server hasn't received (and checked the assets of), the agent is asked
+// to send its advertisement again.
+func handleHeartbeat(tc CommsPackage, cfg config.Config, data []byte) (err error) {
+
+	env, err := openMessage(cfg, data)
+	if err != nil {
+		log.Errorf("Rejecting agent heartbeat: %v", err)
+		return err
+	}
+
+	defer forgetOnError(cfg, env, &err)
+
+	var hb defs.AgentHeartbeat
+	err = json.Unmarshal(env.Body, &hb)
+	if err != nil {
+		log.Error("Failed to unmarshal agent heartbeat")
+		log.Debug(err)
+		return err
+	}
+
+	if env.Sender != hb.Uuid {
+		log.Errorf("Rejecting heartbeat for agent %s sent by %s", hb.Uuid, env.Sender)
+		return fmt.Errorf("Heartbeat sender %s does not match agent %s", env.Sender, hb.Uuid)
+	}
+
+	if !isVerifiedAdvert(hb.Uuid, hb.AdvertHash) {
+		log.Infof("Heartbeat from agent %s does not match a known advertisement. Requesting a new one.", hb.Uuid)
+		return requestAdvert(tc, hb.Uuid)
+	}
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		log.Error("Failed to connect to DB")
+		log.Debug(err)
+		return err
+	}
+
+	// The agent may have been removed after going offline
+	agent, err := tdb.GetAgent(hb.Uuid)
+	if err != nil {
+		log.Infof("Heartbeat received from unknown agent %s. Requesting a new advertisement.", hb.Uuid)
+		return requestAdvert(tc, hb.Uuid)
+	}
+
+	return agentstate.MarkSeen(tdb, *agent)
+}
+
+// requestAdvert asks an agent to send a full advertisement. The agent keeps the hash of the last advertisement it sent in
+// its cache, and will advertise again as soon as this is cleared.
+func requestAdvert(tc CommsPackage, uuid string) error {
+
+	// Agents only send heartbeats if they support this task, so there's no need to check
+	var kvt tasks.KeyValueTask
+	kvt.BaseTask = tasks.NewBaseTask("KeyValue")
+	kvt.Key = "adverthash"
+	kvt.Value = ""
+
+	return tc.SendTask(uuid, kvt)
+}
+
+var (
+	verifiedAdvertsMu sync.Mutex
+	verifiedAdverts   = make(map[string]string)
+)
+
+// setVerifiedAdvert records the hash of the last advertisement from an agent that this server accepted
+func setVerifiedAdvert(uuid, hash string) {
+	verifiedAdvertsMu.Lock()
+	defer verifiedAdvertsMu.Unlock()
+	verifiedAdverts[uuid] = hash
+}
+
+// isVerifiedAdvert returns true if the provided hash matches the last advertisement from an agent that this server accepted
+func isVerifiedAdvert(uuid, hash string) bool {
+	verifiedAdvertsMu.Lock()
+	defer verifiedAdvertsMu.Unlock()
+	return hash != "" && verifiedAdverts[uuid] == hash
+}
+
+var (
+	assetSyncsMu sync.Mutex
+	assetSyncs   = make(map[string]bool)
+)
+
+// startAssetSync records that an asset sync is in progress for an agent. It returns false if one already was.
+func startAssetSync(uuid string) bool {
+	assetSyncsMu.Lock()
+	defer assetSyncsMu.Unlock()
+
+	if assetSyncs[uuid] {
+		return false
+	}
+	assetSyncs[uuid] = true
+	return true
+}
+
+// finishAssetSync records that the asset sync for an agent has finished (successfully or not)
+func finishAssetSync(uuid string) {
+	assetSyncsMu.Lock()
+	defer assetSyncsMu.Unlock()
+	delete(assetSyncs, uuid)
+}
+
+// handleTask processes a single task received by an agent, and runs the specific task indicated by the message type.
+// The outcome is reported to the server in a TaskResult response. An error is returned if the task could not be run,
+// so that the comms plugin can arrange for it to be redelivered. Tasks that have already been run by this agent
+// (determined by task ID) are not run again - the outcome of the first run is reported instead.
+func handleTask(tc CommsPackage, cfg config.Config, data []byte) (err error) {
+
+	env, err := openMessage(cfg, data)
+	if err != nil {
+		log.Errorf("Rejecting task: %v", err)
+		return err
+	}
+
+	defer forgetOnError(cfg, env, &err)
+	body := env.Body
+
+	// Unmarshal into BaseTaskMessage to determine type
+	var base_msg tasks.BaseTask
+	err = json.Unmarshal(body, &base_msg)
+	if err != nil {
+		log.Error("Failed to unmarshal received task")
+		log.Debug(err)
+		return err
+	}
+
+	log.Debugf("Agent task received: %s", body)
+
+	var ac = cache.NewAgentCache(cfg)
+
+	// Retrieve UUID
+	uuid := ac.GetKeyValue("uuid")
+
+	if base_msg.ID != "" {
+		handled, taskErr, err := ac.GetTaskResult(base_msg.ID)
+		if err != nil {
+			log.Errorf("Failed to look up task %s in the agent cache: %v", base_msg.ID, err)
+		} else if handled {
+			// The result is reported again, in case the first report was lost
+			log.Infof("Dropping duplicate %s task %s", base_msg.Type, base_msg.ID)
+			var runErr error
+			if taskErr != "" {
+				runErr = errors.New(taskErr)
+			}
+			sendTaskResult(tc, uuid, base_msg, runErr)
+			return nil
+		}
+	}
+
+	// runErr holds the failure of a task that reports its own status to the server. These tasks are not run again.
+	var runErr error
+
+	// call agent task method based on type
+	switch base_msg.Type {
+	case "DownloadAsset":
+
+		downloadAssetTask := tasks.DownloadAssetTask{
+			HTTPClient:   &http.Client{},
+			Fs:           tasks.OsFS{},
+			Ios:          tasks.IoSys{},
+			CollectorDir: fmt.Sprintf("%s/assets/factcollectors", cfg.LocalResources.OptDir),
+			TestletDir:   fmt.Sprintf("%s/assets/testlets", cfg.LocalResources.OptDir),
+		}
+
+		err = json.Unmarshal(body, &downloadAssetTask)
+		if err != nil {
+			break
+		}
+
+		err = downloadAssetTask.Run()
+		if err != nil {
+			log.Warning("The DownloadAsset task failed to initialize")
+			break
+		}
+
+		// The agent's assets have changed, so it should advertise again right away
+		err = ac.SetKeyValue("adverthash", "")
+
+	case "KeyValue":
+
+		kv_task := tasks.KeyValueTask{
+			Config: cfg,
+		}
+
+		err = json.Unmarshal(body, &kv_task)
+		if err != nil {
+			break
+		}
+
+		err = kv_task.Run()
+		if err != nil {
+			log.Warning("The KeyValue task failed to initialize")
+		}
+
+	case "SetGroup":
+
+		sg_task := tasks.SetGroupTask{
+			Config: cfg,
+		}
+
+		err = json.Unmarshal(body, &sg_task)
+		if err != nil {
+			break
+		}
+
+		err = sg_task.Run()
+		if err != nil {
+			log.Warning("The SetGroup task failed to initialize")
+		}
+
+	case "DeleteTestData":
+
+		dtdt_task := tasks.DeleteTestDataTask{
+			Config: cfg,
+		}
+
+		err = json.Unmarshal(body, &dtdt_task)
+		if err != nil {
+			break
+		}
+
+		err = dtdt_task.Run()
+		if err != nil {
+			log.Warning("The DeleteTestData task failed to initialize")
+		}
+
+	case "InstallTestRun":
+
+		itr_task := tasks.InstallTestRunTask{
+			Config: cfg,
+		}
+
+		err = json.Unmarshal(body, &itr_task)
+		if err != nil {
+			break
+		}
+
+		var response responses.SetAgentStatusResponse
+		response.Type = "AgentStatus" //TODO(mierdin): This is an extra step. Maybe a factory function for the task could help here?
+		response.AgentUuid = uuid
+		response.TestUuid = itr_task.Tr.Uuid
+
+		// A failure here is reported to the server in the response, so there's no sense in running this task again
+		runErr = itr_task.Run()
+		if runErr != nil {
+			log.Warning("The InstallTestRun task failed to initialize")
+			response.Status = "fail"
+		} else {
+			response.Status = "ready"
+		}
+		err = tc.SendResponse(response)
+
+	case "ExecuteTestRun":
+
+		etr_task := tasks.ExecuteTestRunTask{
+			Config: cfg,
+		}
+
+		err = json.Unmarshal(body, &etr_task)
+		if err != nil {
+			break
+		}
+
+		// Send status that the testing has begun, right now.
+		response := responses.SetAgentStatusResponse{
+			TestUuid: etr_task.TestUuid,
+			Status:   "testing",
+		}
+		response.AgentUuid = uuid     // TODO(mierdin): Can't declare this in the literal, it's that embedding behavior again. Need to figure this out.
+		response.Type = "AgentStatus" //TODO(mierdin): This is an extra step. Maybe a factory function for the task could help here?
+		tc.SendResponse(response)
+
+		// As above, a failure here is reported to the server rather than retried
+		runErr = etr_task.Run()
+		if runErr != nil {
+			log.Warning("The ExecuteTestRun task failed to initialize")
+			response.Status = "fail"
+			err = tc.SendResponse(response)
+		}
+
+	default:
+		log.Errorf("Unexpected type value for received task: %s", base_msg.Type)
+		err = fmt.Errorf("Unexpected task type %s", base_msg.Type)
+	}
+
+	if err != nil {
+		log.Errorf("Failed to handle %s task %s: %v", base_msg.Type, base_msg.ID, err)
+		sendTaskResult(tc, uuid, base_msg, err)
+		return err
+	}
+
+	sendTaskResult(tc, uuid, base_msg, runErr)
+
+	if base_msg.ID != "" {
+		var taskErr string
+		if runErr != nil {
+			taskErr = runErr.Error()
+		}
+		err = ac.MarkTaskHandled(base_msg.ID, taskErr)
+		if err != nil {
+			log.Errorf("Failed to record task %s in the agent cache: %v", base_msg.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// sendTaskResult reports the outcome of a task to the server. A nil error indicates that the task succeeded.
+func sendTaskResult(tc CommsPackage, uuid string, task tasks.BaseTask, taskErr error) {
+
+	result := responses.TaskResultResponse{
+		TaskID:   task.ID,
+		TaskType: task.Type,
+		Success:  taskErr == nil,
+	}
+	result.AgentUuid = uuid
+	result.Type = "TaskResult"
+	if taskErr != nil {
+		result.Error = taskErr.Error()
+	}
+
+	err := tc.SendResponse(result)
+	if err != nil {
+		log.Errorf("Failed to report result of %s task %s", task.Type, task.ID)
+	}
+}
+
+// handleGroupTask processes a single task received by an agent on its group queue. Tasks broadcast to a group are run in exactly
+// the same way as tasks sent to an agent directly.
+func handleGroupTask(tc CommsPackage, cfg config.Config, body []byte) error {
+	return handleTask(tc, cfg, body)
+}
+
+// handleResponse processes a single response sent to the server by an agent.
+func handleResponse(tc CommsPackage, cfg config.Config, tdb db.DatabasePackage, data []byte) (err error) {
+
+	env, err := openMessage(cfg, data)
+	if err != nil {
+		log.Errorf("Rejecting response: %v", err)
+		return err
+	}
+
+	defer forgetOnError(cfg, env, &err)
+	body := env.Body
+
+	// Unmarshal into BaseResponse to determine type
+	var base_msg responses.BaseResponse
+	err = json.Unmarshal(body, &base_msg)
+	if err != nil {
+		log.Error("Failed to unmarshal received response")
+		log.Debug(err)
+		return err
+	}
+
+	log.Debugf("Agent response received: %s", body)
+
+	// Agents may only send responses on their own behalf
+	if env.Sender != base_msg.AgentUuid {
+		log.Errorf("Rejecting response for agent %s sent by %s", base_msg.AgentUuid, env.Sender)
+		return fmt.Errorf("Response sender %s does not match agent %s", env.Sender, base_msg.AgentUuid)
+	}
+
+	// call agent response method based on type
+	switch base_msg.Type {
+	case "AgentStatus":
+
+		var sasr responses.SetAgentStatusResponse
+		err = json.Unmarshal(body, &sasr)
+		if err != nil {
+			return err
+		}
+
+		log.Debugf("Agent %s is '%s' regarding test %s. Writing to DB.", sasr.AgentUuid, sasr.Status, sasr.TestUuid)
+		err := tdb.SetAgentTestStatus(sasr.TestUuid, sasr.AgentUuid, sasr.Status)
+		if err != nil {
+			log.Errorf("Error writing agent status to DB: %v", err)
+			return err
+		}
+
+	case "TestData":
+
+		var utdr responses.UploadTestDataResponse
+		err = json.Unmarshal(body, &utdr)
+		if err != nil {
+			return err
+		}
+
+		err = tdb.SetAgentTestData(utdr.TestUuid, utdr.AgentUuid, utdr.TestData)
+		if err != nil {
+			log.Errorf("Error writing agent test data to DB: %v", err)
+			return err
+		}
+
+		// Send task to the agent that says to delete the entry
+		agent, err := tdb.GetAgent(utdr.AgentUuid)
+		if err == nil {
+			err = CheckTaskSupported(*agent, "DeleteTestData")
+		}
+		if err != nil {
+			log.Warnf("Not asking agent %s to delete test data: %v", utdr.AgentUuid, err)
+		} else {
+			var dtdt tasks.DeleteTestDataTask
+			dtdt.BaseTask = tasks.NewBaseTask("DeleteTestData")
+			dtdt.TestUuid = utdr.TestUuid
+			tc.SendTask(utdr.AgentUuid, dtdt)
+		}
+
+		// Finally, set the status for this agent in the test to "finished"
+		err = tdb.SetAgentTestStatus(utdr.TestUuid, utdr.AgentUuid, "finished")
+		if err != nil {
+			log.Errorf("Error writing agent status to DB: %v", err)
+			return err
+		}
+
+	case "TaskResult":
+
+		var tr responses.TaskResultResponse
+		err = json.Unmarshal(body, &tr)
+		if err != nil {
+			return err
+		}
+
+		if tr.Success {
+			log.Debugf("Agent %s completed %s task %s", tr.AgentUuid, tr.TaskType, tr.TaskID)
+		} else {
+			log.Warnf("Agent %s failed %s task %s: %s", tr.AgentUuid, tr.TaskType, tr.TaskID, tr.Error)
+		}
+
+		if !deliverTaskResult(tr) {
+			log.Debugf("Nobody is waiting for the result of task %s", tr.TaskID)
+		}
+
+	default:
+		log.Errorf("Unexpected type value for received response: %s", base_msg.Type)
+		return fmt.Errorf("Unexpected response type %s", base_msg.Type)
+	}
+
+	return nil
+}
+
+// watchForGroup contains the plugin-independent portion of WatchForGroup. It spawns a goroutine that runs the provided
+// comms package's ListenForGroupTasks function on the agent's current group, and restarts it when the group changes.
+func watchForGroup(tc CommsPackage, cfg config.Config) {
+
+	var ac = cache.NewAgentCache(cfg)
+
+rereg:
+
+	// dereg is a channel that allows us to instruct the goroutine that's listening for tests to stop. This allows us to re-register to a new command.
+	// Each registration has its own, so that a listener that is slow to stop can't be confused with the next one.
+	dereg := make(chan bool)
+
+	group := ac.GetKeyValue("group")
+
+	// if the group is nothing, rewrite to "mull". This is being done for now so that we don't have to worry if the goroutine was started or not
+	// This way, it's always running, but if the agent is not in a group, it's listening on the "null" queue, which never has anything on it.
+	// This is a minor waste of resources on the agent, so TODO(mierdin): you should probably fix this at some point and figure out how to only run
+	// the goroutine when needed, but at the same time prevent the dereg channel from blocking unnecessarily in that case
+	//
+	// This will also handle the cases when the agent first starts up, and the key for this group isn't present in the cache, and therefore is "".
+	if group == "" {
+		group = "null"
+	}
+
+	go listenForGroup(tc, group, dereg)
+
+	// Loop until the unackedGroup flag is set
+	for {
+		time.Sleep(2 * time.Second)
+
+		// The key "unackedGroup" stores a "true" or "false" to indicate that there has been a group change that we need to acknowledge (handle)
+		if ac.GetKeyValue("unackedGroup") == "true" {
+
+			// This will kill the underlying goroutine, and in effect stop listening to the old queue. Closing the channel
+			// doesn't block, even if the goroutine is waiting to retry after a failure.
+			close(dereg)
+
+			// Finally, set the "unackedGroup" to indicate that we've acknowledged the group change, and go back to the "rereg" label
+			// to re-register onto the new group name
+			ac.SetKeyValue("unackedGroup", "false")
+			goto rereg
+		}
+	}
+}
+
+// listenForGroup runs the provided comms package's ListenForGroupTasks function on a group until dereg is closed,
+// trying again if it fails
+func listenForGroup(tc CommsPackage, group string, dereg chan bool) {
+	for {
+		err := tc.ListenForGroupTasks(group, dereg)
+		if err == nil {
+			// We've been deregistered from this group
+			return
+		}
+
+		log.Warn("ListenForGroupTasks reported a failure. Trying again...")
+		select {
+		case <-dereg:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+    Tests for the comms message handlers
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/cache"
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/agent/responses"
+	"github.com/Mierdin/todd/agent/tasks"
+	"github.com/Mierdin/todd/config"
+)
+
+// TestHandleTaskDuplicate tests that an agent only runs a task once, even if it is delivered several times
+func TestHandleTaskDuplicate(t *testing.T) {
+	cfg, cleanup := newTestAgentConfig(t, "agent1")
+	defer cleanup()
+
+	ac := cache.NewAgentCache(cfg)
+
+	var kvt tasks.KeyValueTask
+	kvt.BaseTask = tasks.NewBaseTask("KeyValue")
+	kvt.Key = "foo"
+	kvt.Value = "bar"
+
+	body, err := sealMessage(cfg, ServerSenderID, kvt.ID, kvt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc := memoryComms{config: cfg, bus: newMemoryBus()}
+
+	err = handleTask(mc, cfg, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.GetKeyValue("foo") != "bar" {
+		t.Fatal("Task was not run")
+	}
+
+	// Deliver the same task again, after the value has been changed by someone else
+	ac.SetKeyValue("foo", "baz")
+
+	err = handleTask(mc, cfg, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.GetKeyValue("foo") != "baz" {
+		t.Fatal("Duplicate task was run")
+	}
+}
+
+// TestHandleTaskDuplicateResult tests that an agent reports the outcome of the first run of a task when it's
+// delivered again, rather than reporting success
+func TestHandleTaskDuplicateResult(t *testing.T) {
+	cfg, cleanup := newTestAgentConfig(t, "agent1")
+	defer cleanup()
+
+	ac := cache.NewAgentCache(cfg)
+
+	var kvt tasks.KeyValueTask
+	kvt.BaseTask = tasks.NewBaseTask("KeyValue")
+	kvt.Key = "foo"
+	kvt.Value = "bar"
+
+	err := ac.MarkTaskHandled(kvt.ID, "testlet failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := sealMessage(cfg, ServerSenderID, kvt.ID, kvt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc := memoryComms{config: cfg, bus: newMemoryBus()}
+
+	err = handleTask(mc, cfg, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.GetKeyValue("foo") != "" {
+		t.Fatal("Duplicate task was run")
+	}
+
+	data := mc.bus.poll("agentresponses", time.Second, nil)
+	if data == nil {
+		t.Fatal("Result of duplicate task was not reported")
+	}
+	var result responses.TaskResultResponse
+	err = unmarshalTestMessage(data, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TaskID != kvt.ID || result.Success || result.Error != "testlet failed" {
+		t.Fatalf("Incorrect result reported for duplicate task: %+v", result)
+	}
+}
+
+// TestOpenMessage tests that messages without an envelope, or from a newer protocol version, are rejected
+func TestOpenMessage(t *testing.T) {
+	data, err := sealMessage(config.Config{}, "agent1", "", map[string]string{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := openMessage(config.Config{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Sender != "agent1" || env.MessageID == "" || string(env.Body) != `{"foo":"bar"}` {
+		t.Fatalf("Incorrect envelope: %+v", env)
+	}
+
+	_, err = openMessage(config.Config{}, []byte(`{"type":"KeyValue","key":"foo"}`))
+	if err != ErrNoEnvelope {
+		t.Fatal("Expected a message without an envelope to be rejected")
+	}
+
+	env.Version = defs.ProtocolVersion + 1
+	data, err = json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openMessage(config.Config{}, data)
+	if err != ErrUnsupportedVersion {
+		t.Fatalf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+// TestHandleHeartbeatUnknownAdvert tests that the server asks an agent to advertise again if it receives a heartbeat
+// that doesn't match an advertisement it has accepted, and that the agent clears its advertisement hash when asked
+func TestHandleHeartbeatUnknownAdvert(t *testing.T) {
+	cfg, cleanup := newTestAgentConfig(t, "hbagent")
+	defer cleanup()
+
+	ac := cache.NewAgentCache(cfg)
+	ac.SetKeyValue("adverthash", "abc123")
+
+	mc := memoryComms{config: cfg, bus: newMemoryBus()}
+
+	hb := defs.AgentHeartbeat{Uuid: "hbagent", AdvertHash: "abc123"}
+	data, err := sealMessage(cfg, "hbagent", "", hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handleHeartbeat(mc, cfg, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := mc.bus.poll("hbagent", 0, nil)
+	if task == nil {
+		t.Fatal("Agent was not asked to advertise again")
+	}
+
+	err = handleTask(mc, cfg, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.GetKeyValue("adverthash") != "" {
+		t.Fatal("Agent did not clear its advertisement hash")
+	}
+
+	// A heartbeat can't be sent on behalf of another agent
+	data, err = sealMessage(cfg, "otheragent", "", hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handleHeartbeat(mc, cfg, data) == nil {
+		t.Fatal("Accepted a heartbeat sent by a different agent")
+	}
+}
@@ -0,0 +1,303 @@
+/*
+    ToDD commsPackage implementation for HTTP
+
+    This plugin allows agents to communicate directly with the ToDD server's API, rather than
+    through a message broker. Agents post advertisements, heartbeats and responses to the server, and
+    long-poll the server for tasks sent to their UUID or group. Everything an agent posts - including
+    each poll - is wrapped in an envelope, and checked by the server before it is accepted, just like
+    messages sent over the other plugins.
+
+    On the server side, messages received by the API are placed onto in-process queues (see memory.go),
+    so the server's half of this plugin behaves exactly like the memory plugin.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/agent/responses"
+	"github.com/Mierdin/todd/config"
+)
+
+const (
+	// HTTPPollTimeout is the amount of time the server will hold a task poll open before
+	// telling the agent that there is nothing to do.
+	HTTPPollTimeout = 30 * time.Second
+
+	// httpRetryInterval is the amount of time an agent will wait before polling again after a failure
+	httpRetryInterval = 1 * time.Second
+)
+
+// ErrForeignQueue is returned when an agent polls for tasks on a queue that belongs to another agent
+var ErrForeignQueue = errors.New("Agents may only poll their own queues")
+
+// taskPoll is sent by an agent (wrapped in an envelope) to poll the server for tasks on one of its queues
+type taskPoll struct {
+	Queue string `json:"queue"`
+	Group string `json:"group,omitempty"` // the agent's current group, if Queue is its group queue
+}
+
+// VerifyMessage checks an advertisement, heartbeat or response received by the server's API before it is queued, so
+// that messages that aren't correctly signed are refused straight away. The message isn't recorded as received, since
+// it is opened (and checked for replays) again when it is handled.
+func VerifyMessage(cfg config.Config, body []byte) error {
+	_, err := openEnvelope(cfg, body, false)
+	return err
+}
+
+// OpenTaskPoll checks a task poll received by the server's API, and returns the queue it is for, along with the agent's
+// group if the agent is polling its group queue. Agents may only poll their own queues, so that they can't take tasks
+// meant for other agents.
+func OpenTaskPoll(cfg config.Config, body []byte) (string, string, error) {
+
+	env, err := openMessage(cfg, body)
+	if err != nil {
+		return "", "", err
+	}
+
+	var poll taskPoll
+	err = json.Unmarshal(env.Body, &poll)
+	if err != nil {
+		return "", "", err
+	}
+
+	if poll.Queue != env.Sender && poll.Queue != agentGroupQueueName(env.Sender) {
+		log.Errorf("Rejecting poll from %s for tasks on %s", env.Sender, poll.Queue)
+		return "", "", ErrForeignQueue
+	}
+
+	return poll.Queue, poll.Group, nil
+}
+
+// PublishAgentAdvert places an agent advertisement, received by the server's API, onto the server's local advertisement queue.
+func PublishAgentAdvert(body []byte) error {
+	return defaultMemoryBus.publish("agentadvert", body)
+}
+
+// PublishHeartbeat places an agent heartbeat, received by the server's API, onto the server's local heartbeat queue.
+func PublishHeartbeat(body []byte) error {
+	return defaultMemoryBus.publish("agentheartbeat", body)
+}
+
+// PublishResponse places an agent response, received by the server's API, onto the server's local response queue.
+func PublishResponse(body []byte) error {
+	return defaultMemoryBus.publish("agentresponses", body)
+}
+
+// PollTask waits up to HTTPPollTimeout for a task to be sent to the provided queue (an agent UUID, or an agent's group queue),
+// or until done is closed because the agent has gone away. If no task is sent in that time, nil is returned.
+func PollTask(queueName string, done <-chan struct{}) []byte {
+	return defaultMemoryBus.poll(queueName, HTTPPollTimeout, done)
+}
+
+// RequeueTask puts a task returned by PollTask back onto its queue, because it couldn't be passed on to the agent
+func RequeueTask(queueName string, task []byte) error {
+	return defaultMemoryBus.publish(queueName, task)
+}
+
+// BindGroup ensures that an agent's group queue receives the tasks broadcast to the agent's current group.
+func BindGroup(queueName, groupName string) {
+	defaultMemoryBus.bindGroup(queueName, groupName)
+}
+
+// newHTTPComms is a factory function that produces a new instance of httpComms with the configuration
+// loaded and ready to be used.
+func newHTTPComms(cfg config.Config) *httpComms {
+	var hc httpComms
+	hc.memoryComms = *newMemoryComms(cfg)
+
+	hc.serverUrl = fmt.Sprintf("http://%s:%s", cfg.Comms.Host, cfg.Comms.Port)
+
+	// The client timeout must be longer than the time the server will hold a poll open
+	hc.client = &http.Client{Timeout: HTTPPollTimeout + 15*time.Second}
+
+	return &hc
+}
+
+// httpComms embeds memoryComms, which provides the server-side functions (ListenForAgent, ListenForHeartbeats, SendTask, BroadcastTask
+// and ListenForResponses).
+// The agent-side functions are overridden here to talk to the ToDD server's API.
+type httpComms struct {
+	memoryComms
+	serverUrl string
+	client    *http.Client
+}
+
+// post wraps a message in an envelope from the provided sender, and sends it to the provided path on the ToDD server
+func (hc httpComms) post(path, sender string, msg interface{}) error {
+
+	json_data, err := sealMessage(hc.config, sender, "", msg)
+	if err != nil {
+		log.Error("Failed to marshal message")
+		log.Debug(err)
+		return err
+	}
+
+	resp, err := hc.client.Post(hc.serverUrl+path, "application/json", bytes.NewBuffer(json_data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	log.Debugf("Sent message to %s: %s", path, json_data)
+
+	return nil
+}
+
+// getTask performs a single long-poll against the ToDD server for tasks on the provided queue. If this is the agent's
+// group queue, groupName should be the agent's current group, otherwise it should be empty. If the server had no tasks
+// for this queue, nil is returned.
+func (hc httpComms) getTask(queueName, groupName string) ([]byte, error) {
+
+	json_data, err := sealMessage(hc.config, agentSenderID(hc.config), "", taskPoll{Queue: queueName, Group: groupName})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hc.client.Post(hc.serverUrl+"/v1/comms/tasks", "application/json", bytes.NewBuffer(json_data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, errors.New(resp.Status)
+	}
+}
+
+// pollTasks continuously polls the ToDD server for tasks on the provided queue, and sends them into the "tasks" channel.
+// It will return once the "stop" channel is closed.
+func (hc httpComms) pollTasks(queueName, groupName string, tasks chan<- []byte, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		body, err := hc.getTask(queueName, groupName)
+		if err != nil {
+			log.Warnf("Failure polling ToDD server for tasks on %s", queueName)
+			log.Debug(err)
+			time.Sleep(httpRetryInterval)
+			continue
+		}
+		if body == nil {
+			continue
+		}
+
+		select {
+		case tasks <- body:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// AdvertiseAgent will send an agent advertisement to the ToDD server
+func (hc httpComms) AdvertiseAgent(me defs.AgentAdvert) error {
+
+	err := hc.post("/v1/comms/advert", me.Uuid, me)
+	if err != nil {
+		log.Error("Failed to publish agent advertisement")
+		log.Debug(err)
+		return err
+	}
+
+	log.Infof("AGENTADV -- %s", time.Now().UTC())
+
+	return nil
+}
+
+// SendHeartbeat will send an agent heartbeat to the ToDD server
+func (hc httpComms) SendHeartbeat(hb defs.AgentHeartbeat) error {
+
+	err := hc.post("/v1/comms/heartbeat", hb.Uuid, hb)
+	if err != nil {
+		log.Error("Failed to publish agent heartbeat")
+		log.Debug(err)
+		return err
+	}
+
+	return nil
+}
+
+// ListenForTasks is a method that recieves task notices from the server
+func (hc httpComms) ListenForTasks(uuid string) error {
+
+	tasks := make(chan []byte)
+	go hc.pollTasks(uuid, "", tasks, nil)
+
+	log.Infof(" [*] Waiting for messages. To exit press CTRL+C")
+
+	for body := range tasks {
+		handleTask(hc, hc.config, body)
+	}
+
+	return nil
+}
+
+// WatchForGroup should be run as a goroutine, like other background services. This is because it will itself spawn a goroutine to
+// listen for tasks that are sent to groups, and this goroutine can be restarted when group membership changes
+func (hc httpComms) WatchForGroup() {
+	watchForGroup(hc, hc.config)
+}
+
+// ListenForGroupTasks is a method that recieves tasks from the server that are intended for groups
+func (hc httpComms) ListenForGroupTasks(groupName string, dereg chan bool) error {
+
+	log.Debug("Agent re-registering onto group queue - ", groupName)
+
+	tasks := make(chan []byte)
+	stop := make(chan struct{})
+	defer close(stop)
+	go hc.pollTasks(groupQueueName(hc.config), groupName, tasks, stop)
+
+	for {
+		select {
+		case body := <-tasks:
+			handleGroupTask(hc, hc.config, body)
+
+		// This indicates that we wish to stop listening for new group tasks, ususally because we need
+		// to re-register onto a new queue
+		case <-dereg:
+			return nil
+		}
+	}
+}
+
+// SendResponse will send a response object to the ToDD server
+func (hc httpComms) SendResponse(resp responses.Response) error {
+
+	err := hc.post("/v1/comms/response", agentSenderID(hc.config), resp)
+	if err != nil {
+		log.Error("Failed to publish a response to the ToDD server")
+		log.Debug(err)
+		return err
+	}
+
+	return nil
+}
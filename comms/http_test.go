@@ -0,0 +1,227 @@
+/*
+    Tests for the http comms plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/agent/responses"
+	"github.com/Mierdin/todd/agent/tasks"
+	"github.com/Mierdin/todd/config"
+)
+
+// newTestHTTPComms starts a test server that mimics the comms endpoints of the ToDD API, and returns
+// an httpComms instance that is pointed at it. The server and the agent share the provided comms configuration.
+// The returned function stops the server and cleans up.
+func newTestHTTPComms(t *testing.T, comms config.Comms) (*httpComms, func()) {
+
+	cfg, cleanup := newTestAgentConfig(t, "httpagent1")
+	cfg.Comms = comms
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/comms/advert", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := VerifyMessage(cfg, body); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		PublishAgentAdvert(body)
+	})
+	mux.HandleFunc("/v1/comms/response", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := VerifyMessage(cfg, body); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		PublishResponse(body)
+	})
+	mux.HandleFunc("/v1/comms/tasks", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		queueName, groupName, err := OpenTaskPoll(cfg, body)
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		if groupName != "" {
+			BindGroup(queueName, groupName)
+		}
+
+		// Don't hold the poll open during tests
+		task := defaultMemoryBus.poll(queueName, 0, nil)
+		if task == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write(task)
+	})
+	ts := httptest.NewServer(mux)
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Comms.Host = host
+	cfg.Comms.Port = port
+
+	return newHTTPComms(cfg), func() {
+		ts.Close()
+		cleanup()
+	}
+}
+
+// TestHTTPAdvertiseAgent tests that an advertisement sent by an agent ends up on the server's advertisement queue
+func TestHTTPAdvertiseAgent(t *testing.T) {
+	hc, cleanup := newTestHTTPComms(t, config.Comms{})
+	defer cleanup()
+
+	err := hc.AdvertiseAgent(defs.AgentAdvert{Uuid: "httpagent1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-defaultMemoryBus.queue("agentadvert"):
+		var adv defs.AgentAdvert
+		err = unmarshalTestMessage(body, &adv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if adv.Uuid != "httpagent1" {
+			t.Fatalf("Received incorrect advertisement: %s", body)
+		}
+	default:
+		t.Fatal("Advertisement was not placed on the advertisement queue")
+	}
+}
+
+// TestHTTPSendResponse tests that a response sent by an agent ends up on the server's response queue
+func TestHTTPSendResponse(t *testing.T) {
+	hc, cleanup := newTestHTTPComms(t, config.Comms{})
+	defer cleanup()
+
+	var resp responses.SetAgentStatusResponse
+	resp.Type = "AgentStatus"
+	resp.AgentUuid = "httpagent1"
+	resp.Status = "ready"
+
+	err := hc.SendResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-defaultMemoryBus.queue("agentresponses"):
+		var received responses.SetAgentStatusResponse
+		err = unmarshalTestMessage(body, &received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.AgentUuid != "httpagent1" || received.Status != "ready" {
+			t.Fatalf("Received incorrect response: %s", body)
+		}
+	default:
+		t.Fatal("Response was not placed on the response queue")
+	}
+}
+
+// TestHTTPGetTask tests that a task sent by the server can be retrieved by an agent, and that an empty poll returns nothing
+func TestHTTPGetTask(t *testing.T) {
+	hc, cleanup := newTestHTTPComms(t, config.Comms{})
+	defer cleanup()
+
+	body, err := hc.getTask("httpagent1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		t.Fatalf("Expected no task, got %s", body)
+	}
+
+	var kvt tasks.KeyValueTask
+	kvt.BaseTask = tasks.NewBaseTask("KeyValue")
+	kvt.Key = "foo"
+	kvt.Value = "bar"
+
+	// The server side of this plugin sends tasks onto the local queues
+	err = hc.SendTask("httpagent1", kvt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err = hc.getTask("httpagent1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received tasks.KeyValueTask
+	err = unmarshalTestMessage(body, &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Key != "foo" || received.Value != "bar" {
+		t.Fatalf("Received incorrect task: %s", body)
+	}
+}
+
+// TestHTTPAuth tests that the server checks the envelope of everything an agent sends it, and that agents can only poll
+// their own queues
+func TestHTTPAuth(t *testing.T) {
+	hc, cleanup := newTestHTTPComms(t, config.Comms{Auth: "hmac", SharedSecret: "sssh"})
+	defer cleanup()
+
+	err := hc.AdvertiseAgent(defs.AgentAdvert{Uuid: "httpagent1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-defaultMemoryBus.queue("agentadvert")
+
+	var kvt tasks.KeyValueTask
+	kvt.BaseTask = tasks.NewBaseTask("KeyValue")
+	kvt.Key = "foo"
+	err = hc.SendTask("httpagent3", kvt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Agents can't take tasks meant for other agents
+	if _, err = hc.getTask("httpagent3", ""); err == nil {
+		t.Fatal("Expected an error polling another agent's queue")
+	}
+	if _, err = hc.getTask(agentGroupQueueName("httpagent3"), "datacenter"); err == nil {
+		t.Fatal("Expected an error polling another agent's group queue")
+	}
+	if body, err := hc.getTask(agentGroupQueueName("httpagent1"), "datacenter"); err != nil || body != nil {
+		t.Fatalf("Expected an empty poll of the agent's own group queue, got %s, %v", body, err)
+	}
+
+	// Messages signed with the wrong secret are refused
+	forger := *hc
+	forger.config.Comms.SharedSecret = "hunter2"
+	if err = forger.AdvertiseAgent(defs.AgentAdvert{Uuid: "httpagent1"}); err == nil {
+		t.Fatal("Expected a forged advertisement to be refused")
+	}
+	if _, err = forger.getTask("httpagent1", ""); err == nil {
+		t.Fatal("Expected a forged poll to be refused")
+	}
+
+	if task := defaultMemoryBus.poll("httpagent3", 0, nil); task == nil {
+		t.Fatal("Expected the other agent's task to be left on its queue")
+	}
+}
@@ -0,0 +1,346 @@
+/*
+    ToDD commsPackage implementation for in-process (memory) communication
+
+    This plugin does not use an external message broker. Instead, all messages are passed over
+    Go channels within a single process. This is useful for running a ToDD server and several
+    agents within the same binary, for demos and end-to-end tests.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/agent/responses"
+	"github.com/Mierdin/todd/agent/tasks"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+)
+
+const (
+	// memoryQueueDepth is the number of messages a single in-memory queue will hold before publishing to it fails.
+	memoryQueueDepth = 1024
+)
+
+// defaultMemoryBus is shared by every memoryComms instance in this process. This is what allows the server and the agents
+// to communicate with each other, even though each of them creates its own comms instance.
+var defaultMemoryBus = newMemoryBus()
+
+// memoryBus is the in-process equivalent of a message broker. It holds a set of named queues, each of which
+// behaves like a non-durable RabbitMQ queue bound to a direct exchange: a message is delivered to exactly one consumer.
+// A queue may also be bound to a group, in which case it receives a copy of every message broadcast to that group.
+type memoryBus struct {
+	mu       sync.Mutex
+	queues   map[string]chan []byte
+	bindings map[string]string
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{
+		queues:   make(map[string]chan []byte),
+		bindings: make(map[string]string),
+	}
+}
+
+// queue returns the queue with the provided name, declaring it first if it does not yet exist.
+func (b *memoryBus) queue(name string) chan []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		q = make(chan []byte, memoryQueueDepth)
+		b.queues[name] = q
+	}
+	return q
+}
+
+// publish places a message onto the named queue. It will not block if the queue is full; an error is returned instead.
+func (b *memoryBus) publish(name string, body []byte) error {
+	select {
+	case b.queue(name) <- body:
+		return nil
+	default:
+		return fmt.Errorf("Memory queue %s is full", name)
+	}
+}
+
+// bindGroup binds the named queue to a group, replacing any previous binding. As with the RabbitMQ plugin, messages
+// still waiting on the queue are kept.
+func (b *memoryBus) bindGroup(name, groupName string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bindings[name] = groupName
+}
+
+// broadcast places a message onto every queue that is bound to the provided group
+func (b *memoryBus) broadcast(groupName string, body []byte) error {
+	b.mu.Lock()
+	var names []string
+	for name, group := range b.bindings {
+		if group == groupName {
+			names = append(names, name)
+		}
+	}
+	b.mu.Unlock()
+
+	var err error
+	for _, name := range names {
+		if perr := b.publish(name, body); perr != nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// poll waits up to the provided timeout for a message on the named queue, or until done is closed. If no message arrives in
+// that time, nil is returned. done may be nil.
+func (b *memoryBus) poll(name string, timeout time.Duration, done <-chan struct{}) []byte {
+	q := b.queue(name)
+
+	// Messages that are already waiting are always returned, even if the timeout is zero
+	select {
+	case body := <-q:
+		return body
+	default:
+	}
+
+	select {
+	case body := <-q:
+		return body
+	case <-time.After(timeout):
+		return nil
+	case <-done:
+		return nil
+	}
+}
+
+// newMemoryComms is a factory function that produces a new instance of memoryComms with the configuration
+// loaded and ready to be used.
+func newMemoryComms(cfg config.Config) *memoryComms {
+	return &memoryComms{
+		config: cfg,
+		bus:    defaultMemoryBus,
+	}
+}
+
+type memoryComms struct {
+	config config.Config
+	bus    *memoryBus
+}
+
+// AdvertiseAgent will place an agent advertisement message on the in-memory queue
+func (mc memoryComms) AdvertiseAgent(me defs.AgentAdvert) error {
+
+	// Marshal agent struct to JSON
+	json_data, err := sealMessage(mc.config, me.Uuid, "", me)
+	if err != nil {
+		log.Error("Failed to marshal agent data from queue")
+		log.Debug(err)
+		return err
+	}
+
+	err = mc.bus.publish("agentadvert", json_data)
+	if err != nil {
+		log.Error("Failed to publish agent advertisement")
+		log.Debug(err)
+		return err
+	}
+
+	log.Infof("AGENTADV -- %s", time.Now().UTC())
+
+	return nil
+}
+
+// ListenForAgent will listen on the in-memory queue for new agent advertisements.
+// It is meant to be run as a goroutine
+func (mc memoryComms) ListenForAgent(assets map[string]map[string]string) error {
+
+	log.Infof(" [*] Waiting for messages. To exit press CTRL+C")
+
+	for body := range mc.bus.queue("agentadvert") {
+		handleAgentAdvert(mc, mc.config, assets, body)
+	}
+
+	return nil
+}
+
+// SendHeartbeat will place an agent heartbeat message on the in-memory queue
+func (mc memoryComms) SendHeartbeat(hb defs.AgentHeartbeat) error {
+
+	json_data, err := sealMessage(mc.config, hb.Uuid, "", hb)
+	if err != nil {
+		log.Error("Failed to marshal agent heartbeat")
+		log.Debug(err)
+		return err
+	}
+
+	err = mc.bus.publish("agentheartbeat", json_data)
+	if err != nil {
+		log.Error("Failed to publish agent heartbeat")
+		log.Debug(err)
+		return err
+	}
+
+	return nil
+}
+
+// ListenForHeartbeats will listen on the in-memory queue for agent heartbeats.
+// It is meant to be run as a goroutine
+func (mc memoryComms) ListenForHeartbeats() error {
+
+	log.Infof(" [*] Waiting for messages. To exit press CTRL+C")
+
+	for body := range mc.bus.queue("agentheartbeat") {
+		handleHeartbeat(mc, mc.config, body)
+	}
+
+	return nil
+}
+
+// SendTask will send a task object onto the specified queue ("queueName"), which is an agent's UUID. Tasks for every agent
+// in a group are sent with BroadcastTask instead, since agents don't listen on a queue named after their group.
+func (mc memoryComms) SendTask(queueName string, task tasks.Task) error {
+
+	json_data, err := sealMessage(mc.config, ServerSenderID, task.TaskID(), task)
+	if err != nil {
+		log.Error("Failed to marshal object data")
+		log.Debug(err)
+		return err
+	}
+
+	err = mc.bus.publish(queueName, json_data)
+	if err != nil {
+		log.Error("Failed to publish a task onto message queue")
+		log.Debug(err)
+		return err
+	}
+
+	log.Debugf("Sent task to %s: %s", queueName, json_data)
+
+	return nil
+}
+
+// ListenForTasks is a method that recieves task notices from the server
+func (mc memoryComms) ListenForTasks(uuid string) error {
+
+	log.Infof(" [*] Waiting for messages. To exit press CTRL+C")
+
+	for body := range mc.bus.queue(uuid) {
+		handleTask(mc, mc.config, body)
+	}
+
+	return nil
+}
+
+// WatchForGroup should be run as a goroutine, like other background services. This is because it will itself spawn a goroutine to
+// listen for tasks that are sent to groups, and this goroutine can be restarted when group membership changes
+func (mc memoryComms) WatchForGroup() {
+	watchForGroup(mc, mc.config)
+}
+
+// ListenForGroupTasks is a method that recieves tasks from the server that are intended for groups
+func (mc memoryComms) ListenForGroupTasks(groupName string, dereg chan bool) error {
+
+	log.Debug("Agent re-registering onto group queue - ", groupName)
+
+	queueName := groupQueueName(mc.config)
+	mc.bus.bindGroup(queueName, groupName)
+
+	q := mc.bus.queue(queueName)
+	for {
+		select {
+		case body := <-q:
+			handleGroupTask(mc, mc.config, body)
+
+		// This indicates that we wish to stop listening for new group tasks, ususally because we need
+		// to re-register onto a new queue
+		case <-dereg:
+			return nil
+		}
+	}
+}
+
+// BroadcastTask will send a task object to every agent in the provided group
+func (mc memoryComms) BroadcastTask(groupName string, task tasks.Task) error {
+
+	json_data, err := sealMessage(mc.config, ServerSenderID, task.TaskID(), task)
+	if err != nil {
+		log.Error("Failed to marshal object data")
+		log.Debug(err)
+		return err
+	}
+
+	err = mc.bus.broadcast(groupName, json_data)
+	if err != nil {
+		log.Error("Failed to broadcast a task onto message queue")
+		log.Debug(err)
+		return err
+	}
+
+	log.Debugf("Broadcast task to group %s: %s", groupName, json_data)
+
+	return nil
+}
+
+// SendResponse will send a response object onto the statically-defined queue for receiving such messages.
+func (mc memoryComms) SendResponse(resp responses.Response) error {
+
+	queueName := "agentresponses"
+
+	json_data, err := sealMessage(mc.config, agentSenderID(mc.config), "", resp)
+	if err != nil {
+		log.Error("Failed to marshal response data")
+		log.Debug(err)
+		return err
+	}
+
+	err = mc.bus.publish(queueName, json_data)
+	if err != nil {
+		log.Error("Failed to publish a response onto message queue")
+		log.Debug(err)
+		return err
+	}
+
+	log.Debugf("Sent response to %s: %s", queueName, json_data)
+
+	return nil
+}
+
+// ListenForResponses listens for responses from an agent
+func (mc memoryComms) ListenForResponses(stopListeningForResponses *chan bool) error {
+
+	tdb, err := db.NewToddDB(mc.config)
+	if err != nil {
+		log.Error("Failed to connect to DB")
+		log.Debug(err)
+		return err
+	}
+
+	log.Infof(" [*] Waiting for messages. To exit press CTRL+C")
+
+	q := mc.bus.queue("agentresponses")
+	for {
+		select {
+		case body := <-q:
+			handleResponse(mc, mc.config, tdb, body)
+		case <-*stopListeningForResponses:
+			return nil
+		}
+	}
+}
+
+// ListDeadLetters always returns an empty list, since the memory plugin does not redeliver (or dead-letter) messages
+func (mc memoryComms) ListDeadLetters() ([]DeadLetter, error) {
+	return []DeadLetter{}, nil
+}
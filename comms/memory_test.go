@@ -0,0 +1,243 @@
+/*
+    Tests for the memory comms plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/cache"
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/agent/tasks"
+	"github.com/Mierdin/todd/config"
+)
+
+// newTestAgentConfig returns the configuration for an agent with the provided UUID, along with a function that cleans
+// up after it. The agent cache is stored in a temporary directory.
+func newTestAgentConfig(t *testing.T, uuid string) (config.Config, func()) {
+	dir, err := ioutil.TempDir("", "todd-comms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config.Config
+	cfg.LocalResources.OptDir = dir
+
+	ac := cache.NewAgentCache(cfg)
+	ac.Init()
+	ac.SetKeyValue("uuid", uuid)
+
+	return cfg, func() { os.RemoveAll(dir) }
+}
+
+// unmarshalTestMessage opens the envelope of a message sent over the comms package, and unmarshals the message inside it
+func unmarshalTestMessage(data []byte, v interface{}) error {
+	env, err := openMessage(config.Config{}, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(env.Body, v)
+}
+
+// TestMemoryBusFull tests that publishing to a full queue returns an error instead of blocking
+func TestMemoryBusFull(t *testing.T) {
+	bus := newMemoryBus()
+
+	for i := 0; i < memoryQueueDepth; i++ {
+		if err := bus.publish("full", []byte("x")); err != nil {
+			t.Fatalf("Unexpected error publishing message %d: %v", i, err)
+		}
+	}
+
+	if err := bus.publish("full", []byte("x")); err == nil {
+		t.Fatal("Expected an error publishing to a full queue")
+	}
+}
+
+// TestMemorySendTask tests that a task sent to an agent UUID lands on the queue for that UUID
+func TestMemorySendTask(t *testing.T) {
+	mc := memoryComms{bus: newMemoryBus()}
+
+	var sgt tasks.SetGroupTask
+	sgt.BaseTask = tasks.NewBaseTask("SetGroup")
+	sgt.GroupName = "datacenter"
+
+	err := mc.SendTask("agent1", sgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-mc.bus.queue("agent1"):
+		var received tasks.SetGroupTask
+		err = unmarshalTestMessage(body, &received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.Type != "SetGroup" || received.GroupName != "datacenter" {
+			t.Fatalf("Received incorrect task: %s", body)
+		}
+	default:
+		t.Fatal("Task was not placed on the agent queue")
+	}
+}
+
+// TestMemoryAdvertiseAgent tests that agent advertisements are placed on the advertisement queue
+func TestMemoryAdvertiseAgent(t *testing.T) {
+	mc := memoryComms{bus: newMemoryBus()}
+
+	err := mc.AdvertiseAgent(defs.AgentAdvert{Uuid: "agent1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-mc.bus.queue("agentadvert"):
+		var adv defs.AgentAdvert
+		err = unmarshalTestMessage(body, &adv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if adv.Uuid != "agent1" {
+			t.Fatalf("Received incorrect advertisement: %s", body)
+		}
+	default:
+		t.Fatal("Advertisement was not placed on the advertisement queue")
+	}
+}
+
+// TestMemoryListenForGroupTasksDereg tests that ListenForGroupTasks returns when instructed to deregister
+func TestMemoryListenForGroupTasksDereg(t *testing.T) {
+	cfg, cleanup := newTestAgentConfig(t, "agent1")
+	defer cleanup()
+
+	mc := memoryComms{config: cfg, bus: newMemoryBus()}
+
+	dereg := make(chan bool)
+	done := make(chan error)
+	go func() {
+		done <- mc.ListenForGroupTasks("group1", dereg)
+	}()
+
+	dereg <- true
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenForGroupTasks did not return after deregistering")
+	}
+}
+
+// TestListenForGroupDereg tests that the agent stops listening to a group (rather than listening to it again) once
+// it has been deregistered from it
+func TestListenForGroupDereg(t *testing.T) {
+	cfg, cleanup := newTestAgentConfig(t, "agent1")
+	defer cleanup()
+
+	mc := memoryComms{config: cfg, bus: newMemoryBus()}
+
+	dereg := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		listenForGroup(mc, "group1", dereg)
+		done <- true
+	}()
+
+	close(dereg)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listenForGroup did not return after deregistering")
+	}
+
+	// A new registration must not be undone by the old one
+	dereg2 := make(chan bool)
+	defer close(dereg2)
+	go listenForGroup(mc, "group2", dereg2)
+	time.Sleep(50 * time.Millisecond)
+	mc.bus.mu.Lock()
+	group := mc.bus.bindings[groupQueueName(cfg)]
+	mc.bus.mu.Unlock()
+	if group != "group2" {
+		t.Fatalf("Expected group queue to be bound to group2, got %q", group)
+	}
+}
+
+// TestMemorySendTaskAndWait tests that the server receives the result of a task it sent to an agent
+func TestMemorySendTaskAndWait(t *testing.T) {
+	cfg, cleanup := newTestAgentConfig(t, "agent1")
+	defer cleanup()
+
+	mc := memoryComms{config: cfg, bus: newMemoryBus()}
+
+	// Play the part of both the agent and the server's response listener
+	go func() {
+		handleTask(mc, cfg, <-mc.bus.queue("agent1"))
+		handleResponse(mc, cfg, nil, <-mc.bus.queue("agentresponses"))
+	}()
+
+	var kvt tasks.KeyValueTask
+	kvt.BaseTask = tasks.NewBaseTask("KeyValue")
+	kvt.Key = "foo"
+	kvt.Value = "bar"
+
+	result, err := SendTaskAndWait(mc, "agent1", kvt, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TaskID != kvt.ID || !result.Success {
+		t.Fatalf("Received incorrect result: %+v", result)
+	}
+
+	// Nobody will answer this one
+	kvt.BaseTask = tasks.NewBaseTask("KeyValue")
+	_, err = SendTaskAndWait(mc, "agent2", kvt, 10*time.Millisecond)
+	if err != ErrTaskTimeout {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+}
+
+// TestMemoryBroadcastTask tests that a task broadcast to a group is received by every agent in that group, and only by those agents
+func TestMemoryBroadcastTask(t *testing.T) {
+	bus := newMemoryBus()
+
+	var agents []memoryComms
+	for _, uuid := range []string{"agent1", "agent2", "agent3"} {
+		cfg, cleanup := newTestAgentConfig(t, uuid)
+		defer cleanup()
+		agents = append(agents, memoryComms{config: cfg, bus: bus})
+	}
+
+	bus.bindGroup(groupQueueName(agents[0].config), "datacenter")
+	bus.bindGroup(groupQueueName(agents[1].config), "datacenter")
+	bus.bindGroup(groupQueueName(agents[2].config), "branch")
+
+	var sgt tasks.SetGroupTask
+	sgt.BaseTask = tasks.NewBaseTask("SetGroup")
+	sgt.GroupName = "datacenter"
+
+	err := agents[0].BroadcastTask("datacenter", sgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []int{1, 1, 0} {
+		q := bus.queue(groupQueueName(agents[i].config))
+		if len(q) != expected {
+			t.Fatalf("Agent %d received %d tasks, expected %d", i+1, len(q), expected)
+		}
+	}
+}
@@ -0,0 +1,799 @@
+/*
+    ToDD commsPackage implementation for RabbitMQ - connection management
+
+    All rabbitMQComms instances that point at the same RabbitMQ URL share a single, long-lived
+    connection. Messages are published over a small pool of channels (in confirm mode), and the
+    connection is automatically re-established if it is lost.
+
+    Queues are durable, and messages are only acknowledged once they have been handled. A message
+    that fails to be handled (or that was in flight when its consumer died) is redelivered a limited
+    number of times, after which it is moved to the dead-letter queue for inspection.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+
+	"github.com/Mierdin/todd/config"
+)
+
+const (
+	connectRetry = 3
+
+	// rabbitMQExchange is the exchange that all ToDD queues are bound to, using the name of the queue within ToDD
+	// (such as "agentadvert", or an agent's UUID) as the routing key
+	rabbitMQExchange = "todd_messages"
+
+	// rabbitMQQueuePrefix starts the name of every ToDD queue in RabbitMQ. Older versions of ToDD declared their queues
+	// (and their exchange, "test_exchange") without the durability and dead-lettering settings used now, under the
+	// bare names, and RabbitMQ refuses to re-declare an existing queue with different settings. Using new names lets
+	// an upgraded ToDD start against a RabbitMQ server that still has the old queues.
+	rabbitMQQueuePrefix = "todd."
+
+	// rabbitMQGroupExchange is the exchange used to broadcast tasks to every agent in a group. Each agent's group queue is
+	// bound to this exchange using the name of the agent's current group as the routing key.
+	rabbitMQGroupExchange = "todd_groups"
+
+	// rabbitMQChannelPoolSize is the maximum number of idle publishing channels that are kept open
+	rabbitMQChannelPoolSize = 8
+
+	// rabbitMQConfirmTimeout is how long we will wait for RabbitMQ to confirm a published message before
+	// assuming it was lost, and publishing it again
+	rabbitMQConfirmTimeout = 10 * time.Second
+
+	// rabbitMQPublishRetry is the number of times a message will be republished if it could not be confirmed
+	rabbitMQPublishRetry = 3
+
+	// rabbitMQReconnectInterval is how long we wait between attempts to re-establish a lost connection
+	rabbitMQReconnectInterval = 2 * time.Second
+
+	// rabbitMQDeadLetterExchange and rabbitMQDeadLetterQueue hold messages that could not be handled
+	rabbitMQDeadLetterExchange = "todd_deadletter"
+	rabbitMQDeadLetterQueue    = "todd_deadletter"
+
+	// rabbitMQMaxDeliveries is the number of times a message will be delivered to a consumer before it is dead-lettered
+	rabbitMQMaxDeliveries = 3
+
+	// rabbitMQAttemptsHeader is the message header used to count failed deliveries of a message
+	rabbitMQAttemptsHeader = "x-todd-attempts"
+
+	// rabbitMQDeadLetterListMax is the maximum number of dead-lettered messages returned by ListDeadLetters
+	rabbitMQDeadLetterListMax = 1000
+)
+
+// rabbitMQTransientQueues are queues whose messages are not worth keeping if they can't be handled. Agent
+// advertisements and heartbeats expire quickly and are resent regularly, so they are not dead-lettered.
+var rabbitMQTransientQueues = map[string]bool{
+	"agentadvert":    true,
+	"agentheartbeat": true,
+}
+
+// rabbitMQQueueName returns the name in RabbitMQ of the provided ToDD queue
+func rabbitMQQueueName(queueName string) string {
+	return rabbitMQQueuePrefix + queueName
+}
+
+var (
+	rabbitMQConnectionsMu sync.Mutex
+	rabbitMQConnections   = make(map[config.Comms]*rabbitMQConnection)
+)
+
+// getRabbitMQConnection returns the managed connection for the provided configuration, creating it if needed. The connection
+// to RabbitMQ itself is not established until it is first used.
+func getRabbitMQConnection(cfg config.Comms) (*rabbitMQConnection, error) {
+	rabbitMQConnectionsMu.Lock()
+	defer rabbitMQConnectionsMu.Unlock()
+
+	if c, ok := rabbitMQConnections[cfg]; ok {
+		return c, nil
+	}
+
+	tlsConfig, err := rabbitMQTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rabbitMQConnection{
+		queueUrl:  rabbitMQURL(cfg),
+		tlsConfig: tlsConfig,
+		pool:      make(chan *pooledChannel, rabbitMQChannelPoolSize),
+	}
+	rabbitMQConnections[cfg] = c
+	return c, nil
+}
+
+// rabbitMQURL builds the AMQP URL for the RabbitMQ server described by the provided configuration
+func rabbitMQURL(cfg config.Comms) string {
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(cfg.User, cfg.Password),
+		Host:   net.JoinHostPort(cfg.Host, cfg.Port),
+		Path:   "/" + cfg.Vhost,
+	}
+	if cfg.TLS {
+		u.Scheme = "amqps"
+	}
+	return u.String()
+}
+
+// rabbitMQTLSConfig loads the CA bundle and client certificate in the provided configuration. nil is returned if TLS
+// is not enabled.
+func rabbitMQTLSConfig(cfg config.Comms) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+	}
+
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.CACert)
+		}
+	}
+
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// connectRabbitMQ wraps the amqp.DialTLS function in order to provide connection retry functionality. The TLS
+// configuration is only used for amqps URLs.
+func connectRabbitMQ(queueUrl string, tlsConfig *tls.Config) (*amqp.Connection, error) {
+
+	conn, err := amqp.DialTLS(queueUrl, tlsConfig)
+
+	for retries := 0; err != nil; {
+		if retries > connectRetry {
+			return nil, err
+		}
+
+		retries++
+		log.Warnf("Failure connecting to RabbitMQ - retry #%d", retries)
+		time.Sleep(1 * time.Second)
+
+		conn, err = amqp.DialTLS(queueUrl, tlsConfig)
+	}
+
+	return conn, nil
+}
+
+// rabbitMQConnection manages a single connection to RabbitMQ, along with a pool of channels used for publishing.
+type rabbitMQConnection struct {
+	queueUrl  string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+
+	// generation is incremented each time a new connection is established. Channels and queue declarations
+	// are only valid for the generation they were created in.
+	generation int
+
+	// declared keeps track of the queues that have already been declared and bound on this connection
+	declared map[string]bool
+
+	pool chan *pooledChannel
+}
+
+// pooledChannel is a publishing channel (in confirm mode), along with its confirmation channels
+type pooledChannel struct {
+	ch         *amqp.Channel
+	acks       chan uint64
+	nacks      chan uint64
+	generation int
+}
+
+// connection returns the current connection to RabbitMQ, establishing a new one if necessary.
+func (c *rabbitMQConnection) connection() (*amqp.Connection, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		return c.conn, c.generation, nil
+	}
+
+	conn, err := connectRabbitMQ(c.queueUrl, c.tlsConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.conn = conn
+	c.generation++
+	c.declared = make(map[string]bool)
+
+	go c.watch(conn, c.generation)
+
+	return c.conn, c.generation, nil
+}
+
+// watch waits for the provided connection to close. If it was closed because of an error, the connection
+// is re-established right away, so that consumers are able to pick back up where they left off.
+func (c *rabbitMQConnection) watch(conn *amqp.Connection, generation int) {
+	err := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+
+	// A nil error indicates the connection was closed on purpose
+	if err == nil {
+		return
+	}
+
+	log.Warnf("Connection to RabbitMQ lost - reconnecting: %v", err)
+
+	for {
+		_, _, err := c.connection()
+		if err == nil {
+			log.Info("Reconnected to RabbitMQ")
+			return
+		}
+		time.Sleep(rabbitMQReconnectInterval)
+	}
+}
+
+// currentGeneration returns the generation of the current connection
+func (c *rabbitMQConnection) currentGeneration() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// channel retrieves an idle publishing channel from the pool, or opens a new one if the pool is empty.
+func (c *rabbitMQConnection) channel() (*pooledChannel, error) {
+
+	for {
+		select {
+		case pc := <-c.pool:
+			// Channels left over from a previous connection are of no use to us
+			if pc.generation != c.currentGeneration() {
+				pc.ch.Close()
+				continue
+			}
+			return pc, nil
+		default:
+		}
+		break
+	}
+
+	conn, generation, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	acks, nacks := ch.NotifyConfirm(make(chan uint64, 1), make(chan uint64, 1))
+
+	return &pooledChannel{
+		ch:         ch,
+		acks:       acks,
+		nacks:      nacks,
+		generation: generation,
+	}, nil
+}
+
+// release returns a publishing channel to the pool. If the pool is full, the channel is closed.
+func (c *rabbitMQConnection) release(pc *pooledChannel) {
+	select {
+	case c.pool <- pc:
+	default:
+		pc.ch.Close()
+	}
+}
+
+// declare ensures that the ToDD exchange and the provided queue exist, and that the queue is bound to the
+// exchange using its own name as the routing key. This is only done once per queue per connection.
+func (c *rabbitMQConnection) declare(ch *amqp.Channel, generation int, queueName string) error {
+
+	c.mu.Lock()
+	done := c.generation == generation && c.declared[queueName]
+	c.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	err := c.declareDeadLetter(ch)
+	if err != nil {
+		return err
+	}
+
+	err = ch.ExchangeDeclare(
+		rabbitMQExchange, // name
+		"direct",         // kind
+		true,             // durable
+		false,            // delete when unused
+		false,            // internal
+		false,            // no-wait
+		nil,              // args
+	)
+	if err != nil {
+		log.Error("Failed to declare an exchange")
+		return err
+	}
+
+	var args amqp.Table
+	if !rabbitMQTransientQueues[queueName] {
+		args = amqp.Table{"x-dead-letter-exchange": rabbitMQDeadLetterExchange}
+	}
+
+	_, err = ch.QueueDeclare(
+		rabbitMQQueueName(queueName), // name
+		true,                         // durable
+		false,                        // delete when unused
+		false,                        // exclusive
+		false,                        // no-wait
+		args,                         // arguments
+	)
+	if err != nil {
+		log.Error("Failed to declare a queue")
+		return err
+	}
+
+	err = ch.QueueBind(
+		rabbitMQQueueName(queueName), // name
+		queueName,                    // routing key
+		rabbitMQExchange,             // exchange
+		false,                        // no-wait
+		nil,                          // args
+	)
+	if err != nil {
+		log.Error("Failed to bind exchange to queue")
+		return err
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.declared[queueName] = true
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// declareDeadLetter ensures that the dead-letter exchange exists, and that every message sent to it ends up in
+// the dead-letter queue.
+func (c *rabbitMQConnection) declareDeadLetter(ch *amqp.Channel) error {
+
+	err := ch.ExchangeDeclare(
+		rabbitMQDeadLetterExchange, // name
+		"fanout",                   // kind
+		true,                       // durable
+		false,                      // delete when unused
+		false,                      // internal
+		false,                      // no-wait
+		nil,                        // args
+	)
+	if err != nil {
+		log.Error("Failed to declare the dead-letter exchange")
+		return err
+	}
+
+	_, err = ch.QueueDeclare(
+		rabbitMQDeadLetterQueue, // name
+		true,                    // durable
+		false,                   // delete when unused
+		false,                   // exclusive
+		false,                   // no-wait
+		nil,                     // arguments
+	)
+	if err != nil {
+		log.Error("Failed to declare the dead-letter queue")
+		return err
+	}
+
+	err = ch.QueueBind(
+		rabbitMQDeadLetterQueue,    // name
+		"",                         // routing key
+		rabbitMQDeadLetterExchange, // exchange
+		false,                      // no-wait
+		nil,                        // args
+	)
+	if err != nil {
+		log.Error("Failed to bind the dead-letter exchange to the dead-letter queue")
+		return err
+	}
+
+	return nil
+}
+
+// declareGroupExchange ensures that the exchange used to broadcast messages to groups exists
+func declareGroupExchange(ch *amqp.Channel) error {
+
+	err := ch.ExchangeDeclare(
+		rabbitMQGroupExchange, // name
+		"direct",              // kind
+		true,                  // durable
+		false,                 // delete when unused
+		false,                 // internal
+		false,                 // no-wait
+		nil,                   // args
+	)
+	if err != nil {
+		log.Error("Failed to declare the group exchange")
+		return err
+	}
+
+	return nil
+}
+
+// groupBinder is the part of an AMQP channel used to change which group a group queue is bound to
+type groupBinder interface {
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+}
+
+// bindGroup declares the provided queue, and binds it to the provided group, so that it receives every message broadcast
+// to that group. oldGroup is the group the queue was last bound to (if any), which is unbound if the group has changed.
+// The queue itself is left alone, so that messages waiting on it aren't lost.
+func (c *rabbitMQConnection) bindGroup(queueName, oldGroup, groupName string) error {
+
+	conn, generation, err := c.connection()
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	err = declareGroupExchange(ch)
+	if err != nil {
+		return err
+	}
+
+	err = c.declare(ch, generation, queueName)
+	if err != nil {
+		return err
+	}
+
+	return rebindGroup(ch, queueName, oldGroup, groupName)
+}
+
+// rebindGroup binds a group queue to a group, and then removes its binding to the group it was bound to before, if this
+// is a different group. Binding a queue to the group it is already bound to does nothing.
+func rebindGroup(ch groupBinder, queueName, oldGroup, groupName string) error {
+
+	err := ch.QueueBind(
+		rabbitMQQueueName(queueName), // name
+		groupName,                    // routing key
+		rabbitMQGroupExchange,        // exchange
+		false,                        // no-wait
+		nil,                          // args
+	)
+	if err != nil {
+		log.Error("Failed to bind group exchange to queue")
+		return err
+	}
+
+	if oldGroup == "" || oldGroup == groupName {
+		return nil
+	}
+
+	err = ch.QueueUnbind(
+		rabbitMQQueueName(queueName), // name
+		oldGroup,                     // routing key
+		rabbitMQGroupExchange,        // exchange
+		nil,                          // args
+	)
+	if err != nil {
+		log.Errorf("Failed to unbind group queue from group %s", oldGroup)
+		return err
+	}
+
+	return nil
+}
+
+// publish sends a message to the provided queue, and waits for RabbitMQ to confirm that it was received.
+// If the connection is lost while the message is in flight, the message is published again once the
+// connection has been re-established.
+func (c *rabbitMQConnection) publish(queueName string, msg amqp.Publishing) error {
+	return c.publishTo(rabbitMQExchange, queueName, msg)
+}
+
+// broadcast sends a message to every queue that is bound to the provided group (see bindGroup), and waits for RabbitMQ
+// to confirm that it was received. If no queues are bound to the group, the message is dropped.
+func (c *rabbitMQConnection) broadcast(groupName string, msg amqp.Publishing) error {
+	return c.publishTo(rabbitMQGroupExchange, groupName, msg)
+}
+
+// publishTo sends a message to the provided exchange, and waits for RabbitMQ to confirm that it was received.
+// For the ToDD exchange, the routing key is the name of the queue to publish to, which is declared first.
+func (c *rabbitMQConnection) publishTo(exchange, routingKey string, msg amqp.Publishing) error {
+
+	var err error
+
+	for attempt := 0; attempt <= rabbitMQPublishRetry; attempt++ {
+
+		if attempt > 0 {
+			log.Warnf("Republishing message to %s - attempt #%d", routingKey, attempt)
+		}
+
+		var pc *pooledChannel
+		pc, err = c.channel()
+		if err != nil {
+			// We already retried the connection itself, so there's no sense in continuing
+			return err
+		}
+
+		if exchange == rabbitMQExchange {
+			err = c.declare(pc.ch, pc.generation, routingKey)
+		} else {
+			err = declareGroupExchange(pc.ch)
+		}
+		if err != nil {
+			pc.ch.Close()
+			continue
+		}
+
+		err = pc.ch.Publish(
+			exchange,   // exchange
+			routingKey, // routing key
+			false,      // mandatory
+			false,      // immediate
+			msg,
+		)
+		if err != nil {
+			pc.ch.Close()
+			continue
+		}
+
+		select {
+		case _, ok := <-pc.acks:
+			if ok {
+				c.release(pc)
+				return nil
+			}
+			err = errors.New("Channel closed before message was confirmed")
+		case _, ok := <-pc.nacks:
+			if ok {
+				c.release(pc)
+				return fmt.Errorf("RabbitMQ refused message sent to %s", routingKey)
+			}
+			err = errors.New("Channel closed before message was confirmed")
+		case <-time.After(rabbitMQConfirmTimeout):
+			err = errors.New("Timed out waiting for message confirmation")
+			pc.ch.Close()
+		}
+
+		// Give the connection a chance to recover before trying again
+		time.Sleep(rabbitMQReconnectInterval)
+	}
+
+	return err
+}
+
+// consume declares the provided queue and passes the body of every message received on it to the handler function.
+// Messages are acknowledged once the handler returns successfully; if the handler returns an error (or panics), the
+// message is redelivered up to rabbitMQMaxDeliveries times before being dead-lettered.
+// If the connection to RabbitMQ is lost, it will start consuming again once the connection has been re-established.
+// This function will block until a value is received on the "stop" channel. If "stop" is nil, it will block forever
+// (unless a connection to RabbitMQ can't be made at all).
+func (c *rabbitMQConnection) consume(queueName string, handler func([]byte) error, stop <-chan bool) error {
+
+	for {
+		conn, generation, err := c.connection()
+		if err != nil {
+			log.Errorf("Failed to connect to RabbitMQ to consume from %s", queueName)
+			return err
+		}
+
+		ch, err := conn.Channel()
+		if err != nil {
+			log.Error("Failed to open a channel")
+			return err
+		}
+
+		err = c.declare(ch, generation, queueName)
+		if err != nil {
+			ch.Close()
+			return err
+		}
+
+		// Only hand us one message at a time, so that unacknowledged messages stay in the queue
+		// (and are redelivered) if we go away
+		err = ch.Qos(1, 0, false)
+		if err != nil {
+			log.Error("Failed to set channel QoS")
+			ch.Close()
+			return err
+		}
+
+		msgs, err := ch.Consume(
+			rabbitMQQueueName(queueName), // queue
+			queueName,                    // consumer
+			false,                        // auto-ack
+			false,                        // exclusive
+			false,                        // no-local
+			false,                        // no-wait
+			nil,                          // args
+		)
+		if err != nil {
+			log.Error("Failed to register a consumer")
+			ch.Close()
+			return err
+		}
+
+	consumeloop:
+		for {
+			select {
+			case d, ok := <-msgs:
+				if !ok {
+					log.Warnf("Stopped receiving messages from %s - waiting for reconnect", queueName)
+					break consumeloop
+				}
+				c.deliver(queueName, d, handler)
+			case <-stop:
+				ch.Close()
+				return nil
+			}
+		}
+
+		time.Sleep(rabbitMQReconnectInterval)
+	}
+}
+
+// deliver passes a single message to the handler function, and then acknowledges, retries or dead-letters it.
+func (c *rabbitMQConnection) deliver(queueName string, d amqp.Delivery, handler func([]byte) error) {
+
+	// Messages on transient queues are handled at most once
+	if rabbitMQTransientQueues[queueName] {
+		err := safeHandle(handler, d.Body)
+		if err != nil {
+			log.Warnf("Failed to handle message from %s - discarding: %v", queueName, err)
+		}
+		d.Ack(false)
+		return
+	}
+
+	attempts := deliveryAttempts(d)
+
+	// A message that is redelivered by RabbitMQ was never acknowledged, most likely because the consumer died while
+	// handling it. We count this as a failed attempt, and don't hand it to the handler again straight away - otherwise
+	// a message that crashes its consumer would be redelivered forever.
+	var err error
+	if d.Redelivered {
+		err = errors.New("Message was redelivered without being acknowledged")
+	} else {
+		err = safeHandle(handler, d.Body)
+		if err == nil {
+			d.Ack(false)
+			return
+		}
+	}
+
+	attempts++
+	if attempts >= rabbitMQMaxDeliveries {
+		log.Errorf("Giving up on message from %s after %d attempts - dead-lettering: %v", queueName, attempts, err)
+		d.Nack(false, false)
+		return
+	}
+
+	log.Warnf("Failed to handle message from %s (attempt #%d) - requeueing: %v", queueName, attempts, err)
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[rabbitMQAttemptsHeader] = int32(attempts)
+
+	err = c.publish(queueName, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: d.DeliveryMode,
+		MessageId:    d.MessageId,
+		Body:         d.Body,
+	})
+	if err != nil {
+		// Leave the original message for RabbitMQ to redeliver
+		log.Errorf("Failed to requeue message from %s: %v", queueName, err)
+		d.Nack(false, true)
+		return
+	}
+
+	d.Ack(false)
+}
+
+// deliveryAttempts returns the number of failed deliveries recorded on a message
+func deliveryAttempts(d amqp.Delivery) int {
+	switch v := d.Headers[rabbitMQAttemptsHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int16:
+		return int(v)
+	case uint8:
+		return int(v)
+	}
+	return 0
+}
+
+// safeHandle runs the handler function, converting a panic into an error
+func safeHandle(handler func([]byte) error, body []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Handler panicked: %v", r)
+		}
+	}()
+	return handler(body)
+}
+
+// deadLetters returns (up to "max") messages from the dead-letter queue, without removing them.
+func (c *rabbitMQConnection) deadLetters(max int) ([]amqp.Delivery, error) {
+
+	conn, _, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the channel returns every message we have not acknowledged back to the queue
+	defer ch.Close()
+
+	// The dead-letter queue is declared along with every other queue, but may not exist yet if nothing has been sent
+	err = c.declareDeadLetter(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []amqp.Delivery
+	for len(msgs) < max {
+		d, ok, err := ch.Get(rabbitMQDeadLetterQueue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		msgs = append(msgs, d)
+	}
+
+	return msgs, nil
+}
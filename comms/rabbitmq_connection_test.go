@@ -0,0 +1,156 @@
+/*
+    Tests for RabbitMQ message acknowledgement, dead-lettering and group bindings
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// testAcknowledger records how a delivery was acknowledged
+type testAcknowledger struct {
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+	a.requeue = requeue
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// TestRabbitMQDeliverAck tests that a message is acknowledged once it has been handled successfully
+func TestRabbitMQDeliverAck(t *testing.T) {
+	var c rabbitMQConnection
+	ack := &testAcknowledger{}
+
+	handled := false
+	c.deliver("agent1", amqp.Delivery{Acknowledger: ack, Body: []byte("{}")}, func(body []byte) error {
+		handled = true
+		return nil
+	})
+
+	if !handled {
+		t.Fatal("Handler was not called")
+	}
+	if !ack.acked || ack.nacked {
+		t.Fatal("Message was not acknowledged")
+	}
+}
+
+// TestRabbitMQDeliverDeadLetter tests that a message which fails on its last attempt is dead-lettered
+func TestRabbitMQDeliverDeadLetter(t *testing.T) {
+	var c rabbitMQConnection
+	ack := &testAcknowledger{}
+
+	d := amqp.Delivery{
+		Acknowledger: ack,
+		Headers:      amqp.Table{rabbitMQAttemptsHeader: int32(rabbitMQMaxDeliveries - 1)},
+		Body:         []byte("{}"),
+	}
+	c.deliver("agent1", d, func(body []byte) error {
+		return errors.New("task failed")
+	})
+
+	if ack.acked || !ack.nacked || ack.requeue {
+		t.Fatal("Message was not dead-lettered")
+	}
+}
+
+// TestRabbitMQDeliverRedelivered tests that a message which was in flight when its consumer died is not handed to the
+// handler again if it has run out of attempts. This prevents a message that crashes the agent from being redelivered forever.
+func TestRabbitMQDeliverRedelivered(t *testing.T) {
+	var c rabbitMQConnection
+	ack := &testAcknowledger{}
+
+	d := amqp.Delivery{
+		Acknowledger: ack,
+		Redelivered:  true,
+		Headers:      amqp.Table{rabbitMQAttemptsHeader: int32(rabbitMQMaxDeliveries - 1)},
+		Body:         []byte("{}"),
+	}
+	c.deliver("agent1", d, func(body []byte) error {
+		panic("this task crashes the agent")
+	})
+
+	if ack.acked || !ack.nacked || ack.requeue {
+		t.Fatal("Message was not dead-lettered")
+	}
+}
+
+// TestRabbitMQDeliverPanic tests that a panic in the handler is treated as a failed attempt
+func TestRabbitMQDeliverPanic(t *testing.T) {
+	err := safeHandle(func(body []byte) error {
+		panic("this task crashes the agent")
+	}, nil)
+	if err == nil {
+		t.Fatal("Expected an error from a panicking handler")
+	}
+}
+
+// testGroupExchange stands in for the group exchange, and a single group queue bound to it
+type testGroupExchange struct {
+	bindings map[string]bool // routing keys the queue is bound to
+	pending  []string        // messages waiting on the queue
+}
+
+func (e *testGroupExchange) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	e.bindings[key] = true
+	return nil
+}
+
+func (e *testGroupExchange) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	delete(e.bindings, key)
+	return nil
+}
+
+func (e *testGroupExchange) broadcast(groupName, body string) {
+	if e.bindings[groupName] {
+		e.pending = append(e.pending, body)
+	}
+}
+
+// TestRebindGroup tests that binding a group queue to the group it is already bound to (such as when the agent restarts)
+// keeps the messages waiting on it, and that moving to another group only removes the binding to the old group
+func TestRebindGroup(t *testing.T) {
+	e := &testGroupExchange{bindings: make(map[string]bool)}
+
+	if err := rebindGroup(e, "agent1.group", "", "datacenter"); err != nil {
+		t.Fatal(err)
+	}
+	e.broadcast("datacenter", "task1")
+
+	if err := rebindGroup(e, "agent1.group", "datacenter", "datacenter"); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.pending) != 1 || len(e.bindings) != 1 || !e.bindings["datacenter"] {
+		t.Fatalf("Expected rebinding to the same group to change nothing, got %+v", e)
+	}
+
+	if err := rebindGroup(e, "agent1.group", "datacenter", "branch"); err != nil {
+		t.Fatal(err)
+	}
+	e.broadcast("datacenter", "task2")
+	e.broadcast("branch", "task3")
+	if len(e.pending) != 2 || e.pending[0] != "task1" || e.pending[1] != "task3" {
+		t.Fatalf("Expected the waiting task to be kept, and only the new group's tasks to be received, got %v", e.pending)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+    Tests for the RabbitMQ connection settings
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/Mierdin/todd/config"
+)
+
+// writeTestCert creates a certificate for the provided name, signed by the parent certificate (or self-signed if parent
+// is nil), and writes it and its key to the provided directory
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// TestRabbitMQURL tests that credentials and vhosts are escaped properly, and that amqps is used when TLS is enabled
+func TestRabbitMQURL(t *testing.T) {
+	cfg := config.Comms{User: "todd", Password: "p@ss/word", Host: "rabbit.example.com", Port: "5671", Vhost: "todd", TLS: true}
+
+	uri, err := amqp.ParseURI(rabbitMQURL(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "amqps" || uri.Username != "todd" || uri.Password != "p@ss/word" || uri.Host != "rabbit.example.com" || uri.Port != 5671 || uri.Vhost != "todd" {
+		t.Fatalf("Incorrect URL: %+v", uri)
+	}
+
+	// An empty vhost should use RabbitMQ's default vhost
+	cfg.Vhost = ""
+	cfg.TLS = false
+	uri, err = amqp.ParseURI(rabbitMQURL(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "amqp" || uri.Vhost != "/" {
+		t.Fatalf("Incorrect URL: %+v", uri)
+	}
+}
+
+// TestRabbitMQTLSConfig tests that the loaded TLS configuration verifies the server against the CA bundle, and presents
+// the client certificate to a server that requires one
+func TestRabbitMQTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "todd-rabbitmq-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "rabbit.example.com", ca, caKey)
+	writeTestCert(t, dir, "agent", ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "rabbit.example.com.crt"), filepath.Join(dir, "rabbit.example.com.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	handshakes := make(chan error, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	tlsConfig, err := rabbitMQTLSConfig(config.Comms{
+		TLS:        true,
+		CACert:     filepath.Join(dir, "ca.crt"),
+		ClientCert: filepath.Join(dir, "agent.crt"),
+		ClientKey:  filepath.Join(dir, "agent.key"),
+		ServerName: "rabbit.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := <-handshakes; err != nil {
+		t.Fatalf("Server rejected the client certificate: %s", err)
+	}
+
+	// The server certificate is not valid for any other name
+	tlsConfig.ServerName = "other.example.com"
+	_, err = tls.Dial("tcp", ln.Addr().String(), tlsConfig)
+	if err == nil {
+		t.Fatal("Connected to a server with a certificate for the wrong name")
+	}
+}
@@ -0,0 +1,99 @@
+/*
+    ToDD comms - task results
+
+    Agents send a TaskResultResponse after running every task. The functions in this file allow the
+    server to send a task, and wait for the result of that specific task (correlated by task ID).
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package comms
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/responses"
+	"github.com/Mierdin/todd/agent/tasks"
+)
+
+// DefaultTaskTimeout is a reasonable amount of time to wait for the result of a task that does not involve testing
+const DefaultTaskTimeout = 30 * time.Second
+
+// ErrTaskTimeout is returned by SendTaskAndWait if no result was received for the task in time
+var ErrTaskTimeout = errors.New("Timed out waiting for task result")
+
+var (
+	taskResultsMu sync.Mutex
+	taskResults   = make(map[string]chan responses.TaskResultResponse)
+)
+
+// SendTaskAndWait sends a task onto the specified queue (usually an agent UUID), and waits up to "timeout" for the agent to
+// report the result of that task. If the agent reports that the task failed, the result is returned along with an error.
+//
+// Results are received by ListenForResponses, so this process must be listening for responses for this to work.
+func SendTaskAndWait(tc CommsPackage, queueName string, task tasks.Task, timeout time.Duration) (responses.TaskResultResponse, error) {
+
+	var result responses.TaskResultResponse
+
+	id := task.TaskID()
+	if id == "" {
+		return result, errors.New("Can't wait for the result of a task without an ID")
+	}
+
+	// Register before sending, so that we can't miss a quick result
+	results := make(chan responses.TaskResultResponse, 1)
+	taskResultsMu.Lock()
+	taskResults[id] = results
+	taskResultsMu.Unlock()
+
+	defer func() {
+		taskResultsMu.Lock()
+		delete(taskResults, id)
+		taskResultsMu.Unlock()
+	}()
+
+	err := tc.SendTask(queueName, task)
+	if err != nil {
+		return result, err
+	}
+
+	select {
+	case result = <-results:
+	case <-time.After(timeout):
+		return result, ErrTaskTimeout
+	}
+
+	if !result.Success {
+		return result, fmt.Errorf("%s task %s failed on agent %s: %s", result.TaskType, id, result.AgentUuid, result.Error)
+	}
+
+	return result, nil
+}
+
+// deliverTaskResult passes a task result to whoever is waiting for it in SendTaskAndWait. It returns false if nobody was waiting.
+func deliverTaskResult(result responses.TaskResultResponse) bool {
+
+	taskResultsMu.Lock()
+	results, ok := taskResults[result.TaskID]
+	taskResultsMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	// Only the first result is of interest (a task may be delivered, and therefore reported on, more than once)
+	select {
+	case results <- result:
+	default:
+		log.Debugf("Ignoring additional result for task %s", result.TaskID)
+	}
+
+	return true
+}
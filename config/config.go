@@ -9,7 +9,7 @@
 package config
 
 import (
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/gcfg.v1"
 )
 
@@ -29,6 +29,21 @@ type Comms struct {
 	Password string
 	Host     string
 	Port     string
+
+	// Message authentication
+	Auth          string // "hmac" or "ed25519" (disabled if empty)
+	SharedSecret  string // hmac only
+	PrivateKey    string // ed25519 only - path to this process's PEM-encoded private key
+	TrustedKeys   string // ed25519 only - path to a file containing the PEM-encoded public keys to trust
+	MaxMessageAge int    // seconds after it was sent that a signed message is accepted (defaults to 300)
+
+	// RabbitMQ connection
+	Vhost      string // defaults to "/"
+	TLS        bool   // connect using amqps
+	CACert     string // path to a PEM-encoded CA bundle used to verify the server (system roots are used if empty)
+	ClientCert string // path to a PEM-encoded client certificate, if the server requires one
+	ClientKey  string // path to the PEM-encoded private key for ClientCert
+	ServerName string // name to verify the server certificate against (defaults to Host)
 }
 
 type DB struct {
@@ -36,6 +51,7 @@ type DB struct {
 	Port         string
 	Plugin       string
 	DatabaseName string
+	Path         string // sqlite only - path to the database file (defaults to <OptDir>/server.db)
 }
 
 type TSDB struct {
@@ -43,6 +59,12 @@ type TSDB struct {
 	Port         string
 	Plugin       string
 	DatabaseName string
+	Prefix       string // graphite only - first node of every metric path (defaults to "todd")
+	BatchSize    int    // graphite only - most metrics sent in a single write (defaults to 500)
+	Path         string // file only - directory holding the results files (defaults to <OptDir>/results)
+	Format       string // file only - "jsonl" (the default) or "csv"
+	MaxSize      int    // file only - megabytes a file can grow to before a new one is started (defaults to 100, negative never rotates by size)
+	MaxAge       int    // file only - hours a file is written to before a new one is started (defaults to 24, negative never rotates by age)
 }
 
 type Testing struct {
@@ -53,6 +75,18 @@ type Grouping struct {
 	Interval int // seconds
 }
 
+type Heartbeat struct {
+	Interval       int // seconds between heartbeats sent by an agent
+	AdvertInterval int // seconds between checks of an agent's facts and assets for changes
+	StaleAfter     int // seconds without a heartbeat before an agent is considered stale
+	OfflineAfter   int // seconds without a heartbeat before an agent is considered offline, and removed
+}
+
+type History struct {
+	MaxAge  int // hours a testrun is kept after it started (negative keeps testruns forever)
+	MaxRuns int // most testruns kept - the oldest are removed first (negative keeps any number)
+}
+
 type LocalResources struct {
 	DefaultInterface string
 	OptDir           string
@@ -65,8 +99,11 @@ type Config struct {
 	Comms          Comms
 	DB             DB
 	TSDB           TSDB
+	Sink           map[string]*TSDB // more result sinks, as [Sink "<name>"] sections with the same options as [TSDB]
 	Testing        Testing
 	Grouping       Grouping
+	Heartbeat      Heartbeat
+	History        History
 	LocalResources LocalResources
 }
 
@@ -79,5 +116,29 @@ func GetConfig(cfgpath string) (Config, error) {
 		log.Error(err)
 	}
 
+	setDefaults(&cfg)
+
 	return cfg, err
 }
+
+// setDefaults fills in any options that were left out of the configuration file, and have a sensible default
+func setDefaults(cfg *Config) {
+	if cfg.Heartbeat.Interval == 0 {
+		cfg.Heartbeat.Interval = 15
+	}
+	if cfg.Heartbeat.AdvertInterval == 0 {
+		cfg.Heartbeat.AdvertInterval = 60
+	}
+	if cfg.Heartbeat.StaleAfter == 0 {
+		cfg.Heartbeat.StaleAfter = 3 * cfg.Heartbeat.Interval
+	}
+	if cfg.Heartbeat.OfflineAfter == 0 {
+		cfg.Heartbeat.OfflineAfter = 8 * cfg.Heartbeat.Interval
+	}
+	if cfg.History.MaxAge == 0 {
+		cfg.History.MaxAge = 30 * 24
+	}
+	if cfg.History.MaxRuns == 0 {
+		cfg.History.MaxRuns = 1000
+	}
+}
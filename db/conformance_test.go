@@ -0,0 +1,66 @@
+/*
+    Runs the database plugin conformance suite against each plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/db/dbtest"
+	"github.com/Mierdin/todd/db/etcdtest"
+	"github.com/Mierdin/todd/hostresources"
+)
+
+// newTestDB returns a function that creates a database using the provided plugin, for use with dbtest.Conformance
+func newTestDB(configure func(t *testing.T, cfg *config.Config)) func(t *testing.T) db.DatabasePackage {
+	return func(t *testing.T) db.DatabasePackage {
+		var cfg config.Config
+		configure(t, &cfg)
+
+		tdb, err := db.NewToddDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tdb
+	}
+}
+
+func TestMemoryConformance(t *testing.T) {
+	dbtest.Conformance(t, newTestDB(func(t *testing.T, cfg *config.Config) {
+		cfg.DB.Plugin = "memory"
+		cfg.DB.DatabaseName = hostresources.GenerateUuid()
+	}))
+}
+
+func TestSqliteConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "todd-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbtest.Conformance(t, newTestDB(func(t *testing.T, cfg *config.Config) {
+		cfg.DB.Plugin = "sqlite"
+		cfg.DB.Path = dir + "/" + hostresources.GenerateUuid() + ".db"
+	}))
+}
+
+func TestEtcdConformance(t *testing.T) {
+	host, port, stop := etcdtest.Start(t)
+	defer stop()
+
+	dbtest.Conformance(t, newTestDB(func(t *testing.T, cfg *config.Config) {
+		cfg.DB.Plugin = "etcd"
+		cfg.DB.Host = host
+		cfg.DB.Port = port
+	}))
+}
@@ -12,6 +12,8 @@ package db
 
 import (
 	"errors"
+	"sort"
+	"time"
 
 	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/config"
@@ -38,9 +40,21 @@ type DatabasePackage interface {
 	// (agent advertisement to remove)
 	RemoveAgent(defs.AgentAdvert) error
 
-	SetObject(objects.ToddObject) error
+	// (object, author) - every change to an object is also kept as a new revision of it
+	SetObject(objects.ToddObject, string) error
 	GetObjects(string) ([]objects.ToddObject, error)
-	DeleteObject(string, string) error
+
+	// (label, type, author)
+	DeleteObject(string, string, string) error
+
+	// (type, label) - returns every revision of the object, oldest first
+	GetObjectRevisions(string, string) ([]objects.ObjectRevision, error)
+
+	// (type, label, revisions) - replaces every revision of the object, such as when restoring a backup
+	SetObjectRevisions(string, string, []objects.ObjectRevision) error
+
+	// (type) - returns the labels of every object of this type that has revisions, including deleted objects, sorted
+	GetRevisedObjects(string) ([]string, error)
 
 	GetGroupMap() (map[string]string, error)
 	SetGroupMap(map[string]string) error
@@ -49,10 +63,25 @@ type DatabasePackage interface {
 	InitTestRun(string, map[string]map[string]string) error
 	SetAgentTestStatus(string, string, string) error
 	GetTestStatus(string) (map[string]string, error)
+
+	// (testrun UUID, channel that ends the watch when written to) - the returned channel receives the status of every agent
+	// in the testrun when the watch starts, and again every time it changes. It is closed once the watch has ended.
+	WatchTestStatus(string, *chan bool) (<-chan map[string]string, error)
+
 	SetAgentTestData(string, string, string) error
 	GetAgentTestData(string, string) (map[string]string, error)
 	WriteCleanTestData(string, string) error
 	GetCleanTestData(string) (string, error)
+
+	// Testrun history
+	SetTestRunRecord(defs.TestRunRecord) error
+	GetTestRunRecord(string) (*defs.TestRunRecord, error)
+
+	// Returns all records, most recently started first
+	GetTestRunRecords() ([]defs.TestRunRecord, error)
+
+	// (testrun UUID) - removes the testrun's record, along with its status and data
+	DeleteTestRun(string) error
 }
 
 // NewToddDB will create a new instance of toddDatabase, and load the desired
@@ -66,9 +95,46 @@ func NewToddDB(cfg config.Config) (DatabasePackage, error) {
 	switch cfg.DB.Plugin {
 	case "etcd":
 		tdb = newEtcdDB(cfg)
+	case "etcdv3":
+		etcdv3db, err := newEtcdV3DB(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tdb = etcdv3db
+	case "memory":
+		tdb = newMemoryDB(cfg)
+	case "sqlite":
+		sqlitedb, err := newSqliteDB(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tdb = sqlitedb
 	default:
 		return nil, ErrInvalidDBPlugin
 	}
 
 	return tdb, nil
 }
+
+// agentTTL returns how long an agent record should be kept after it was last written. The server removes agents once they
+// have gone offline (see server/agentstate), so this only matters if the server stops doing so. Zero means no expiry.
+func agentTTL(cfg config.Config) time.Duration {
+	return time.Duration(cfg.Heartbeat.OfflineAfter) * time.Second
+}
+
+// testRunTTL returns how long a testrun's status and data should be kept. Testruns are removed along with their history
+// record by the server (see testrun.PruneHistory), so like agentTTL, this only matters if the server stops doing so.
+// Zero means no expiry.
+func testRunTTL(cfg config.Config) time.Duration {
+	if cfg.History.MaxAge < 0 {
+		return 0
+	}
+	return time.Duration(cfg.History.MaxAge) * time.Hour
+}
+
+// sortTestRunRecords sorts testrun records so that the most recently started testrun comes first
+func sortTestRunRecords(records []defs.TestRunRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Started.After(records[j].Started)
+	})
+}
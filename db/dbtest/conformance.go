@@ -0,0 +1,702 @@
+/*
+    ToDD database plugin conformance tests
+
+    Every DatabasePackage implementation is expected to behave the same way, so that the rest of ToDD doesn't
+    need to know which plugin is in use. Plugins should run this suite from their tests to prove that they do.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package dbtest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/hostresources"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// Conformance runs every conformance test against the database returned by newDB. newDB is called once per test, and
+// should return a database that doesn't share agents or testruns with the others. Objects and the group map may be shared
+// (as they are in a single etcd instance), since these tests only make assertions about the objects they create.
+func Conformance(t *testing.T, newDB func(t *testing.T) db.DatabasePackage) {
+	tests := []struct {
+		name string
+		test func(*testing.T, db.DatabasePackage)
+	}{
+		{"Agents", testAgents},
+		{"Objects", testObjects},
+		{"ObjectRevisions", testObjectRevisions},
+		{"GroupMap", testGroupMap},
+		{"TestRun", testTestRun},
+		{"MissingTestRun", testMissingTestRun},
+		{"WatchTestStatus", testWatchTestStatus},
+		{"History", testHistory},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := newDB(t)
+			if err := tdb.Init(); err != nil {
+				t.Fatal(err)
+			}
+			tc.test(t, tdb)
+		})
+	}
+}
+
+// testAgents checks that agents can be set, updated, retrieved and removed, and that missing agents are reported with db.ErrNotExist
+func testAgents(t *testing.T, tdb db.DatabasePackage) {
+
+	agents, err := tdb.GetAgents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agents == nil || len(agents) != 0 {
+		t.Fatalf("Expected an empty list of agents after Init, got %+v", agents)
+	}
+
+	if _, err = tdb.GetAgent("missing"); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist for a missing agent, got %v", err)
+	}
+	if err = tdb.RemoveAgent(defs.AgentAdvert{Uuid: "missing"}); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist removing a missing agent, got %v", err)
+	}
+
+	for _, uuid := range []string{"agent1", "agent2"} {
+		err = tdb.SetAgent(defs.AgentAdvert{
+			Uuid:        uuid,
+			DefaultAddr: "10.0.0.1",
+			Facts:       map[string][]string{"Hostname": {uuid}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Setting an agent again replaces it
+	err = tdb.SetAgent(defs.AgentAdvert{Uuid: "agent1", DefaultAddr: "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := tdb.GetAgent("agent1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Uuid != "agent1" || agent.DefaultAddr != "10.0.0.2" || len(agent.Facts) != 0 {
+		t.Fatalf("Retrieved incorrect agent: %+v", agent)
+	}
+
+	agents, err = tdb.GetAgents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 {
+		t.Fatalf("Expected 2 agents, got %+v", agents)
+	}
+
+	err = tdb.RemoveAgent(*agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tdb.GetAgent("agent1"); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist for a removed agent, got %v", err)
+	}
+
+	// Init removes all agents
+	err = tdb.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents, err = tdb.GetAgents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 0 {
+		t.Fatalf("Expected Init to remove all agents, got %+v", agents)
+	}
+}
+
+// findObject returns the object with the provided label from a list of objects, or nil
+func findObject(objs []objects.ToddObject, label string) objects.ToddObject {
+	for _, obj := range objs {
+		if obj.GetLabel() == label {
+			return obj
+		}
+	}
+	return nil
+}
+
+// testObjects checks that objects are stored by type and label, and are returned as their specific object type
+func testObjects(t *testing.T, tdb db.DatabasePackage) {
+
+	if _, err := tdb.GetObjects(""); err == nil {
+		t.Fatal("Expected an error retrieving objects without a type")
+	}
+
+	objs, err := tdb.GetObjects("conformancetype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objs == nil || len(objs) != 0 {
+		t.Fatalf("Expected an empty list of objects for an unused type, got %+v", objs)
+	}
+
+	label := fmt.Sprintf("conformance-%s", hostresources.GenerateUuid())
+
+	var group objects.GroupObject
+	group.Type = "group"
+	group.Label = label
+	group.Spec.Group = label
+	group.Spec.Matches = []map[string]string{{"hostname": "todd-agent-1"}}
+
+	err = tdb.SetObject(group, "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Setting an object with the same type and label replaces it
+	group.Spec.Matches = []map[string]string{{"hostname": "todd-agent-2"}}
+	err = tdb.SetObject(group, "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err = tdb.GetObjects("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, ok := findObject(objs, label).(objects.GroupObject)
+	if !ok {
+		t.Fatalf("Group %s was not returned as a GroupObject: %+v", label, objs)
+	}
+	if len(found.Spec.Matches) != 1 || found.Spec.Matches[0]["hostname"] != "todd-agent-2" {
+		t.Fatalf("Retrieved incorrect group: %+v", found)
+	}
+
+	// Objects of other types are kept separate
+	objs, err = tdb.GetObjects("testrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findObject(objs, label) != nil {
+		t.Fatalf("Group %s was returned as a testrun", label)
+	}
+
+	err = tdb.DeleteObject(label, "group", "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err = tdb.GetObjects("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findObject(objs, label) != nil {
+		t.Fatalf("Group %s was not deleted", label)
+	}
+
+	if err = tdb.DeleteObject(label, "group", "conformance"); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist deleting a missing object, got %v", err)
+	}
+}
+
+// testObjectRevisions checks that every change to an object is kept as a numbered revision, including its deletion, and
+// that revisions are numbered without gaps or duplicates when an object is changed concurrently
+func testObjectRevisions(t *testing.T, tdb db.DatabasePackage) {
+
+	label := fmt.Sprintf("conformance-%s", hostresources.GenerateUuid())
+
+	revs, err := tdb.GetObjectRevisions("group", label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 0 {
+		t.Fatalf("Expected no revisions of a missing object, got %+v", revs)
+	}
+
+	var group objects.GroupObject
+	group.Type = "group"
+	group.Label = label
+	group.Spec.Group = label
+	group.Spec.Matches = []map[string]string{{"hostname": "todd-agent-1"}}
+
+	if err = tdb.SetObject(group, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	group.Spec.Matches = []map[string]string{{"hostname": "todd-agent-2"}}
+	if err = tdb.SetObject(group, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tdb.DeleteObject(label, "group", "carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An object whose label starts with the same characters has its own revisions
+	other := group
+	other.Label = label + "-other"
+	if err = tdb.SetObject(other, "dave"); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err = tdb.GetObjectRevisions("group", label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 {
+		t.Fatalf("Expected 3 revisions, got %+v", revs)
+	}
+	for i, author := range []string{"alice", "bob", "carol"} {
+		if revs[i].Revision != i+1 || revs[i].Author != author || revs[i].Time.IsZero() {
+			t.Fatalf("Revision %d is incorrect: %+v", i+1, revs[i])
+		}
+	}
+	if revs[0].Deleted || revs[1].Deleted || !revs[2].Deleted {
+		t.Fatalf("Only the last revision should be a deletion: %+v", revs)
+	}
+
+	obj, err := revs[0].ParseObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, ok := obj.(objects.GroupObject)
+	if !ok || len(found.Spec.Matches) != 1 || found.Spec.Matches[0]["hostname"] != "todd-agent-1" {
+		t.Fatalf("Retrieved incorrect object for revision 1: %+v", obj)
+	}
+
+	// Deleted objects still have revisions, and are listed along with the objects that haven't been deleted
+	labels, err := tdb.GetRevisedObjects("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := sort.SearchStrings(labels, label); !sort.StringsAreSorted(labels) || i+1 >= len(labels) ||
+		labels[i] != label || labels[i+1] != other.Label {
+		t.Fatalf("Expected %s and %s in the sorted labels of revised objects, got %v", label, other.Label, labels)
+	}
+
+	// A failed deletion isn't a revision
+	if err = tdb.DeleteObject(label, "group", "carol"); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist deleting a missing object, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- tdb.SetObject(group, "erin")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revs, err = tdb.GetObjectRevisions("group", label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 13 {
+		t.Fatalf("Expected 13 revisions, got %d", len(revs))
+	}
+	for i, rev := range revs {
+		if rev.Revision != i+1 {
+			t.Fatalf("Expected revision %d, got %d", i+1, rev.Revision)
+		}
+	}
+
+	// Revisions can be replaced as a whole, and are returned exactly as they were set
+	restored := revs[:3]
+	if err = tdb.SetObjectRevisions("group", other.Label, restored); err != nil {
+		t.Fatal(err)
+	}
+	revs, err = tdb.GetObjectRevisions("group", other.Label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != len(restored) {
+		t.Fatalf("Expected %d revisions, got %+v", len(restored), revs)
+	}
+	for i := range revs {
+		if revs[i].Revision != restored[i].Revision || revs[i].Author != restored[i].Author || !revs[i].Time.Equal(restored[i].Time) ||
+			revs[i].Deleted != restored[i].Deleted || string(revs[i].Object) != string(restored[i].Object) {
+			t.Fatalf("Revision %d was not restored correctly: %+v", i+1, revs[i])
+		}
+	}
+}
+
+// testGroupMap checks that the group map is replaced as a whole every time it is set
+func testGroupMap(t *testing.T, tdb db.DatabasePackage) {
+
+	err := tdb.SetGroupMap(map[string]string{"agent1": "group1", "agent2": "group2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tdb.SetGroupMap(map[string]string{"agent1": "group2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groupmap, err := tdb.GetGroupMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groupmap) != 1 || groupmap["agent1"] != "group2" {
+		t.Fatalf("Retrieved incorrect group map: %v", groupmap)
+	}
+
+	err = tdb.SetGroupMap(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupmap, err = tdb.GetGroupMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groupmap == nil || len(groupmap) != 0 {
+		t.Fatalf("Expected an empty group map, got %v", groupmap)
+	}
+}
+
+// testTestRun checks the lifecycle of a testrun - initialization, status updates, test data, and clean test data
+func testTestRun(t *testing.T, tdb db.DatabasePackage) {
+
+	testUUID := hostresources.GenerateUuid()
+
+	err := tdb.InitTestRun(testUUID, map[string]map[string]string{
+		"sources": {"agent1": "src", "agent2": "src"},
+		"targets": {"agent3": "dst"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := tdb.GetTestStatus(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 3 || status["agent1"] != "init" || status["agent3"] != "init" {
+		t.Fatalf("Expected every agent to start with status \"init\", got %v", status)
+	}
+
+	err = tdb.SetAgentTestStatus(testUUID, "agent1", "finished")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = tdb.GetTestStatus(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status["agent1"] != "finished" || status["agent2"] != "init" {
+		t.Fatalf("Retrieved incorrect test status: %v", status)
+	}
+
+	for _, agent := range []string{"agent1", "agent2", "agent3"} {
+		err = tdb.SetAgentTestData(testUUID, agent, fmt.Sprintf(`{"data":"%s"}`, agent))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the agents in the requested group are returned
+	data, err := tdb.GetAgentTestData(testUUID, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data["agent1"] != `{"data":"agent1"}` || data["agent2"] != `{"data":"agent2"}` {
+		t.Fatalf("Retrieved incorrect test data: %v", data)
+	}
+
+	if _, err = tdb.GetCleanTestData(testUUID); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist before clean test data is written, got %v", err)
+	}
+
+	err = tdb.WriteCleanTestData(testUUID, `{"clean":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean, err := tdb.GetCleanTestData(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clean != `{"clean":true}` {
+		t.Fatalf("Retrieved incorrect clean test data: %s", clean)
+	}
+}
+
+// testMissingTestRun checks how each testrun function behaves for a testrun that doesn't exist
+func testMissingTestRun(t *testing.T, tdb db.DatabasePackage) {
+
+	testUUID := hostresources.GenerateUuid()
+
+	status, err := tdb.GetTestStatus(testUUID)
+	if err != nil {
+		t.Fatalf("Expected no error retrieving the status of a missing testrun, got %v", err)
+	}
+	if status == nil || len(status) != 0 {
+		t.Fatalf("Expected an empty status for a missing testrun, got %v", status)
+	}
+
+	if _, err = tdb.GetAgentTestData(testUUID, "src"); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist retrieving test data of a missing testrun, got %v", err)
+	}
+
+	if _, err = tdb.GetCleanTestData(testUUID); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist retrieving clean test data of a missing testrun, got %v", err)
+	}
+}
+
+// waitForStatus receives status snapshots from a watch until one satisfies done, failing the test if none does within a few seconds
+func waitForStatus(t *testing.T, updates <-chan map[string]string, done func(map[string]string) bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case status, ok := <-updates:
+			if !ok {
+				t.Fatal("Watch ended unexpectedly")
+			}
+			if done(status) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the expected test status")
+		}
+	}
+}
+
+// testWatchTestStatus checks that a watch reports the current status of a testrun, follows every change to it, and ends when asked to
+func testWatchTestStatus(t *testing.T, tdb db.DatabasePackage) {
+
+	testUUID := hostresources.GenerateUuid()
+
+	// Watching a testrun that hasn't been created yet is allowed, since the watch may be set up first
+	stop := make(chan bool, 1)
+	updates, err := tdb.WatchTestStatus(testUUID, &stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, updates, func(status map[string]string) bool {
+		if len(status) != 0 {
+			t.Fatalf("Expected an empty status for a testrun that doesn't exist, got %v", status)
+		}
+		return true
+	})
+
+	err = tdb.InitTestRun(testUUID, map[string]map[string]string{
+		"sources": {"agent1": "src"},
+		"targets": {"agent2": "dst"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, updates, func(status map[string]string) bool {
+		return len(status) == 2 && status["agent1"] == "init" && status["agent2"] == "init"
+	})
+
+	for _, s := range []string{"ready", "testing", "finished"} {
+		err = tdb.SetAgentTestStatus(testUUID, "agent1", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, updates, func(status map[string]string) bool {
+			return status["agent1"] == s && status["agent2"] == "init"
+		})
+	}
+
+	// A new watch starts with the current status
+	otherStop := make(chan bool, 1)
+	otherUpdates, err := tdb.WatchTestStatus(testUUID, &otherStop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, otherUpdates, func(status map[string]string) bool {
+		if status["agent1"] != "finished" || status["agent2"] != "init" {
+			t.Fatalf("Expected a new watch to start with the current status, got %v", status)
+		}
+		return true
+	})
+	otherStop <- true
+
+	// Once stopped, the watch channel is closed
+	stop <- true
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Watch was not closed after being stopped")
+		}
+	}
+}
+
+// testHistory checks that testrun records can be stored, updated, listed in order and removed along with the testrun's data
+func testHistory(t *testing.T, tdb db.DatabasePackage) {
+
+	if _, err := tdb.GetTestRunRecord("missing"); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist for a missing testrun record, got %v", err)
+	}
+	if err := tdb.DeleteTestRun("missing"); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist deleting a missing testrun, got %v", err)
+	}
+
+	// Records are started in the future, so that they're listed before any left behind by other tests
+	start := time.Now().Add(time.Hour).UTC()
+	var uuids []string
+	for i := 0; i < 3; i++ {
+		record := defs.TestRunRecord{
+			Uuid:      hostresources.GenerateUuid(),
+			Label:     "conformance",
+			Overrides: map[string]string{"SourceArgs": "-c 1"},
+			User:      "tester",
+			Agents:    map[string]map[string]string{"sources": {"agent1": "src"}},
+			State:     defs.TestRunRunning,
+			Started:   start.Add(time.Duration(i) * time.Minute),
+		}
+		record.Object.Label = "conformance"
+		record.Object.Spec.Source = map[string]string{"name": "src"}
+
+		err := tdb.SetTestRunRecord(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uuids = append(uuids, record.Uuid)
+	}
+
+	// Records are updated as the testrun progresses
+	record, err := tdb.GetTestRunRecord(uuids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Phases = append(record.Phases, defs.TestRunPhase{Name: "testing", Start: start, End: start.Add(time.Second)})
+	record.State = defs.TestRunFinished
+	record.Ended = start.Add(time.Second)
+	err = tdb.SetTestRunRecord(*record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err = tdb.GetTestRunRecord(uuids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != defs.TestRunFinished || len(record.Phases) != 1 || !record.Phases[0].End.Equal(start.Add(time.Second)) ||
+		record.Overrides["SourceArgs"] != "-c 1" || record.Agents["sources"]["agent1"] != "src" || record.Object.Spec.Source["name"] != "src" {
+		t.Fatalf("Retrieved incorrect testrun record: %+v", record)
+	}
+
+	records, err := tdb.GetTestRunRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < 3 || records[0].Uuid != uuids[2] || records[1].Uuid != uuids[1] || records[2].Uuid != uuids[0] {
+		t.Fatalf("Expected the most recently started testruns first, got %+v", records)
+	}
+
+	// Deleting a testrun removes its data as well as its record
+	err = tdb.InitTestRun(uuids[0], map[string]map[string]string{"sources": {"agent1": "src"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tdb.WriteCleanTestData(uuids[0], "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tdb.DeleteTestRun(uuids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tdb.GetTestRunRecord(uuids[0]); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist for a deleted testrun record, got %v", err)
+	}
+	if _, err = tdb.GetCleanTestData(uuids[0]); err != db.ErrNotExist {
+		t.Fatalf("Expected ErrNotExist for the clean data of a deleted testrun, got %v", err)
+	}
+	status, err := tdb.GetTestStatus(uuids[0])
+	if err != nil || len(status) != 0 {
+		t.Fatalf("Expected no status for a deleted testrun, got %v, %v", status, err)
+	}
+
+	for _, uuid := range uuids[1:] {
+		err = tdb.DeleteTestRun(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testConcurrent checks that the database can be used from many goroutines at once, as the server does while a testrun is in progress
+func testConcurrent(t *testing.T, tdb db.DatabasePackage) {
+
+	testUUID := hostresources.GenerateUuid()
+
+	testAgentMap := map[string]map[string]string{"sources": {}}
+	for i := 0; i < 20; i++ {
+		testAgentMap["sources"][fmt.Sprintf("agent%d", i)] = "src"
+	}
+	err := tdb.InitTestRun(testUUID, testAgentMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+
+			errs <- tdb.SetAgent(defs.AgentAdvert{Uuid: uuid})
+			errs <- tdb.SetAgentTestStatus(testUUID, uuid, "finished")
+			errs <- tdb.SetAgentTestData(testUUID, uuid, "{}")
+			_, err := tdb.GetTestStatus(testUUID)
+			errs <- err
+		}(fmt.Sprintf("agent%d", i))
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agents, err := tdb.GetAgents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := tdb.GetTestStatus(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := tdb.GetAgentTestData(testUUID, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 20 || len(status) != 20 || len(data) != 20 {
+		t.Fatalf("Expected 20 of each, got %d agents, %d statuses and %d sets of test data", len(agents), len(status), len(data))
+	}
+	for agent, s := range status {
+		if s != "finished" {
+			t.Fatalf("Agent %s has status %s", agent, s)
+		}
+	}
+}
@@ -12,11 +12,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/etcd/client"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 
 	"github.com/Mierdin/todd/agent/defs"
@@ -50,10 +51,10 @@ type etcdDB struct {
 
 func (etcddb *etcdDB) Init() error {
 
-	_, err := etcddb.keysAPI.Get(context.Background(), "/todd/agents", &client.GetOptions{Recursive: true})
+	_, err := etcddb.keysAPI.Get(context.Background(), etcdAgentsDir, &client.GetOptions{Recursive: true})
 	if err == nil {
 		log.Info("Deleting '/todd/agents' key")
-		_, err = etcddb.keysAPI.Delete(context.Background(), "/todd/agents", &client.DeleteOptions{Recursive: true, Dir: true})
+		_, err = etcddb.keysAPI.Delete(context.Background(), etcdAgentsDir, &client.DeleteOptions{Recursive: true, Dir: true})
 		if err != nil {
 			return err
 		}
@@ -62,7 +63,23 @@ func (etcddb *etcdDB) Init() error {
 	// TODO(mierdin): Consider deleting the entire /todd key here, and recreating all of the various subkeys, just to start from scratch.
 	// Shouldn't need any previous data if you restart the server.
 
-	return nil
+	return migrateSchema(etcddb)
+}
+
+func (etcddb *etcdDB) getSchemaVersion() (int, error) {
+	resp, err := etcddb.keysAPI.Get(context.Background(), etcdSchemaKey, nil)
+	if notFoundToErrNotExist(err) == ErrNotExist {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(resp.Node.Value)
+}
+
+func (etcddb *etcdDB) setSchemaVersion(version int) error {
+	_, err := etcddb.keysAPI.Set(context.Background(), etcdSchemaKey, strconv.Itoa(version), nil)
+	return err
 }
 
 // SetAgent will ingest an agent advertisement, and update or insert the agent record
@@ -76,33 +93,32 @@ func (etcddb *etcdDB) SetAgent(adv defs.AgentAdvert) error {
 		return err
 	}
 
-	// TODO(mierdin): TTL needs to be user-configurable
-	resp, err := etcddb.keysAPI.Set(
-		context.Background(),                      // context
-		fmt.Sprintf("/todd/agents/%s", adv.Uuid),  // key
-		string(advJSON),                           // value
-		&client.SetOptions{TTL: time.Second * 30}, //optional args
+	_, err = etcddb.keysAPI.Set(
+		context.Background(),   // context
+		etcdAgentKey(adv.Uuid), // key
+		string(advJSON),        // value
+		&client.SetOptions{TTL: agentTTL(etcddb.config)}, //optional args
 	)
 	if err != nil {
 		log.Error("Problem setting agent in etcd")
 		return err
 	}
 
-	log.Infof("Agent set in etcd. This advertisement is good until %s", resp.Node.Expiration)
+	log.Infof("Agent set in etcd")
 
 	return nil
 }
 
 // GetAgent will retrieve a specific agent from the database by UUID
 func (etcddb *etcdDB) GetAgent(uuid string) (*defs.AgentAdvert, error) {
-	keyStr := fmt.Sprintf("/todd/agents/%s", uuid)
+	keyStr := etcdAgentKey(uuid)
 
 	log.Printf("Getting %q key value", keyStr)
 
 	resp, err := etcddb.keysAPI.Get(context.Background(), keyStr, &client.GetOptions{Recursive: true})
 	if err != nil {
 		log.Errorf("Agent %s not found.", uuid)
-		return nil, err
+		return nil, notFoundToErrNotExist(err)
 	}
 
 	log.Debugf("Etcd 'get' is done. Metadata is %q\n", resp)
@@ -126,9 +142,6 @@ func nodeToAgentAdvert(node *client.Node, expectedUUID string) (*defs.AgentAdver
 		return nil, err
 	}
 
-	// We want to use the TTLDuration field from etcd for simplicity
-	adv.Expires = node.TTLDuration()
-
 	// The etcd key should always match the inner JSON
 	if expectedUUID != adv.Uuid {
 		return nil, errors.New("UUID in etcd does not match inner JSON text")
@@ -137,6 +150,15 @@ func nodeToAgentAdvert(node *client.Node, expectedUUID string) (*defs.AgentAdver
 	return adv, nil
 }
 
+// notFoundToErrNotExist returns ErrNotExist if the provided error indicates that a key was not found in etcd, so that
+// callers can check for missing values the same way regardless of the database plugin. Other errors are returned unchanged.
+func notFoundToErrNotExist(err error) error {
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		return ErrNotExist
+	}
+	return err
+}
+
 // GetAgents will retrieve all agents from the database
 func (etcddb *etcdDB) GetAgents() ([]defs.AgentAdvert, error) {
 
@@ -144,7 +166,7 @@ func (etcddb *etcdDB) GetAgents() ([]defs.AgentAdvert, error) {
 
 	log.Print("Getting /todd/agents' key value")
 
-	keyStr := "/todd/agents"
+	keyStr := etcdAgentsDir
 
 	resp, err := etcddb.keysAPI.Get(context.Background(), keyStr, &client.GetOptions{Recursive: true})
 	if err != nil {
@@ -161,7 +183,7 @@ func (etcddb *etcdDB) GetAgents() ([]defs.AgentAdvert, error) {
 	for _, node := range resp.Node.Nodes {
 
 		// Extract UUID from key string
-		uuid := strings.Replace(node.Key, "/todd/agents/", "", 1)
+		uuid := strings.Replace(node.Key, etcdAgentsDir+"/", "", 1)
 
 		adv, err := nodeToAgentAdvert(node, uuid)
 		if err != nil {
@@ -176,12 +198,12 @@ func (etcddb *etcdDB) GetAgents() ([]defs.AgentAdvert, error) {
 
 }
 
-// RemoveAgent will delete an agent advertisement present in etcd. This function exists for the rare situation when
-// an Agent needs to be removed immediately, as opposed to simply waiting for the TTL to expire.
+// RemoveAgent will delete an agent advertisement present in etcd. This is done by the server once an agent has stopped
+// sending heartbeats for long enough to be considered offline.
 func (etcddb *etcdDB) RemoveAgent(adv defs.AgentAdvert) error {
-	_, err := etcddb.keysAPI.Delete(context.Background(), fmt.Sprintf("/todd/agents/%s", adv.Uuid), &client.DeleteOptions{Recursive: true, Dir: true})
+	_, err := etcddb.keysAPI.Delete(context.Background(), etcdAgentKey(adv.Uuid), &client.DeleteOptions{Recursive: true, Dir: true})
 	if err != nil {
-		return err
+		return notFoundToErrNotExist(err)
 	}
 
 	log.Infof("Removed '/todd/agents/%s' key", adv.Uuid)
@@ -202,7 +224,7 @@ func (etcddb *etcdDB) GetObjects(objType string) ([]objects.ToddObject, error) {
 	}
 
 	//Construct a path to the key based on the provided type
-	keyStr := fmt.Sprintf("/todd/objects/%s/", objType)
+	keyStr := etcdObjectsDir(objType)
 
 	log.Info("Accessing objects at", keyStr)
 
@@ -240,10 +262,10 @@ func (etcddb *etcdDB) GetObjects(objType string) ([]objects.ToddObject, error) {
 	return retObj, nil
 }
 
-// SetObject will insert or update a ToddObject within etcd
-func (etcddb *etcdDB) SetObject(tobj objects.ToddObject) error {
+// SetObject will insert or update a ToddObject within etcd, and keep it as a new revision
+func (etcddb *etcdDB) SetObject(tobj objects.ToddObject, author string) error {
 
-	objJSON, err := json.Marshal(tobj)
+	rev, err := objects.NewObjectRevision(tobj, author)
 	if err != nil {
 		return err
 	}
@@ -252,12 +274,12 @@ func (etcddb *etcdDB) SetObject(tobj objects.ToddObject) error {
 
 	// Here, we set the key string, using the following format:
 	// /todd/objects/<type>/<label(name)>
-	keyStr := fmt.Sprintf("/todd/objects/%s/%s", tobj.GetType(), tobj.GetLabel())
+	keyStr := etcdObjectKey(tobj.GetType(), tobj.GetLabel())
 
 	_, err = etcddb.keysAPI.Set(
 		context.Background(), // context
 		keyStr,               // key
-		string(objJSON),      // value
+		string(rev.Object),   // value
 		nil,                  //optional args
 	)
 	if err != nil {
@@ -265,14 +287,32 @@ func (etcddb *etcdDB) SetObject(tobj objects.ToddObject) error {
 		return err
 	}
 
+	err = etcddb.addObjectRevision(tobj.GetType(), tobj.GetLabel(), rev)
+	if err != nil {
+		log.Error("Problem setting object revision in etcd")
+		return err
+	}
+
 	log.Infof("Wrote new Todd Object to etcd: %s/%s", tobj.GetType(), tobj.GetLabel())
 	return nil
 }
 
-// DeleteObject will delete a ToddObject from etcd
-func (etcddb *etcdDB) DeleteObject(label string, objtype string) error {
-	_, err := etcddb.keysAPI.Delete(context.Background(), fmt.Sprintf("/todd/objects/%s/%s", objtype, label), &client.DeleteOptions{Recursive: true, Dir: true})
+// DeleteObject will delete a ToddObject from etcd, and keep its deletion as a new revision
+func (etcddb *etcdDB) DeleteObject(label string, objtype string, author string) error {
+
+	rev, err := objects.NewObjectRevision(nil, author)
+	if err != nil {
+		return err
+	}
+
+	_, err = etcddb.keysAPI.Delete(context.Background(), etcdObjectKey(objtype, label), &client.DeleteOptions{Recursive: true, Dir: true})
+	if err != nil {
+		return notFoundToErrNotExist(err)
+	}
+
+	err = etcddb.addObjectRevision(objtype, label, rev)
 	if err != nil {
+		log.Error("Problem setting object revision in etcd")
 		return err
 	}
 
@@ -281,6 +321,119 @@ func (etcddb *etcdDB) DeleteObject(label string, objtype string) error {
 	return nil
 }
 
+// addObjectRevision numbers a revision and adds it to the object's revisions, under
+// /todd/objectrevisions/<type>/<label>/<revision>. The v2 API has no transactions, so the revision is written after the
+// object itself, and if another server takes the same revision number first, the next number is tried.
+func (etcddb *etcdDB) addObjectRevision(objType, label string, rev objects.ObjectRevision) error {
+	for {
+		revs, err := etcddb.GetObjectRevisions(objType, label)
+		if err != nil {
+			return err
+		}
+		rev.Revision = 1
+		if len(revs) > 0 {
+			rev.Revision = revs[len(revs)-1].Revision + 1
+		}
+
+		revJSON, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+
+		_, err = etcddb.keysAPI.Set(
+			context.Background(),
+			etcdObjectRevisionKey(objType, label, rev.Revision),
+			string(revJSON),
+			&client.SetOptions{PrevExist: client.PrevNoExist},
+		)
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+			continue
+		}
+		return err
+	}
+}
+
+// GetObjectRevisions retrieves every revision of a ToddObject, oldest first
+func (etcddb *etcdDB) GetObjectRevisions(objType, label string) ([]objects.ObjectRevision, error) {
+
+	revs := []objects.ObjectRevision{}
+
+	resp, err := etcddb.keysAPI.Get(
+		context.Background(),
+		etcdObjectRevisionsDir(objType, label),
+		&client.GetOptions{Recursive: true, Sort: true},
+	)
+	if err != nil {
+		if notFoundToErrNotExist(err) == ErrNotExist {
+			return revs, nil
+		}
+		return nil, err
+	}
+
+	for _, node := range resp.Node.Nodes {
+		var rev objects.ObjectRevision
+		err = json.Unmarshal([]byte(node.Value), &rev)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+
+	return revs, nil
+}
+
+// SetObjectRevisions replaces every revision of a ToddObject
+func (etcddb *etcdDB) SetObjectRevisions(objType, label string, revs []objects.ObjectRevision) error {
+
+	_, err := etcddb.keysAPI.Delete(
+		context.Background(),
+		etcdObjectRevisionsDir(objType, label),
+		&client.DeleteOptions{Recursive: true, Dir: true},
+	)
+	if err != nil && notFoundToErrNotExist(err) != ErrNotExist {
+		return err
+	}
+
+	for _, rev := range revs {
+		revJSON, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+
+		_, err = etcddb.keysAPI.Set(context.Background(), etcdObjectRevisionKey(objType, label, rev.Revision), string(revJSON), nil)
+		if err != nil {
+			log.Error("Problem setting object revision in etcd")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetRevisedObjects retrieves the labels of every object of a type that has revisions, including deleted objects
+func (etcddb *etcdDB) GetRevisedObjects(objType string) ([]string, error) {
+
+	labels := []string{}
+
+	resp, err := etcddb.keysAPI.Get(
+		context.Background(),
+		etcdObjectTypeRevisionsDir(objType),
+		&client.GetOptions{Sort: true},
+	)
+	if err != nil {
+		if notFoundToErrNotExist(err) == ErrNotExist {
+			return labels, nil
+		}
+		return nil, err
+	}
+
+	for _, node := range resp.Node.Nodes {
+		labels = append(labels, strings.Replace(node.Key, etcdObjectTypeRevisionsDir(objType)+"/", "", 1))
+	}
+
+	return labels, nil
+}
+
 // SetGroupMapping will update etcd with the results of a grouping calculation
 func (etcddb *etcdDB) SetGroupMap(groupmap map[string]string) error {
 
@@ -292,7 +445,7 @@ func (etcddb *etcdDB) SetGroupMap(groupmap map[string]string) error {
 
 	log.Debug("Setting '/todd/groupmap' key")
 
-	keyStr := "/todd/groupmap"
+	keyStr := etcdGroupMapKey
 
 	_, err = etcddb.keysAPI.Set(
 		context.Background(), // context
@@ -315,7 +468,7 @@ func (etcddb *etcdDB) GetGroupMap() (map[string]string, error) {
 
 	retMap := map[string]string{}
 
-	keyStr := "/todd/groupmap"
+	keyStr := etcdGroupMapKey
 
 	log.Debug("Retrieving group map")
 
@@ -344,12 +497,10 @@ func (etcddb *etcdDB) InitTestRun(testUUID string, testAgentMap map[string]map[s
 	// Create high-level UUID key for this testrun
 	log.Debug("Creating entry in etcd for testrun ", testUUID)
 	_, err := etcddb.keysAPI.Set(
-		context.Background(),                       // context
-		fmt.Sprintf("/todd/testruns/%s", testUUID), // key
-		"", // value
-		&client.SetOptions{Dir: true, TTL: time.Second * 3000}, //optional args
-		// TODO(mierdin): I set the TTL here so that I didn't dirty etcd with a bunch of old testruns while I develop this feature.
-		// Need to decide if doing our own garbage collection is a better approach.
+		context.Background(),     // context
+		etcdTestRunKey(testUUID), // key
+		"",                       // value
+		&client.SetOptions{Dir: true, TTL: testRunTTL(etcddb.config)}, //optional args
 	)
 	if err != nil {
 		log.Error("Problem setting testrun UUID: ", testUUID)
@@ -367,10 +518,10 @@ func (etcddb *etcdDB) InitTestRun(testUUID string, testAgentMap map[string]map[s
 			// Create agent entry within this testrun
 			log.Debugf("Creating agent entry within testrun %s for agent %s", testUUID, agent)
 			_, err = etcddb.keysAPI.Set(
-				context.Background(),                                        // context
-				fmt.Sprintf("/todd/testruns/%s/agents/%s", testUUID, agent), // key
-				"", // value
-				&client.SetOptions{Dir: true}, //optional args
+				context.Background(),                 // context
+				etcdTestRunAgentDir(testUUID, agent), // key
+				"",                                   // value
+				&client.SetOptions{Dir: true},        //optional args
 			)
 			if err != nil {
 				log.Error("Problem setting initial agent placeholder in testrun: ", testUUID)
@@ -387,10 +538,10 @@ func (etcddb *etcdDB) InitTestRun(testUUID string, testAgentMap map[string]map[s
 			for k, v := range initAgentProps {
 
 				_, err = etcddb.keysAPI.Set(
-					context.Background(),                                              // context
-					fmt.Sprintf("/todd/testruns/%s/agents/%s/%s", testUUID, agent, k), // key
-					v,   // value
-					nil, //optional args
+					context.Background(),                    // context
+					etcdTestRunAgentKey(testUUID, agent, k), // key
+					v,                                       // value
+					nil,                                     //optional args
 				)
 				if err != nil {
 					log.Error("Problem setting initial agent placeholder in testrun: ", testUUID)
@@ -408,8 +559,8 @@ func (etcddb *etcdDB) InitTestRun(testUUID string, testAgentMap map[string]map[s
 // SetAgentTestStatus sets the status for an agent in a particular testrun key.
 func (etcddb *etcdDB) SetAgentTestStatus(testUUID, agentUUID, status string) error {
 	_, err := etcddb.keysAPI.Set(
-		context.Background(),                                                   // context
-		fmt.Sprintf("/todd/testruns/%s/agents/%s/status", testUUID, agentUUID), // key
+		context.Background(), // context
+		etcdTestRunAgentKey(testUUID, agentUUID, "status"), // key
 		status, // value
 		nil,    //optional args
 	)
@@ -425,8 +576,8 @@ func (etcddb *etcdDB) SetAgentTestStatus(testUUID, agentUUID, status string) err
 // SetAgentTestData sets the post-test data for an agent in a particular testrun
 func (etcddb *etcdDB) SetAgentTestData(testUUID, agentUUID, testData string) error {
 	_, err := etcddb.keysAPI.Set(
-		context.Background(),                                                     // context
-		fmt.Sprintf("/todd/testruns/%s/agents/%s/testdata", testUUID, agentUUID), // key
+		context.Background(), // context
+		etcdTestRunAgentKey(testUUID, agentUUID, "testdata"), // key
 		testData, // value
 		nil,      //optional args
 	)
@@ -444,7 +595,7 @@ func (etcddb *etcdDB) GetTestStatus(testUUID string) (map[string]string, error)
 
 	retMap := make(map[string]string)
 
-	keyStr := fmt.Sprintf("/todd/testruns/%s/agents", testUUID)
+	keyStr := etcdTestRunAgentsDir(testUUID)
 
 	log.Debug("Retrieving detailed test status for ", testUUID)
 
@@ -466,7 +617,7 @@ func (etcddb *etcdDB) GetTestStatus(testUUID string) (map[string]string, error)
 		statusKey := fmt.Sprintf("%s/status", node.Key)
 
 		// Extract UUID from key string
-		agentUUID := strings.Replace(node.Key, fmt.Sprintf("/todd/testruns/%s/agents/", testUUID), "", 1)
+		agentUUID := strings.Replace(node.Key, etcdTestRunAgentsDir(testUUID)+"/", "", 1)
 
 		statusResp, err := etcddb.keysAPI.Get(context.Background(), statusKey, nil)
 		if err != nil {
@@ -480,20 +631,118 @@ func (etcddb *etcdDB) GetTestStatus(testUUID string) (map[string]string, error)
 	return retMap, nil
 }
 
+// getTestStatusAtIndex returns the status of every agent in a testrun, along with the etcd index it was read at. Unlike
+// GetTestStatus, this uses the values returned by the recursive Get, instead of retrieving each agent's status separately.
+func (etcddb *etcdDB) getTestStatusAtIndex(testUUID string) (map[string]string, uint64, error) {
+
+	retMap := make(map[string]string)
+
+	keyStr := etcdTestRunAgentsDir(testUUID)
+
+	resp, err := etcddb.keysAPI.Get(context.Background(), keyStr, &client.GetOptions{Recursive: true})
+	if err != nil {
+		// A testrun that doesn't exist yet has no agents, but can still be watched
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+			return retMap, cerr.Index, nil
+		}
+		return nil, 0, err
+	}
+
+	for _, agentNode := range resp.Node.Nodes {
+		agentUUID := strings.Replace(agentNode.Key, keyStr+"/", "", 1)
+		for _, node := range agentNode.Nodes {
+			if node.Key == agentNode.Key+"/status" {
+				retMap[agentUUID] = node.Value
+			}
+		}
+	}
+
+	return retMap, resp.Index, nil
+}
+
+// WatchTestStatus sends the status of every agent in the provided testrun, and sends it again whenever it changes, until stop is written to.
+// The statuses are read once, and then kept up to date using etcd's watch events, instead of being retrieved again after every change.
+func (etcddb *etcdDB) WatchTestStatus(testUUID string, stop *chan bool) (<-chan map[string]string, error) {
+
+	keyStr := etcdTestRunAgentsDir(testUUID)
+
+	status, index, err := etcddb.getTestStatusAtIndex(testUUID)
+	if err != nil {
+		log.Errorf("Error retrieving status of testrun %s: %v", testUUID, err)
+		return nil, err
+	}
+
+	out := make(chan map[string]string, 1)
+	out <- copyStatus(status)
+
+	// Cancelling this context interrupts the watcher when we're asked to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-*stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		watcher := etcddb.keysAPI.Watcher(keyStr, &client.WatcherOptions{AfterIndex: index, Recursive: true})
+		for {
+			resp, err := watcher.Next(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+
+			// etcd only keeps a limited number of past events. If the watch has fallen too far behind, start over from the current status.
+			if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeEventIndexCleared {
+				status, index, err = etcddb.getTestStatusAtIndex(testUUID)
+				if err == nil {
+					sendLatestStatus(out, copyStatus(status))
+					watcher = etcddb.keysAPI.Watcher(keyStr, &client.WatcherOptions{AfterIndex: index, Recursive: true})
+					continue
+				}
+			}
+			if err != nil {
+				log.Errorf("Error watching status of testrun %s: %v", testUUID, err)
+				return
+			}
+
+			// Only changes to an agent's status are interesting
+			if !strings.HasSuffix(resp.Node.Key, "/status") {
+				continue
+			}
+			agentUUID := strings.TrimSuffix(strings.Replace(resp.Node.Key, keyStr+"/", "", 1), "/status")
+
+			switch resp.Action {
+			case "delete", "compareAndDelete", "expire":
+				delete(status, agentUUID)
+			default:
+				status[agentUUID] = resp.Node.Value
+			}
+			sendLatestStatus(out, copyStatus(status))
+		}
+	}()
+
+	return out, nil
+}
+
 // GetAgentTestData returns un-sanitized data from the individual agents. For a report of all agents' data,
 // which has been sanitized by the server, see GetCleanTestData
 func (etcddb *etcdDB) GetAgentTestData(testUUID, sourceGroup string) (map[string]string, error) {
 
 	retMap := make(map[string]string)
 
-	keyStr := fmt.Sprintf("/todd/testruns/%s/agents", testUUID)
+	keyStr := etcdTestRunAgentsDir(testUUID)
 
 	log.Debug("Retrieving detailed test data for ", testUUID)
 
 	resp, err := etcddb.keysAPI.Get(context.Background(), keyStr, &client.GetOptions{Recursive: true})
 	if err != nil {
 		log.Errorf("Error - empty test encountered for %q: %v", testUUID, err)
-		return nil, err
+		return nil, notFoundToErrNotExist(err)
 	}
 
 	log.Debugf("Etcd 'get' is done. Metadata is %q\n", resp)
@@ -506,7 +755,7 @@ func (etcddb *etcdDB) GetAgentTestData(testUUID, sourceGroup string) (map[string
 	// Iterate over found objects
 	for _, node := range resp.Node.Nodes {
 		// Extract UUID from key string
-		agentUUID := strings.Replace(node.Key, fmt.Sprintf("/todd/testruns/%s/agents/", testUUID), "", 1)
+		agentUUID := strings.Replace(node.Key, etcdTestRunAgentsDir(testUUID)+"/", "", 1)
 
 		groupKey := fmt.Sprintf("%s/group", node.Key)
 		groupResp, err := etcddb.keysAPI.Get(context.Background(), groupKey, nil)
@@ -523,7 +772,7 @@ func (etcddb *etcdDB) GetAgentTestData(testUUID, sourceGroup string) (map[string
 		dataResp, err := etcddb.keysAPI.Get(context.Background(), testRunDataKey, nil)
 		if err != nil {
 			log.Errorf("Error retrieving testdata of agent in: %s", testUUID)
-			return nil, err
+			return nil, notFoundToErrNotExist(err)
 		}
 		retMap[agentUUID] = dataResp.Node.Value
 	}
@@ -537,7 +786,7 @@ func (etcddb *etcdDB) WriteCleanTestData(testUUID string, testData string) error
 
 	log.Debugf("/todd/testruns/%s/cleandata/", testUUID)
 
-	keyStr := fmt.Sprintf("/todd/testruns/%s/cleandata/", testUUID)
+	keyStr := etcdCleanDataKey(testUUID)
 
 	_, err := etcddb.keysAPI.Set(
 		context.Background(), // context
@@ -558,7 +807,7 @@ func (etcddb *etcdDB) WriteCleanTestData(testUUID string, testData string) error
 // GetCleanTestData will retrieve clean test data from the database
 func (etcddb *etcdDB) GetCleanTestData(testUUID string) (string, error) {
 
-	keyStr := fmt.Sprintf("/todd/testruns/%s/cleandata", testUUID)
+	keyStr := etcdCleanDataKey(testUUID)
 
 	log.Debug("Retrieving clean test data for ", testUUID)
 
@@ -577,6 +826,85 @@ func (etcddb *etcdDB) GetCleanTestData(testUUID string) (string, error) {
 	return string(resp.Node.Value), nil
 }
 
+// SetTestRunRecord inserts or updates the history record of a testrun
+func (etcddb *etcdDB) SetTestRunRecord(record defs.TestRunRecord) error {
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = etcddb.keysAPI.Set(context.Background(), etcdHistoryKey(record.Uuid), string(recordJSON), nil)
+	if err != nil {
+		log.Errorf("Problem setting history of testrun %s in etcd", record.Uuid)
+		return err
+	}
+
+	return nil
+}
+
+// GetTestRunRecord retrieves the history record of a testrun
+func (etcddb *etcdDB) GetTestRunRecord(testUUID string) (*defs.TestRunRecord, error) {
+
+	resp, err := etcddb.keysAPI.Get(context.Background(), etcdHistoryKey(testUUID), nil)
+	if err != nil {
+		return nil, notFoundToErrNotExist(err)
+	}
+
+	record := new(defs.TestRunRecord)
+	err = json.Unmarshal([]byte(resp.Node.Value), record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// GetTestRunRecords retrieves the history records of all testruns, most recently started first
+func (etcddb *etcdDB) GetTestRunRecords() ([]defs.TestRunRecord, error) {
+
+	records := []defs.TestRunRecord{}
+
+	resp, err := etcddb.keysAPI.Get(context.Background(), etcdHistoryDir, &client.GetOptions{Recursive: true})
+	if err != nil {
+		if notFoundToErrNotExist(err) == ErrNotExist {
+			return records, nil
+		}
+		return nil, err
+	}
+
+	for _, node := range resp.Node.Nodes {
+		var record defs.TestRunRecord
+		err = json.Unmarshal([]byte(node.Value), &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sortTestRunRecords(records)
+
+	return records, nil
+}
+
+// DeleteTestRun removes the history record of a testrun, along with its status and data
+func (etcddb *etcdDB) DeleteTestRun(testUUID string) error {
+
+	// The testrun's data may have already expired
+	_, err := etcddb.keysAPI.Delete(context.Background(), etcdTestRunKey(testUUID), &client.DeleteOptions{Recursive: true, Dir: true})
+	if err != nil && notFoundToErrNotExist(err) != ErrNotExist {
+		return err
+	}
+
+	_, err = etcddb.keysAPI.Delete(context.Background(), etcdHistoryKey(testUUID), nil)
+	if err != nil {
+		return notFoundToErrNotExist(err)
+	}
+
+	log.Infof("Removed testrun %s", testUUID)
+
+	return nil
+}
+
 // TODO (mierdin): I have commented this out for now - may use this in the future to ensure that only one test is activated at a time.
 //
 // SetFlag will update etcd with the flag that indicates if tests can be run.
@@ -0,0 +1,84 @@
+/*
+    ToDD key layout in etcd
+
+    Both etcd plugins ("etcd" and "etcdv3") use the same key layout, and every key used by either plugin is built here.
+    Directories (v2) double as key prefixes (v3), with the v3 plugin adding a trailing "/" so that, for instance, the
+    revisions of object "dc" don't include those of "dc2". etcd keeps data written through its v2 and v3 APIs apart,
+    though, so neither plugin can see what the other wrote - use "todd-server backup" and "todd-server restore" to move
+    a server from one plugin to the other.
+
+    Any change to this layout must come with a migration to move existing data, and a new schema version (see schema.go).
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"fmt"
+)
+
+const (
+	// etcdSchemaKey holds the version of the layout below
+	etcdSchemaKey = "/todd/schema"
+
+	etcdAgentsDir   = "/todd/agents"
+	etcdGroupMapKey = "/todd/groupmap"
+	etcdHistoryDir  = "/todd/history"
+)
+
+func etcdAgentKey(uuid string) string {
+	return fmt.Sprintf("%s/%s", etcdAgentsDir, uuid)
+}
+
+func etcdObjectsDir(objType string) string {
+	return fmt.Sprintf("/todd/objects/%s", objType)
+}
+
+func etcdObjectKey(objType, label string) string {
+	return fmt.Sprintf("%s/%s", etcdObjectsDir(objType), label)
+}
+
+// etcdObjectTypeRevisionsDir holds the revisions of every object of a type, in a directory for each object
+func etcdObjectTypeRevisionsDir(objType string) string {
+	return fmt.Sprintf("/todd/objectrevisions/%s", objType)
+}
+
+func etcdObjectRevisionsDir(objType, label string) string {
+	return fmt.Sprintf("%s/%s", etcdObjectTypeRevisionsDir(objType), label)
+}
+
+// etcdObjectRevisionKey returns the key of a revision of an object. Revisions are zero-padded, so that their keys sort
+// in the same order as the revisions themselves.
+func etcdObjectRevisionKey(objType, label string, revision int) string {
+	return fmt.Sprintf("%s/%010d", etcdObjectRevisionsDir(objType, label), revision)
+}
+
+// etcdTestRunKey is the directory holding everything about a testrun in the v2 layout, and an empty marker key,
+// created along with the rest of the testrun, in the v3 layout
+func etcdTestRunKey(testUUID string) string {
+	return fmt.Sprintf("/todd/testruns/%s", testUUID)
+}
+
+func etcdTestRunAgentsDir(testUUID string) string {
+	return fmt.Sprintf("%s/agents", etcdTestRunKey(testUUID))
+}
+
+func etcdTestRunAgentDir(testUUID, agentUUID string) string {
+	return fmt.Sprintf("%s/%s", etcdTestRunAgentsDir(testUUID), agentUUID)
+}
+
+// etcdTestRunAgentKey returns the key of one of the "group", "status" or "testdata" fields of an agent in a testrun
+func etcdTestRunAgentKey(testUUID, agentUUID, field string) string {
+	return fmt.Sprintf("%s/%s", etcdTestRunAgentDir(testUUID, agentUUID), field)
+}
+
+func etcdCleanDataKey(testUUID string) string {
+	return fmt.Sprintf("%s/cleandata", etcdTestRunKey(testUUID))
+}
+
+func etcdHistoryKey(testUUID string) string {
+	return fmt.Sprintf("%s/%s", etcdHistoryDir, testUUID)
+}
@@ -0,0 +1,76 @@
+/*
+    Helpers for testing the etcd database plugins
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package etcdtest
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Start returns the host and port of an etcd server with both the v2 and v3 APIs enabled, along with a function that
+// stops it. Normally this is a new etcd server, started in this process with its data in a temporary directory. If
+// TODD_TEST_ETCD is set to the host:port of an existing etcd server, that server is used instead - since the tests
+// remove data, don't point this at an etcd server that ToDD is using.
+func Start(t *testing.T) (host, port string, stop func()) {
+	if addr := os.Getenv("TODD_TEST_ETCD"); addr != "" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return host, port, func() {}
+	}
+
+	dir, err := ioutil.TempDir("", "todd-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Port 0 lets the OS pick free ports, so tests don't collide with each other or with a real etcd server
+	localURL := url.URL{Scheme: "http", Host: "127.0.0.1:0"}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.EnableV2 = true
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{localURL}
+	cfg.AdvertiseClientUrls = []url.URL{localURL}
+	cfg.ListenPeerUrls = []url.URL{localURL}
+	cfg.AdvertisePeerUrls = []url.URL{localURL}
+	cfg.InitialCluster = cfg.Name + "=" + localURL.String()
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stop = func() {
+		e.Close()
+		os.RemoveAll(dir)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		stop()
+		t.Fatal("Embedded etcd server did not start")
+	}
+
+	host, port, err = net.SplitHostPort(e.Clients[0].Addr().String())
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return host, port, stop
+}
@@ -0,0 +1,920 @@
+/*
+   ToDD databasePackage implementation for etcd, using the v3 API
+
+   Newer etcd clusters have the v2 API disabled, so this plugin talks to etcd using the v3 (gRPC) API instead. It stores
+   the same /todd/... layout as the "etcd" plugin. Agents and testruns are attached to leases, so etcd removes them when they
+   expire.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+const (
+	// etcdV3RequestTimeout is how long a single request to etcd is allowed to take
+	etcdV3RequestTimeout = 5 * time.Second
+
+	// etcdV3TxnOps is the most operations put in a single transaction, which must be within etcd's --max-txn-ops
+	// option (128 by default)
+	etcdV3TxnOps = 100
+)
+
+var (
+	etcdV3ClientsMu sync.Mutex
+	etcdV3Clients   = make(map[string]*clientv3.Client)
+)
+
+// getEtcdV3Client returns the shared client for the provided etcd endpoint, connecting if needed. The server creates a new
+// instance of the database plugin for most operations, and each client holds its own connections, so they are shared.
+func getEtcdV3Client(endpoint string) (*clientv3.Client, error) {
+	etcdV3ClientsMu.Lock()
+	defer etcdV3ClientsMu.Unlock()
+
+	if c, ok := etcdV3Clients[endpoint]; ok {
+		return c, nil
+	}
+
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{endpoint},
+		DialTimeout: etcdV3RequestTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	etcdV3Clients[endpoint] = c
+	return c, nil
+}
+
+// newEtcdV3DB is a factory function that produces a new instance of etcdV3DB with the configuration
+// loaded and ready to be used.
+func newEtcdV3DB(cfg config.Config) (DatabasePackage, error) {
+	c, err := getEtcdV3Client(net.JoinHostPort(cfg.DB.Host, cfg.DB.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdV3DB{config: cfg, client: c}, nil
+}
+
+type etcdV3DB struct {
+	config config.Config
+	client *clientv3.Client
+}
+
+// context returns a context for a single request to etcd
+func (etcdv3db *etcdV3DB) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+}
+
+// Init removes any registered agents, as the other plugins do when the server starts, and migrates the data
+// to the current schema version
+func (etcdv3db *etcdV3DB) Init() error {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	log.Info("Deleting '/todd/agents/' keys")
+	_, err := etcdv3db.client.Delete(ctx, etcdAgentsDir+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	return migrateSchema(etcdv3db)
+}
+
+func (etcdv3db *etcdV3DB) getSchemaVersion() (int, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdSchemaKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(resp.Kvs[0].Value))
+}
+
+func (etcdv3db *etcdV3DB) setSchemaVersion(version int) error {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	_, err := etcdv3db.client.Put(ctx, etcdSchemaKey, strconv.Itoa(version))
+	return err
+}
+
+// SetAgent will ingest an agent advertisement, and update or insert the agent record
+// in the database as needed. The agent is attached to a lease, which is renewed each time
+// the agent is written, so the agent is removed by etcd if it isn't written again before
+// the lease expires.
+func (etcdv3db *etcdV3DB) SetAgent(adv defs.AgentAdvert) error {
+	log.Infof("Setting '/todd/agents/%s' key", adv.Uuid)
+
+	advJSON, err := json.Marshal(adv)
+	if err != nil {
+		log.Error("Problem converting Agent Advertisement to JSON")
+		return err
+	}
+
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if ttl := agentTTL(etcdv3db.config); ttl > 0 {
+		leaseID, err := etcdv3db.agentLease(ctx, adv.Uuid, ttl)
+		if err != nil {
+			log.Error("Problem creating lease for agent in etcd")
+			return err
+		}
+		opts = append(opts, clientv3.WithLease(leaseID))
+	}
+
+	_, err = etcdv3db.client.Put(ctx, etcdAgentKey(adv.Uuid), string(advJSON), opts...)
+	if err != nil {
+		log.Error("Problem setting agent in etcd")
+		return err
+	}
+
+	return nil
+}
+
+// agentLease renews the lease that an agent is already attached to, and returns it. A new lease is only granted if the
+// agent isn't registered, or its lease has expired, so that each heartbeat doesn't leave another lease behind.
+func (etcdv3db *etcdV3DB) agentLease(ctx context.Context, uuid string, ttl time.Duration) (clientv3.LeaseID, error) {
+	resp, err := etcdv3db.client.Get(ctx, etcdAgentKey(uuid))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	if len(resp.Kvs) > 0 && resp.Kvs[0].Lease != 0 {
+		leaseID := clientv3.LeaseID(resp.Kvs[0].Lease)
+		_, err = etcdv3db.client.KeepAliveOnce(ctx, leaseID)
+		if err == nil {
+			return leaseID, nil
+		}
+		if err != rpctypes.ErrLeaseNotFound {
+			return clientv3.NoLease, err
+		}
+	}
+
+	lease, err := etcdv3db.client.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	return lease.ID, nil
+}
+
+// GetAgent will retrieve a specific agent from the database by UUID
+func (etcdv3db *etcdV3DB) GetAgent(uuid string) (*defs.AgentAdvert, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdAgentKey(uuid))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		log.Errorf("Agent %s not found.", uuid)
+		return nil, ErrNotExist
+	}
+
+	adv := new(defs.AgentAdvert)
+	err = json.Unmarshal(resp.Kvs[0].Value, adv)
+	if err != nil {
+		log.Errorf("Failed to unmarshal json into agent advertisement: %v", err)
+		return nil, err
+	}
+
+	return adv, nil
+}
+
+// GetAgents will retrieve all agents from the database
+func (etcdv3db *etcdV3DB) GetAgents() ([]defs.AgentAdvert, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdAgentsDir+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	retAdv := []defs.AgentAdvert{}
+	for _, kv := range resp.Kvs {
+		var adv defs.AgentAdvert
+		err = json.Unmarshal(kv.Value, &adv)
+		if err != nil {
+			log.Errorf("Failed to unmarshal json into agent advertisement: %v", err)
+			return nil, err
+		}
+		retAdv = append(retAdv, adv)
+	}
+
+	return retAdv, nil
+}
+
+// RemoveAgent will delete an agent from the database
+func (etcdv3db *etcdV3DB) RemoveAgent(adv defs.AgentAdvert) error {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Delete(ctx, etcdAgentKey(adv.Uuid), clientv3.WithPrevKV())
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrNotExist
+	}
+
+	// Nothing else is attached to the agent's lease, so there's no need to wait for it to expire
+	if len(resp.PrevKvs) > 0 && resp.PrevKvs[0].Lease != 0 {
+		_, err = etcdv3db.client.Revoke(ctx, clientv3.LeaseID(resp.PrevKvs[0].Lease))
+		if err != nil && err != rpctypes.ErrLeaseNotFound {
+			log.Warnf("Problem revoking lease of agent %s: %v", adv.Uuid, err)
+		}
+	}
+
+	log.Infof("Removed '/todd/agents/%s' key", adv.Uuid)
+
+	return nil
+}
+
+// GetObjects retrieves a list of ToddObjects of the provided type
+func (etcdv3db *etcdV3DB) GetObjects(objType string) ([]objects.ToddObject, error) {
+
+	if objType == "" {
+		return nil, errors.New("Object API queried with no type argument")
+	}
+
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	// Keys are returned in order, so objects are sorted by label
+	resp, err := etcdv3db.client.Get(ctx, etcdObjectsDir(objType)+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	retObj := []objects.ToddObject{}
+	for _, kv := range resp.Kvs {
+
+		var baseobj objects.BaseObject
+		err = json.Unmarshal(kv.Value, &baseobj)
+		if err != nil {
+			return nil, err
+		}
+
+		retObj = append(retObj, baseobj.ParseToddObject(kv.Value))
+	}
+
+	return retObj, nil
+}
+
+// SetObject will insert or update a ToddObject within etcd, and keep it as a new revision
+func (etcdv3db *etcdV3DB) SetObject(tobj objects.ToddObject, author string) error {
+
+	rev, err := objects.NewObjectRevision(tobj, author)
+	if err != nil {
+		return err
+	}
+
+	objKey := etcdObjectKey(tobj.GetType(), tobj.GetLabel())
+	_, err = etcdv3db.changeObject(tobj.GetType(), tobj.GetLabel(), rev, clientv3.OpPut(objKey, string(rev.Object)))
+	if err != nil {
+		log.Error("Problem setting object in etcd")
+		return err
+	}
+
+	log.Infof("Wrote new Todd Object to etcd: %s/%s", tobj.GetType(), tobj.GetLabel())
+	return nil
+}
+
+// DeleteObject will delete a ToddObject from etcd, and keep its deletion as a new revision
+func (etcdv3db *etcdV3DB) DeleteObject(label string, objtype string, author string) error {
+
+	rev, err := objects.NewObjectRevision(nil, author)
+	if err != nil {
+		return err
+	}
+
+	objKey := etcdObjectKey(objtype, label)
+	ok, err := etcdv3db.changeObject(objtype, label, rev, clientv3.OpDelete(objKey), clientv3.Compare(clientv3.Version(objKey), ">", 0))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotExist
+	}
+
+	log.Infof("Removed '/todd/objects/%s/%s' key", objtype, label)
+
+	return nil
+}
+
+// changeObject changes an object with the provided operation, and adds a revision of it, in a single transaction. If
+// another server takes the same revision number first, the next number is tried. It returns false, without changing
+// anything, if any of the provided comparisons fail.
+func (etcdv3db *etcdV3DB) changeObject(objType, label string, rev objects.ObjectRevision, op clientv3.Op, cmps ...clientv3.Cmp) (bool, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	for {
+		last, err := etcdv3db.client.Get(ctx, etcdObjectRevisionsDir(objType, label)+"/", clientv3.WithLastKey()...)
+		if err != nil {
+			return false, err
+		}
+		rev.Revision = 1
+		if len(last.Kvs) > 0 {
+			var lastRev objects.ObjectRevision
+			err = json.Unmarshal(last.Kvs[0].Value, &lastRev)
+			if err != nil {
+				return false, err
+			}
+			rev.Revision = lastRev.Revision + 1
+		}
+
+		revJSON, err := json.Marshal(rev)
+		if err != nil {
+			return false, err
+		}
+
+		// The revision must not exist yet, and the comparisons must succeed
+		revKey := etcdObjectRevisionKey(objType, label, rev.Revision)
+		resp, err := etcdv3db.client.Txn(ctx).
+			If(append(cmps, clientv3.Compare(clientv3.CreateRevision(revKey), "=", 0))...).
+			Then(op, clientv3.OpPut(revKey, string(revJSON))).
+			Else(clientv3.OpGet(revKey, clientv3.WithCountOnly())).
+			Commit()
+		if err != nil {
+			return false, err
+		}
+		if resp.Succeeded {
+			return true, nil
+		}
+
+		// If the revision was taken, try again with the next one - otherwise one of the caller's comparisons failed
+		if resp.Responses[0].GetResponseRange().Count == 0 {
+			return false, nil
+		}
+	}
+}
+
+// GetObjectRevisions retrieves every revision of a ToddObject, oldest first
+func (etcdv3db *etcdV3DB) GetObjectRevisions(objType, label string) ([]objects.ObjectRevision, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	// Keys are returned in order, and revision numbers are zero-padded, so revisions are sorted
+	resp, err := etcdv3db.client.Get(ctx, etcdObjectRevisionsDir(objType, label)+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	revs := []objects.ObjectRevision{}
+	for _, kv := range resp.Kvs {
+		var rev objects.ObjectRevision
+		err = json.Unmarshal(kv.Value, &rev)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+
+	return revs, nil
+}
+
+// SetObjectRevisions replaces every revision of a ToddObject. Objects can have more revisions than etcd allows in a
+// single transaction, so the revisions are written one at a time.
+func (etcdv3db *etcdV3DB) SetObjectRevisions(objType, label string, revs []objects.ObjectRevision) error {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	_, err := etcdv3db.client.Delete(ctx, etcdObjectRevisionsDir(objType, label)+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	for _, rev := range revs {
+		revJSON, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+
+		_, err = etcdv3db.client.Put(ctx, etcdObjectRevisionKey(objType, label, rev.Revision), string(revJSON))
+		if err != nil {
+			log.Error("Problem setting object revision in etcd")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetRevisedObjects retrieves the labels of every object of a type that has revisions, including deleted objects
+func (etcdv3db *etcdV3DB) GetRevisedObjects(objType string) ([]string, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	dir := etcdObjectTypeRevisionsDir(objType) + "/"
+	resp, err := etcdv3db.client.Get(ctx, dir, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are returned in order, so the revisions of each object come together. Labels still need sorting, since
+	// "a-b/..." sorts before "a/...".
+	labels := []string{}
+	for _, kv := range resp.Kvs {
+		label := path.Dir(strings.TrimPrefix(string(kv.Key), dir))
+		if len(labels) == 0 || labels[len(labels)-1] != label {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	return labels, nil
+}
+
+// SetGroupMap will update etcd with the results of a grouping calculation
+func (etcdv3db *etcdV3DB) SetGroupMap(groupmap map[string]string) error {
+
+	gmapJSON, err := json.Marshal(groupmap)
+	if err != nil {
+		log.Error("Problem converting group map to JSON")
+		return err
+	}
+
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	_, err = etcdv3db.client.Put(ctx, etcdGroupMapKey, string(gmapJSON))
+	if err != nil {
+		log.Error("Problem setting group map in etcd")
+		return err
+	}
+
+	log.Infof("Updated group map in etcd: %s", gmapJSON)
+
+	return nil
+}
+
+// GetGroupMap returns a map containing agent-to-group mappings. Agent UUIDs are used for keys
+func (etcdv3db *etcdV3DB) GetGroupMap() (map[string]string, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdGroupMapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	retMap := map[string]string{}
+	if len(resp.Kvs) == 0 {
+		return retMap, nil
+	}
+
+	err = json.Unmarshal(resp.Kvs[0].Value, &retMap)
+	if err != nil {
+		log.Error("Failed to retrieve group map from etcd")
+		return nil, err
+	}
+
+	return retMap, nil
+}
+
+// InitTestRun creates an entry for a new testrun, and an entry for each agent participating in it. Each agent entry
+// starts out with that agent's current group, and an initial status of "init". Everything is attached to a lease, so
+// that etcd removes the testrun once it's older than the configured history retention.
+//
+// A testrun that fits within etcdV3TxnOps is written in a single transaction, so it is created atomically.
+func (etcdv3db *etcdV3DB) InitTestRun(testUUID string, testAgentMap map[string]map[string]string) error {
+
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	leaseID := clientv3.NoLease
+	if ttl := testRunTTL(etcdv3db.config); ttl > 0 {
+		lease, err := etcdv3db.client.Grant(ctx, int64(ttl/time.Second))
+		if err != nil {
+			log.Error("Problem creating lease for testrun: ", testUUID)
+			return err
+		}
+		leaseID = lease.ID
+	}
+	withLease := clientv3.WithLease(leaseID)
+
+	var ops []clientv3.Op
+	for _, uuidmappings := range testAgentMap {
+
+		// uuidmappings is a map[string]string that contains uuid (key) to group name (value) mappings for this test.
+		for agent, group := range uuidmappings {
+			ops = append(ops,
+				clientv3.OpPut(etcdTestRunAgentKey(testUUID, agent, "group"), group, withLease),
+				clientv3.OpPut(etcdTestRunAgentKey(testUUID, agent, "status"), "init", withLease),
+			)
+		}
+	}
+	testRunOp := clientv3.OpPut(etcdTestRunKey(testUUID), "", withLease)
+
+	if len(ops)+1 <= etcdV3TxnOps {
+		_, err := etcdv3db.client.Txn(ctx).Then(append(ops, testRunOp)...).Commit()
+		if err != nil {
+			log.Errorf("Problem creating testrun %s: %v", testUUID, err)
+			return err
+		}
+		return nil
+	}
+
+	// Larger testruns would go past etcd's limit on operations in a transaction, so the agent entries are written in
+	// batches, and the testrun's own key is written last. This only emulates an atomic write: getTestRunAgents ignores
+	// agent entries until the testrun's key exists, and if a batch fails, the entries already written are removed. But if
+	// the server stops part way through, the entries written so far are left behind until the testrun's lease expires (or
+	// for good, if testruns aren't given a lease).
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > etcdV3TxnOps {
+			n = etcdV3TxnOps
+		}
+
+		_, err := etcdv3db.client.Txn(ctx).Then(ops[:n]...).Commit()
+		if err != nil {
+			log.Errorf("Problem creating agent entries for testrun %s: %v", testUUID, err)
+			etcdv3db.removeTestRunKeys(testUUID, leaseID)
+			return err
+		}
+		ops = ops[n:]
+	}
+
+	_, err := etcdv3db.client.Do(ctx, testRunOp)
+	if err != nil {
+		log.Error("Problem setting testrun UUID: ", testUUID)
+		etcdv3db.removeTestRunKeys(testUUID, leaseID)
+		return err
+	}
+
+	return nil
+}
+
+// removeTestRunKeys removes what was written of a testrun that couldn't be created
+func (etcdv3db *etcdV3DB) removeTestRunKeys(testUUID string, leaseID clientv3.LeaseID) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	// Revoking the lease removes every key attached to it, but without a lease, the keys have to be removed directly
+	var err error
+	if leaseID != clientv3.NoLease {
+		_, err = etcdv3db.client.Revoke(ctx, leaseID)
+	} else {
+		_, err = etcdv3db.client.Delete(ctx, etcdTestRunKey(testUUID)+"/", clientv3.WithPrefix())
+	}
+	if err != nil {
+		log.Errorf("Problem removing partially created testrun %s: %v", testUUID, err)
+	}
+}
+
+// setTestRunKey writes a key that belongs to a testrun, attaching it to that testrun's lease so that it is removed along with
+// the rest of the testrun. Keys for testruns that don't exist aren't attached to any lease.
+func (etcdv3db *etcdV3DB) setTestRunKey(testUUID, key, value string) error {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdTestRunKey(testUUID))
+	if err != nil {
+		return err
+	}
+
+	var opts []clientv3.OpOption
+	if len(resp.Kvs) > 0 && resp.Kvs[0].Lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(resp.Kvs[0].Lease)))
+	}
+
+	_, err = etcdv3db.client.Put(ctx, key, value, opts...)
+	return err
+}
+
+// SetAgentTestStatus sets the status for an agent in a particular testrun key.
+func (etcdv3db *etcdV3DB) SetAgentTestStatus(testUUID, agentUUID, status string) error {
+	err := etcdv3db.setTestRunKey(testUUID, etcdTestRunAgentKey(testUUID, agentUUID, "status"), status)
+	if err != nil {
+		log.Errorf("Problem updating status for agent %s in test %s", agentUUID, testUUID)
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// SetAgentTestData sets the post-test data for an agent in a particular testrun
+func (etcdv3db *etcdV3DB) SetAgentTestData(testUUID, agentUUID, testData string) error {
+	err := etcdv3db.setTestRunKey(testUUID, etcdTestRunAgentKey(testUUID, agentUUID, "testdata"), testData)
+	if err != nil {
+		log.Errorf("Problem updating testdata for agent %s in test %s", agentUUID, testUUID)
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// getTestRunAgents returns the fields of each agent's entry in a testrun, keyed by agent UUID and then by field name
+func (etcdv3db *etcdV3DB) getTestRunAgents(testUUID string) (map[string]map[string]string, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	// The agents are only read if the testrun's own key exists, since it's written once all of them have been
+	prefix := etcdTestRunAgentsDir(testUUID) + "/"
+	resp, err := etcdv3db.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(etcdTestRunKey(testUUID)), ">", 0)).
+		Then(clientv3.OpGet(prefix, clientv3.WithPrefix())).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make(map[string]map[string]string)
+	if !resp.Succeeded {
+		return agents, nil
+	}
+	for _, kv := range resp.Responses[0].GetResponseRange().Kvs {
+		// Keys look like <prefix><agent UUID>/<field>
+		parts := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if agents[parts[0]] == nil {
+			agents[parts[0]] = make(map[string]string)
+		}
+		agents[parts[0]][parts[1]] = string(kv.Value)
+	}
+
+	return agents, nil
+}
+
+// GetTestStatus returns a map containing a list of agent UUIDs that are participating in the provided test, and their status in this test.
+func (etcdv3db *etcdV3DB) GetTestStatus(testUUID string) (map[string]string, error) {
+
+	log.Debug("Retrieving detailed test status for ", testUUID)
+
+	agents, err := etcdv3db.getTestRunAgents(testUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	retMap := make(map[string]string)
+	for agent, fields := range agents {
+		if status, ok := fields["status"]; ok {
+			retMap[agent] = status
+		}
+	}
+
+	return retMap, nil
+}
+
+// WatchTestStatus sends the status of every agent in the provided testrun, and sends it again whenever it changes, until stop is written to.
+// The statuses are read once, and then kept up to date using etcd's watch events, starting from the revision they were read at.
+func (etcdv3db *etcdV3DB) WatchTestStatus(testUUID string, stop *chan bool) (<-chan map[string]string, error) {
+
+	prefix := etcdTestRunAgentsDir(testUUID) + "/"
+
+	getCtx, getCancel := etcdv3db.context()
+	resp, err := etcdv3db.client.Get(getCtx, prefix, clientv3.WithPrefix())
+	getCancel()
+	if err != nil {
+		log.Errorf("Error retrieving status of testrun %s: %v", testUUID, err)
+		return nil, err
+	}
+
+	status := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		if strings.HasSuffix(string(kv.Key), "/status") {
+			status[strings.TrimSuffix(strings.TrimPrefix(string(kv.Key), prefix), "/status")] = string(kv.Value)
+		}
+	}
+
+	out := make(chan map[string]string, 1)
+	out <- copyStatus(status)
+
+	// Cancelling this context ends the watch when we're asked to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-*stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	watch := etcdv3db.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		for wresp := range watch {
+			if err := wresp.Err(); err != nil {
+				log.Errorf("Error watching status of testrun %s: %v", testUUID, err)
+				return
+			}
+
+			changed := false
+			for _, ev := range wresp.Events {
+				// Only changes to an agent's status are interesting
+				key := string(ev.Kv.Key)
+				if !strings.HasSuffix(key, "/status") {
+					continue
+				}
+				agentUUID := strings.TrimSuffix(strings.TrimPrefix(key, prefix), "/status")
+
+				if ev.Type == clientv3.EventTypeDelete {
+					delete(status, agentUUID)
+				} else {
+					status[agentUUID] = string(ev.Kv.Value)
+				}
+				changed = true
+			}
+
+			if changed {
+				sendLatestStatus(out, copyStatus(status))
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// GetAgentTestData returns un-sanitized data from the individual agents. For a report of all agents' data,
+// which has been sanitized by the server, see GetCleanTestData
+func (etcdv3db *etcdV3DB) GetAgentTestData(testUUID, sourceGroup string) (map[string]string, error) {
+
+	log.Debug("Retrieving detailed test data for ", testUUID)
+
+	agents, err := etcdv3db.getTestRunAgents(testUUID)
+	if err != nil {
+		return nil, err
+	}
+	if len(agents) == 0 {
+		log.Errorf("Error - empty test encountered for %q", testUUID)
+		return nil, ErrNotExist
+	}
+
+	retMap := make(map[string]string)
+	for agent, fields := range agents {
+		if fields["group"] != sourceGroup {
+			continue
+		}
+
+		testData, ok := fields["testdata"]
+		if !ok {
+			log.Errorf("Error retrieving testdata of agent in: %s", testUUID)
+			return nil, ErrNotExist
+		}
+		retMap[agent] = testData
+	}
+
+	return retMap, nil
+}
+
+// WriteCleanTestData will write the post-test metrics data that has been cleaned up and
+// ready to be displayed or exported to the database
+func (etcdv3db *etcdV3DB) WriteCleanTestData(testUUID string, testData string) error {
+	err := etcdv3db.setTestRunKey(testUUID, etcdCleanDataKey(testUUID), testData)
+	if err != nil {
+		log.Error("Problem setting object in etcd")
+		return err
+	}
+
+	log.Infof("Wrote clean test data to test uuid: %s", testUUID)
+
+	return nil
+}
+
+// GetCleanTestData will retrieve clean test data from the database
+func (etcdv3db *etcdV3DB) GetCleanTestData(testUUID string) (string, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdCleanDataKey(testUUID))
+	if err != nil {
+		log.Errorf("Error - empty test data: %s", testUUID)
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrNotExist
+	}
+
+	return string(resp.Kvs[0].Value), nil
+}
+
+// SetTestRunRecord inserts or updates the history record of a testrun
+func (etcdv3db *etcdV3DB) SetTestRunRecord(record defs.TestRunRecord) error {
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	_, err = etcdv3db.client.Put(ctx, etcdHistoryKey(record.Uuid), string(recordJSON))
+	if err != nil {
+		log.Errorf("Problem setting history of testrun %s in etcd", record.Uuid)
+		return err
+	}
+
+	return nil
+}
+
+// GetTestRunRecord retrieves the history record of a testrun
+func (etcdv3db *etcdV3DB) GetTestRunRecord(testUUID string) (*defs.TestRunRecord, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdHistoryKey(testUUID))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNotExist
+	}
+
+	record := new(defs.TestRunRecord)
+	err = json.Unmarshal(resp.Kvs[0].Value, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// GetTestRunRecords retrieves the history records of all testruns, most recently started first
+func (etcdv3db *etcdV3DB) GetTestRunRecords() ([]defs.TestRunRecord, error) {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Get(ctx, etcdHistoryDir+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	records := []defs.TestRunRecord{}
+	for _, kv := range resp.Kvs {
+		var record defs.TestRunRecord
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sortTestRunRecords(records)
+
+	return records, nil
+}
+
+// DeleteTestRun removes the history record of a testrun, along with its status and data
+func (etcdv3db *etcdV3DB) DeleteTestRun(testUUID string) error {
+	ctx, cancel := etcdv3db.context()
+	defer cancel()
+
+	resp, err := etcdv3db.client.Txn(ctx).Then(
+		clientv3.OpDelete(etcdHistoryKey(testUUID)),
+		clientv3.OpDelete(etcdTestRunKey(testUUID)),
+		clientv3.OpDelete(etcdTestRunKey(testUUID)+"/", clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	// The first response is for the history record. The testrun's data may have already expired.
+	if resp.Responses[0].GetResponseDeleteRange().Deleted == 0 {
+		return ErrNotExist
+	}
+
+	log.Infof("Removed testrun %s", testUUID)
+
+	return nil
+}
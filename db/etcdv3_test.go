@@ -0,0 +1,190 @@
+/*
+    Tests for the etcd v3 database plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/db/dbtest"
+	"github.com/Mierdin/todd/db/etcdtest"
+	"github.com/Mierdin/todd/hostresources"
+)
+
+// etcdV3Config returns a config pointing the etcdv3 plugin at a test etcd server (see etcdtest.Start), along with a
+// function that stops the server
+func etcdV3Config(t *testing.T) (config.Config, func()) {
+	host, port, stop := etcdtest.Start(t)
+
+	var cfg config.Config
+	cfg.DB.Plugin = "etcdv3"
+	cfg.DB.Host = host
+	cfg.DB.Port = port
+	return cfg, stop
+}
+
+func TestEtcdV3Conformance(t *testing.T) {
+	cfg, stop := etcdV3Config(t)
+	defer stop()
+
+	dbtest.Conformance(t, func(t *testing.T) db.DatabasePackage {
+		tdb, err := db.NewToddDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tdb
+	})
+}
+
+// TestEtcdV3Leases tests that agents expire, and that every key belonging to a testrun shares the testrun's lease
+func TestEtcdV3Leases(t *testing.T) {
+	cfg, stop := etcdV3Config(t)
+	defer stop()
+
+	// etcd doesn't grant leases shorter than a couple of seconds
+	cfg.Heartbeat.OfflineAfter = 2
+	cfg.History.MaxAge = 1
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{net.JoinHostPort(cfg.DB.Host, cfg.DB.Port)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Each heartbeat renews the agent's lease, rather than granting another
+	var agentLease int64
+	for i := 0; i < 2; i++ {
+		err = tdb.SetAgent(defs.AgentAdvert{Uuid: "agent1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Get(context.Background(), "/todd/agents/agent1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 || resp.Kvs[0].Lease == 0 {
+			t.Fatal("Expected agent to be attached to a lease")
+		}
+		if i > 0 && resp.Kvs[0].Lease != agentLease {
+			t.Fatalf("Agent moved from lease %d to %d", agentLease, resp.Kvs[0].Lease)
+		}
+		agentLease = resp.Kvs[0].Lease
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err = tdb.GetAgent("agent1"); err == db.ErrNotExist {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Agent was not removed when its lease expired: %v", err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	testUUID := hostresources.GenerateUuid()
+	err = tdb.InitTestRun(testUUID, map[string]map[string]string{
+		"sources": {"agent1": "src"},
+		"targets": {"agent2": "dst"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A testrun this small is written in a single transaction
+	resp, err := c.Get(context.Background(), "/todd/testruns/"+testUUID, clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 5 {
+		t.Fatalf("Expected 5 keys for new testrun, got %d", len(resp.Kvs))
+	}
+	for _, kv := range resp.Kvs {
+		if kv.CreateRevision != resp.Kvs[0].CreateRevision {
+			t.Fatalf("Key %s was created at revision %d, expected %d", kv.Key, kv.CreateRevision, resp.Kvs[0].CreateRevision)
+		}
+	}
+
+	err = tdb.SetAgentTestData(testUUID, "agent1", "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Get(context.Background(), "/todd/testruns/"+testUUID, clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 6 {
+		t.Fatalf("Expected 6 keys for testrun, got %d", len(resp.Kvs))
+	}
+
+	lease := resp.Kvs[0].Lease
+	for _, kv := range resp.Kvs {
+		if kv.Lease == 0 || kv.Lease != lease {
+			t.Fatalf("Key %s has lease %d, expected %d", kv.Key, kv.Lease, lease)
+		}
+	}
+
+	ttl, err := c.TimeToLive(context.Background(), clientv3.LeaseID(lease))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl.GrantedTTL != 3600 {
+		t.Fatalf("Expected testrun lease to be granted for an hour, got %d seconds", ttl.GrantedTTL)
+	}
+}
+
+// TestEtcdV3ManyAgents tests that a testrun with more agents than etcd allows operations in one transaction is created
+func TestEtcdV3ManyAgents(t *testing.T) {
+	cfg, stop := etcdV3Config(t)
+	defer stop()
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testUUID := hostresources.GenerateUuid()
+	testAgentMap := map[string]map[string]string{"sources": {}, "targets": {}}
+	for i := 0; i < 150; i++ {
+		testAgentMap["sources"]["src"+strconv.Itoa(i)] = "src"
+		testAgentMap["targets"]["dst"+strconv.Itoa(i)] = "dst"
+	}
+
+	err = tdb.InitTestRun(testUUID, testAgentMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := tdb.GetTestStatus(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 300 {
+		t.Fatalf("Expected 300 agents in testrun, got %d", len(status))
+	}
+	for agent, s := range status {
+		if s != "init" {
+			t.Fatalf("Expected agent %s to have status init, got %q", agent, s)
+		}
+	}
+}
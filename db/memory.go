@@ -0,0 +1,550 @@
+/*
+   ToDD databasePackage implementation for in-process (memory) storage
+
+   Nothing is persisted - everything is lost when the process exits. This plugin is meant for tests, and
+   for demos where the ToDD server and agents run within the same binary (see the memory comms plugin).
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+var (
+	memoryStoresMu sync.Mutex
+	memoryStores   = make(map[string]*memoryStore)
+)
+
+// memoryStore holds all of the data for one in-memory database. Values are stored as JSON, so that callers never
+// share memory with the database, just like with the other plugins.
+type memoryStore struct {
+	mu       sync.RWMutex
+	agents   map[string]memoryAgent
+	objects  map[string]map[string][]byte
+	groupmap map[string]string
+	testruns map[string]*memoryTestRun
+	history  map[string][]byte
+
+	// revisions holds every revision of each object, by type and label
+	revisions map[string]map[string][]objects.ObjectRevision
+
+	// schema is the schema version of this data, or 0 until the first Init
+	schema int
+
+	// notifier wakes up WatchTestStatus callers whenever a testrun's status changes
+	notifier statusNotifier
+}
+
+type memoryAgent struct {
+	advert  []byte
+	expires time.Time // zero means the agent doesn't expire
+}
+
+type memoryTestRun struct {
+	agents    map[string]map[string]string // agent UUID -> "group", "status" and "testdata"
+	cleandata *string
+}
+
+// getMemoryStore returns the in-memory database with the provided name, creating it if needed. Every memoryDB instance
+// using the same name shares the same data, since the server creates a new instance of the database plugin for most operations.
+func getMemoryStore(name string) *memoryStore {
+	memoryStoresMu.Lock()
+	defer memoryStoresMu.Unlock()
+
+	store, ok := memoryStores[name]
+	if !ok {
+		store = &memoryStore{
+			agents:    make(map[string]memoryAgent),
+			objects:   make(map[string]map[string][]byte),
+			groupmap:  make(map[string]string),
+			testruns:  make(map[string]*memoryTestRun),
+			history:   make(map[string][]byte),
+			revisions: make(map[string]map[string][]objects.ObjectRevision),
+		}
+		memoryStores[name] = store
+	}
+	return store
+}
+
+// newMemoryDB is a factory function that produces a new instance of memoryDB with the configuration
+// loaded and ready to be used. The DatabaseName option selects which in-memory database to use.
+func newMemoryDB(cfg config.Config) *memoryDB {
+	return &memoryDB{
+		config: cfg,
+		store:  getMemoryStore(cfg.DB.DatabaseName),
+	}
+}
+
+type memoryDB struct {
+	config config.Config
+	store  *memoryStore
+}
+
+// Init removes any registered agents, as the other plugins do when the server starts, and migrates the data
+// to the current schema version
+func (mdb *memoryDB) Init() error {
+	mdb.store.mu.Lock()
+	mdb.store.agents = make(map[string]memoryAgent)
+	mdb.store.mu.Unlock()
+
+	return migrateSchema(mdb)
+}
+
+func (mdb *memoryDB) getSchemaVersion() (int, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	return mdb.store.schema, nil
+}
+
+func (mdb *memoryDB) setSchemaVersion(version int) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	mdb.store.schema = version
+
+	return nil
+}
+
+// SetAgent will ingest an agent advertisement, and update or insert the agent record
+// in the database as needed.
+func (mdb *memoryDB) SetAgent(adv defs.AgentAdvert) error {
+
+	advJSON, err := json.Marshal(adv)
+	if err != nil {
+		log.Error("Problem converting Agent Advertisement to JSON")
+		return err
+	}
+
+	agent := memoryAgent{advert: advJSON}
+	if ttl := agentTTL(mdb.config); ttl > 0 {
+		agent.expires = time.Now().Add(ttl)
+	}
+
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	mdb.store.agents[adv.Uuid] = agent
+
+	return nil
+}
+
+// live returns true if this agent has not yet expired
+func (a memoryAgent) live() bool {
+	return a.expires.IsZero() || time.Now().Before(a.expires)
+}
+
+// GetAgent will retrieve a specific agent from the database by UUID
+func (mdb *memoryDB) GetAgent(uuid string) (*defs.AgentAdvert, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	agent, ok := mdb.store.agents[uuid]
+	if !ok || !agent.live() {
+		return nil, ErrNotExist
+	}
+
+	adv := new(defs.AgentAdvert)
+	err := json.Unmarshal(agent.advert, adv)
+	if err != nil {
+		return nil, err
+	}
+
+	return adv, nil
+}
+
+// GetAgents will retrieve all agents from the database
+func (mdb *memoryDB) GetAgents() ([]defs.AgentAdvert, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	retAdv := []defs.AgentAdvert{}
+	for _, agent := range mdb.store.agents {
+		if !agent.live() {
+			continue
+		}
+
+		var adv defs.AgentAdvert
+		err := json.Unmarshal(agent.advert, &adv)
+		if err != nil {
+			return nil, err
+		}
+		retAdv = append(retAdv, adv)
+	}
+
+	return retAdv, nil
+}
+
+// RemoveAgent will delete an agent from the database
+func (mdb *memoryDB) RemoveAgent(adv defs.AgentAdvert) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	if _, ok := mdb.store.agents[adv.Uuid]; !ok {
+		return ErrNotExist
+	}
+	delete(mdb.store.agents, adv.Uuid)
+
+	return nil
+}
+
+// GetObjects retrieves a list of ToddObjects of the provided type
+func (mdb *memoryDB) GetObjects(objType string) ([]objects.ToddObject, error) {
+
+	if objType == "" {
+		return nil, errors.New("Object API queried with no type argument")
+	}
+
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	// Objects are returned in order of their labels, as the other plugins do
+	var labels []string
+	for label := range mdb.store.objects[objType] {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	retObj := []objects.ToddObject{}
+	for _, label := range labels {
+		objJSON := mdb.store.objects[objType][label]
+
+		var baseobj objects.BaseObject
+		err := json.Unmarshal(objJSON, &baseobj)
+		if err != nil {
+			return nil, err
+		}
+
+		retObj = append(retObj, baseobj.ParseToddObject(objJSON))
+	}
+
+	return retObj, nil
+}
+
+// SetObject will insert or update a ToddObject, and keep it as a new revision
+func (mdb *memoryDB) SetObject(tobj objects.ToddObject, author string) error {
+
+	rev, err := objects.NewObjectRevision(tobj, author)
+	if err != nil {
+		return err
+	}
+
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	if mdb.store.objects[tobj.GetType()] == nil {
+		mdb.store.objects[tobj.GetType()] = make(map[string][]byte)
+	}
+	mdb.store.objects[tobj.GetType()][tobj.GetLabel()] = rev.Object
+	mdb.addObjectRevision(tobj.GetType(), tobj.GetLabel(), rev)
+
+	return nil
+}
+
+// DeleteObject will delete a ToddObject, and keep its deletion as a new revision
+func (mdb *memoryDB) DeleteObject(label string, objtype string, author string) error {
+
+	rev, err := objects.NewObjectRevision(nil, author)
+	if err != nil {
+		return err
+	}
+
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	if _, ok := mdb.store.objects[objtype][label]; !ok {
+		return ErrNotExist
+	}
+	delete(mdb.store.objects[objtype], label)
+	mdb.addObjectRevision(objtype, label, rev)
+
+	return nil
+}
+
+// addObjectRevision numbers a revision and adds it to the object's revisions. The store must be locked by the caller.
+func (mdb *memoryDB) addObjectRevision(objType, label string, rev objects.ObjectRevision) {
+	if mdb.store.revisions[objType] == nil {
+		mdb.store.revisions[objType] = make(map[string][]objects.ObjectRevision)
+	}
+	rev.Revision = len(mdb.store.revisions[objType][label]) + 1
+	mdb.store.revisions[objType][label] = append(mdb.store.revisions[objType][label], rev)
+}
+
+// GetObjectRevisions retrieves every revision of a ToddObject, oldest first
+func (mdb *memoryDB) GetObjectRevisions(objType, label string) ([]objects.ObjectRevision, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	revs := []objects.ObjectRevision{}
+	revs = append(revs, mdb.store.revisions[objType][label]...)
+
+	return revs, nil
+}
+
+// SetObjectRevisions replaces every revision of a ToddObject
+func (mdb *memoryDB) SetObjectRevisions(objType, label string, revs []objects.ObjectRevision) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	if mdb.store.revisions[objType] == nil {
+		mdb.store.revisions[objType] = make(map[string][]objects.ObjectRevision)
+	}
+	mdb.store.revisions[objType][label] = append([]objects.ObjectRevision{}, revs...)
+
+	return nil
+}
+
+// GetRevisedObjects retrieves the labels of every object of a type that has revisions, including deleted objects
+func (mdb *memoryDB) GetRevisedObjects(objType string) ([]string, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	labels := []string{}
+	for label := range mdb.store.revisions[objType] {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	return labels, nil
+}
+
+// SetGroupMap replaces the group map with the results of a grouping calculation
+func (mdb *memoryDB) SetGroupMap(groupmap map[string]string) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	mdb.store.groupmap = make(map[string]string)
+	for agent, group := range groupmap {
+		mdb.store.groupmap[agent] = group
+	}
+
+	return nil
+}
+
+// GetGroupMap returns a map containing agent-to-group mappings. Agent UUIDs are used for keys
+func (mdb *memoryDB) GetGroupMap() (map[string]string, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	retMap := map[string]string{}
+	for agent, group := range mdb.store.groupmap {
+		retMap[agent] = group
+	}
+
+	return retMap, nil
+}
+
+// InitTestRun creates an entry for a new testrun, and an entry for each agent participating in it. Each agent entry
+// starts out with that agent's current group, and an initial status of "init".
+func (mdb *memoryDB) InitTestRun(testUUID string, testAgentMap map[string]map[string]string) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	tr := &memoryTestRun{agents: make(map[string]map[string]string)}
+	for _, uuidmappings := range testAgentMap {
+		for agent, group := range uuidmappings {
+			tr.agents[agent] = map[string]string{
+				"group":  group,
+				"status": "init",
+			}
+		}
+	}
+	mdb.store.testruns[testUUID] = tr
+	mdb.store.notifier.notify(testUUID)
+
+	return nil
+}
+
+// setTestRunAgentField sets a single field of an agent's entry in a testrun, creating the entry if it doesn't exist.
+// The caller must hold the write lock.
+func (mdb *memoryDB) setTestRunAgentField(testUUID, agentUUID, field, value string) {
+	tr, ok := mdb.store.testruns[testUUID]
+	if !ok {
+		tr = &memoryTestRun{agents: make(map[string]map[string]string)}
+		mdb.store.testruns[testUUID] = tr
+	}
+	if tr.agents[agentUUID] == nil {
+		tr.agents[agentUUID] = make(map[string]string)
+	}
+	tr.agents[agentUUID][field] = value
+}
+
+// SetAgentTestStatus sets the status for an agent in a particular testrun
+func (mdb *memoryDB) SetAgentTestStatus(testUUID, agentUUID, status string) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	mdb.setTestRunAgentField(testUUID, agentUUID, "status", status)
+	mdb.store.notifier.notify(testUUID)
+	return nil
+}
+
+// SetAgentTestData sets the post-test data for an agent in a particular testrun
+func (mdb *memoryDB) SetAgentTestData(testUUID, agentUUID, testData string) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	mdb.setTestRunAgentField(testUUID, agentUUID, "testdata", testData)
+	return nil
+}
+
+// GetTestStatus returns a map containing a list of agent UUIDs that are participating in the provided test, and their status in this test.
+func (mdb *memoryDB) GetTestStatus(testUUID string) (map[string]string, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	retMap := make(map[string]string)
+	if tr, ok := mdb.store.testruns[testUUID]; ok {
+		for agent, fields := range tr.agents {
+			if status, ok := fields["status"]; ok {
+				retMap[agent] = status
+			}
+		}
+	}
+
+	return retMap, nil
+}
+
+// WatchTestStatus sends the status of every agent in the provided testrun, and sends it again whenever it changes, until stop is written to
+func (mdb *memoryDB) WatchTestStatus(testUUID string, stop *chan bool) (<-chan map[string]string, error) {
+	return mdb.store.notifier.watch(testUUID, stop, mdb.GetTestStatus)
+}
+
+// GetAgentTestData returns un-sanitized data from the individual agents in the provided source group. For a report of all
+// agents' data, which has been sanitized by the server, see GetCleanTestData
+func (mdb *memoryDB) GetAgentTestData(testUUID, sourceGroup string) (map[string]string, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	tr, ok := mdb.store.testruns[testUUID]
+	if !ok || len(tr.agents) == 0 {
+		return nil, ErrNotExist
+	}
+
+	retMap := make(map[string]string)
+	for agent, fields := range tr.agents {
+		if fields["group"] != sourceGroup {
+			continue
+		}
+		testData, ok := fields["testdata"]
+		if !ok {
+			return nil, ErrNotExist
+		}
+		retMap[agent] = testData
+	}
+
+	return retMap, nil
+}
+
+// WriteCleanTestData will write the post-test metrics data that has been cleaned up and
+// ready to be displayed or exported to the database
+func (mdb *memoryDB) WriteCleanTestData(testUUID string, testData string) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	tr, ok := mdb.store.testruns[testUUID]
+	if !ok {
+		tr = &memoryTestRun{agents: make(map[string]map[string]string)}
+		mdb.store.testruns[testUUID] = tr
+	}
+	tr.cleandata = &testData
+
+	return nil
+}
+
+// GetCleanTestData will retrieve clean test data from the database
+func (mdb *memoryDB) GetCleanTestData(testUUID string) (string, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	tr, ok := mdb.store.testruns[testUUID]
+	if !ok || tr.cleandata == nil {
+		return "", ErrNotExist
+	}
+
+	return *tr.cleandata, nil
+}
+
+// SetTestRunRecord inserts or updates the history record of a testrun
+func (mdb *memoryDB) SetTestRunRecord(record defs.TestRunRecord) error {
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	mdb.store.history[record.Uuid] = recordJSON
+
+	return nil
+}
+
+// GetTestRunRecord retrieves the history record of a testrun
+func (mdb *memoryDB) GetTestRunRecord(testUUID string) (*defs.TestRunRecord, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	recordJSON, ok := mdb.store.history[testUUID]
+	if !ok {
+		return nil, ErrNotExist
+	}
+
+	record := new(defs.TestRunRecord)
+	err := json.Unmarshal(recordJSON, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// GetTestRunRecords retrieves the history records of all testruns, most recently started first
+func (mdb *memoryDB) GetTestRunRecords() ([]defs.TestRunRecord, error) {
+	mdb.store.mu.RLock()
+	defer mdb.store.mu.RUnlock()
+
+	records := []defs.TestRunRecord{}
+	for _, recordJSON := range mdb.store.history {
+		var record defs.TestRunRecord
+		err := json.Unmarshal(recordJSON, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sortTestRunRecords(records)
+
+	return records, nil
+}
+
+// DeleteTestRun removes the history record of a testrun, along with its status and data
+func (mdb *memoryDB) DeleteTestRun(testUUID string) error {
+	mdb.store.mu.Lock()
+	defer mdb.store.mu.Unlock()
+
+	_, ok := mdb.store.history[testUUID]
+	delete(mdb.store.history, testUUID)
+	delete(mdb.store.testruns, testUUID)
+	if !ok {
+		return ErrNotExist
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+    ToDD Database Schema Versions
+
+    Every database plugin keeps the version of the layout its data is stored in. When the server starts, tdb.Init()
+    brings older data forward by running each migration written since, and refuses to run against data written by a
+    newer server, which this server may not understand.
+
+    Migrations are written once against the DatabasePackage interface where possible, so that they apply to every plugin.
+    A migration that only concerns one plugin can check for it with a type assertion, and return nil for the others.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// migrationAuthor is recorded as the author of any object revisions created by a migration
+const migrationAuthor = "todd-server migration"
+
+// migration moves data from one schema version to the next
+type migration struct {
+	description string
+	migrate     func(DatabasePackage) error
+}
+
+// migrations holds every migration, in order. migrations[0] moves data from version 1 to version 2, and so on, so new
+// migrations must only ever be added to the end of this list.
+var migrations = []migration{
+	{"add a first revision to objects created before revisions were kept", addMissingObjectRevisions},
+}
+
+// schemaVersion is the version of the layout written by this server
+var schemaVersion = len(migrations) + 1
+
+// schemaStore is implemented by every database plugin, to keep the schema version alongside the rest of its data
+type schemaStore interface {
+	DatabasePackage
+
+	// Returns 0 if no version has been stored yet
+	getSchemaVersion() (int, error)
+	setSchemaVersion(int) error
+}
+
+// migrateSchema runs every migration needed to bring the database up to schemaVersion. Databases without a version
+// were written before versions were kept, and are treated as version 1.
+func migrateSchema(tdb schemaStore) error {
+
+	version, err := tdb.getSchemaVersion()
+	if err != nil {
+		log.Error("Problem retrieving schema version")
+		return err
+	}
+	if version == 0 {
+		version = 1
+	}
+
+	if version > schemaVersion {
+		return fmt.Errorf(
+			"Database has schema version %d, but this server only supports up to version %d - please upgrade ToDD",
+			version, schemaVersion,
+		)
+	}
+
+	for ; version < schemaVersion; version++ {
+		m := migrations[version-1]
+		log.Infof("Migrating database from schema version %d to %d: %s", version, version+1, m.description)
+
+		err = m.migrate(tdb)
+		if err != nil {
+			return fmt.Errorf("Error migrating database to schema version %d: %v", version+1, err)
+		}
+
+		// Store the version after each migration, so that a failed migration doesn't run the earlier ones again
+		err = tdb.setSchemaVersion(version + 1)
+		if err != nil {
+			log.Error("Problem setting schema version")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addMissingObjectRevisions adds the current state of an object as its first revision, if it has none. Without this,
+// objects created before revisions were kept would have no history to diff or roll back to.
+func addMissingObjectRevisions(tdb DatabasePackage) error {
+	for _, objType := range objects.Types {
+		objs, err := tdb.GetObjects(objType)
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range objs {
+			revs, err := tdb.GetObjectRevisions(objType, obj.GetLabel())
+			if err != nil {
+				return err
+			}
+			if len(revs) > 0 {
+				continue
+			}
+
+			rev, err := objects.NewObjectRevision(obj, migrationAuthor)
+			if err != nil {
+				return err
+			}
+			rev.Revision = 1
+
+			err = tdb.SetObjectRevisions(objType, obj.GetLabel(), []objects.ObjectRevision{rev})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+    Tests for database schema versions and migrations
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"testing"
+
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db/etcdtest"
+	"github.com/Mierdin/todd/hostresources"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// testMigrations checks that Init brings a database up to the current schema version, that objects created before
+// revisions were kept are given a first revision, and that a database with a newer schema is refused
+func testMigrations(t *testing.T, tdb schemaStore) {
+
+	err := tdb.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := tdb.getSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion {
+		t.Fatalf("Expected schema version %d after Init, got %d", schemaVersion, version)
+	}
+
+	// Go back to the first version, with an object that has no revisions
+	label := "migration-" + hostresources.GenerateUuid()
+
+	var group objects.GroupObject
+	group.Type = "group"
+	group.Label = label
+	group.Spec.Group = label
+	group.Spec.Matches = []map[string]string{{"hostname": "todd-agent-1"}}
+
+	err = tdb.SetObject(group, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tdb.SetObjectRevisions("group", label, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tdb.setSchemaVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tdb.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := tdb.GetObjectRevisions("group", label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 || revs[0].Revision != 1 || revs[0].Author != migrationAuthor || revs[0].Deleted {
+		t.Fatalf("Expected a single revision added by the migration, got %+v", revs)
+	}
+	version, err = tdb.getSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion {
+		t.Fatalf("Expected schema version %d after migrating, got %d", schemaVersion, version)
+	}
+
+	// Objects that already have revisions are left alone
+	err = tdb.setSchemaVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tdb.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revs, err = tdb.GetObjectRevisions("group", label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 {
+		t.Fatalf("Expected migrating again to leave the revisions alone, got %+v", revs)
+	}
+
+	// Data written by a newer server is refused, and left as it is
+	err = tdb.setSchemaVersion(schemaVersion + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.setSchemaVersion(schemaVersion)
+
+	if err = tdb.Init(); err == nil {
+		t.Fatal("Expected Init to refuse a newer schema version")
+	}
+	version, err = tdb.getSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion+1 {
+		t.Fatalf("Expected a newer schema version to be left alone, got %d", version)
+	}
+}
+
+func TestMemoryMigrations(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.DatabaseName = hostresources.GenerateUuid()
+
+	testMigrations(t, newMemoryDB(cfg))
+}
+
+func TestSqliteMigrations(t *testing.T) {
+	sqlitedb, cleanup := newTestSqliteDB(t)
+	defer cleanup()
+
+	testMigrations(t, sqlitedb)
+}
+
+func TestEtcdMigrations(t *testing.T) {
+	host, port, stop := etcdtest.Start(t)
+	defer stop()
+
+	var cfg config.Config
+	cfg.DB.Host = host
+	cfg.DB.Port = port
+
+	testMigrations(t, newEtcdDB(cfg))
+}
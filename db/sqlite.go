@@ -0,0 +1,824 @@
+/*
+   ToDD databasePackage implementation for SQLite
+
+   This plugin stores everything in a single SQLite file on the ToDD server, so it doesn't require a separate
+   database server. It is well suited for lab or single-node deployments, but since the database is local
+   to the server, it can't be shared between several ToDD servers.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // This look strange but is necessary - the sqlite package is used indirectly by database/sql
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// sqliteBusyTimeout is how long (in milliseconds) a query will wait for a lock held by another process
+const sqliteBusyTimeout = 5000
+
+var (
+	sqliteConnsMu sync.Mutex
+	sqliteConns   = make(map[string]*sql.DB)
+
+	// sqliteNotifiers wake up WatchTestStatus callers for each database file. Only the ToDD server writes to the file,
+	// so every status change goes through this plugin.
+	sqliteNotifiers = make(map[string]*statusNotifier)
+)
+
+// getSqliteConn returns the shared connection to the database file at the provided path, opening it if needed. Every
+// sqliteDB instance using the same file shares a single connection, so that writes from different goroutines are
+// serialized, instead of failing because the database is locked.
+func getSqliteConn(path string) (*sql.DB, *statusNotifier, error) {
+	sqliteConnsMu.Lock()
+	defer sqliteConnsMu.Unlock()
+
+	if conn, ok := sqliteConns[path]; ok {
+		return conn, sqliteNotifiers[path], nil
+	}
+
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=%d", path, sqliteBusyTimeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetMaxOpenConns(1)
+
+	sqliteConns[path] = conn
+	sqliteNotifiers[path] = new(statusNotifier)
+	return conn, sqliteNotifiers[path], nil
+}
+
+// newSqliteDB is a factory function that produces a new instance of sqliteDB with the configuration
+// loaded and ready to be used.
+func newSqliteDB(cfg config.Config) (*sqliteDB, error) {
+	path := cfg.DB.Path
+	if path == "" {
+		path = fmt.Sprintf("%s/server.db", cfg.LocalResources.OptDir)
+	}
+
+	conn, notifier, err := getSqliteConn(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteDB{config: cfg, db: conn, notifier: notifier}, nil
+}
+
+type sqliteDB struct {
+	config   config.Config
+	db       *sql.DB
+	notifier *statusNotifier
+}
+
+// Init creates the tables used by this plugin, if they don't already exist, and migrates the data to the current
+// schema version. As with the etcd plugin, any agents registered before the server was restarted are removed.
+func (sqlitedb *sqliteDB) Init() error {
+
+	sqlStmt := `
+    create table if not exists agents (uuid text not null primary key, advert text, expires integer);
+    delete from agents;
+    create table if not exists objects (type text not null, label text not null, object text, primary key (type, label));
+    create table if not exists groupmap (agent text not null primary key, groupname text);
+    create table if not exists testruns (uuid text not null primary key, created integer, cleandata text);
+    create table if not exists testrunagents (testrun text not null, agent text not null, groupname text, status text, testdata text, primary key (testrun, agent));
+    create table if not exists history (uuid text not null primary key, started integer, record text);
+    create table if not exists objectrevisions (type text not null, label text not null, revision integer not null, record text, primary key (type, label, revision));
+    create table if not exists schema (version integer);
+    `
+
+	_, err := sqlitedb.db.Exec(sqlStmt)
+	if err != nil {
+		log.Errorf("%q: %s\n", err, sqlStmt)
+		return err
+	}
+
+	return migrateSchema(sqlitedb)
+}
+
+func (sqlitedb *sqliteDB) getSchemaVersion() (int, error) {
+	var version int
+	err := sqlitedb.db.QueryRow("select version from schema").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (sqlitedb *sqliteDB) setSchemaVersion(version int) error {
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from schema")
+	if err == nil {
+		_, err = tx.Exec("insert into schema(version) values(?)", version)
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Error("Problem setting schema version in sqlite")
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetAgent will ingest an agent advertisement, and update or insert the agent record
+// in the database as needed.
+func (sqlitedb *sqliteDB) SetAgent(adv defs.AgentAdvert) error {
+	log.Infof("Setting agent %s", adv.Uuid)
+
+	advJSON, err := json.Marshal(adv)
+	if err != nil {
+		log.Error("Problem converting Agent Advertisement to JSON")
+		return err
+	}
+
+	var expires int64
+	if ttl := agentTTL(sqlitedb.config); ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+
+	_, err = sqlitedb.db.Exec("insert or replace into agents(uuid, advert, expires) values(?, ?, ?)", adv.Uuid, string(advJSON), expires)
+	if err != nil {
+		log.Error("Problem setting agent in sqlite")
+		return err
+	}
+
+	return nil
+}
+
+// GetAgent will retrieve a specific agent from the database by UUID
+func (sqlitedb *sqliteDB) GetAgent(uuid string) (*defs.AgentAdvert, error) {
+
+	var advJSON string
+	err := sqlitedb.db.QueryRow(
+		"select advert from agents where uuid = ? and (expires = 0 or expires > ?)", uuid, time.Now().UnixNano(),
+	).Scan(&advJSON)
+	if err == sql.ErrNoRows {
+		log.Errorf("Agent %s not found.", uuid)
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	adv := new(defs.AgentAdvert)
+	err = json.Unmarshal([]byte(advJSON), adv)
+	if err != nil {
+		log.Error("Failed to unmarshal json into agent advertisement")
+		return nil, err
+	}
+
+	return adv, nil
+}
+
+// GetAgents will retrieve all agents from the database
+func (sqlitedb *sqliteDB) GetAgents() ([]defs.AgentAdvert, error) {
+
+	retAdv := []defs.AgentAdvert{}
+
+	rows, err := sqlitedb.db.Query("select advert from agents where expires = 0 or expires > ?", time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var advJSON string
+		err = rows.Scan(&advJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		var adv defs.AgentAdvert
+		err = json.Unmarshal([]byte(advJSON), &adv)
+		if err != nil {
+			log.Error("Failed to unmarshal json into agent advertisement")
+			return nil, err
+		}
+
+		retAdv = append(retAdv, adv)
+	}
+
+	return retAdv, rows.Err()
+}
+
+// RemoveAgent will delete an agent from the database
+func (sqlitedb *sqliteDB) RemoveAgent(adv defs.AgentAdvert) error {
+
+	res, err := sqlitedb.db.Exec("delete from agents where uuid = ?", adv.Uuid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotExist
+	}
+
+	log.Infof("Removed agent %s", adv.Uuid)
+
+	return nil
+}
+
+// GetObjects retrieves a list of ToddObjects stored within the database, and returns this as a slice.
+// This requires an "objType" string to specify the type of object being looked up.
+func (sqlitedb *sqliteDB) GetObjects(objType string) ([]objects.ToddObject, error) {
+
+	retObj := []objects.ToddObject{}
+
+	if objType == "" {
+		return nil, errors.New("Object API queried with no type argument")
+	}
+
+	rows, err := sqlitedb.db.Query("select object from objects where type = ? order by label", objType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var objJSON string
+		err = rows.Scan(&objJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		// Marshal API data into ToddObject
+		var baseobj objects.BaseObject
+		err = json.Unmarshal([]byte(objJSON), &baseobj)
+		if err != nil {
+			return nil, err
+		}
+
+		// Generate a more specific Todd Object based on the JSON data
+		retObj = append(retObj, baseobj.ParseToddObject([]byte(objJSON)))
+	}
+
+	return retObj, rows.Err()
+}
+
+// SetObject will insert or update a ToddObject within the database, and keep it as a new revision
+func (sqlitedb *sqliteDB) SetObject(tobj objects.ToddObject, author string) error {
+
+	rev, err := objects.NewObjectRevision(tobj, author)
+	if err != nil {
+		return err
+	}
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"insert or replace into objects(type, label, object) values(?, ?, ?)", tobj.GetType(), tobj.GetLabel(), string(rev.Object),
+	)
+	if err != nil {
+		tx.Rollback()
+		log.Error("Problem setting object in sqlite")
+		return err
+	}
+
+	err = addObjectRevision(tx, tobj.GetType(), tobj.GetLabel(), rev)
+	if err != nil {
+		tx.Rollback()
+		log.Error("Problem setting object revision in sqlite")
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Wrote new Todd Object to sqlite: %s/%s", tobj.GetType(), tobj.GetLabel())
+	return nil
+}
+
+// DeleteObject will delete a ToddObject from the database, and keep its deletion as a new revision
+func (sqlitedb *sqliteDB) DeleteObject(label string, objtype string, author string) error {
+
+	rev, err := objects.NewObjectRevision(nil, author)
+	if err != nil {
+		return err
+	}
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("delete from objects where type = ? and label = ?", objtype, label)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		return ErrNotExist
+	}
+
+	err = addObjectRevision(tx, objtype, label, rev)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Removed object %s/%s", objtype, label)
+
+	return nil
+}
+
+// addObjectRevision numbers a revision and adds it to the object's revisions, within the transaction that changed the object
+func addObjectRevision(tx *sql.Tx, objType, label string, rev objects.ObjectRevision) error {
+
+	err := tx.QueryRow(
+		"select coalesce(max(revision), 0) + 1 from objectrevisions where type = ? and label = ?", objType, label,
+	).Scan(&rev.Revision)
+	if err != nil {
+		return err
+	}
+
+	revJSON, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"insert into objectrevisions(type, label, revision, record) values(?, ?, ?, ?)", objType, label, rev.Revision, string(revJSON),
+	)
+	return err
+}
+
+// GetObjectRevisions retrieves every revision of a ToddObject, oldest first
+func (sqlitedb *sqliteDB) GetObjectRevisions(objType, label string) ([]objects.ObjectRevision, error) {
+
+	rows, err := sqlitedb.db.Query(
+		"select record from objectrevisions where type = ? and label = ? order by revision", objType, label,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []objects.ObjectRevision{}
+	for rows.Next() {
+		var revJSON string
+		err = rows.Scan(&revJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		var rev objects.ObjectRevision
+		err = json.Unmarshal([]byte(revJSON), &rev)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+
+	return revs, rows.Err()
+}
+
+// SetObjectRevisions replaces every revision of a ToddObject
+func (sqlitedb *sqliteDB) SetObjectRevisions(objType, label string, revs []objects.ObjectRevision) error {
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from objectrevisions where type = ? and label = ?", objType, label)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, rev := range revs {
+		revJSON, err := json.Marshal(rev)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(
+			"insert into objectrevisions(type, label, revision, record) values(?, ?, ?, ?)", objType, label, rev.Revision, string(revJSON),
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetRevisedObjects retrieves the labels of every object of a type that has revisions, including deleted objects
+func (sqlitedb *sqliteDB) GetRevisedObjects(objType string) ([]string, error) {
+
+	rows, err := sqlitedb.db.Query("select distinct label from objectrevisions where type = ? order by label", objType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []string{}
+	for rows.Next() {
+		var label string
+		err = rows.Scan(&label)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+
+	return labels, rows.Err()
+}
+
+// SetGroupMap replaces the group map with the results of a grouping calculation
+func (sqlitedb *sqliteDB) SetGroupMap(groupmap map[string]string) error {
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from groupmap")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for agent, group := range groupmap {
+		_, err = tx.Exec("insert into groupmap(agent, groupname) values(?, ?)", agent, group)
+		if err != nil {
+			tx.Rollback()
+			log.Error("Problem setting group map in sqlite")
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Updated group map in sqlite: %v", groupmap)
+
+	return nil
+}
+
+// GetGroupMap returns a map containing agent-to-group mappings. Agent UUIDs are used for keys
+func (sqlitedb *sqliteDB) GetGroupMap() (map[string]string, error) {
+
+	retMap := map[string]string{}
+
+	rows, err := sqlitedb.db.Query("select agent, groupname from groupmap")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var agent, group string
+		err = rows.Scan(&agent, &group)
+		if err != nil {
+			return nil, err
+		}
+		retMap[agent] = group
+	}
+
+	return retMap, rows.Err()
+}
+
+// InitTestRun creates an entry for a new testrun, and an entry for each agent participating in it. Each agent entry
+// starts out with that agent's current group, and an initial status of "init".
+func (sqlitedb *sqliteDB) InitTestRun(testUUID string, testAgentMap map[string]map[string]string) error {
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("insert or replace into testruns(uuid, created) values(?, ?)", testUUID, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		log.Error("Problem setting testrun UUID: ", testUUID)
+		return err
+	}
+
+	// The outer key is either "targets" or "sources". The inner map contains uuid (key) to group name (value) mappings for this test.
+	for _, uuidmappings := range testAgentMap {
+		for agent, group := range uuidmappings {
+			_, err = tx.Exec(
+				"insert or replace into testrunagents(testrun, agent, groupname, status) values(?, ?, ?, ?)",
+				testUUID, agent, group, "init",
+			)
+			if err != nil {
+				tx.Rollback()
+				log.Error("Problem setting initial agent placeholder in testrun: ", testUUID)
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	sqlitedb.notifier.notify(testUUID)
+	return nil
+}
+
+// setTestRunAgentField sets a single field of an agent's entry in a testrun, creating the entry if it doesn't exist
+func (sqlitedb *sqliteDB) setTestRunAgentField(testUUID, agentUUID, field, value string) error {
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("insert or ignore into testrunagents(testrun, agent) values(?, ?)", testUUID, agentUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("update testrunagents set %s = ? where testrun = ? and agent = ?", field), value, testUUID, agentUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetAgentTestStatus sets the status for an agent in a particular testrun
+func (sqlitedb *sqliteDB) SetAgentTestStatus(testUUID, agentUUID, status string) error {
+	err := sqlitedb.setTestRunAgentField(testUUID, agentUUID, "status", status)
+	if err != nil {
+		log.Errorf("Problem updating status for agent %s in test %s", agentUUID, testUUID)
+		log.Error(err)
+		return err
+	}
+
+	sqlitedb.notifier.notify(testUUID)
+	return nil
+}
+
+// SetAgentTestData sets the post-test data for an agent in a particular testrun
+func (sqlitedb *sqliteDB) SetAgentTestData(testUUID, agentUUID, testData string) error {
+	err := sqlitedb.setTestRunAgentField(testUUID, agentUUID, "testdata", testData)
+	if err != nil {
+		log.Errorf("Problem updating testdata for agent %s in test %s", agentUUID, testUUID)
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// GetTestStatus returns a map containing a list of agent UUIDs that are participating in the provided test, and their status in this test.
+func (sqlitedb *sqliteDB) GetTestStatus(testUUID string) (map[string]string, error) {
+
+	retMap := make(map[string]string)
+
+	rows, err := sqlitedb.db.Query("select agent, status from testrunagents where testrun = ? and status is not null", testUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var agent, status string
+		err = rows.Scan(&agent, &status)
+		if err != nil {
+			return nil, err
+		}
+		retMap[agent] = status
+	}
+
+	return retMap, rows.Err()
+}
+
+// WatchTestStatus sends the status of every agent in the provided testrun, and sends it again whenever it changes, until stop is written to
+func (sqlitedb *sqliteDB) WatchTestStatus(testUUID string, stop *chan bool) (<-chan map[string]string, error) {
+	return sqlitedb.notifier.watch(testUUID, stop, sqlitedb.GetTestStatus)
+}
+
+// GetAgentTestData returns un-sanitized data from the individual agents in the provided source group. For a report of all
+// agents' data, which has been sanitized by the server, see GetCleanTestData
+func (sqlitedb *sqliteDB) GetAgentTestData(testUUID, sourceGroup string) (map[string]string, error) {
+
+	retMap := make(map[string]string)
+
+	rows, err := sqlitedb.db.Query("select agent, testdata from testrunagents where testrun = ? and groupname = ?", testUUID, sourceGroup)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		found = true
+
+		var agent string
+		var testData sql.NullString
+		err = rows.Scan(&agent, &testData)
+		if err != nil {
+			return nil, err
+		}
+		if !testData.Valid {
+			log.Errorf("Error retrieving testdata of agent in: %s", testUUID)
+			return nil, ErrNotExist
+		}
+		retMap[agent] = testData.String
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// As with etcd, asking for the data of a testrun that doesn't exist is an error
+	if !found {
+		var count int
+		err = sqlitedb.db.QueryRow("select count(*) from testrunagents where testrun = ?", testUUID).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			log.Errorf("Error - empty test encountered for %q", testUUID)
+			return nil, ErrNotExist
+		}
+	}
+
+	return retMap, nil
+}
+
+// WriteCleanTestData will write the post-test metrics data that has been cleaned up and
+// ready to be displayed or exported to the database
+func (sqlitedb *sqliteDB) WriteCleanTestData(testUUID string, testData string) error {
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("insert or ignore into testruns(uuid, created) values(?, ?)", testUUID, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("update testruns set cleandata = ? where uuid = ?", testData, testUUID)
+	if err != nil {
+		tx.Rollback()
+		log.Error("Problem setting clean test data in sqlite")
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Wrote clean test data to test uuid: %s", testUUID)
+
+	return nil
+}
+
+// GetCleanTestData will retrieve clean test data from the database
+func (sqlitedb *sqliteDB) GetCleanTestData(testUUID string) (string, error) {
+
+	var testData sql.NullString
+	err := sqlitedb.db.QueryRow("select cleandata from testruns where uuid = ?", testUUID).Scan(&testData)
+	if err == sql.ErrNoRows || (err == nil && !testData.Valid) {
+		return "", ErrNotExist
+	} else if err != nil {
+		log.Errorf("Error - empty test data: %s", testUUID)
+		return "", err
+	}
+
+	return testData.String, nil
+}
+
+// SetTestRunRecord inserts or updates the history record of a testrun
+func (sqlitedb *sqliteDB) SetTestRunRecord(record defs.TestRunRecord) error {
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlitedb.db.Exec(
+		"insert or replace into history(uuid, started, record) values(?, ?, ?)",
+		record.Uuid, record.Started.UnixNano(), string(recordJSON),
+	)
+	if err != nil {
+		log.Errorf("Problem setting history of testrun %s in sqlite", record.Uuid)
+		return err
+	}
+
+	return nil
+}
+
+// GetTestRunRecord retrieves the history record of a testrun
+func (sqlitedb *sqliteDB) GetTestRunRecord(testUUID string) (*defs.TestRunRecord, error) {
+
+	var recordJSON string
+	err := sqlitedb.db.QueryRow("select record from history where uuid = ?", testUUID).Scan(&recordJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := new(defs.TestRunRecord)
+	err = json.Unmarshal([]byte(recordJSON), record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// GetTestRunRecords retrieves the history records of all testruns, most recently started first
+func (sqlitedb *sqliteDB) GetTestRunRecords() ([]defs.TestRunRecord, error) {
+
+	rows, err := sqlitedb.db.Query("select record from history order by started desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []defs.TestRunRecord{}
+	for rows.Next() {
+		var recordJSON string
+		err = rows.Scan(&recordJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		var record defs.TestRunRecord
+		err = json.Unmarshal([]byte(recordJSON), &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// DeleteTestRun removes the history record of a testrun, along with its status and data
+func (sqlitedb *sqliteDB) DeleteTestRun(testUUID string) error {
+
+	tx, err := sqlitedb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("delete from history where uuid = ?", testUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, stmt := range []string{"delete from testruns where uuid = ?", "delete from testrunagents where testrun = ?"} {
+		_, err = tx.Exec(stmt, testUUID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err == nil && deleted == 0 {
+		return ErrNotExist
+	}
+
+	log.Infof("Removed testrun %s", testUUID)
+
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+    Tests for the SQLite database plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// newTestSqliteDB returns an initialized sqliteDB stored in a temporary directory, along with a function that cleans up after it
+func newTestSqliteDB(t *testing.T) (*sqliteDB, func()) {
+	dir, err := ioutil.TempDir("", "todd-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config.Config
+	cfg.DB.Plugin = "sqlite"
+	cfg.LocalResources.OptDir = dir
+
+	sqlitedb, err := newSqliteDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitedb.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sqlitedb, func() { os.RemoveAll(dir) }
+}
+
+// TestSqliteAgents tests that agents can be set, retrieved and removed, and that they expire
+func TestSqliteAgents(t *testing.T) {
+	sqlitedb, cleanup := newTestSqliteDB(t)
+	defer cleanup()
+
+	err := sqlitedb.SetAgent(defs.AgentAdvert{Uuid: "agent1", DefaultAddr: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := sqlitedb.GetAgent("agent1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.DefaultAddr != "10.0.0.1" {
+		t.Fatalf("Retrieved incorrect agent: %+v", agent)
+	}
+
+	err = sqlitedb.RemoveAgent(*agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sqlitedb.GetAgent("agent1"); err != ErrNotExist {
+		t.Fatalf("Expected ErrNotExist for a removed agent, got %v", err)
+	}
+
+	// Agents expire once they've gone long enough without being written
+	sqlitedb.config.Heartbeat.OfflineAfter = 1
+	err = sqlitedb.SetAgent(defs.AgentAdvert{Uuid: "agent2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	agents, err := sqlitedb.GetAgents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 0 {
+		t.Fatalf("Expected expired agent to be left out, got %+v", agents)
+	}
+}
+
+// TestSqliteTestRun tests the lifecycle of a testrun's status and data
+func TestSqliteTestRun(t *testing.T) {
+	sqlitedb, cleanup := newTestSqliteDB(t)
+	defer cleanup()
+
+	err := sqlitedb.InitTestRun("test1", map[string]map[string]string{
+		"sources": {"agent1": "src"},
+		"targets": {"agent2": "dst"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sqlitedb.SetAgentTestStatus("test1", "agent1", "finished")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := sqlitedb.GetTestStatus("test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status["agent1"] != "finished" || status["agent2"] != "init" {
+		t.Fatalf("Retrieved incorrect test status: %v", status)
+	}
+
+	err = sqlitedb.SetAgentTestData("test1", "agent1", `{"10.0.0.2":{}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := sqlitedb.GetAgentTestData("test1", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data["agent1"] != `{"10.0.0.2":{}}` {
+		t.Fatalf("Retrieved incorrect test data: %v", data)
+	}
+
+	if _, err = sqlitedb.GetCleanTestData("test1"); err != ErrNotExist {
+		t.Fatalf("Expected ErrNotExist before clean data is written, got %v", err)
+	}
+	err = sqlitedb.WriteCleanTestData("test1", "clean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean, err := sqlitedb.GetCleanTestData("test1")
+	if err != nil || clean != "clean" {
+		t.Fatalf("Retrieved incorrect clean test data: %q, %v", clean, err)
+	}
+}
+
+// TestSqliteConcurrent tests that several instances of the plugin can write to the same database at once, as the server does
+func TestSqliteConcurrent(t *testing.T) {
+	sqlitedb, cleanup := newTestSqliteDB(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// The server creates a new instance of the plugin for almost every operation
+			tdb, err := newSqliteDB(sqlitedb.config)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			var group objects.GroupObject
+			group.Type = "group"
+			group.Label = fmt.Sprintf("group%d", i)
+
+			errs <- tdb.SetAgent(defs.AgentAdvert{Uuid: fmt.Sprintf("agent%d", i)})
+			errs <- tdb.SetObject(group, "test")
+			errs <- tdb.SetGroupMap(map[string]string{fmt.Sprintf("agent%d", i): group.Label})
+			errs <- tdb.SetAgentTestStatus("test1", fmt.Sprintf("agent%d", i), "finished")
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agents, err := sqlitedb.GetAgents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := sqlitedb.GetObjects("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := sqlitedb.GetTestStatus("test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 20 || len(groups) != 20 || len(status) != 20 {
+		t.Fatalf("Expected 20 of each, got %d agents, %d groups and %d statuses", len(agents), len(groups), len(status))
+	}
+}
@@ -0,0 +1,147 @@
+/*
+    ToDD testrun status watching
+
+    Helpers shared by the database plugins for implementing WatchTestStatus.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package db
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sendLatestStatus sends a status snapshot on a watch channel without blocking. Each snapshot contains the status of
+// every agent, so if the watcher hasn't received the previous snapshot yet, it is replaced with this one.
+func sendLatestStatus(out chan map[string]string, status map[string]string) {
+	select {
+	case out <- status:
+	default:
+		select {
+		case <-out:
+		default:
+		}
+		out <- status
+	}
+}
+
+// statusEqual returns true if two status snapshots contain the same agents with the same statuses
+func statusEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for agent, status := range a {
+		if s, ok := b[agent]; !ok || s != status {
+			return false
+		}
+	}
+	return true
+}
+
+// copyStatus returns a copy of a status snapshot, for plugins that keep updating their own copy after sending it
+func copyStatus(status map[string]string) map[string]string {
+	retMap := make(map[string]string)
+	for agent, s := range status {
+		retMap[agent] = s
+	}
+	return retMap
+}
+
+// statusNotifier wakes up goroutines watching the status of a testrun. It is used by plugins whose database can't be
+// watched directly, and which are only written to by this process (sqlite and memory), so every status change is
+// made through the plugin and can be announced here.
+type statusNotifier struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan bool]bool
+}
+
+// subscribe returns a channel that receives a value whenever the status of the provided testrun may have changed
+func (sn *statusNotifier) subscribe(testUUID string) chan bool {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if sn.watchers == nil {
+		sn.watchers = make(map[string]map[chan bool]bool)
+	}
+	if sn.watchers[testUUID] == nil {
+		sn.watchers[testUUID] = make(map[chan bool]bool)
+	}
+
+	c := make(chan bool, 1)
+	sn.watchers[testUUID][c] = true
+	return c
+}
+
+// unsubscribe stops sending notifications on a channel returned by subscribe
+func (sn *statusNotifier) unsubscribe(testUUID string, c chan bool) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	delete(sn.watchers[testUUID], c)
+	if len(sn.watchers[testUUID]) == 0 {
+		delete(sn.watchers, testUUID)
+	}
+}
+
+// notify wakes up every watcher of the provided testrun. It never blocks - watchers that haven't caught up with a
+// previous notification already have one pending.
+func (sn *statusNotifier) notify(testUUID string) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	for c := range sn.watchers[testUUID] {
+		select {
+		case c <- true:
+		default:
+		}
+	}
+}
+
+// watch implements WatchTestStatus using notifications. The status is read with getStatus when the watch starts, and
+// again after every notification, and a snapshot is sent whenever it has changed.
+func (sn *statusNotifier) watch(testUUID string, stop *chan bool, getStatus func(string) (map[string]string, error)) (<-chan map[string]string, error) {
+
+	// Subscribe before the first read, so that no change can be missed in between
+	notifications := sn.subscribe(testUUID)
+
+	status, err := getStatus(testUUID)
+	if err != nil {
+		sn.unsubscribe(testUUID, notifications)
+		return nil, err
+	}
+
+	out := make(chan map[string]string, 1)
+	out <- status
+
+	go func() {
+		defer close(out)
+		defer sn.unsubscribe(testUUID, notifications)
+
+		for {
+			select {
+			case <-*stop:
+				return
+			case <-notifications:
+			}
+
+			newStatus, err := getStatus(testUUID)
+			if err != nil {
+				log.Errorf("Error retrieving status of testrun %s: %v", testUUID, err)
+				return
+			}
+			if statusEqual(status, newStatus) {
+				continue
+			}
+
+			status = newStatus
+			sendLatestStatus(out, status)
+		}
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,157 @@
+/*
+    ToDD agent state tracking
+
+    Agents send the server a heartbeat at a regular interval. The server records when it last heard from
+    each agent, and moves agents it hasn't heard from in a while from "online" to "stale", and eventually
+    to "offline", at which point they are removed from the database.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package agentstate
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+)
+
+// Event describes an agent moving from one state to another. From is empty for agents that were just registered.
+type Event struct {
+	Uuid string
+	From string
+	To   string
+	Time time.Time
+}
+
+var (
+	subscribersMu sync.Mutex
+	subscribers   []func(Event)
+)
+
+// Subscribe registers a function to be called every time an agent changes state
+func Subscribe(f func(Event)) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers = append(subscribers, f)
+}
+
+// emit logs an event, and passes it to all subscribers
+func emit(uuid, from, to string) {
+	e := Event{
+		Uuid: uuid,
+		From: from,
+		To:   to,
+		Time: time.Now().UTC(),
+	}
+
+	log.WithFields(log.Fields{
+		"agent": uuid,
+		"from":  from,
+		"to":    to,
+	}).Infof("Agent %s is now %s", uuid, to)
+
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for _, f := range subscribers {
+		f(e)
+	}
+}
+
+// State returns the state an agent should be in, based on the last time the server heard from it
+func State(cfg config.Config, agent defs.AgentAdvert, now time.Time) string {
+	silence := now.Sub(agent.LastSeen)
+
+	switch {
+	case silence >= time.Duration(cfg.Heartbeat.OfflineAfter)*time.Second:
+		return defs.AgentOffline
+	case silence >= time.Duration(cfg.Heartbeat.StaleAfter)*time.Second:
+		return defs.AgentStale
+	default:
+		return defs.AgentOnline
+	}
+}
+
+// Available returns true if an agent has been heard from recently enough to be included in groups and testruns
+func Available(cfg config.Config, agent defs.AgentAdvert) bool {
+	return State(cfg, agent, time.Now()) == defs.AgentOnline
+}
+
+// MarkSeen records that the server has just heard from an agent, and writes the agent to the database.
+func MarkSeen(tdb db.DatabasePackage, agent defs.AgentAdvert) error {
+
+	// An error here just means this is a new agent
+	var previous string
+	if existing, err := tdb.GetAgent(agent.Uuid); err == nil {
+		previous = existing.State
+	}
+
+	agent.LastSeen = time.Now().UTC()
+	agent.State = defs.AgentOnline
+
+	err := tdb.SetAgent(agent)
+	if err != nil {
+		return err
+	}
+
+	if previous != defs.AgentOnline {
+		emit(agent.Uuid, previous, defs.AgentOnline)
+	}
+
+	return nil
+}
+
+// Monitor checks when each agent was last heard from, and updates its state. Agents that have gone offline are
+// removed from the database.
+func Monitor(cfg config.Config) {
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		log.Errorf("Error connecting to DB: %v", err)
+		return
+	}
+
+	agents, err := tdb.GetAgents()
+	if err != nil {
+		log.Errorf("Error retrieving agents: %v", err)
+		return
+	}
+
+	for i := range agents {
+		state := State(cfg, agents[i], time.Now())
+		if state == agents[i].State {
+			continue
+		}
+
+		// Fetch the agent again, so we don't overwrite a heartbeat that arrived in the meantime
+		agent, err := tdb.GetAgent(agents[i].Uuid)
+		if err != nil {
+			continue
+		}
+		state = State(cfg, *agent, time.Now())
+		if state == agent.State {
+			continue
+		}
+
+		previous := agent.State
+		if state == defs.AgentOffline {
+			err = tdb.RemoveAgent(*agent)
+		} else {
+			agent.State = state
+			err = tdb.SetAgent(*agent)
+		}
+		if err != nil {
+			log.Errorf("Error updating state of agent %s: %v", agent.Uuid, err)
+			continue
+		}
+
+		emit(agent.Uuid, previous, state)
+	}
+}
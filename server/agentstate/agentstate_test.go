@@ -0,0 +1,43 @@
+/*
+    Tests for agent state tracking
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package agentstate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+// TestState tests that agents move from online, to stale, to offline as time passes without a heartbeat
+func TestState(t *testing.T) {
+	var cfg config.Config
+	cfg.Heartbeat.StaleAfter = 45
+	cfg.Heartbeat.OfflineAfter = 120
+
+	now := time.Now()
+	agent := defs.AgentAdvert{Uuid: "agent1", LastSeen: now}
+
+	for _, tc := range []struct {
+		silence time.Duration
+		state   string
+	}{
+		{0, defs.AgentOnline},
+		{44 * time.Second, defs.AgentOnline},
+		{45 * time.Second, defs.AgentStale},
+		{119 * time.Second, defs.AgentStale},
+		{120 * time.Second, defs.AgentOffline},
+	} {
+		state := State(cfg, agent, now.Add(tc.silence))
+		if state != tc.state {
+			t.Errorf("Expected agent silent for %s to be %s, got %s", tc.silence, tc.state, state)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/*
+    ToDD Server Backups
+
+    Backups contain everything the server keeps that can't be recalculated or re-sent by the agents - objects along with
+    their revisions (including the revisions of deleted objects), the group map, and the history of testruns along with
+    their clean test data. They are written through the DatabasePackage interface,
+    so a backup taken from one database plugin can be restored into any other.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package backup
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// ArchiveVersion is the version of the archive format written by Backup. It must be increased whenever the format
+// changes in a way that older servers can't restore, and Restore must keep supporting every older version.
+//
+// Version 2 added the revisions of deleted objects, and the clean test data of testruns.
+const ArchiveVersion = 2
+
+// restoreAuthor is recorded as the author of objects restored from archives without any revisions
+const restoreAuthor = "todd-server restore"
+
+// Archive is the contents of a backup. Archives are stored as gzipped JSON.
+type Archive struct {
+	Version  int                  `json:"version"`
+	Created  time.Time            `json:"created"`
+	Objects  []ArchivedObject     `json:"objects"`
+	Deleted  []ArchivedObject     `json:"deleted"` // objects that have been deleted, which only have revisions
+	GroupMap map[string]string    `json:"groupmap"`
+	TestRuns []defs.TestRunRecord `json:"testruns"`
+
+	// CleanData is the clean test data of each testrun that has any, by testrun UUID
+	CleanData map[string]string `json:"cleandata"`
+}
+
+// ArchivedObject is an object, as it currently is, along with all of its revisions. Deleted objects have no Object.
+type ArchivedObject struct {
+	Type      string                   `json:"type"`
+	Label     string                   `json:"label"`
+	Object    json.RawMessage          `json:"object,omitempty"`
+	Revisions []objects.ObjectRevision `json:"revisions"`
+}
+
+// Backup writes an archive of the database to w, and returns what was written
+func Backup(tdb db.DatabasePackage, w io.Writer) (*Archive, error) {
+
+	archive := Archive{
+		Version:   ArchiveVersion,
+		Created:   time.Now().UTC(),
+		CleanData: make(map[string]string),
+	}
+
+	for _, objType := range objects.Types {
+		objs, err := tdb.GetObjects(objType)
+		if err != nil {
+			return nil, fmt.Errorf("Error retrieving %s objects: %v", objType, err)
+		}
+
+		current := make(map[string]bool)
+		for _, obj := range objs {
+			current[obj.GetLabel()] = true
+
+			objJSON, err := json.Marshal(obj)
+			if err != nil {
+				return nil, err
+			}
+
+			revs, err := tdb.GetObjectRevisions(objType, obj.GetLabel())
+			if err != nil {
+				return nil, fmt.Errorf("Error retrieving revisions of %s %s: %v", objType, obj.GetLabel(), err)
+			}
+
+			archive.Objects = append(archive.Objects, ArchivedObject{
+				Type:      objType,
+				Label:     obj.GetLabel(),
+				Object:    objJSON,
+				Revisions: revs,
+			})
+		}
+
+		labels, err := tdb.GetRevisedObjects(objType)
+		if err != nil {
+			return nil, fmt.Errorf("Error retrieving revised %s objects: %v", objType, err)
+		}
+		for _, label := range labels {
+			if current[label] {
+				continue
+			}
+
+			revs, err := tdb.GetObjectRevisions(objType, label)
+			if err != nil {
+				return nil, fmt.Errorf("Error retrieving revisions of %s %s: %v", objType, label, err)
+			}
+			archive.Deleted = append(archive.Deleted, ArchivedObject{
+				Type:      objType,
+				Label:     label,
+				Revisions: revs,
+			})
+		}
+	}
+
+	groupMap, err := tdb.GetGroupMap()
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving group map: %v", err)
+	}
+	archive.GroupMap = groupMap
+
+	archive.TestRuns, err = tdb.GetTestRunRecords()
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving testrun history: %v", err)
+	}
+
+	for _, record := range archive.TestRuns {
+		cleanData, err := tdb.GetCleanTestData(record.Uuid)
+		if err == db.ErrNotExist {
+			continue // the testrun failed before its data was cleaned, or the data has expired
+		} else if err != nil {
+			return nil, fmt.Errorf("Error retrieving test data of testrun %s: %v", record.Uuid, err)
+		}
+		archive.CleanData[record.Uuid] = cleanData
+	}
+
+	gz := gzip.NewWriter(w)
+	err = json.NewEncoder(gz).Encode(archive)
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &archive, nil
+}
+
+// Restore reads an archive from r, and writes its contents to the database. Objects and testruns that are in the
+// database, but not in the archive, are left alone, so archives are best restored into an empty database.
+func Restore(tdb db.DatabasePackage, r io.Reader) (*Archive, error) {
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Not a ToDD server backup: %v", err)
+	}
+	defer gz.Close()
+
+	var archive Archive
+	err = json.NewDecoder(gz).Decode(&archive)
+	if err != nil {
+		return nil, fmt.Errorf("Not a ToDD server backup: %v", err)
+	}
+
+	if archive.Version < 1 {
+		return nil, fmt.Errorf("Not a ToDD server backup: missing archive version")
+	}
+	if archive.Version > ArchiveVersion {
+		return nil, fmt.Errorf(
+			"Backup has archive version %d, but this server only supports up to version %d - please upgrade ToDD",
+			archive.Version, ArchiveVersion,
+		)
+	}
+
+	// Check every object before restoring anything, since parsing an object of an unknown type ends the process
+	for _, archived := range append(archive.Objects, archive.Deleted...) {
+		if !knownType(archived.Type) {
+			return nil, fmt.Errorf("Backup contains %s %s, which is not a known type of object", archived.Type, archived.Label)
+		}
+	}
+
+	for _, archived := range archive.Objects {
+		var baseobj objects.BaseObject
+		err = json.Unmarshal(archived.Object, &baseobj)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s %s from backup: %v", archived.Type, archived.Label, err)
+		}
+
+		err = tdb.SetObject(baseobj.ParseToddObject(archived.Object), restoreAuthor)
+		if err != nil {
+			return nil, fmt.Errorf("Error restoring %s %s: %v", archived.Type, archived.Label, err)
+		}
+
+		// Replace the revision made by restoring the object with the revisions it had before
+		if len(archived.Revisions) > 0 {
+			err = tdb.SetObjectRevisions(archived.Type, archived.Label, archived.Revisions)
+			if err != nil {
+				return nil, fmt.Errorf("Error restoring revisions of %s %s: %v", archived.Type, archived.Label, err)
+			}
+		}
+	}
+
+	for _, archived := range archive.Deleted {
+		err = tdb.SetObjectRevisions(archived.Type, archived.Label, archived.Revisions)
+		if err != nil {
+			return nil, fmt.Errorf("Error restoring revisions of deleted %s %s: %v", archived.Type, archived.Label, err)
+		}
+	}
+
+	if archive.GroupMap != nil {
+		err = tdb.SetGroupMap(archive.GroupMap)
+		if err != nil {
+			return nil, fmt.Errorf("Error restoring group map: %v", err)
+		}
+	}
+
+	for _, record := range archive.TestRuns {
+
+		// Testruns that were running when the backup was taken will never finish on this server
+		if record.State == defs.TestRunRunning {
+			record.State = defs.TestRunFailed
+		}
+
+		err = tdb.SetTestRunRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("Error restoring history of testrun %s: %v", record.Uuid, err)
+		}
+
+		if cleanData, ok := archive.CleanData[record.Uuid]; ok {
+			err = tdb.WriteCleanTestData(record.Uuid, cleanData)
+			if err != nil {
+				return nil, fmt.Errorf("Error restoring test data of testrun %s: %v", record.Uuid, err)
+			}
+		}
+	}
+
+	log.Infof("Restored %d objects (and %d deleted objects) and %d testruns from a backup created at %s",
+		len(archive.Objects), len(archive.Deleted), len(archive.TestRuns), archive.Created)
+
+	return &archive, nil
+}
+
+// knownType returns true if objType is a type of ToDD object this server can handle
+func knownType(objType string) bool {
+	for _, t := range objects.Types {
+		if t == objType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+/*
+    Tests for ToDD Server Backups
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// TestBackupRestore tests that a backup of one database plugin can be restored into another, with objects, their
+// revisions (including those of deleted objects), the group map, and testrun history and data all intact
+func TestBackupRestore(t *testing.T) {
+	var src config.Config
+	src.DB.Plugin = "memory"
+	src.DB.DatabaseName = "TestBackupRestore"
+
+	srcDB, err := db.NewToddDB(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var group objects.GroupObject
+	group.Type = "group"
+	group.Label = "datacenter"
+	group.Spec.Group = "datacenter"
+	group.Spec.Matches = []map[string]string{{"hostname": "todd-agent-1"}}
+	if err = srcDB.SetObject(group, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	group.Spec.Matches = []map[string]string{{"hostname": "todd-agent-2"}}
+	if err = srcDB.SetObject(group, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	var tr objects.TestRunObject
+	tr.Type = "testrun"
+	tr.Label = "test-ping"
+	tr.Spec.TargetType = "uncontrolled"
+	tr.Spec.Source = map[string]string{"name": "datacenter", "app": "ping", "args": "-c 10"}
+	tr.Spec.Target = []interface{}{"8.8.8.8"}
+	if err = srcDB.SetObject(tr, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	var removed objects.GroupObject
+	removed.Type = "group"
+	removed.Label = "removed"
+	removed.Spec.Group = "removed"
+	removed.Spec.Matches = []map[string]string{{"hostname": "todd-agent-3"}}
+	if err = srcDB.SetObject(removed, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = srcDB.DeleteObject("removed", "group", "carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = srcDB.SetGroupMap(map[string]string{"agent1": "datacenter"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []defs.TestRunRecord{
+		{Uuid: "finished", Label: "test-ping", State: defs.TestRunFinished, Started: time.Now().Add(-time.Hour)},
+		{Uuid: "running", Label: "test-ping", State: defs.TestRunRunning, Started: time.Now()},
+	} {
+		if err = srcDB.SetTestRunRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanData := `{"agent1":{"8.8.8.8":{"packet_loss":"0"}}}`
+	if err = srcDB.WriteCleanTestData("finished", cleanData); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err = Backup(srcDB, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "todd-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var dst config.Config
+	dst.DB.Plugin = "sqlite"
+	dst.DB.Path = filepath.Join(dir, "server.db")
+
+	dstDB, err := db.NewToddDB(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dstDB.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := Restore(dstDB, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.Objects) != 2 || len(archive.Deleted) != 1 || len(archive.TestRuns) != 2 || len(archive.CleanData) != 1 {
+		t.Fatalf("Expected 2 objects, 1 deleted object and 2 testruns (1 with data) in the backup, got %+v", archive)
+	}
+
+	groups, err := dstDB.GetObjects("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].(objects.GroupObject).Spec.Matches[0]["hostname"] != "todd-agent-2" {
+		t.Fatalf("Group was not restored: %+v", groups)
+	}
+	testruns, err := dstDB.GetObjects("testrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testruns) != 1 || testruns[0].GetLabel() != "test-ping" {
+		t.Fatalf("Testrun object was not restored: %+v", testruns)
+	}
+
+	revs, err := dstDB.GetObjectRevisions("group", "datacenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].Author != "alice" || revs[1].Author != "bob" {
+		t.Fatalf("Revisions were not restored: %+v", revs)
+	}
+
+	// Deleted objects aren't restored, but their history is
+	revs, err = dstDB.GetObjectRevisions("group", "removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].Author != "alice" || !revs[1].Deleted || revs[1].Author != "carol" {
+		t.Fatalf("Revisions of the deleted group were not restored: %+v", revs)
+	}
+
+	groupMap, err := dstDB.GetGroupMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groupMap["agent1"] != "datacenter" {
+		t.Fatalf("Group map was not restored: %v", groupMap)
+	}
+
+	record, err := dstDB.GetTestRunRecord("running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != defs.TestRunFailed {
+		t.Fatalf("Expected a testrun that was running to be restored as failed, got %s", record.State)
+	}
+
+	restoredData, err := dstDB.GetCleanTestData("finished")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredData != cleanData {
+		t.Fatalf("Clean test data was not restored: %s", restoredData)
+	}
+	if _, err = dstDB.GetCleanTestData("running"); err != db.ErrNotExist {
+		t.Fatalf("Expected no test data for a testrun without any, got %v", err)
+	}
+}
+
+// TestRestoreNewerVersion tests that archives written by a newer server are refused
+func TestRestoreNewerVersion(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.Plugin = "memory"
+	cfg.DB.DatabaseName = "TestRestoreNewerVersion"
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	json.NewEncoder(gz).Encode(Archive{Version: ArchiveVersion + 1})
+	gz.Close()
+
+	_, err = Restore(tdb, &buf)
+	if err == nil || !strings.Contains(err.Error(), "upgrade") {
+		t.Fatalf("Expected an error restoring a newer archive, got %v", err)
+	}
+
+	_, err = Restore(tdb, strings.NewReader("not a backup"))
+	if err == nil {
+		t.Fatal("Expected an error restoring something that isn't a backup")
+	}
+}
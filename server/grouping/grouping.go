@@ -11,14 +11,17 @@ package grouping
 import (
 	"net"
 	"regexp"
+	"sync"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/agent/tasks"
 	"github.com/Mierdin/todd/comms"
 	"github.com/Mierdin/todd/config"
 	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/server/agentstate"
 	"github.com/Mierdin/todd/server/objects"
 )
 
@@ -32,11 +35,21 @@ func CalculateGroups(cfg config.Config) {
 	}
 
 	// Retrieve all currently active agents
-	agents, err := tdb.GetAgents()
+	allAgents, err := tdb.GetAgents()
 	if err != nil {
 		log.Fatalf("Error retrieving agents: %v", err)
 	}
 
+	// Agents that we haven't heard from recently are left out of all groups (and aren't sent anything) until they're back
+	var agents []defs.AgentAdvert
+	for i := range allAgents {
+		if agentstate.Available(cfg, allAgents[i]) {
+			agents = append(agents, allAgents[i])
+		} else {
+			log.Debugf("Agent %s is %s, and will not be placed in a group", allAgents[i].Uuid, agentstate.State(cfg, allAgents[i], time.Now()))
+		}
+	}
+
 	// Retrieve all objects with type "group"
 	group_objs, err := tdb.GetObjects("group")
 	if err != nil {
@@ -89,24 +102,50 @@ next:
 		log.Fatalf("Error setting up ToDD Comms during group calculation")
 	}
 
-	for uuid, groupName := range groupmap {
-		setGroupTask := tasks.SetGroupTask{
-			GroupName: groupName,
-		}
+	// Each agent confirms that it has cached its new group. These are sent (and waited for) in parallel, so that
+	// one unresponsive agent doesn't hold up the others.
+	var wg sync.WaitGroup
 
-		setGroupTask.Type = "SetGroup" //TODO(mierdin): Apparently this is necessary because inner type promotion doesn't apply for struct literals?
-		tc.CommsPackage.SendTask(uuid, setGroupTask)
+	for i := range agents {
+		if groupName, ok := groupmap[agents[i].Uuid]; ok {
+			wg.Add(1)
+			go setGroup(tc, agents[i], groupName, &wg)
+		}
 	}
 
 	// need to send a message to all agents that weren't in groupmap to set their group to nothing
 	for x := range lonelyAgents {
-		setGroupTask := tasks.SetGroupTask{
-			GroupName: "",
-		}
+		wg.Add(1)
+		go setGroup(tc, lonelyAgents[x], "", &wg)
+	}
+
+	wg.Wait()
+}
 
-		setGroupTask.Type = "SetGroup" //TODO(mierdin): Apparently this is necessary because inner type promotion doesn't apply for struct literals?
-		tc.CommsPackage.SendTask(lonelyAgents[x].Uuid, setGroupTask)
+// setGroup sends a SetGroup task to an agent, and waits for the agent to confirm that its group was set
+func setGroup(tc comms.CommsPackage, agent defs.AgentAdvert, groupName string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	uuid := agent.Uuid
+
+	err := comms.CheckTaskSupported(agent, "SetGroup")
+	if err != nil {
+		log.Warnf("Not sending group (%q) to agent: %v", groupName, err)
+		return
+	}
+
+	setGroupTask := tasks.SetGroupTask{
+		GroupName: groupName,
 	}
+	setGroupTask.BaseTask = tasks.NewBaseTask("SetGroup")
+
+	_, err = comms.SendTaskAndWait(tc, uuid, setGroupTask, comms.DefaultTaskTimeout)
+	if err != nil {
+		log.Warnf("Agent %s did not confirm its group (%q): %v", uuid, groupName, err)
+		return
+	}
+
+	log.Debugf("Agent %s confirmed its group (%q)", uuid, groupName)
 }
 
 // isInGroup takes a set of match statements (typically present in a group object definition) and a map of a single agent's facts,
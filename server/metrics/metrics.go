@@ -0,0 +1,263 @@
+/*
+    ToDD Prometheus Metrics
+
+    The most recent results of each testrun are kept in memory, and served to Prometheus in its text exposition format
+    on the API server's /metrics endpoint. Each testrun label is replaced as a whole when it runs again, so agents and
+    targets that didn't take part in the latest run disappear from /metrics.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/db"
+)
+
+// contentType is the content type of version 0.0.4 of the Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds the most recent results of each testrun label
+type Registry struct {
+	mu      sync.RWMutex
+	results map[string]result
+}
+
+type result struct {
+	testUuid    string
+	sourceGroup string
+	time        time.Time
+	data        defs.TestData
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{results: make(map[string]result)}
+}
+
+// DefaultRegistry is the Registry served by the ToDD server. Testruns write their results to it as they finish.
+var DefaultRegistry = NewRegistry()
+
+// Record replaces the results of a testrun label with the clean test data of its latest run
+func (r *Registry) Record(label, testUuid, sourceGroup string, t time.Time, data defs.TestData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.results[label] = result{
+		testUuid:    testUuid,
+		sourceGroup: sourceGroup,
+		time:        t,
+		data:        data,
+	}
+}
+
+// Record replaces the results of a testrun label in the DefaultRegistry
+func Record(label, testUuid, sourceGroup string, t time.Time, data defs.TestData) {
+	DefaultRegistry.Record(label, testUuid, sourceGroup, t, data)
+}
+
+// Load fills the registry with the results of the most recent finished run of each testrun label in the database, so
+// that /metrics doesn't start out empty when the server is restarted. Labels that already have results are left alone.
+// Testruns whose source was overridden are left out, as they are when they finish.
+func (r *Registry) Load(tdb db.DatabasePackage) error {
+	records, err := tdb.GetTestRunRecords()
+	if err != nil {
+		return err
+	}
+
+	// Records are sorted most recent first, so the first finished record of each label is the one to use
+	seen := make(map[string]bool)
+	for _, record := range records {
+		if seen[record.Label] || record.State != defs.TestRunFinished || len(record.Overrides) > 0 {
+			continue
+		}
+		seen[record.Label] = true
+
+		cleanData, err := tdb.GetCleanTestData(record.Uuid)
+		if err == db.ErrNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var data defs.TestData
+		err = json.Unmarshal([]byte(cleanData), &data)
+		if err != nil {
+			log.Errorf("Skipping unreadable test data of testrun %s: %v", record.Uuid, err)
+			continue
+		}
+
+		// As when the testrun finished, results from agents that don't report when they were measured use the time the
+		// testrun ended
+		measured := data.Measured()
+		if measured.IsZero() {
+			measured = record.Ended
+		}
+
+		r.mu.Lock()
+		if _, ok := r.results[record.Label]; !ok {
+			r.results[record.Label] = result{
+				testUuid:    record.Uuid,
+				sourceGroup: record.Object.Spec.Source["name"],
+				time:        measured,
+				data:        data,
+			}
+		}
+		r.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Load fills the DefaultRegistry with the results of the most recent run of each testrun label in the database
+func Load(tdb db.DatabasePackage) error {
+	return DefaultRegistry.Load(tdb)
+}
+
+// ServeHTTP serves the metrics in the registry in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+
+	err := r.Write(w)
+	if err != nil {
+		log.Errorf("Problem writing metrics: %v", err)
+	}
+}
+
+// sample is a single metric reported by a testlet
+type sample struct {
+	label, sourceGroup, agent, target, metric string
+	value                                     defs.MetricValue
+}
+
+// Write writes the metrics in the registry to w in the Prometheus text exposition format. Booleans are written as 1 or
+// 0, and durations as seconds. Strings can't be the value of a gauge, so they are written to the
+// todd_testrun_result_info metric instead, with the value as a label. Metrics with a unit have it as a label too.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var samples []sample
+	labels := make([]string, 0, len(r.results))
+	for label, res := range r.results {
+		labels = append(labels, label)
+		for agent, targets := range res.data {
+			for target, targetData := range targets {
+				for metric, value := range targetData.Metrics {
+					samples = append(samples, sample{label, res.sourceGroup, agent, target, metric, value})
+				}
+			}
+		}
+	}
+	sort.Strings(labels)
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i], samples[j]
+		if a.label != b.label {
+			return a.label < b.label
+		}
+		if a.agent != b.agent {
+			return a.agent < b.agent
+		}
+		if a.target != b.target {
+			return a.target < b.target
+		}
+		return a.metric < b.metric
+	})
+
+	var values, infos []string
+	for _, s := range samples {
+		pairs := []string{
+			"testrun", s.label,
+			"source_group", s.sourceGroup,
+			"agent", s.agent,
+			"target", s.target,
+			"metric", s.metric,
+		}
+
+		unit := s.value.Unit
+		if s.value.Type == defs.MetricDuration {
+			unit = "s"
+		}
+		if unit != "" {
+			pairs = append(pairs, "unit", unit)
+		}
+
+		value, ok := s.value.Float()
+		if !ok {
+			infos = append(infos, fmt.Sprintf("todd_testrun_result_info%s 1", formatLabels(append(pairs, "value", s.value.String())...)))
+			continue
+		}
+		values = append(values, fmt.Sprintf("todd_testrun_result%s %s", formatLabels(pairs...), formatValue(value)))
+	}
+
+	var times, runs []string
+	for _, label := range labels {
+		res := r.results[label]
+		times = append(times, fmt.Sprintf(
+			"todd_testrun_last_result_timestamp_seconds%s %s",
+			formatLabels("testrun", label), formatValue(float64(res.time.UnixNano())/float64(time.Second)),
+		))
+		runs = append(runs, fmt.Sprintf(
+			"todd_testrun_last_result_info%s 1",
+			formatLabels("testrun", label, "source_group", res.sourceGroup, "uuid", res.testUuid),
+		))
+	}
+
+	bw := bufio.NewWriter(w)
+	writeFamily(bw, "todd_testrun_result", "Most recent value of each metric reported by a testlet, by testrun label", values)
+	writeFamily(bw, "todd_testrun_result_info", "Most recent value of each non-numeric metric reported by a testlet, by testrun label", infos)
+	writeFamily(bw, "todd_testrun_last_result_timestamp_seconds", "When the most recent results of each testrun label were measured", times)
+	writeFamily(bw, "todd_testrun_last_result_info", "The testrun that reported the most recent results of each testrun label", runs)
+
+	return bw.Flush()
+}
+
+// writeFamily writes a gauge metric, along with its HELP and TYPE lines. Nothing is written for metrics without samples.
+func writeFamily(w io.Writer, name, help string, samples []string) {
+	if len(samples) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	for _, sample := range samples {
+		fmt.Fprintln(w, sample)
+	}
+}
+
+// formatLabels formats pairs of label names and values as a Prometheus label set, such as {name="value"}
+func formatLabels(pairs ...string) string {
+	var parts []string
+	for i := 0; i < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", pairs[i], escapeLabelValue(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes backslashes, double quotes and newlines, as the text exposition format requires
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// formatValue formats a sample value, including NaN and infinities, as Prometheus expects them
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,176 @@
+/*
+    Tests for ToDD Prometheus Metrics
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+	"github.com/Mierdin/todd/server/objects"
+)
+
+// TestWrite tests that the latest results of each testrun label are written in the Prometheus text format, with
+// strings written as info metrics
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+
+	r.Record("test-ping", "uuid-1", "datacenter", time.Unix(1000, 0), testData(t, `{
+		"agent1": {"8.8.8.8": {"avg_latency_ms": "20.5", "packet_loss": "1"}}
+	}`))
+
+	// Running a label again replaces all of its results
+	r.Record("test-ping", "uuid-2", "datacenter", time.Unix(2000, 0), testData(t, `{
+		"agent1": {"8.8.8.8": {"avg_latency_ms": "10.25", "packet_loss": {"value": 0, "type": "int", "unit": "%"}}},
+		"agent2": {"8.8.4.4": {"rtt": {"value": "1.5ms", "type": "duration"}, "reachable": true, "result": "say \"hi\"\n"}}
+	}`))
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP todd_testrun_result Most recent value of each metric reported by a testlet, by testrun label
+# TYPE todd_testrun_result gauge
+todd_testrun_result{testrun="test-ping",source_group="datacenter",agent="agent1",target="8.8.8.8",metric="avg_latency_ms"} 10.25
+todd_testrun_result{testrun="test-ping",source_group="datacenter",agent="agent1",target="8.8.8.8",metric="packet_loss",unit="%"} 0
+todd_testrun_result{testrun="test-ping",source_group="datacenter",agent="agent2",target="8.8.4.4",metric="reachable"} 1
+todd_testrun_result{testrun="test-ping",source_group="datacenter",agent="agent2",target="8.8.4.4",metric="rtt",unit="s"} 0.0015
+# HELP todd_testrun_result_info Most recent value of each non-numeric metric reported by a testlet, by testrun label
+# TYPE todd_testrun_result_info gauge
+todd_testrun_result_info{testrun="test-ping",source_group="datacenter",agent="agent2",target="8.8.4.4",metric="result",value="say \"hi\"\n"} 1
+# HELP todd_testrun_last_result_timestamp_seconds When the most recent results of each testrun label were measured
+# TYPE todd_testrun_last_result_timestamp_seconds gauge
+todd_testrun_last_result_timestamp_seconds{testrun="test-ping"} 2000
+# HELP todd_testrun_last_result_info The testrun that reported the most recent results of each testrun label
+# TYPE todd_testrun_last_result_info gauge
+todd_testrun_last_result_info{testrun="test-ping",source_group="datacenter",uuid="uuid-2"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+
+	// An empty registry writes nothing
+	buf.Reset()
+	if err := NewRegistry().Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no metrics from an empty registry, got:\n%s", buf.String())
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Header().Get("Content-Type") != contentType {
+		t.Fatalf("Unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+	if w.Body.String() != expected {
+		t.Fatalf("Expected the same metrics over HTTP, got:\n%s", w.Body.String())
+	}
+}
+
+// testData reads test data from JSON, in the same way as the test data kept in the database
+func testData(t *testing.T, dataJSON string) defs.TestData {
+	var data defs.TestData
+	if err := json.Unmarshal([]byte(dataJSON), &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestLoad tests that the results of the most recent finished run of each testrun label are loaded from the database
+func TestLoad(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.Plugin = "memory"
+	cfg.DB.DatabaseName = "TestLoad"
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tr objects.TestRunObject
+	tr.Label = "test-ping"
+	tr.Spec.Source = map[string]string{"name": "datacenter"}
+
+	runs := []struct {
+		uuid      string
+		state     string
+		overrides map[string]string
+		data      string
+	}{
+		{"old", defs.TestRunFinished, nil, `{"agent1": {"8.8.8.8": {"packet_loss": "1"}}}`},
+		{"latest", defs.TestRunFinished, nil, `{"agent1": {"8.8.8.8": {"start": "1970-01-01T00:16:38Z", "end": "1970-01-01T00:16:40Z", "metrics": {"packet_loss": {"type": "float", "value": 0}}}}}`},
+		{"overridden", defs.TestRunFinished, map[string]string{"SourceGroup": "branch"}, `{"agent2": {"8.8.8.8": {"packet_loss": "5"}}}`},
+		{"failed", defs.TestRunFailed, nil, ""},
+	}
+
+	started := time.Now().Add(-time.Hour)
+	for i, run := range runs {
+		record := defs.TestRunRecord{
+			Uuid:      run.uuid,
+			Label:     tr.Label,
+			Object:    tr,
+			Overrides: run.overrides,
+			State:     run.state,
+			Started:   started.Add(time.Duration(i) * time.Minute),
+			Ended:     started.Add(time.Duration(i)*time.Minute + time.Second),
+		}
+		if err = tdb.SetTestRunRecord(record); err != nil {
+			t.Fatal(err)
+		}
+		if run.data != "" {
+			if err = tdb.WriteCleanTestData(run.uuid, run.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	r := NewRegistry()
+	if err = r.Load(tdb); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`todd_testrun_result{testrun="test-ping",source_group="datacenter",agent="agent1",target="8.8.8.8",metric="packet_loss"} 0`,
+		`todd_testrun_last_result_info{testrun="test-ping",source_group="datacenter",uuid="latest"} 1`,
+		`todd_testrun_last_result_timestamp_seconds{testrun="test-ping"} 1000`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("Expected %s in:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "agent2") {
+		t.Fatalf("Expected the overridden testrun to be left out:\n%s", buf.String())
+	}
+
+	// Results recorded since the server started aren't replaced
+	r.Record("test-ping", "newer", "datacenter", time.Now(), nil)
+	if err = r.Load(tdb); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err = r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `uuid="newer"`) {
+		t.Fatalf("Expected Load to leave newer results alone:\n%s", buf.String())
+	}
+}
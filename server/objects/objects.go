@@ -12,9 +12,12 @@ import (
 	"encoding/json"
 	"os"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
+// Types lists every type of ToDD object, for code that needs to handle all objects, such as server backups
+var Types = []string{"group", "testrun"}
+
 // ToddObject is the "base" struct for all objects in ToDD. All metadata shared by all todd objects should be stored here.
 // Any structs representing todd objects should embed this struct.
 //
@@ -22,11 +25,12 @@ import (
 // or JSON into the base "ToddObject" struct first, to determine type. Then, this value is used to determine which "child" struct
 // should be used to parse the entire structure, using a "switch" statement, we'll call a "type switch".
 //
-// The process for adding a new object type in ToDD should be done in 3 places:
+// The process for adding a new object type in ToDD should be done in 4 places:
 //
 // - Here, a new struct that embeds ToddObject should be added.
 // - The "switch" statement in the ParseToddObject and ParseToddObjects functions below should be augmented to look for the new object type for an incoming YAML file
 // - The "Create" function in the client api contains a "type switch" - update this.
+// - The new type should be added to Types above.
 //
 // It should be mentioned that the steps above only add a new object type to the various infrastructure
 // elements of ToDD - it does not automatically give those objects meaning.
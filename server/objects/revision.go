@@ -0,0 +1,55 @@
+/*
+    ToDD Object Revisions
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package objects
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ObjectRevision is one version of a ToDD object, kept by the database every time the object is created, updated or
+// deleted. Revisions of an object are numbered from 1, in the order they were made.
+type ObjectRevision struct {
+	Revision int             `json:"revision"`
+	Time     time.Time       `json:"time"`
+	Author   string          `json:"author"`  // as reported by the client - this is not authenticated
+	Deleted  bool            `json:"deleted"` // the object was deleted in this revision, so there is no Object
+	Object   json.RawMessage `json:"object,omitempty"`
+}
+
+// NewObjectRevision prepares a revision for the provided object, or for its deletion if tobj is nil. The revision number
+// is left for the database to fill in.
+func NewObjectRevision(tobj ToddObject, author string) (ObjectRevision, error) {
+	rev := ObjectRevision{
+		Time:    time.Now().UTC(),
+		Author:  author,
+		Deleted: tobj == nil,
+	}
+
+	if tobj != nil {
+		objJSON, err := json.Marshal(tobj)
+		if err != nil {
+			return rev, err
+		}
+		rev.Object = objJSON
+	}
+
+	return rev, nil
+}
+
+// ParseObject returns the object as it was at this revision
+func (r ObjectRevision) ParseObject() (ToddObject, error) {
+	var baseobj BaseObject
+	err := json.Unmarshal(r.Object, &baseobj)
+	if err != nil {
+		return nil, err
+	}
+
+	return baseobj.ParseToddObject(r.Object), nil
+}
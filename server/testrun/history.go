@@ -0,0 +1,122 @@
+/*
+    ToDD Test Run History
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package testrun
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+)
+
+// recorder keeps the history record of a testrun up to date in the database as the testrun progresses
+type recorder struct {
+	tdb    db.DatabasePackage
+	record defs.TestRunRecord
+}
+
+// save writes the current record to the database. Failing to do so doesn't stop the testrun.
+func (r *recorder) save() {
+	err := r.tdb.SetTestRunRecord(r.record)
+	if err != nil {
+		log.Errorf("Error saving history of testrun %s: %v", r.record.Uuid, err)
+	}
+}
+
+// startPhase records the start of a new phase, ending the current one if needed
+func (r *recorder) startPhase(name string) {
+	r.endPhase()
+	r.record.Phases = append(r.record.Phases, defs.TestRunPhase{
+		Name:  name,
+		Start: time.Now().UTC(),
+	})
+	r.save()
+}
+
+// endPhase records the end of the current phase, if there is one. The record isn't saved, since a phase always
+// ends because another is starting, or because the testrun is over.
+func (r *recorder) endPhase() {
+	if n := len(r.record.Phases); n > 0 && r.record.Phases[n-1].End.IsZero() {
+		r.record.Phases[n-1].End = time.Now().UTC()
+	}
+}
+
+// setSinks records whether the results of the testrun were written to each result sink
+func (r *recorder) setSinks(sinks []defs.TestRunSink) {
+	r.record.Sinks = sinks
+	r.save()
+}
+
+// updateSink records the outcome of a result sink that finished after the testrun was over. The record is read back from
+// the database first, since spooled results may have been written to other sinks in the meantime.
+func (r *recorder) updateSink(sink defs.TestRunSink) {
+	record, err := r.tdb.GetTestRunRecord(r.record.Uuid)
+	if err == db.ErrNotExist {
+		return // the testrun has been removed from the history since
+	} else if err != nil {
+		log.Errorf("Error retrieving history of testrun %s: %v", r.record.Uuid, err)
+		return
+	}
+
+	for i := range record.Sinks {
+		if record.Sinks[i].Name == sink.Name {
+			record.Sinks[i] = sink
+		}
+	}
+	r.record = *record
+	r.save()
+}
+
+// finish records the final state of the testrun. If the testrun failed, the phase it failed in is left unfinished.
+func (r *recorder) finish(state string) {
+	if state == defs.TestRunFinished {
+		r.endPhase()
+	}
+	r.record.State = state
+	r.record.Ended = time.Now().UTC()
+	r.save()
+}
+
+// PruneHistory removes testruns that are older than the configured history retention, along with their data
+func PruneHistory(cfg config.Config) {
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		log.Errorf("Error connecting to DB: %v", err)
+		return
+	}
+
+	records, err := tdb.GetTestRunRecords()
+	if err != nil {
+		log.Errorf("Error retrieving testrun history: %v", err)
+		return
+	}
+
+	maxAge := time.Duration(cfg.History.MaxAge) * time.Hour
+
+	// Records are sorted from newest to oldest, so once one is too old (or past MaxRuns), so are the rest
+	keep := 0
+	for ; keep < len(records); keep++ {
+		tooMany := cfg.History.MaxRuns >= 0 && keep >= cfg.History.MaxRuns
+		tooOld := cfg.History.MaxAge >= 0 && time.Since(records[keep].Started) > maxAge
+		if tooMany || tooOld {
+			break
+		}
+	}
+
+	for _, record := range records[keep:] {
+		err = tdb.DeleteTestRun(record.Uuid)
+		if err != nil && err != db.ErrNotExist {
+			log.Errorf("Error removing testrun %s: %v", record.Uuid, err)
+		}
+	}
+}
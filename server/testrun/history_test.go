@@ -0,0 +1,124 @@
+/*
+    Tests for ToDD Test Run History
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package testrun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+)
+
+// TestPruneHistory tests that testruns past either retention limit are removed, along with their data
+func TestPruneHistory(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.Plugin = "memory"
+	cfg.DB.DatabaseName = "TestPruneHistory"
+	cfg.History.MaxAge = 24
+	cfg.History.MaxRuns = 2
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "extra" is past MaxRuns, and "old" is past both limits
+	started := map[string]time.Time{
+		"new":    time.Now(),
+		"recent": time.Now().Add(-time.Hour),
+		"extra":  time.Now().Add(-2 * time.Hour),
+		"old":    time.Now().Add(-48 * time.Hour),
+	}
+	for uuid, t0 := range started {
+		err = tdb.InitTestRun(uuid, map[string]map[string]string{"sources": {"agent1": "src"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tdb.SetTestRunRecord(defs.TestRunRecord{Uuid: uuid, State: defs.TestRunFinished, Started: t0})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	PruneHistory(cfg)
+
+	records, err := tdb.GetTestRunRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Uuid != "new" || records[1].Uuid != "recent" {
+		t.Fatalf("Expected only testruns new and recent to be kept, got %+v", records)
+	}
+
+	for _, uuid := range []string{"extra", "old"} {
+		status, err := tdb.GetTestStatus(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(status) != 0 {
+			t.Fatalf("Expected status of testrun %s to be removed, got %v", uuid, status)
+		}
+	}
+
+	// Negative limits keep everything
+	cfg.History.MaxAge = -1
+	cfg.History.MaxRuns = -1
+	err = tdb.SetTestRunRecord(defs.TestRunRecord{Uuid: "ancient", Started: time.Now().Add(-10000 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PruneHistory(cfg)
+	if records, _ = tdb.GetTestRunRecords(); len(records) != 3 {
+		t.Fatalf("Expected no testruns to be removed, got %+v", records)
+	}
+}
+
+// TestUpdateSink tests that a sink finishing after the testrun is over is recorded, without undoing changes that were
+// made to the other sinks in the meantime
+func TestUpdateSink(t *testing.T) {
+	var cfg config.Config
+	cfg.DB.Plugin = "memory"
+	cfg.DB.DatabaseName = "TestUpdateSink"
+
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := recorder{tdb: tdb, record: defs.TestRunRecord{Uuid: "testuuid", Started: time.Now()}}
+	rec.setSinks([]defs.TestRunSink{
+		{Name: "slow", State: defs.SinkFailed, Error: "timed out after 1m0s"},
+		{Name: "down", State: defs.SinkSpooled, Error: "connection refused"},
+	})
+	rec.finish(defs.TestRunFinished)
+
+	// The spooled results are written by RetrySpool, which updates the record in the database
+	record, err := tdb.GetTestRunRecord("testuuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Sinks[1] = defs.TestRunSink{Name: "down", State: defs.SinkWritten}
+	if err = tdb.SetTestRunRecord(*record); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.updateSink(defs.TestRunSink{Name: "slow", State: defs.SinkWritten, Duration: 90 * time.Second})
+
+	record, err = tdb.GetTestRunRecord("testuuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != defs.TestRunFinished || len(record.Sinks) != 2 ||
+		record.Sinks[0].State != defs.SinkWritten || record.Sinks[0].Error != "" ||
+		record.Sinks[1].State != defs.SinkWritten {
+		t.Fatalf("Expected both sinks to be written, got %+v", record)
+	}
+}
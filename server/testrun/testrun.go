@@ -11,6 +11,7 @@ package testrun
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -22,12 +23,15 @@ import (
 	"github.com/Mierdin/todd/config"
 	"github.com/Mierdin/todd/db"
 	"github.com/Mierdin/todd/hostresources"
+	"github.com/Mierdin/todd/server/agentstate"
+	"github.com/Mierdin/todd/server/metrics"
 	"github.com/Mierdin/todd/server/objects"
 	"github.com/Mierdin/todd/server/tsdb"
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
-func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map[string]string) string {
+// Start starts a testrun, and returns its UUID. The user is only recorded in the testrun's history.
+func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map[string]string, user string) string {
 
 	// Generate UUID for test
 	testUuid := hostresources.GenerateUuid()
@@ -69,6 +73,13 @@ func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map
 	// Here, we iterate over ALL of the agents, and pick out the ones that are part of this test, as well as what group they're in.
 	for agent, group := range allGroupMap {
 
+		// The group map may be a little out of date, so leave out any agents that we haven't heard from recently
+		adv, err := tdb.GetAgent(agent)
+		if err != nil || !agentstate.Available(cfg, *adv) {
+			log.Warnf("Agent %s is not available, and will not take part in this testrun", agent)
+			continue
+		}
+
 		// If our target type is group, and the group this agent is in matches the target group provided in the testrun object, add it to our map
 		if trObj.Spec.TargetType == "group" && group == trObj.Spec.Target.(map[string]interface{})["name"].(string) {
 			testAgentMap["targets"][agent] = group
@@ -82,6 +93,24 @@ func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map
 		return "invalidtopology"
 	}
 
+	// Refuse to run this test if any of the agents involved can't handle the tasks we're about to send them
+	for _, agentMap := range testAgentMap {
+		for uuid := range agentMap {
+			agent, err := tdb.GetAgent(uuid)
+			if err != nil {
+				log.Errorf("Error retrieving agent: %v", err)
+				return "failure"
+			}
+			for _, taskType := range []string{"InstallTestRun", "ExecuteTestRun"} {
+				err = comms.CheckTaskSupported(*agent, taskType)
+				if err != nil {
+					log.Error(err)
+					return "unsupportedagents"
+				}
+			}
+		}
+	}
+
 	// Start listening for responses from agents
 	tc, err := comms.NewToDDComms(cfg)
 	if err != nil {
@@ -90,11 +119,45 @@ func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map
 	stopListeningForResponses := make(chan bool, 1)
 	go tc.CommsPackage.ListenForResponses(&stopListeningForResponses)
 
+	// Keep a record of this testrun, which outlives the testrun's status and data
+	overrides := make(map[string]string)
+	for key, value := range sourceOverrideMap {
+		if value != "" {
+			overrides[key] = value
+		}
+	}
+	// Objects created before revisions were kept have no revisions at all, and are recorded as revision 0
+	var revision int
+	revs, err := tdb.GetObjectRevisions("testrun", trObj.Label)
+	if err != nil {
+		log.Errorf("Error retrieving revisions of testrun object %s: %v", trObj.Label, err)
+	} else if len(revs) > 0 {
+		revision = revs[len(revs)-1].Revision
+	}
+
+	rec := &recorder{
+		tdb: tdb,
+		record: defs.TestRunRecord{
+			Uuid:      testUuid,
+			Label:     trObj.Label,
+			Object:    trObj,
+			Revision:  revision,
+			Overrides: overrides,
+			User:      user,
+			Agents:    testAgentMap,
+			State:     defs.TestRunRunning,
+			Started:   time.Now().UTC(),
+		},
+	}
+	rec.startPhase("install")
+
 	// Initialize test in database. This will create an entry for this test under the UUID we just created, and will also write the
 	// list of agents participating in this test, with some kind of default status, for other goroutines to update with a further status.
 	err = tdb.InitTestRun(testUuid, testAgentMap)
 	if err != nil {
-		log.Fatal("Problem initializing testrun in database.")
+		log.Errorf("Problem initializing testrun in database: %v", err)
+		rec.finish(defs.TestRunFailed)
+		stopListeningForResponses <- true
 		return "failure"
 	}
 
@@ -132,15 +195,17 @@ func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map
 
 	// Prepare a task for carrying the testrun instruction to the agent
 	var itrTask tasks.InstallTestRunTask
-	itrTask.Type = "InstallTestRun" //TODO(mierdin): This is an extra step. Maybe a factory function for the task could help here?
+	itrTask.BaseTask = tasks.NewBaseTask("InstallTestRun")
 	itrTask.Tr = sourceTr
 
-	// Send testrun to each agent UUID in the sources group
-	// TODO(mierdin): this is something I'd like to improve in the future. Right now this works, and is sort-of resilient, since
-	// the testrun will require a response from each agent before actually moving on with execution, but I'd like something better.
-	// Something that feels more like a true distributed system. Perfect is the enemy of good, however, and this works well for a prototype.
-	for uuid, _ := range testAgentMap["sources"] {
-		tc.CommsPackage.SendTask(uuid, itrTask)
+	// Send testrun to every source agent. The testrun will still require a response from each agent
+	// before actually moving on with execution.
+	err = sendToAgents(tc.CommsPackage, allGroupMap, trObj.Spec.Source["name"], testAgentMap["sources"], itrTask)
+	if err != nil {
+		log.Errorf("Failed to send testrun to source group: %v", err)
+		rec.finish(defs.TestRunFailed)
+		stopListeningForResponses <- true
+		return "failure"
 	}
 
 	// If this testrun is targeted at another todd group, we want to send testrun tasks to those as well
@@ -153,17 +218,16 @@ func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map
 			Args:    trObj.Spec.Target.(map[string]interface{})["args"].(string),
 		}
 		var itrTask tasks.InstallTestRunTask
-		itrTask.Type = "InstallTestRun" //TODO(mierdin): This is an extra step. Maybe a factory function for the task could help here?
+		itrTask.BaseTask = tasks.NewBaseTask("InstallTestRun")
 		itrTask.Tr = targetTr
 
-		tc, err := comms.NewToDDComms(cfg)
+		// Send testrun to every target agent
+		err = sendToAgents(tc.CommsPackage, allGroupMap, trObj.Spec.Target.(map[string]interface{})["name"].(string), testAgentMap["targets"], itrTask)
 		if err != nil {
-			os.Exit(1) //TODO(mierdin): remove
-		}
-
-		// Send testrun to each agent UUID in the targets group
-		for uuid, _ := range testAgentMap["targets"] {
-			tc.CommsPackage.SendTask(uuid, itrTask)
+			log.Errorf("Failed to send testrun to target group: %v", err)
+			rec.finish(defs.TestRunFailed)
+			stopListeningForResponses <- true
+			return "failure"
 		}
 	}
 
@@ -171,19 +235,59 @@ func Start(cfg config.Config, trObj objects.TestRunObject, sourceOverrideMap map
 	leash := make(chan bool, 1)
 	go testMonitor(cfg, testUuid, &leash)
 
-	go executeTestRun(testAgentMap, testUuid, trObj, cfg, &leash, &stopListeningForResponses, sourceOverride)
+	go executeTestRun(testAgentMap, allGroupMap, testUuid, trObj, cfg, &leash, &stopListeningForResponses, sourceOverride, rec)
 
 	// Return the testUuid so that the client can subscribe to it.
 	return testUuid
 }
 
+// sendToAgents sends a task to the provided agents (a map of agent UUIDs to groups), which are in the provided group. If
+// they are every member of the group in the group map, the task is broadcast to the group. Otherwise - because agents that
+// haven't been heard from recently were left out of the testrun, or the sources and targets are in the same group - it
+// is sent to each agent on its own, so that it doesn't reach agents that aren't taking part.
+func sendToAgents(tc comms.CommsPackage, groupMap map[string]string, groupName string, agents map[string]string, task tasks.Task) error {
+
+	wholeGroup := true
+	for uuid, group := range groupMap {
+		if _, ok := agents[uuid]; group == groupName && !ok {
+			wholeGroup = false
+			break
+		}
+	}
+	if wholeGroup {
+		err := tc.BroadcastTask(groupName, task)
+		if err != nil {
+			return fmt.Errorf("Failed to broadcast task to group %s: %v", groupName, err)
+		}
+		return nil
+	}
+
+	for uuid := range agents {
+		err := tc.SendTask(uuid, task)
+		if err != nil {
+			return fmt.Errorf("Failed to send task to agent %s: %v", uuid, err)
+		}
+	}
+	return nil
+}
+
 // executeTestRun will perform three things:
 //
 // - Monitor the database to determine which agents have which statuses
 // - When the status for all agents is "ready", it will send execution tasks to one or both groups
 // - It will continue to monitor, and when all agents have finished, it will pull the "leash" to stop the TCP stream to the client
 // - After pulling the leash, it will call the function that will aggregate the test data and upload to a third party service
-func executeTestRun(testAgentMap map[string]map[string]string, testUuid string, trObj objects.TestRunObject, cfg config.Config, leash, responseLeash *chan bool, sourceOverride bool) {
+//
+// Each of these phases is recorded in the testrun's history as it starts and finishes.
+func executeTestRun(testAgentMap map[string]map[string]string, allGroupMap map[string]string, testUuid string, trObj objects.TestRunObject, cfg config.Config, leash, responseLeash *chan bool, sourceOverride bool, rec *recorder) {
+
+	// If any agent fails, there is nothing left to do but record the failure and clean up our goroutines
+	fail := func(err error) {
+		log.Error(err)
+		rec.finish(defs.TestRunFailed)
+		*leash <- true
+		*responseLeash <- true
+	}
 
 	// Sleep for 2 seconds so that the client moniting can connect first
 	time.Sleep(2000 * time.Millisecond)
@@ -193,25 +297,20 @@ func executeTestRun(testAgentMap map[string]map[string]string, testUuid string,
 		log.Fatalf("Error connecting to DB: %v", err)
 	}
 
-	// First, let's just keep retrieving statuses until all of the agents are reporting ready
-readyloop:
-	for {
-		time.Sleep(1000 * time.Millisecond)
+	// Follow changes to the agents' statuses, instead of repeatedly retrieving all of them
+	stopWatching := make(chan bool, 1)
+	defer func() { stopWatching <- true }()
+	updates, err := tdb.WatchTestStatus(testUuid, &stopWatching)
+	if err != nil {
+		log.Fatalf("Error retrieving test status: %v", err)
+	}
+	testStatuses := <-updates
 
-		testStatuses, err := tdb.GetTestStatus(testUuid)
-		if err != nil {
-			log.Fatalf("Error retrieving test status: %v", err)
-		}
-		for _, status := range testStatuses {
-			switch true {
-			case status == "fail":
-				log.Error("Agent reported failure during testing")
-				os.Exit(1)
-			case status != "ready":
-				continue readyloop
-			}
-		}
-		break
+	// First, wait until all of the agents are reporting ready
+	testStatuses, err = waitForStatus(updates, testStatuses, "ready", allAgents)
+	if err != nil {
+		fail(err)
+		return
 	}
 
 	tc, err := comms.NewToDDComms(cfg)
@@ -222,91 +321,54 @@ readyloop:
 	// If this is a group target type, we want to make sure that the targets are set up and reporting a status of "testing"
 	// before we spin up the source tests
 	if trObj.Spec.TargetType == "group" {
+		rec.startPhase("targets")
+
 		var target_task tasks.ExecuteTestRunTask
-		target_task.Type = "ExecuteTestRun" //TODO(mierdin): This is an extra step. Maybe a factory function for the task could help here?
+		target_task.BaseTask = tasks.NewBaseTask("ExecuteTestRun")
 		target_task.TestUuid = testUuid
 		target_task.TimeLimit = cfg.Testing.Timeout
 
-		// Send testrun to each agent UUID in the targets group
-		for uuid, _ := range testAgentMap["targets"] {
-			tc.CommsPackage.SendTask(uuid, target_task)
+		// Send testrun to every target agent
+		targetGroup := trObj.Spec.Target.(map[string]interface{})["name"].(string)
+		err = sendToAgents(tc.CommsPackage, allGroupMap, targetGroup, testAgentMap["targets"], target_task)
+		if err != nil {
+			log.Errorf("Failed to send testrun to target group: %v", err)
 		}
 
-		// Next, we want to wait to make sure that the targets are all "testing" before instructing the source group to execute
-	targetsreadyloop:
-		for {
-
-			time.Sleep(1000 * time.Millisecond)
-
-			testStatuses, err := tdb.GetTestStatus(testUuid)
-			if err != nil {
-				log.Fatalf("Error retrieving test status: %v", err)
-			}
-
-			// We're creating this map to hold ONLY the targets that are in testStatuses (which also contains sources)
-			targetStatuses := make(map[string]string)
-
-			// Iterate all of the sources and agents
-			for agent, status := range testStatuses {
-
-				// if this agent is present in the group map....
-				targetmap := testAgentMap["targets"]
-				if val, ok := targetmap[agent]; ok {
-
-					//...and it's also in our target group, add it to our targets map
-					if val == trObj.Spec.Target.(map[string]interface{})["name"].(string) {
-						targetStatuses[agent] = status
-						log.Error(agent)
-					}
-				}
-			}
-
-			for agent, status := range targetStatuses {
-				switch true {
-				case status == "fail":
-					log.Errorf("Agent %s reported failure during testing", agent)
-					os.Exit(1)
-				case status != "testing":
-					log.Errorf("%s is not ready, so the sources must wait!!")
-					continue targetsreadyloop
-				}
-			}
-			break
+		// Next, we want to wait to make sure that the targets are all "testing" before instructing the source group to execute.
+		// Only the agents in our target group are considered here - the sources are still "ready".
+		isTarget := func(agent string) bool {
+			return testAgentMap["targets"][agent] == targetGroup
+		}
+		testStatuses, err = waitForStatus(updates, testStatuses, "testing", isTarget)
+		if err != nil {
+			fail(err)
+			return
 		}
 	}
 
 	// The targets are ready; execute testing on the source agents
+	rec.startPhase("testing")
 	var source_task tasks.ExecuteTestRunTask
-	source_task.Type = "ExecuteTestRun" //TODO(mierdin): This is an extra step. Maybe a factory function for the task could help here?
+	source_task.BaseTask = tasks.NewBaseTask("ExecuteTestRun")
 	source_task.TestUuid = testUuid
 	source_task.TimeLimit = 30
 
-	// Send testrun to each agent UUID in the targets group
-	for uuid, _ := range testAgentMap["sources"] {
-		tc.CommsPackage.SendTask(uuid, source_task)
+	// Send testrun to every source agent
+	err = sendToAgents(tc.CommsPackage, allGroupMap, trObj.Spec.Source["name"], testAgentMap["sources"], source_task)
+	if err != nil {
+		log.Errorf("Failed to send testrun to source group: %v", err)
 	}
 
 	// Let's wait once more until all agents are stored in the database with a status of "finished"
-finishedloop:
-	for {
-		time.Sleep(1000 * time.Millisecond)
-
-		testStatuses, err := tdb.GetTestStatus(testUuid)
-		if err != nil {
-			log.Fatalf("Error retrieving test status: %v", err)
-		}
-		for agent, status := range testStatuses {
-			switch true {
-			case status == "fail":
-				log.Errorf("Agent %s reported failure during testing", agent)
-				os.Exit(1)
-			case status != "finished":
-				continue finishedloop
-			}
-		}
-		break
+	_, err = waitForStatus(updates, testStatuses, "finished", allAgents)
+	if err != nil {
+		fail(err)
+		return
 	}
 
+	rec.startPhase("report")
+
 	uncondensedData, err := tdb.GetAgentTestData(testUuid, trObj.Spec.Source["name"])
 	if err != nil {
 		log.Fatalf("Error retrieving agent test data: %v", err)
@@ -325,35 +387,90 @@ finishedloop:
 
 	time.Sleep(1000 * time.Millisecond)
 
+	var late <-chan defs.TestRunSink
 	if !sourceOverride {
-		testDataMap := make(map[string]map[string]map[string]string)
-		err = json.Unmarshal(clean_data_json, &testDataMap)
-		if err != nil {
-			panic("Problem converting post-test data to a map")
+		// Keep the latest results of this testrun for Prometheus to scrape from /metrics, timestamped with when they
+		// were measured (or now, for results from agents that don't report this)
+		measured := clean_data_map.Measured()
+		if measured.IsZero() {
+			measured = time.Now()
 		}
+		metrics.Record(trObj.Label, testUuid, trObj.Spec.Source["name"], measured, clean_data_map)
 
-		var time_db = tsdb.NewToddTSDB(cfg)
-		err = time_db.TSDBPackage.WriteData(testUuid, trObj.Label, trObj.Spec.Source["name"], testDataMap)
+		sinks, err := tsdb.NewSinks(cfg)
 		if err != nil {
+			log.Error(err)
 			log.Error("TSDB ERROR - TESTRUN METRICS NOT PUBLISHED")
+		} else {
+			var statuses []defs.TestRunSink
+			statuses, late = tsdb.WriteSinks(sinks, testUuid, trObj.Label, trObj.Spec.Source["name"], clean_data_map)
+			rec.setSinks(statuses)
 		}
 
 	}
 
+	rec.finish(defs.TestRunFinished)
+
+	// Sinks that timed out may still finish writing (or spooling) the results, long after the testrun is over
+	if late != nil {
+		go func() {
+			for sink := range late {
+				rec.updateSink(sink)
+			}
+		}()
+	}
+
 	// Clean up our goroutines
 	*leash <- true
 	*responseLeash <- true
 
 }
 
-func cleanTestData(dirtyData map[string]string) map[string]map[string]map[string]string {
+// allAgents selects every agent in a testrun, for use with waitForStatus
+func allAgents(agent string) bool {
+	return true
+}
+
+// waitForStatus receives status updates from WatchTestStatus until every agent selected by include reports the wanted
+// status, starting with the most recent status received. It returns the status it stopped at, so that the next phase of
+// the testrun can continue from there.
+func waitForStatus(updates <-chan map[string]string, testStatuses map[string]string, want string, include func(string) bool) (map[string]string, error) {
+	for {
+		done := true
+		for agent, status := range testStatuses {
+			if !include(agent) {
+				continue
+			}
+			switch status {
+			case "fail":
+				return nil, fmt.Errorf("Agent %s reported failure during testing", agent)
+			case want:
+			default:
+				done = false
+			}
+		}
+		if done {
+			return testStatuses, nil
+		}
+
+		var ok bool
+		testStatuses, ok = <-updates
+		if !ok {
+			return nil, errors.New("Stopped receiving test status updates")
+		}
+	}
+}
+
+// cleanTestData turns the data uploaded by each agent into typed metrics for every agent and target, along with when
+// and how the testlet ran. Metrics that a testlet reported incorrectly are logged and left out.
+func cleanTestData(dirtyData map[string]string) defs.TestData {
 
-	ret_map := make(map[string]map[string]map[string]string)
+	ret_map := make(defs.TestData)
 
 	for source_uuid, agentData := range dirtyData {
 
 		// Marshal data into a nested map. The keys for the outside map are target IPs,
-		var dataMap map[string]string
+		var dataMap map[string]json.RawMessage
 		err := json.Unmarshal([]byte(agentData), &dataMap)
 		if err != nil {
 			log.Error(err)
@@ -362,18 +479,32 @@ func cleanTestData(dirtyData map[string]string) map[string]map[string]map[string
 			os.Exit(1)
 		}
 
-		targetMap := make(map[string]map[string]string)
+		targetMap := make(map[string]defs.TargetData)
 		for target_ip, test_data := range dataMap {
-			var testletMap map[string]string
-			err := json.Unmarshal([]byte(test_data), &testletMap)
+
+			// Agents older than protocol version 2 only upload the testlet's output
+			var result defs.TestletResult
+			if err := json.Unmarshal(test_data, &result.Output); err != nil {
+				if err := json.Unmarshal(test_data, &result); err != nil {
+					log.Error(err)
+					log.Error(string(test_data))
+					log.Error("Failed to unmarshal dirty test data 2")
+					os.Exit(1)
+				}
+			}
+
+			// A testlet that failed may not have reported anything, but when and how it ran is still kept
+			testletMap, metricErrs, err := defs.ParseTestletOutput([]byte(result.Output))
 			if err != nil {
-				log.Error(err)
-				log.Error(testletMap)
-				log.Error("Failed to unmarshal dirty test data 2")
-				os.Exit(1)
+				log.Errorf("Testlet run by agent %s for target %s (exit status %d) didn't report any metrics: %v - output was %q",
+					source_uuid, target_ip, result.ExitStatus, err, result.Output)
+				testletMap = make(map[string]defs.MetricValue)
+			}
+			for _, err := range metricErrs {
+				log.Errorf("Leaving out invalid metric reported by agent %s for target %s: %v", source_uuid, target_ip, err)
 			}
 
-			targetMap[target_ip] = testletMap
+			targetMap[target_ip] = defs.TargetData{TestletRun: result.TestletRun, Metrics: testletMap}
 		}
 		ret_map[source_uuid] = targetMap
 	}
@@ -417,15 +548,16 @@ retrytcpserver:
 
 	tdb, _ := db.NewToddDB(cfg)
 
-	// Constantly poll for test status, and send statuses to client
-	for {
-		time.Sleep(1000 * time.Millisecond)
-
-		testStatuses, err := tdb.GetTestStatus(testUuid)
-		if err != nil {
-			log.Fatalf("Error retrieving test status: %v", err)
-		}
+	stopWatching := make(chan bool, 1)
+	defer func() { stopWatching <- true }()
+	updates, err := tdb.WatchTestStatus(testUuid, &stopWatching)
+	if err != nil {
+		log.Errorf("Error retrieving test status: %v", err)
+		return
+	}
 
+	// sendStatus sends statuses to the client, and waits for the client to acknowledge them
+	sendStatus := func(testStatuses map[string]string) error {
 		statuses_json, err := json.Marshal(testStatuses)
 		if err != nil {
 			log.Fatal("Failed to marshal agent test status message")
@@ -433,26 +565,40 @@ retrytcpserver:
 		}
 
 		// Send status to client
-		newmessage := fmt.Sprintf(string(statuses_json))
-		conn.Write([]byte(newmessage + "\n"))
+		conn.Write(append(statuses_json, '\n'))
 
 		// Detect a client disconnect
 		_, err = bufio.NewReader(conn).ReadString('\n')
-		if err != nil {
-			return
-		}
+		return err
+	}
+
+	// Send statuses to the client every time they change
+	for {
+		select {
+		case testStatuses, ok := <-updates:
+			if !ok {
+				return
+			}
+			if sendStatus(testStatuses) != nil {
+				return
+			}
 
 		// TODO(mierdin): Need to add failure notification (status of "fail" for any one agent)
 
 		// Check to see if the calling function has asked that we shut down
-		// Because of the presence of the default statement, this select statement will not block. It will allow the
-		// loop to repeat if the channel does not contain data, and if it does this function will return.
-		select {
 		case _, _ = <-*leash:
+
+			// Make sure the client has seen the final statuses before shutting down
+			select {
+			case testStatuses, ok := <-updates:
+				if ok {
+					sendStatus(testStatuses)
+				}
+			default:
+			}
+
 			log.Debug("Killed testrun monitoring goroutine")
 			return
-		default:
 		}
-
 	}
 }
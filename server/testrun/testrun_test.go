@@ -0,0 +1,170 @@
+/*
+    Tests for ToDD Test Runs
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package testrun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/agent/tasks"
+	"github.com/Mierdin/todd/comms"
+)
+
+// TestWaitForStatus tests that each phase of a testrun waits for the right agents, and picks up where the last phase stopped
+func TestWaitForStatus(t *testing.T) {
+	updates := make(chan map[string]string, 10)
+	updates <- map[string]string{"src": "ready", "dst": "ready"}
+	updates <- map[string]string{"src": "ready", "dst": "testing"}
+	updates <- map[string]string{"src": "finished", "dst": "finished"}
+
+	isTarget := func(agent string) bool { return agent == "dst" }
+
+	testStatuses, err := waitForStatus(updates, map[string]string{"src": "init", "dst": "ready"}, "ready", allAgents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testStatuses["src"] != "ready" {
+		t.Fatalf("Stopped waiting for ready agents at %v", testStatuses)
+	}
+
+	testStatuses, err = waitForStatus(updates, testStatuses, "testing", isTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testStatuses["dst"] != "testing" || testStatuses["src"] != "ready" {
+		t.Fatalf("Stopped waiting for testing targets at %v", testStatuses)
+	}
+
+	// The latest status is checked first, without waiting for another update
+	testStatuses, err = waitForStatus(updates, testStatuses, "testing", isTarget)
+	if err != nil || len(updates) != 1 {
+		t.Fatalf("Expected to return immediately, got %v, %v", testStatuses, err)
+	}
+
+	_, err = waitForStatus(updates, testStatuses, "finished", allAgents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed agent ends the testrun, as does the end of the watch
+	updates <- map[string]string{"src": "fail", "dst": "testing"}
+	close(updates)
+	if _, err = waitForStatus(updates, map[string]string{"src": "ready"}, "finished", allAgents); err == nil {
+		t.Fatal("Expected an error for a failed agent")
+	}
+	if _, err = waitForStatus(updates, map[string]string{"src": "ready"}, "finished", allAgents); err == nil {
+		t.Fatal("Expected an error once the watch has ended")
+	}
+}
+
+// TestCleanTestData tests that the data uploaded by each agent becomes typed metrics along with the testlet's run,
+// leaving out invalid metrics
+func TestCleanTestData(t *testing.T) {
+	dirtyData := map[string]string{
+		"agent1": `{
+			"8.8.8.8": {
+				"output": "{\"avg_latency_ms\": \"27.007\", \"packet_loss\": {\"value\": 0, \"type\": \"int\", \"unit\": \"%\"}}",
+				"start": "2016-05-02T14:21:07Z", "end": "2016-05-02T14:21:09Z", "duration": 2000000000, "exitstatus": 0
+			},
+			"8.8.4.4": {
+				"output": "ping: unknown host",
+				"start": "2016-05-02T14:21:07Z", "end": "2016-05-02T14:21:08Z", "duration": 1000000000, "exitstatus": 2
+			}
+		}`,
+
+		// Agents older than protocol version 2 upload only the output
+		"agent2": `{"8.8.4.4": "{\"reachable\": false, \"loss\": {\"value\": \"lots\", \"type\": \"int\"}}"}`,
+	}
+
+	data := cleanTestData(dirtyData)
+
+	start := time.Date(2016, 5, 2, 14, 21, 7, 0, time.UTC)
+	expected := defs.TestData{
+		"agent1": {
+			"8.8.8.8": {
+				TestletRun: defs.TestletRun{Start: start, End: start.Add(2 * time.Second), Duration: 2 * time.Second},
+				Metrics: map[string]defs.MetricValue{
+					"avg_latency_ms": {Type: defs.MetricFloat, Value: 27.007},
+					"packet_loss":    {Type: defs.MetricInt, Value: int64(0), Unit: "%"},
+				},
+			},
+			"8.8.4.4": {
+				TestletRun: defs.TestletRun{Start: start, End: start.Add(time.Second), Duration: time.Second, ExitStatus: 2},
+				Metrics:    map[string]defs.MetricValue{},
+			},
+		},
+		"agent2": {
+			"8.8.4.4": {
+				Metrics: map[string]defs.MetricValue{"reachable": {Type: defs.MetricBool, Value: false}},
+			},
+		},
+	}
+	for agent, targets := range expected {
+		for target, e := range targets {
+			got := data[agent][target]
+			if !got.Start.Equal(e.Start) || !got.End.Equal(e.End) || got.Duration != e.Duration || got.ExitStatus != e.ExitStatus {
+				t.Fatalf("Expected the run for %s and %s to be %+v, got %+v", agent, target, e.TestletRun, got.TestletRun)
+			}
+			if len(got.Metrics) != len(e.Metrics) {
+				t.Fatalf("Expected %v for %s and %s, got %v", e.Metrics, agent, target, got.Metrics)
+			}
+			for name, m := range e.Metrics {
+				if got.Metrics[name] != m {
+					t.Fatalf("Expected %s to be %#v, got %#v", name, m, got.Metrics[name])
+				}
+			}
+		}
+	}
+}
+
+// taskRecorder is a comms package that only records who tasks are sent to
+type taskRecorder struct {
+	comms.CommsPackage
+	sent      map[string]bool
+	broadcast []string
+}
+
+func (tr *taskRecorder) SendTask(queueName string, task tasks.Task) error {
+	tr.sent[queueName] = true
+	return nil
+}
+
+func (tr *taskRecorder) BroadcastTask(groupName string, task tasks.Task) error {
+	tr.broadcast = append(tr.broadcast, groupName)
+	return nil
+}
+
+// TestSendToAgents tests that tasks are broadcast to a group when every member takes part in a testrun, and otherwise
+// only go to the agents taking part, rather than everything in their group
+func TestSendToAgents(t *testing.T) {
+	var task tasks.ExecuteTestRunTask
+	task.BaseTask = tasks.NewBaseTask("ExecuteTestRun")
+
+	groupMap := map[string]string{"agent1": "src", "agent2": "src", "agent3": "dst"}
+
+	tr := &taskRecorder{sent: make(map[string]bool)}
+	err := sendToAgents(tr, groupMap, "src", map[string]string{"agent1": "src", "agent2": "src"}, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.broadcast) != 1 || tr.broadcast[0] != "src" || len(tr.sent) != 0 {
+		t.Fatalf("Expected task to be broadcast to src, got %v and %v", tr.broadcast, tr.sent)
+	}
+
+	// agent2 was left out, so broadcasting to the group would reach it too
+	tr = &taskRecorder{sent: make(map[string]bool)}
+	err = sendToAgents(tr, groupMap, "src", map[string]string{"agent1": "src"}, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.broadcast) != 0 || len(tr.sent) != 1 || !tr.sent["agent1"] {
+		t.Fatalf("Expected task to be sent to agent1 only, got %v and %v", tr.broadcast, tr.sent)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+    ToDD tsdbPackage implementation for local files
+
+    Results are appended to files in a directory, one record per metric reported by each agent against each target,
+    as either JSON Lines or CSV. Each file is named after the time it was started, so that the current file (the most
+    recent one) can be found again after the server restarts. A new file is started once the current one is too big or
+    too old, leaving the older files to be shipped elsewhere or loaded into a spreadsheet.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+const (
+	fileDefaultFormat  = "jsonl"
+	fileDefaultMaxSize = 100 // megabytes
+	fileDefaultMaxAge  = 24  // hours
+
+	// fileNamePrefix and fileTimeLayout make up the name of each results file, followed by the format as the extension
+	fileNamePrefix = "todd-results-"
+	fileTimeLayout = "20060102T150405.000Z"
+)
+
+// fileColumns are the fields of each record, in the order they are written to CSV files
+var fileColumns = []string{"time", "testrun", "uuid", "group", "agent", "target", "metric", "value", "type", "unit"}
+
+// fileMu serializes writes, since testruns finishing at the same time would otherwise interleave their records and
+// race to start new files
+var fileMu sync.Mutex
+
+// newFileDB is a factory function that produces a new instance of fileDB with the configuration
+// loaded and ready to be used.
+func newFileDB(cfg config.Config) *fileDB {
+	var fdb fileDB
+	fdb.config = cfg
+	return &fdb
+}
+
+type fileDB struct {
+	config config.Config
+}
+
+// fileRecord is a single metric, as written to JSON Lines files
+type fileRecord struct {
+	Time    time.Time   `json:"time"`
+	TestRun string      `json:"testrun"`
+	Uuid    string      `json:"uuid"`
+	Group   string      `json:"group"`
+	Agent   string      `json:"agent"`
+	Target  string      `json:"target"`
+	Metric  string      `json:"metric"`
+	Value   interface{} `json:"value"`
+	Type    string      `json:"type"`
+	Unit    string      `json:"unit,omitempty"`
+}
+
+// WriteData will append the resulting testrun data to the current results file, starting a new file first if the
+// current one is due to be rotated
+func (fdb fileDB) WriteData(testUuid, testRunName, groupName string, testData defs.TestData) error {
+
+	format := fdb.format()
+	if format != "jsonl" && format != "csv" {
+		return fmt.Errorf("Unknown format %q for file TSDB plugin - use \"jsonl\" or \"csv\"", format)
+	}
+
+	dir := fdb.dir()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Errorf("Error creating results directory %s: %v", dir, err)
+		return err
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	now := time.Now().UTC()
+	path, err := fdb.currentFile(dir, format, now)
+	if err != nil {
+		log.Errorf("Error finding current results file in %s: %v", dir, err)
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Errorf("Error opening results file %s: %v", path, err)
+		return err
+	}
+
+	info, err := f.Stat()
+	if err == nil {
+		err = writeRecords(f, format, info.Size() == 0, fileRecords(testUuid, testRunName, groupName, testData, now))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Errorf("Error writing to results file %s: %v", path, err)
+		return err
+	}
+
+	log.Infof("Wrote test data for %s to %s", testUuid, path)
+
+	return nil
+}
+
+// dir returns the directory holding the results files
+func (fdb fileDB) dir() string {
+	if fdb.config.TSDB.Path != "" {
+		return fdb.config.TSDB.Path
+	}
+	return filepath.Join(fdb.config.LocalResources.OptDir, "results")
+}
+
+func (fdb fileDB) format() string {
+	if fdb.config.TSDB.Format == "" {
+		return fileDefaultFormat
+	}
+	return strings.ToLower(fdb.config.TSDB.Format)
+}
+
+// currentFile returns the path of the file to write to - the most recent file in dir, unless it is due to be rotated,
+// in which case the path of a new file is returned. Negative limits disable rotation by size or age.
+func (fdb fileDB) currentFile(dir, format string, now time.Time) (string, error) {
+	maxSize := int64(fdb.config.TSDB.MaxSize)
+	if maxSize == 0 {
+		maxSize = fileDefaultMaxSize
+	}
+	maxAge := time.Duration(fdb.config.TSDB.MaxAge)
+	if maxAge == 0 {
+		maxAge = fileDefaultMaxAge
+	}
+
+	newFile := filepath.Join(dir, fileNamePrefix+now.Format(fileTimeLayout)+"."+format)
+
+	// Timestamps in the names sort in the order the files were started, so the last one is the most recent
+	files, err := filepath.Glob(filepath.Join(dir, fileNamePrefix+"*."+format))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return newFile, nil
+	}
+	sort.Strings(files)
+	latest := files[len(files)-1]
+
+	started, err := time.Parse(fileTimeLayout, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(latest), fileNamePrefix), "."+format))
+	if err != nil {
+		return "", fmt.Errorf("Unexpected results file name %s", latest)
+	}
+	if maxAge > 0 && now.Sub(started) >= maxAge*time.Hour {
+		return newFile, nil
+	}
+
+	info, err := os.Stat(latest)
+	if err != nil {
+		return "", err
+	}
+	if maxSize > 0 && info.Size() >= maxSize*1024*1024 {
+		return newFile, nil
+	}
+
+	return latest, nil
+}
+
+// fileRecords flattens testrun data into one record per metric, sorted by agent, target and metric. Records have the
+// time their metric was measured, or t if this isn't known.
+func fileRecords(testUuid, testRunName, groupName string, testData defs.TestData, t time.Time) []fileRecord {
+	var records []fileRecord
+
+	for agentUuid, agentData := range testData {
+		for targetAddress, targetData := range agentData {
+			measuredAt := measured(targetData, t)
+			for metric, m := range targetData.Metrics {
+				value := tsdbValue(m)
+				records = append(records, fileRecord{
+					Time:    measuredAt,
+					TestRun: testRunName,
+					Uuid:    testUuid,
+					Group:   groupName,
+					Agent:   agentUuid,
+					Target:  targetAddress,
+					Metric:  metric,
+					Value:   value.Value,
+					Type:    value.Type,
+					Unit:    value.Unit,
+				})
+			}
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Agent != b.Agent {
+			return a.Agent < b.Agent
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Metric < b.Metric
+	})
+
+	return records
+}
+
+// writeRecords writes records to w in the provided format. CSV files start with a header, so header should be set
+// when w is a new file.
+func writeRecords(w io.Writer, format string, header bool, records []fileRecord) error {
+	bw := bufio.NewWriter(w)
+
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(bw)
+		if header {
+			cw.Write(fileColumns)
+		}
+		for _, r := range records {
+			value := defs.MetricValue{Value: r.Value}.String()
+			cw.Write([]string{r.Time.Format(time.RFC3339), r.TestRun, r.Uuid, r.Group, r.Agent, r.Target, r.Metric, value, r.Type, r.Unit})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	default:
+		enc := json.NewEncoder(bw)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
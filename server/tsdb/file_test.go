@@ -0,0 +1,235 @@
+/*
+    Tests for the file TSDB plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+// fileTestData has results for agent1 as they are recorded now, and for agent2 as they were before testlet runs were
+// recorded, without a time
+var fileTestData = testData(`{
+	"agent1": {"8.8.8.8": {
+		"metrics": {"avg_latency_ms": "10.25", "packet_loss": {"value": 0, "type": "int", "unit": "%"}},
+		"start": "2016-05-02T14:21:07Z", "end": "2016-05-02T14:21:09Z", "duration": 2000000000, "exitstatus": 0
+	}},
+	"agent2": {"8.8.4.4": {"result": "a, \"quoted\" value", "rtt": {"value": "1.5ms", "type": "duration"}}}
+}`)
+
+// fileTestMeasured is when the results for agent1 were measured
+var fileTestMeasured = time.Date(2016, 5, 2, 14, 21, 9, 0, time.UTC)
+
+// testData reads test data from JSON, in the same way as the test data kept in the database
+func testData(dataJSON string) defs.TestData {
+	var data defs.TestData
+	if err := json.Unmarshal([]byte(dataJSON), &data); err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// newTestFileDB returns the config of a file TSDB writing to a temporary directory, along with a function that cleans up
+// after it
+func newTestFileDB(t *testing.T, format string) (config.Config, func()) {
+	dir, err := ioutil.TempDir("", "todd-tsdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config.Config
+	cfg.TSDB.Plugin = "file"
+	cfg.TSDB.Format = format
+	cfg.LocalResources.OptDir = dir
+
+	return cfg, func() { os.RemoveAll(dir) }
+}
+
+// resultsFiles returns the results files written by the file TSDB, oldest first
+func resultsFiles(t *testing.T, cfg config.Config) []string {
+	files, err := filepath.Glob(filepath.Join(cfg.LocalResources.OptDir, "results", fileNamePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func writeFileData(t *testing.T, cfg config.Config, testUuid string) {
+	tsdb, err := NewToddTSDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tsdb.WriteData(testUuid, "test-ping", "datacenter", fileTestData)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFileJSONLines tests that every metric is written as a JSON record, and that later testruns are appended to the same file
+func TestFileJSONLines(t *testing.T) {
+	cfg, cleanup := newTestFileDB(t, "")
+	defer cleanup()
+
+	writeFileData(t, cfg, "uuid1")
+	writeFileData(t, cfg, "uuid2")
+
+	files := resultsFiles(t, cfg)
+	if len(files) != 1 || filepath.Ext(files[0]) != ".jsonl" {
+		t.Fatalf("Expected a single JSON Lines file, got %v", files)
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []fileRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+
+	if len(records) != 8 {
+		t.Fatalf("Expected 8 records, got %+v", records)
+	}
+	r := records[0]
+	if r.Uuid != "uuid1" || r.TestRun != "test-ping" || r.Group != "datacenter" || r.Agent != "agent1" ||
+		r.Target != "8.8.8.8" || r.Metric != "avg_latency_ms" || r.Value != 10.25 || r.Type != "float" || !r.Time.Equal(fileTestMeasured) {
+		t.Fatalf("Unexpected first record %+v", r)
+	}
+	if r = records[1]; r.Value != float64(0) || r.Type != "int" || r.Unit != "%" {
+		t.Fatalf("Unexpected int record %+v", r)
+	}
+	if r = records[3]; r.Value != 0.0015 || r.Type != "duration" || r.Unit != "s" {
+		t.Fatalf("Expected durations in seconds, got %+v", r)
+	}
+	if r = records[2]; r.Time.Equal(fileTestMeasured) || r.Time.IsZero() {
+		t.Fatalf("Expected results without a run to have the time they were written, got %+v", r)
+	}
+	if records[2].Value != fileTestData["agent2"]["8.8.4.4"].Metrics["result"].Value || records[4].Uuid != "uuid2" {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+}
+
+// TestFileCSV tests that CSV files start with a single header, and that values are quoted as needed
+func TestFileCSV(t *testing.T) {
+	cfg, cleanup := newTestFileDB(t, "csv")
+	defer cleanup()
+
+	writeFileData(t, cfg, "uuid1")
+	writeFileData(t, cfg, "uuid2")
+
+	files := resultsFiles(t, cfg)
+	if len(files) != 1 || filepath.Ext(files[0]) != ".csv" {
+		t.Fatalf("Expected a single CSV file, got %v", files)
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 9 {
+		t.Fatalf("Expected a header and 8 rows, got %q", rows)
+	}
+	for i, column := range fileColumns {
+		if rows[0][i] != column {
+			t.Fatalf("Unexpected header %q", rows[0])
+		}
+	}
+	if rows[3][6] != "result" || rows[3][7] != fileTestData["agent2"]["8.8.4.4"].Metrics["result"].Value || rows[3][8] != "string" {
+		t.Fatalf("Unexpected row %q", rows[3])
+	}
+	if rows[2][7] != "0" || rows[2][8] != "int" || rows[2][9] != "%" {
+		t.Fatalf("Unexpected row %q", rows[2])
+	}
+	if measured, err := time.Parse(time.RFC3339, rows[1][0]); err != nil || !measured.Equal(fileTestMeasured) {
+		t.Fatalf("Unexpected time in row %q: %v", rows[1], err)
+	}
+}
+
+// TestFileRotation tests that a new file is started once the current one is too big or too old
+func TestFileRotation(t *testing.T) {
+	cfg, cleanup := newTestFileDB(t, "csv")
+	defer cleanup()
+	dir := filepath.Join(cfg.LocalResources.OptDir, "results")
+
+	// A file that's been written to for longer than MaxAge is left alone
+	cfg.TSDB.MaxAge = 1
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(dir, fileNamePrefix+time.Now().UTC().Add(-2*time.Hour).Format(fileTimeLayout)+".csv")
+	if err := ioutil.WriteFile(old, []byte("time\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFileData(t, cfg, "uuid1")
+	files := resultsFiles(t, cfg)
+	if len(files) != 2 || files[0] != old {
+		t.Fatalf("Expected a new file after the old one, got %v", files)
+	}
+
+	// Files in other formats are ignored
+	jsonFile := filepath.Join(dir, fileNamePrefix+time.Now().UTC().Add(time.Hour).Format(fileTimeLayout)+".jsonl")
+	if err := ioutil.WriteFile(jsonFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new file isn't old or big enough to be rotated yet
+	writeFileData(t, cfg, "uuid2")
+	if files = resultsFiles(t, cfg); len(files) != 3 {
+		t.Fatalf("Expected the current file to be reused, got %v", files)
+	}
+
+	// Make the current file bigger than MaxSize
+	cfg.TSDB.MaxSize = 1
+	f, err := os.OpenFile(files[1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 1024*1024))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Millisecond) // so that the new file has a different name
+	writeFileData(t, cfg, "uuid3")
+	if files = resultsFiles(t, cfg); len(files) != 4 {
+		t.Fatalf("Expected a new file once the current one is too big, got %v", files)
+	}
+
+	// Rotation can be turned off
+	cfg.TSDB.MaxSize = -1
+	cfg.TSDB.MaxAge = -1
+	writeFileData(t, cfg, "uuid4")
+	if files = resultsFiles(t, cfg); len(files) != 4 {
+		t.Fatalf("Expected no rotation, got %v", files)
+	}
+}
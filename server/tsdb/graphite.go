@@ -0,0 +1,143 @@
+/*
+    ToDD tsdbPackage implementation for graphite
+
+    Metrics are written to carbon using the plaintext protocol, one "<path> <value> <timestamp>" line per metric,
+    where the path is <prefix>.<testrun>.<group>.<agent>.<target>.<metric>.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+const (
+	graphiteDefaultPort      = "2003"
+	graphiteDefaultPrefix    = "todd"
+	graphiteDefaultBatchSize = 500
+
+	// graphiteTimeout is how long connecting to carbon, or writing a single batch, is allowed to take
+	graphiteTimeout = 5 * time.Second
+)
+
+// newGraphiteDB is a factory function that produces a new instance of graphiteDB with the configuration
+// loaded and ready to be used.
+func newGraphiteDB(cfg config.Config) *graphiteDB {
+	var gdb graphiteDB
+	gdb.config = cfg
+	return &gdb
+}
+
+type graphiteDB struct {
+	config config.Config
+}
+
+// WriteData will write the resulting testrun data to graphite, with a metric for each value reported by each agent
+// against each target. Graphite only stores numbers, so booleans are written as 1 or 0, durations as seconds, and
+// strings are skipped.
+func (gdb graphiteDB) WriteData(testUuid, testRunName, groupName string, testData defs.TestData) error {
+
+	prefix := gdb.config.TSDB.Prefix
+	if prefix == "" {
+		prefix = graphiteDefaultPrefix
+	}
+	port := gdb.config.TSDB.Port
+	if port == "" {
+		port = graphiteDefaultPort
+	}
+	batchSize := gdb.config.TSDB.BatchSize
+	if batchSize <= 0 {
+		batchSize = graphiteDefaultBatchSize
+	}
+
+	lines := graphiteLines(prefix, testRunName, groupName, testData, time.Now())
+
+	addr := net.JoinHostPort(gdb.config.TSDB.Host, port)
+	conn, err := net.DialTimeout("tcp", addr, graphiteTimeout)
+	if err != nil {
+		log.Errorf("Error connecting to Graphite at %s: %v", addr, err)
+		return err
+	}
+	defer conn.Close()
+
+	// Send the lines in batches, rather than one write per line
+	for start := 0; start < len(lines); start += batchSize {
+		end := start + batchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+		_, err = io.WriteString(conn, strings.Join(lines[start:end], ""))
+		if err != nil {
+			log.Errorf("Error writing to Graphite at %s: %v", addr, err)
+			return err
+		}
+	}
+
+	log.Infof("Wrote %d metrics for %s to graphite", len(lines), testUuid)
+
+	return nil
+}
+
+// graphiteLines formats testrun data as lines of the plaintext protocol, sorted by path. Metrics are timestamped with
+// when they were measured, or t if this isn't known.
+func graphiteLines(prefix, testRunName, groupName string, testData defs.TestData, t time.Time) []string {
+	var lines []string
+
+	for agentUuid, agentData := range testData {
+		for targetAddress, targetData := range agentData {
+			timestamp := measured(targetData, t).Unix()
+			for metric, v := range targetData.Metrics {
+				path := strings.Join([]string{
+					prefix,
+					graphiteNode(testRunName),
+					graphiteNode(groupName),
+					graphiteNode(agentUuid),
+					graphiteNode(targetAddress),
+					graphiteNode(metric),
+				}, ".")
+
+				value, ok := v.Float()
+				if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+					log.Warnf("Skipping %s - graphite only stores numbers, not %q", path, v.String())
+					continue
+				}
+
+				lines = append(lines, fmt.Sprintf("%s %s %d\n", path, strconv.FormatFloat(value, 'f', -1, 64), timestamp))
+			}
+		}
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+// graphiteNode makes a string safe to use as a single node of a graphite path. Dots would split it into several nodes
+// (as with IP addresses), and spaces would end the path, so these and any other unusual characters become underscores.
+func graphiteNode(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,142 @@
+/*
+    Tests for the graphite TSDB plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/config"
+)
+
+// listenGraphite starts a TCP listener standing in for carbon, and returns its config along with a channel that
+// receives everything sent over the first connection to it
+func listenGraphite(t *testing.T) (config.Config, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	var cfg config.Config
+	cfg.TSDB.Plugin = "graphite"
+	cfg.TSDB.Host, cfg.TSDB.Port, _ = net.SplitHostPort(l.Addr().String())
+
+	return cfg, received
+}
+
+// TestGraphiteWriteData tests that every metric besides strings is written to carbon as a number, with dots in the
+// path nodes replaced
+func TestGraphiteWriteData(t *testing.T) {
+	cfg, received := listenGraphite(t)
+	cfg.TSDB.Prefix = "lab1.todd"
+	cfg.TSDB.BatchSize = 2 // smaller than the number of metrics, so that several batches are sent
+
+	tsdb, err := NewToddTSDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testData(`{
+		"0d4ac7a2f3ad": {
+			"8.8.8.8": {"avg_latency_ms": "10.25", "packet_loss": {"value": 0, "type": "int"}, "result": "ok"},
+			"8.8.4.4": {"avg_latency_ms": 12, "reachable": false, "rtt": {"value": 1.5, "type": "duration", "unit": "ms"}}
+		},
+		"99fd8ba22e4c": {
+			"8.8.8.8": {
+				"metrics": {"avg_latency_ms": " 1e3 "},
+				"start": "2016-05-02T14:21:07Z", "end": "2016-05-02T14:21:09Z", "duration": 2000000000, "exitstatus": 0
+			}
+		}
+	}`)
+
+	err = tsdb.WriteData("testuuid", "test-ping", "my.group", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent string
+	select {
+	case sent = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for metrics")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(sent, "\n"), "\n")
+	expected := []string{
+		"lab1.todd.test-ping.my_group.0d4ac7a2f3ad.8_8_4_4.avg_latency_ms 12",
+		"lab1.todd.test-ping.my_group.0d4ac7a2f3ad.8_8_4_4.reachable 0",
+		"lab1.todd.test-ping.my_group.0d4ac7a2f3ad.8_8_4_4.rtt 0.0015",
+		"lab1.todd.test-ping.my_group.0d4ac7a2f3ad.8_8_8_8.avg_latency_ms 10.25",
+		"lab1.todd.test-ping.my_group.0d4ac7a2f3ad.8_8_8_8.packet_loss 0",
+		"lab1.todd.test-ping.my_group.99fd8ba22e4c.8_8_8_8.avg_latency_ms 1000",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %q", len(expected), sent)
+	}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0]+" "+fields[1] != expected[i] {
+			t.Fatalf("Expected line %d to be %q with a timestamp, got %q", i, expected[i], line)
+		}
+	}
+
+	// Metrics are timestamped with when they were measured, where this is known
+	if measured := strings.Fields(lines[len(lines)-1])[2]; measured != "1462198869" {
+		t.Fatalf("Expected the last line to have the time it was measured, got %q", lines[len(lines)-1])
+	}
+}
+
+// TestGraphiteUnavailable tests that an error is returned when carbon can't be reached
+func TestGraphiteUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var cfg config.Config
+	cfg.TSDB.Plugin = "graphite"
+	cfg.TSDB.Host, cfg.TSDB.Port, _ = net.SplitHostPort(addr)
+
+	tsdb, err := NewToddTSDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tsdb.WriteData("testuuid", "test-ping", "datacenter", testData(`{"agent1": {"8.8.8.8": {"packet_loss": "0"}}}`))
+	if err == nil {
+		t.Fatal("Expected an error writing to a closed port")
+	}
+}
+
+func TestInvalidTSDBPlugin(t *testing.T) {
+	var cfg config.Config
+	cfg.TSDB.Plugin = "rrdtool"
+
+	if _, err := NewToddTSDB(cfg); err != ErrInvalidTSDBPlugin {
+		t.Fatalf("Expected ErrInvalidTSDBPlugin, got %v", err)
+	}
+}
@@ -10,12 +10,12 @@ package tsdb
 
 import (
 	"fmt"
-	"strconv"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
 
+	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/config"
 )
 
@@ -33,7 +33,7 @@ type influxDB struct {
 
 // WriteData will write the resulting testrun data to influxdb as a batch of points - containing
 // important information like metrics and which agent reported them.
-func (ifdb influxDB) WriteData(testUuid, testRunName, groupName string, testData map[string]map[string]map[string]string) error {
+func (ifdb influxDB) WriteData(testUuid, testRunName, groupName string, testData defs.TestData) error {
 
 	// Make client
 	c, err := influx.NewHTTPClient(influx.HTTPConfig{
@@ -51,11 +51,20 @@ func (ifdb influxDB) WriteData(testUuid, testRunName, groupName string, testData
 		Precision: "s",
 	})
 
+	now := time.Now()
+
 	// Need to publish data from all of the agents that took part in this test
 	for agentUuid, agentData := range testData {
 
 		// Also need to differentiate between the various target that these agents tested against
-		for targetAddress, metrics := range agentData {
+		for targetAddress, targetData := range agentData {
+
+			// InfluxDB won't take a point without any fields, which is what a testlet that reported nothing (or
+			// whose output couldn't be read) leaves us with
+			if len(targetData.Metrics) == 0 {
+				log.Debugf("No metrics from agent %s for target %s - not writing a point", agentUuid, targetAddress)
+				continue
+			}
 
 			// Create a point and add to batch
 			tags := map[string]string{
@@ -65,23 +74,37 @@ func (ifdb influxDB) WriteData(testUuid, testRunName, groupName string, testData
 				"testUuid":    testUuid,
 			}
 
-			// Convert our metrics to float and insert into influx fields
+			// Insert our metrics into influx fields. InfluxDB won't write a field as a different type than it was first
+			// written as, and every metric was written as a float before metrics had types, so everything with a
+			// number (including ints, booleans and durations) is still written as a float. Only strings are kept as is.
 			fields := make(map[string]interface{})
-			for k, v := range metrics {
-				float_v, _ := strconv.ParseFloat(v, 64)
-				fields[k] = float_v
+			for k, v := range targetData.Metrics {
+				if f, ok := v.Float(); ok {
+					fields[k] = f
+				} else {
+					fields[k] = v.String()
+				}
+			}
+			pt, err := influx.NewPoint(fmt.Sprintf("testrun-%s", testRunName), tags, fields, measured(targetData, now))
+			if err != nil {
+				log.Errorf("Error creating InfluxDB point for agent %s and target %s: %v", agentUuid, targetAddress, err)
+				return rejectedError{err}
 			}
-			pt, _ := influx.NewPoint(fmt.Sprintf("testrun-%s", testRunName), tags, fields, time.Now())
 			bp.AddPoint(pt)
 
 		}
 
 	}
 
+	if len(bp.Points()) == 0 {
+		log.Infof("No test data for %s to write to influxdb", testUuid)
+		return nil
+	}
+
 	// Write the batch
 	err = c.Write(bp)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("Error writing to InfluxDB: %v", err)
 		return err
 	}
 
@@ -0,0 +1,128 @@
+/*
+    Tests for the influxdb TSDB plugin
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Mierdin/todd/config"
+)
+
+// listenInfluxDB starts an HTTP server standing in for InfluxDB, and returns its config along with a function that
+// returns the lines of every point written to it so far, sorted
+func listenInfluxDB(t *testing.T) (config.Config, func() []string, func()) {
+	var mu sync.Mutex
+	var lines []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	var cfg config.Config
+	cfg.TSDB.Plugin = "influxdb"
+	cfg.TSDB.DatabaseName = "todd"
+	cfg.TSDB.Host, cfg.TSDB.Port, _ = net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+
+	written := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(lines)
+		return lines
+	}
+	return cfg, written, ts.Close
+}
+
+// TestInfluxDBNoMetrics tests that targets without any metrics are left out, since InfluxDB won't take a point without
+// fields
+func TestInfluxDBNoMetrics(t *testing.T) {
+	cfg, written, stop := listenInfluxDB(t)
+	defer stop()
+
+	tsdb, err := NewToddTSDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testData(`{
+		"agent1": {
+			"8.8.8.8": {"packet_loss": "0"},
+			"8.8.4.4": {"metrics": {}, "start": "2016-05-02T14:21:07Z", "end": "2016-05-02T14:21:09Z", "duration": 2000000000, "exitstatus": 1}
+		}
+	}`)
+	err = tsdb.WriteData("testuuid", "test-ping", "datacenter", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := written()
+	if len(lines) != 1 || !strings.Contains(lines[0], "target=8.8.8.8") {
+		t.Fatalf("Expected a single point for 8.8.8.8, got %q", lines)
+	}
+
+	// Nothing is written if no target has metrics
+	err = tsdb.WriteData("testuuid", "test-ping", "datacenter", testData(`{"agent1": {"8.8.4.4": {}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written()) != 1 {
+		t.Fatalf("Expected nothing else to be written, got %q", written())
+	}
+}
+
+// TestInfluxDBFieldTypes tests that every metric with a number is written as a float, so that its field keeps the type
+// it was written with before metrics had types
+func TestInfluxDBFieldTypes(t *testing.T) {
+	cfg, written, stop := listenInfluxDB(t)
+	defer stop()
+
+	tsdb, err := NewToddTSDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testData(`{
+		"agent1": {
+			"8.8.8.8": {
+				"avg_latency_ms": "10.25",
+				"packet_loss": {"value": 3, "type": "int"},
+				"reachable": true,
+				"rtt": {"value": 1.5, "type": "duration", "unit": "ms"},
+				"result": "ok"
+			}
+		}
+	}`)
+	err = tsdb.WriteData("testuuid", "test-ping", "datacenter", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := written()
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single point, got %q", lines)
+	}
+	for _, field := range []string{"avg_latency_ms=10.25", "packet_loss=3", "reachable=1", "rtt=0.0015", `result="ok"`} {
+		if !strings.Contains(lines[0], field+",") && !strings.Contains(lines[0], field+" ") {
+			t.Fatalf("Expected point to contain %s, got %q", field, lines[0])
+		}
+	}
+}
@@ -0,0 +1,212 @@
+/*
+    ToDD Result Sinks
+
+    The results of each testrun can be written to several TSDB plugins ("sinks") at once - the one configured in the
+    [TSDB] section, and any number of others, each in a [Sink "<name>"] section with the same options. Sinks are
+    written to at the same time, and independently, so that one that fails or hangs doesn't hold up the others. Results
+    that fail to be written are spooled, and retried later (see spool.go).
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+// tsdbSinkName is the name of the sink configured in the [TSDB] section
+const tsdbSinkName = "tsdb"
+
+// sinkTimeout is how long WriteSinks waits for a sink before reporting it as failed. The write is left to finish in
+// the background, since plugins have no way to be cancelled.
+var sinkTimeout = time.Minute
+
+// Sink is a TSDB plugin that testrun results are written to, along with the name of its configuration section
+type Sink struct {
+	Name   string
+	Plugin string
+	TSDBPackage
+
+	spool string // directory that failed writes are spooled to (see spool.go), or empty to not spool them
+}
+
+// NewSinks returns every configured sink - the one in the [TSDB] section, if it has a plugin, followed by each
+// [Sink "<name>"] section in order of name. An error is returned if any of them can't be loaded.
+func NewSinks(cfg config.Config) ([]Sink, error) {
+	var sinks []Sink
+
+	add := func(name string, sinkCfg config.TSDB) error {
+
+		// Plugins read their options from the [TSDB] section, so give each one a config with its own section there
+		pluginCfg := cfg
+		pluginCfg.TSDB = sinkCfg
+
+		tsdb, err := NewToddTSDB(pluginCfg)
+		if err != nil {
+			return fmt.Errorf("Error loading result sink %q: %v", name, err)
+		}
+
+		sinks = append(sinks, Sink{
+			Name:        name,
+			Plugin:      sinkCfg.Plugin,
+			TSDBPackage: tsdb.TSDBPackage,
+			spool:       sinkSpoolDir(cfg, name),
+		})
+		return nil
+	}
+
+	if cfg.TSDB.Plugin != "" {
+		if err := add(tsdbSinkName, cfg.TSDB); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	for name := range cfg.Sink {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == tsdbSinkName {
+			return nil, fmt.Errorf("The name %q is taken by the [TSDB] section - please rename this sink", name)
+		}
+		if err := add(name, *cfg.Sink[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	return sinks, nil
+}
+
+// WriteSinks writes the results of a testrun to every sink at once, and returns the outcome for each, in the same order
+// as sinks. A sink that fails, panics or takes longer than sinkTimeout doesn't affect the others. Failed writes are
+// spooled to be retried later, including those that fail after the timeout, unless the sink refused the results.
+//
+// Sinks that time out are reported as failed, but their writes are left to finish in the background. The final outcome of
+// each of these sinks is sent on the returned channel once it finishes, and the channel is closed once they all have.
+func WriteSinks(sinks []Sink, testUuid, testRunName, groupName string, testData defs.TestData) ([]defs.TestRunSink, <-chan defs.TestRunSink) {
+
+	type outcome struct {
+		index   int
+		err     error
+		spooled bool
+	}
+
+	// Buffered, so that sinks that finish after the timeout don't block forever
+	outcomes := make(chan outcome, len(sinks))
+	start := time.Now()
+
+	for i, sink := range sinks {
+		go func(i int, sink Sink) {
+			err := writeSink(sink, testUuid, testRunName, groupName, testData)
+
+			spooled := false
+			if err != nil && sink.spool != "" && !isRejected(err) {
+				now := time.Now().UTC()
+				serr := spool(sink.spool, spooledBatch{
+					TestUuid:    testUuid,
+					TestRunName: testRunName,
+					GroupName:   groupName,
+					TestData:    testData,
+					Spooled:     now,
+					Attempts:    1,
+					NextAttempt: now.Add(backoff(1)),
+					LastError:   err.Error(),
+				})
+				if serr != nil {
+					log.Errorf("Error spooling results of testrun %s for sink %q - these results are lost: %v", testUuid, sink.Name, serr)
+				} else {
+					log.Warnf("Spooled results of testrun %s for sink %q, to be retried", testUuid, sink.Name)
+					spooled = true
+				}
+			}
+
+			outcomes <- outcome{i, err, spooled}
+		}(i, sink)
+	}
+
+	statuses := make([]defs.TestRunSink, len(sinks))
+	for i, sink := range sinks {
+		statuses[i] = defs.TestRunSink{
+			Name:     sink.Name,
+			Plugin:   sink.Plugin,
+			State:    defs.SinkFailed,
+			Error:    fmt.Sprintf("timed out after %s", sinkTimeout),
+			Duration: sinkTimeout,
+		}
+	}
+
+	// finished fills in the status of a sink that has finished writing
+	finished := func(o outcome) defs.TestRunSink {
+		status := statuses[o.index]
+		status.Duration = time.Since(start)
+		switch {
+		case o.err == nil:
+			status.State = defs.SinkWritten
+			status.Error = ""
+		case o.spooled:
+			status.State = defs.SinkSpooled
+			status.Error = o.err.Error()
+		default:
+			status.Error = o.err.Error()
+		}
+		return status
+	}
+
+	timeout := time.After(sinkTimeout)
+	remaining := len(sinks)
+wait:
+	for ; remaining > 0; remaining-- {
+		select {
+		case o := <-outcomes:
+			statuses[o.index] = finished(o)
+		case <-timeout:
+			break wait
+		}
+	}
+
+	for _, status := range statuses {
+		switch status.State {
+		case defs.SinkWritten:
+			log.Infof("Wrote results of testrun %s to sink %q (%s)", testUuid, status.Name, status.Plugin)
+		default:
+			log.Errorf("Failed to write results of testrun %s to sink %q (%s): %s", testUuid, status.Name, status.Plugin, status.Error)
+		}
+	}
+
+	// Keep waiting for the sinks that timed out, so that results that were written (or spooled) in the end aren't
+	// reported as lost. The channel is buffered, so this never blocks if nobody is listening.
+	late := make(chan defs.TestRunSink, remaining)
+	go func(remaining int) {
+		defer close(late)
+		for ; remaining > 0; remaining-- {
+			status := finished(<-outcomes)
+			log.Infof("Sink %q (%s) finished with results of testrun %s after timing out: %s", status.Name, status.Plugin, testUuid, status.State)
+			late <- status
+		}
+	}(remaining)
+
+	return statuses, late
+}
+
+// writeSink writes the results of a testrun to a single sink, turning a panic in the plugin into an error
+func writeSink(sink Sink, testUuid, testRunName, groupName string, testData defs.TestData) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return sink.WriteData(testUuid, testRunName, groupName, testData)
+}
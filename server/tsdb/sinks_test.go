@@ -0,0 +1,121 @@
+/*
+    Tests for ToDD Result Sinks
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+// fakeTSDB is a TSDB plugin that calls write instead of writing anywhere
+type fakeTSDB struct {
+	write func() error
+}
+
+func (f fakeTSDB) WriteData(string, string, string, defs.TestData) error {
+	return f.write()
+}
+
+func TestNewSinks(t *testing.T) {
+	var cfg config.Config
+	cfg.TSDB.Plugin = "graphite"
+	cfg.Sink = map[string]*config.TSDB{
+		"local":   {Plugin: "file"},
+		"archive": {Plugin: "file", Format: "csv"},
+	}
+
+	sinks, err := NewSinks(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct{ name, plugin string }{{"tsdb", "graphite"}, {"archive", "file"}, {"local", "file"}}
+	if len(sinks) != len(expected) {
+		t.Fatalf("Expected %d sinks, got %+v", len(expected), sinks)
+	}
+	for i, e := range expected {
+		if sinks[i].Name != e.name || sinks[i].Plugin != e.plugin {
+			t.Fatalf("Expected sink %d to be %s (%s), got %+v", i, e.name, e.plugin, sinks[i])
+		}
+	}
+	if sinks[1].TSDBPackage.(*fileDB).format() != "csv" {
+		t.Fatal("Expected each sink to be configured by its own section")
+	}
+
+	// The [TSDB] section can be left out
+	cfg.TSDB.Plugin = ""
+	if sinks, err = NewSinks(cfg); err != nil || len(sinks) != 2 {
+		t.Fatalf("Expected only the [Sink] sections, got %+v, %v", sinks, err)
+	}
+
+	cfg.Sink["broken"] = &config.TSDB{Plugin: "rrdtool"}
+	if _, err = NewSinks(cfg); err == nil {
+		t.Fatal("Expected an error loading an invalid sink")
+	}
+
+	delete(cfg.Sink, "broken")
+	cfg.Sink["tsdb"] = &config.TSDB{Plugin: "file"}
+	if _, err = NewSinks(cfg); err == nil {
+		t.Fatal("Expected an error for a sink named after the [TSDB] section")
+	}
+}
+
+// TestWriteSinks tests that sinks which fail, panic or hang don't affect the others, and that the outcome of a hanging
+// sink is still reported once it finishes
+func TestWriteSinks(t *testing.T) {
+	defer func(timeout time.Duration) { sinkTimeout = timeout }(sinkTimeout)
+	sinkTimeout = 100 * time.Millisecond
+
+	hang := make(chan struct{})
+
+	sinks := []Sink{
+		{Name: "hanging", Plugin: "fake", TSDBPackage: fakeTSDB{func() error { <-hang; return nil }}},
+		{Name: "good", Plugin: "fake", TSDBPackage: fakeTSDB{func() error { return nil }}},
+		{Name: "failing", Plugin: "fake", TSDBPackage: fakeTSDB{func() error { return errors.New("connection refused") }}},
+		{Name: "panicking", Plugin: "fake", TSDBPackage: fakeTSDB{func() error { panic("oops") }}},
+	}
+
+	statuses, late := WriteSinks(sinks, "testuuid", "test-ping", "datacenter", nil)
+
+	expected := []defs.TestRunSink{
+		{Name: "hanging", Plugin: "fake", State: defs.SinkFailed, Error: "timed out after 100ms"},
+		{Name: "good", Plugin: "fake", State: defs.SinkWritten},
+		{Name: "failing", Plugin: "fake", State: defs.SinkFailed, Error: "connection refused"},
+		{Name: "panicking", Plugin: "fake", State: defs.SinkFailed, Error: "panic: oops"},
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("Expected %d statuses, got %+v", len(expected), statuses)
+	}
+	for i, e := range expected {
+		s := statuses[i]
+		if s.Name != e.Name || s.Plugin != e.Plugin || s.State != e.State || s.Error != e.Error {
+			t.Fatalf("Expected %+v, got %+v", e, s)
+		}
+	}
+	if statuses[0].Duration != sinkTimeout || statuses[1].Duration >= sinkTimeout {
+		t.Fatalf("Unexpected durations in %+v", statuses)
+	}
+
+	close(hang)
+	select {
+	case s := <-late:
+		if s.Name != "hanging" || s.State != defs.SinkWritten || s.Error != "" || s.Duration < sinkTimeout {
+			t.Fatalf("Expected the hanging sink to be written in the end, got %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the hanging sink")
+	}
+	if _, ok := <-late; ok {
+		t.Fatal("Expected no more late sinks")
+	}
+}
@@ -0,0 +1,359 @@
+/*
+    ToDD Result Spool
+
+    Results that couldn't be written to a sink are saved ("spooled") to disk, in a directory for each sink under
+    <OptDir>/spool, and retried with an increasing delay until the sink comes back. Batches are retried oldest first,
+    and a sink's remaining batches wait for the next attempt once one of them fails, since the sink is most likely
+    still unavailable. Batches that the sink refuses, or that still can't be written after spoolMaxAttempts, are
+    given up on, and moved aside (as <batch>.json.bad) to be looked at by hand.
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+	"github.com/Mierdin/todd/db"
+)
+
+const (
+	// spoolMinBackoff is how long a batch waits before it is first retried. The wait doubles after every failed
+	// attempt, up to spoolMaxBackoff.
+	spoolMinBackoff = 30 * time.Second
+	spoolMaxBackoff = 30 * time.Minute
+
+	// spoolMaxAttempts is how many times a batch is tried before it is given up on - about a day, with the backoff
+	spoolMaxAttempts = 50
+
+	// spoolBadSuffix is added to the name of batches that have been given up on, which are left in the spool
+	spoolBadSuffix = ".bad"
+
+	// spoolTimeLayout starts the name of each spooled batch, so that batches sort in the order they were spooled
+	spoolTimeLayout = "20060102T150405.000000000Z"
+)
+
+// spoolMu serializes changes to the spool, which are made both by testruns and by RetrySpool
+var spoolMu sync.Mutex
+
+// spooledBatch is the results of a testrun that couldn't be written to a sink
+type spooledBatch struct {
+	TestUuid    string        `json:"testuuid"`
+	TestRunName string        `json:"testrunname"`
+	GroupName   string        `json:"groupname"`
+	TestData    defs.TestData `json:"testdata"`
+	Spooled     time.Time     `json:"spooled"`
+	Attempts    int           `json:"attempts"` // failed attempts to write the batch, including the first
+	NextAttempt time.Time     `json:"nextattempt"`
+	LastError   string        `json:"lasterror"`
+}
+
+// SpoolStatus describes the batches waiting to be written to a single sink
+type SpoolStatus struct {
+	Sink        string    `json:"sink"`
+	Batches     int       `json:"batches"`
+	Oldest      time.Time `json:"oldest"`      // when the oldest batch was spooled
+	Attempts    int       `json:"attempts"`    // failed attempts to write the oldest batch
+	NextAttempt time.Time `json:"nextattempt"` // when the oldest batch will be retried
+	LastError   string    `json:"lasterror"`
+	Bad         int       `json:"bad"` // batches that have been given up on
+}
+
+// spoolDir returns the directory holding the spool of every sink
+func spoolDir(cfg config.Config) string {
+	return filepath.Join(cfg.LocalResources.OptDir, "spool")
+}
+
+// sinkSpoolDir returns the directory holding the spool of a single sink. Sink names come from the configuration file,
+// so they are escaped to keep them from reaching outside the spool directory.
+func sinkSpoolDir(cfg config.Config, sinkName string) string {
+	return filepath.Join(spoolDir(cfg), url.PathEscape(sinkName))
+}
+
+// backoff returns how long to wait before retrying a batch that has failed to be written the provided number of times
+func backoff(attempts int) time.Duration {
+	wait := spoolMinBackoff
+	for i := 1; i < attempts && wait < spoolMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > spoolMaxBackoff {
+		wait = spoolMaxBackoff
+	}
+	return wait
+}
+
+// spool saves a batch that failed to be written to a sink, to be retried by RetrySpool
+func spool(dir string, batch spooledBatch) error {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	name := batch.Spooled.UTC().Format(spoolTimeLayout) + "-" + batch.TestUuid + ".json"
+	return writeBatch(filepath.Join(dir, name), batch)
+}
+
+// writeBatch writes a spooled batch to a temporary file, and then moves it into place, so that a crash never leaves
+// half of a batch behind
+func writeBatch(path string, batch spooledBatch) error {
+	batchJSON, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, batchJSON, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readBatch(path string) (spooledBatch, error) {
+	var batch spooledBatch
+
+	batchJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return batch, err
+	}
+	err = json.Unmarshal(batchJSON, &batch)
+	return batch, err
+}
+
+// spooledBatches returns the paths of the batches in a sink's spool directory, oldest first
+func spooledBatches(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// badBatches returns the paths of the batches in a sink's spool directory that have been given up on
+func badBatches(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "*.json"+spoolBadSuffix))
+}
+
+// moveAside gives up on a spooled batch, leaving it in the spool under a name that isn't retried
+func moveAside(path string) {
+	err := os.Rename(path, path+spoolBadSuffix)
+	if err != nil {
+		log.Errorf("Error moving spooled batch %s aside: %v", path, err)
+	}
+}
+
+// spooledSinks returns the names of the sinks with a spool directory, whether or not they are still configured
+func spooledSinks(cfg config.Config) ([]string, error) {
+	entries, err := ioutil.ReadDir(spoolDir(cfg))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// RetrySpool tries again to write each spooled batch that is due to be retried. Batches that are written are removed
+// from the spool, and the history of their testrun is updated to match.
+func RetrySpool(cfg config.Config) {
+
+	names, err := spooledSinks(cfg)
+	if err != nil {
+		log.Errorf("Error reading result spool: %v", err)
+		return
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	sinks, err := NewSinks(cfg)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	sinksByName := make(map[string]Sink)
+	for _, sink := range sinks {
+		sinksByName[sink.Name] = sink
+	}
+
+	for _, name := range names {
+		sink, ok := sinksByName[name]
+		if !ok {
+			log.Debugf("Leaving spooled results for sink %q alone, since it is no longer configured", name)
+			continue
+		}
+		retrySink(cfg, sink)
+	}
+}
+
+// retrySink retries the spooled batches of a single sink, oldest first, until one of them fails. Batches that are given
+// up on don't stop the rest from being retried.
+func retrySink(cfg config.Config, sink Sink) {
+	dir := sinkSpoolDir(cfg, sink.Name)
+
+	spoolMu.Lock()
+	paths, err := spooledBatches(dir)
+	spoolMu.Unlock()
+	if err != nil {
+		log.Errorf("Error reading result spool of sink %q: %v", sink.Name, err)
+		return
+	}
+
+	for _, path := range paths {
+		spoolMu.Lock()
+		batch, err := readBatch(path)
+		spoolMu.Unlock()
+		if err != nil {
+			log.Errorf("Moving unreadable spooled batch %s aside: %v", path, err)
+			spoolMu.Lock()
+			moveAside(path)
+			spoolMu.Unlock()
+			continue
+		}
+
+		if time.Now().Before(batch.NextAttempt) {
+			return
+		}
+
+		err = writeSink(sink, batch.TestUuid, batch.TestRunName, batch.GroupName, batch.TestData)
+
+		giveUp := false
+		spoolMu.Lock()
+		if err != nil {
+			batch.Attempts++
+			batch.LastError = err.Error()
+			batch.NextAttempt = time.Now().UTC().Add(backoff(batch.Attempts))
+			if werr := writeBatch(path, batch); werr != nil {
+				log.Errorf("Error updating spooled batch %s: %v", path, werr)
+			}
+			if isRejected(err) || batch.Attempts >= spoolMaxAttempts {
+				giveUp = true
+				moveAside(path)
+			}
+		} else if rerr := os.Remove(path); rerr != nil {
+			log.Errorf("Error removing spooled batch %s: %v", path, rerr)
+		}
+		spoolMu.Unlock()
+
+		if giveUp {
+			// The sink is up (or has been given long enough), so carry on with the next batch
+			log.Errorf("Giving up on results of testrun %s for sink %q after %d attempts - moved aside as %s: %v",
+				batch.TestUuid, sink.Name, batch.Attempts, path+spoolBadSuffix, err)
+			setSinkState(cfg, batch.TestUuid, sink.Name, defs.SinkFailed, err.Error())
+			continue
+		}
+
+		if err != nil {
+			log.Warnf("Still unable to write results of testrun %s to sink %q (attempt %d, retrying at %s): %v",
+				batch.TestUuid, sink.Name, batch.Attempts, batch.NextAttempt.Local().Format("15:04:05"), err)
+			return
+		}
+
+		log.Infof("Wrote spooled results of testrun %s to sink %q (%s)", batch.TestUuid, sink.Name, sink.Plugin)
+		setSinkState(cfg, batch.TestUuid, sink.Name, defs.SinkWritten, "")
+	}
+}
+
+// setSinkState updates the history of a testrun once its spooled results have been written to a sink, or given up on
+func setSinkState(cfg config.Config, testUuid, sinkName, state, sinkErr string) {
+	tdb, err := db.NewToddDB(cfg)
+	if err != nil {
+		log.Errorf("Error connecting to DB: %v", err)
+		return
+	}
+
+	record, err := tdb.GetTestRunRecord(testUuid)
+	if err == db.ErrNotExist {
+		return // the testrun has been removed from the history since
+	} else if err != nil {
+		log.Errorf("Error retrieving history of testrun %s: %v", testUuid, err)
+		return
+	}
+
+	for i := range record.Sinks {
+		if record.Sinks[i].Name == sinkName {
+			record.Sinks[i].State = state
+			record.Sinks[i].Error = sinkErr
+		}
+	}
+
+	err = tdb.SetTestRunRecord(*record)
+	if err != nil {
+		log.Errorf("Error saving history of testrun %s: %v", testUuid, err)
+	}
+}
+
+// Spool returns the status of the spool of each sink that has batches waiting to be written, or that have been given up on
+func Spool(cfg config.Config) ([]SpoolStatus, error) {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+
+	statuses := []SpoolStatus{}
+
+	names, err := spooledSinks(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		paths, err := spooledBatches(sinkSpoolDir(cfg, name))
+		if err != nil {
+			return nil, err
+		}
+		bad, err := badBatches(sinkSpoolDir(cfg, name))
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 && len(bad) == 0 {
+			continue
+		}
+
+		status := SpoolStatus{Sink: name, Batches: len(paths), Bad: len(bad)}
+		if len(paths) == 0 {
+			statuses = append(statuses, status)
+			continue
+		}
+		oldest, err := readBatch(paths[0])
+		if err == nil {
+			status.Oldest = oldest.Spooled
+			status.Attempts = oldest.Attempts
+			status.NextAttempt = oldest.NextAttempt
+			status.LastError = oldest.LastError
+		} else {
+			status.LastError = "unreadable batch: " + err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
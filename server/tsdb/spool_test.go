@@ -0,0 +1,196 @@
+/*
+    Tests for the ToDD Result Spool
+
+	Copyright 2016 Matt Oswalt. Use or modification of this
+	source code is governed by the license provided here:
+	https://github.com/Mierdin/todd/blob/master/LICENSE
+*/
+
+package tsdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Mierdin/todd/agent/defs"
+	"github.com/Mierdin/todd/config"
+)
+
+func TestBackoff(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  spoolMinBackoff,
+		2:  2 * spoolMinBackoff,
+		3:  4 * spoolMinBackoff,
+		10: spoolMaxBackoff,
+		99: spoolMaxBackoff,
+	}
+	for attempts, wait := range expected {
+		if b := backoff(attempts); b != wait {
+			t.Fatalf("Expected to wait %s after %d attempts, got %s", wait, attempts, b)
+		}
+	}
+}
+
+// TestSpool tests that failed writes are spooled, and written once the sink comes back
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "todd-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cfg config.Config
+	cfg.LocalResources.OptDir = dir
+	cfg.DB.Plugin = "memory"
+
+	var written []string
+	down := true
+	sink := Sink{
+		Name:   "carbon/1",
+		Plugin: "fake",
+		TSDBPackage: fakeTSDB{func() error {
+			if down {
+				return errors.New("connection refused")
+			}
+			written = append(written, "written")
+			return nil
+		}},
+		spool: sinkSpoolDir(cfg, "carbon/1"),
+	}
+
+	for _, uuid := range []string{"uuid1", "uuid2"} {
+		statuses, _ := WriteSinks([]Sink{sink}, uuid, "test-ping", "datacenter", fileTestData)
+		if statuses[0].State != defs.SinkSpooled || statuses[0].Error != "connection refused" {
+			t.Fatalf("Expected the results to be spooled, got %+v", statuses[0])
+		}
+	}
+
+	spooled, err := Spool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spooled) != 1 || spooled[0].Sink != "carbon/1" || spooled[0].Batches != 2 || spooled[0].Attempts != 1 ||
+		spooled[0].LastError != "connection refused" || spooled[0].NextAttempt.Before(spooled[0].Oldest) {
+		t.Fatalf("Unexpected spool %+v", spooled)
+	}
+
+	// Nothing is retried before it's due
+	retrySink(cfg, sink)
+	if spooled, _ = Spool(cfg); spooled[0].Attempts != 1 {
+		t.Fatalf("Expected nothing to be retried yet, got %+v", spooled)
+	}
+
+	// Make the oldest batch due, and check that a failed retry is backed off
+	paths, err := spooledBatches(sink.spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeDue := func() {
+		for _, path := range paths {
+			batch, err := readBatch(path)
+			if err != nil {
+				continue // already written
+			}
+			batch.NextAttempt = time.Now().Add(-time.Second)
+			if err := writeBatch(path, batch); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	makeDue()
+	retrySink(cfg, sink)
+	spooled, _ = Spool(cfg)
+	if spooled[0].Batches != 2 || spooled[0].Attempts != 2 || spooled[0].NextAttempt.Sub(time.Now()) < backoff(1) {
+		t.Fatalf("Expected the oldest batch to be backed off, got %+v", spooled)
+	}
+
+	// Once the sink is back, every batch is written and removed
+	down = false
+	makeDue()
+	retrySink(cfg, sink)
+	if len(written) != 2 {
+		t.Fatalf("Expected both batches to be written, got %d", len(written))
+	}
+	if spooled, _ = Spool(cfg); len(spooled) != 0 {
+		t.Fatalf("Expected an empty spool, got %+v", spooled)
+	}
+}
+
+// TestSpoolGiveUp tests that batches the sink refuses, or that fail too many times, are moved aside, and that the
+// batches after them are still retried
+func TestSpoolGiveUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "todd-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cfg config.Config
+	cfg.LocalResources.OptDir = dir
+	cfg.DB.Plugin = "memory"
+
+	writes := 0
+	sink := Sink{
+		Name:   "influx",
+		Plugin: "fake",
+		TSDBPackage: fakeTSDB{func() error {
+			// The second testrun's results are refused, and so are the first's when they're retried
+			writes++
+			if writes == 2 || writes == 3 {
+				return rejectedError{errors.New("field type conflict")}
+			}
+			return errors.New("connection refused")
+		}},
+		spool: sinkSpoolDir(cfg, "influx"),
+	}
+
+	// A refused write isn't spooled in the first place
+	statuses, _ := WriteSinks([]Sink{sink}, "uuid1", "test-ping", "datacenter", fileTestData)
+	if statuses[0].State != defs.SinkSpooled {
+		t.Fatalf("Expected the results to be spooled, got %+v", statuses[0])
+	}
+	statuses, _ = WriteSinks([]Sink{sink}, "uuid2", "test-ping", "datacenter", fileTestData)
+	if statuses[0].State != defs.SinkFailed || statuses[0].Error != "field type conflict" {
+		t.Fatalf("Expected refused results to fail without being spooled, got %+v", statuses[0])
+	}
+
+	// Add a batch that has run out of attempts, after the one that will be refused
+	err = spool(sink.spool, spooledBatch{
+		TestUuid:    "uuid3",
+		TestData:    fileTestData,
+		Spooled:     time.Now().Add(time.Second),
+		Attempts:    spoolMaxAttempts - 1,
+		NextAttempt: time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := spooledBatches(sink.spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := readBatch(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.NextAttempt = time.Now().Add(-time.Second)
+	if err = writeBatch(paths[0], batch); err != nil {
+		t.Fatal(err)
+	}
+
+	retrySink(cfg, sink)
+
+	spooled, err := Spool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writes != 4 || len(spooled) != 1 || spooled[0].Batches != 0 || spooled[0].Bad != 2 {
+		t.Fatalf("Expected both batches to be moved aside, got %+v", spooled)
+	}
+	if bad, _ := badBatches(sink.spool); len(bad) != 2 {
+		t.Fatalf("Expected two bad batches in the spool, got %v", bad)
+	}
+}
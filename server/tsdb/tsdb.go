@@ -11,15 +11,30 @@
 package tsdb
 
 import (
-	"os"
+	"errors"
+	"time"
 
+	"github.com/Mierdin/todd/agent/defs"
 	"github.com/Mierdin/todd/config"
-	log "github.com/Sirupsen/logrus"
 )
 
+var ErrInvalidTSDBPlugin = errors.New("Invalid TSDB plugin in config file")
+
+// rejectedError is returned by a TSDB plugin when it refused the results themselves, rather than being unavailable.
+// Writing the same results again won't help, so they aren't retried.
+type rejectedError struct {
+	error
+}
+
+// isRejected returns true if an error returned by a TSDB plugin means that the results were refused
+func isRejected(err error) bool {
+	_, ok := err.(rejectedError)
+	return ok
+}
+
 // TSDBPackage represents all of the behavior that a ToDD TSDB plugin must support
 type TSDBPackage interface {
-	WriteData(string, string, string, map[string]map[string]map[string]string) error
+	WriteData(string, string, string, defs.TestData) error
 }
 
 // toddTSDB is a struct to hold anything that satisfies the databasePackage interface
@@ -27,9 +42,9 @@ type toddTSDB struct {
 	TSDBPackage
 }
 
-// NewToDDComms will create a new instance of toddTSDB, and load the desired
-// databasePackage-compatible comms package into it.
-func NewToddTSDB(cfg config.Config) *toddTSDB {
+// NewToddTSDB will create a new instance of toddTSDB, and load the desired
+// TSDBPackage-compatible package into it.
+func NewToddTSDB(cfg config.Config) (*toddTSDB, error) {
 
 	// Create toddTSDB instance
 	var tsdb toddTSDB
@@ -38,10 +53,31 @@ func NewToddTSDB(cfg config.Config) *toddTSDB {
 	switch cfg.TSDB.Plugin {
 	case "influxdb":
 		tsdb.TSDBPackage = newInfluxDB(cfg)
+	case "graphite":
+		tsdb.TSDBPackage = newGraphiteDB(cfg)
+	case "file":
+		tsdb.TSDBPackage = newFileDB(cfg)
 	default:
-		log.Error("Invalid DB plugin in config file")
-		os.Exit(1)
+		return nil, ErrInvalidTSDBPlugin
 	}
 
-	return &tsdb
+	return &tsdb, nil
+}
+
+// measured returns when the results for a target were measured, or now if this isn't known (such as for results
+// from older agents)
+func measured(td defs.TargetData, now time.Time) time.Time {
+	if t := td.Measured(); !t.IsZero() {
+		return t
+	}
+	return now
+}
+
+// tsdbValue returns a metric as it is written to a TSDB. None of them have a type for durations, so these are written
+// as seconds.
+func tsdbValue(m defs.MetricValue) defs.MetricValue {
+	if d, ok := m.Value.(time.Duration); ok {
+		return defs.MetricValue{Type: m.Type, Value: d.Seconds(), Unit: "s"}
+	}
+	return m
 }